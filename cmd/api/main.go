@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -15,6 +16,8 @@ import (
 	"queue-system/internal/redis"
 	"queue-system/internal/routes"
 	"queue-system/internal/services"
+	"queue-system/pkg/admission"
+	"queue-system/pkg/clientip"
 )
 
 func main() {
@@ -41,13 +44,88 @@ func main() {
 	// 初始化服務
 	queueService := services.NewQueueService(database, redisClient)
 	adminService := services.NewAdminService(database, redisClient)
+	if err := queueService.SetEntryTokenKeys(cfg.Admission.EntryKeySet(), time.Duration(cfg.Admission.ClockSkew)*time.Second); err != nil {
+		log.Fatalf("Failed to initialize entry token verifiers: %v", err)
+	}
+	if err := queueService.SetChallengeKey(context.Background(), []byte(cfg.Admission.ChallengeSecret), cfg.Admission.ChallengeLifetime()); err != nil {
+		log.Fatalf("Failed to initialize proof-of-work challenges: %v", err)
+	}
+	adminService.SetProofOfWorkEnabled(cfg.Admission.ChallengeSecret != "")
+	if err := queueService.SetIPHashKey(cfg.IPHash.Secrets(), cfg.IPHash.Rotation(), cfg.IPHash.Grace()); err != nil {
+		log.Fatalf("Failed to initialize IP hashing: %v", err)
+	}
+	go func() {
+		updated, err := queueService.BackfillIPHashes(context.Background())
+		if err != nil {
+			log.Printf("Failed to backfill legacy IP hashes: %v", err)
+		} else if updated > 0 {
+			log.Printf("Re-hashed %d legacy IP hashes", updated)
+		}
+	}()
+	captchaProviders := make([]string, 0, len(cfg.AntiBot.Providers))
+	for provider, providerCfg := range cfg.AntiBot.Providers {
+		if err := queueService.RegisterSiteVerify(provider, providerCfg.VerifyURL, providerCfg.Secret, cfg.AntiBot.VerifyTimeout()); err != nil {
+			log.Fatalf("Failed to initialize captcha provider: %v", err)
+		}
+		captchaProviders = append(captchaProviders, provider)
+	}
+	adminService.SetCaptchaProviders(captchaProviders)
+
+	// 狀態串流的隊列事件分派
+	statusBroker := services.NewStatusBroker(redisClient)
+	if err := statusBroker.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start status broker: %v", err)
+	}
+	defer statusBroker.Stop()
+	queueService.SetStatusBroker(statusBroker)
+
+	// 活動生命週期切換、預排隊分配與抽籤開獎；多個實例時只由持有主節點鎖的實例執行
+	lifecycleWorker := services.NewLifecycleWorker(database, redisClient)
+	if err := lifecycleWorker.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start lifecycle worker: %v", err)
+	}
+	defer lifecycleWorker.Stop()
+
+	// 初始化 admission token 簽發器
+	signer, err := admission.NewSigner(
+		cfg.Admission.SigningKeyID,
+		[]byte(cfg.Admission.SigningSecret),
+		cfg.Admission.Issuer,
+		time.Duration(cfg.Admission.TokenTTL)*time.Second,
+	)
+	if err != nil {
+		log.Fatalf("Failed to initialize admission signer: %v", err)
+	}
+	verifier, err := admission.NewVerifier(admission.VerifierConfig{
+		Keys:      cfg.Admission.KeySet(),
+		Issuer:    cfg.Admission.Issuer,
+		ClockSkew: time.Duration(cfg.Admission.ClockSkew) * time.Second,
+		Replay:    admission.NewRedisReplayStore(redisClient),
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize admission verifier: %v", err)
+	}
+	admissionService := services.NewAdmissionService(queueService, signer, verifier)
+	admissionService.SetSettlementGrace(cfg.Admission.SettlementGracePeriod())
+	if len(cfg.Admission.ServiceKeys) == 0 {
+		log.Println("No admission service keys configured, /admission/complete will reject all requests")
+	}
 
 	// 初始化處理器
 	queueHandler := handlers.NewQueueHandler(queueService)
+	clientIPResolver, err := clientip.NewResolver(cfg.Server.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Failed to parse trusted proxies: %v", err)
+	}
+	queueHandler.SetClientIPResolver(clientIPResolver)
 	adminHandler := handlers.NewAdminHandler(adminService)
+	admissionHandler := handlers.NewAdmissionHandler(admissionService)
+	socketHandler := handlers.NewSocketHandler(queueService, admissionService)
+	socketHandler.SetMaxConnections(cfg.Server.MaxWebSocketConns)
+	socketHandler.SetAllowedOrigins(cfg.Server.AllowedOrigins)
 
 	// 設定路由
-	router := routes.SetupRoutes(queueHandler, adminHandler)
+	router := routes.SetupRoutes(queueHandler, adminHandler, admissionHandler, socketHandler, cfg.Admission.ServiceKeys, cfg.Server.AllowedOrigins)
 
 	// 建立 HTTP 伺服器
 	srv := &http.Server{
@@ -56,11 +134,22 @@ func main() {
 		ReadTimeout:  time.Duration(cfg.Server.ReadTimeout) * time.Second,
 		WriteTimeout: time.Duration(cfg.Server.WriteTimeout) * time.Second,
 	}
+	// 關閉時先結束狀態串流，否則 Shutdown 會等到逾時
+	srv.RegisterOnShutdown(queueHandler.CloseStreams)
+
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	// 負載平衡器以 PROXY protocol 傳遞來源位址
+	if cfg.Server.ProxyProtocol {
+		listener = clientip.NewListener(listener, clientIPResolver)
+	}
 
 	// 啟動伺服器（非阻塞）
 	go func() {
 		log.Printf("Server starting on port %s", cfg.Server.Port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Failed to start server: %v", err)
 		}
 	}()
@@ -78,6 +167,10 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
+	// WebSocket 連線已脫離 HTTP 伺服器，另外通知並等待結束
+	if err := socketHandler.Shutdown(ctx); err != nil {
+		log.Printf("WebSocket connections forced to close: %v", err)
+	}
 
 	log.Println("Server exited")
 }
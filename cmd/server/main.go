@@ -4,10 +4,12 @@ import (
     "context"
     "database/sql"
     "log"
+    "net"
     "net/http"
     "os"
     "os/signal"
     "strconv"
+    "strings"
     "syscall"
     "time"
 
@@ -17,8 +19,12 @@ import (
     
     "queue-system/internal/handlers"
     "queue-system/internal/metrics"
+    "queue-system/internal/middleware"
     "queue-system/internal/monitoring"
     "queue-system/internal/services"
+    "queue-system/pkg/admission"
+    "queue-system/pkg/clientip"
+    "queue-system/pkg/iphash"
 )
 
 func main() {
@@ -48,7 +54,68 @@ func main() {
 
     // 初始化服務
     queueService := services.NewQueueService(db, rdb)
+    if err := queueService.SetEntryTokenKeys(config.EntryTokenKeys, time.Duration(config.AdmissionClockSkew)*time.Second); err != nil {
+        log.Fatal("Failed to initialize entry token verifiers:", err)
+    }
+    if err := queueService.SetChallengeKey(context.Background(), []byte(config.ChallengeSecret), time.Duration(config.ChallengeTTL)*time.Second); err != nil {
+        log.Fatal("Failed to initialize proof-of-work challenges:", err)
+    }
+    var ipHashSecrets []iphash.Secret
+    if config.IPHashSecret != "" {
+        ipHashSecrets = append(ipHashSecrets, iphash.Secret{ID: config.IPHashKeyID, Key: []byte(config.IPHashSecret)})
+    }
+    if config.IPHashPrevKeyID != "" {
+        ipHashSecrets = append(ipHashSecrets, iphash.Secret{ID: config.IPHashPrevKeyID, Key: []byte(config.IPHashPrevSecret)})
+    }
+    if err := queueService.SetIPHashKey(ipHashSecrets, time.Duration(config.IPHashRotationHours)*time.Hour, time.Duration(config.IPHashGraceMinutes)*time.Minute); err != nil {
+        log.Fatal("Failed to initialize IP hashing:", err)
+    }
+    go func() {
+        updated, err := queueService.BackfillIPHashes(context.Background())
+        if err != nil {
+            log.Printf("Failed to backfill legacy IP hashes: %v", err)
+        } else if updated > 0 {
+            log.Printf("Re-hashed %d legacy IP hashes", updated)
+        }
+    }()
+    for provider, captcha := range config.Captcha {
+        if err := queueService.RegisterSiteVerify(provider, captcha.VerifyURL, captcha.Secret, time.Duration(config.CaptchaTimeout)*time.Second); err != nil {
+            log.Fatal("Failed to initialize captcha provider:", err)
+        }
+    }
     releaseScheduler := services.NewReleaseScheduler(db, rdb)
+    lifecycleWorker := services.NewLifecycleWorker(db, rdb)
+    statusBroker := services.NewStatusBroker(rdb)
+    queueService.SetStatusBroker(statusBroker)
+
+    // 初始化 admission token 簽發器
+    signer, err := admission.NewSigner(
+        config.AdmissionKeyID,
+        []byte(config.AdmissionSecret),
+        "queue-system",
+        time.Duration(config.AdmissionTokenTTL)*time.Second,
+    )
+    if err != nil {
+        log.Fatal("Failed to initialize admission signer:", err)
+    }
+    admissionKeys := map[string][]byte{config.AdmissionKeyID: []byte(config.AdmissionSecret)}
+    if config.AdmissionPrevKeyID != "" {
+        admissionKeys[config.AdmissionPrevKeyID] = []byte(config.AdmissionPrevSecret)
+    }
+    verifier, err := admission.NewVerifier(admission.VerifierConfig{
+        Keys:      admissionKeys,
+        Issuer:    "queue-system",
+        ClockSkew: time.Duration(config.AdmissionClockSkew) * time.Second,
+        Replay:    admission.NewRedisReplayStore(rdb),
+    })
+    if err != nil {
+        log.Fatal("Failed to initialize admission verifier:", err)
+    }
+    admissionService := services.NewAdmissionService(queueService, signer, verifier)
+    admissionService.SetSettlementGrace(time.Duration(config.SettlementGrace) * time.Second)
+    if len(config.ServiceKeys) == 0 {
+        log.Println("No admission service keys configured, /admission/complete and /admission/exit will reject all requests")
+    }
     
     // 初始化監控
     metricsCollector := metrics.NewMetricsCollector(db, rdb)
@@ -63,6 +130,18 @@ func main() {
         }
     }()
 
+    // 啟動狀態串流的隊列事件分派；失敗時串流退回定期更新
+    if err := statusBroker.Start(ctx); err != nil {
+        log.Printf("Failed to start status broker: %v", err)
+    }
+
+    // 啟動活動生命週期切換
+    go func() {
+        if err := lifecycleWorker.Start(ctx); err != nil {
+            log.Printf("Failed to start lifecycle worker: %v", err)
+        }
+    }()
+
     // 啟動指標收集
     go func() {
         metricsCollector.StartCollection(ctx)
@@ -75,18 +154,42 @@ func main() {
         }
     }()
 
+    // 只採用信任代理轉發的用戶端 IP
+    clientIPResolver, err := clientip.NewResolver(config.TrustedProxies)
+    if err != nil {
+        log.Fatal("Failed to parse trusted proxies:", err)
+    }
+
+    // 創建 handlers
+    queueHandler := handlers.NewQueueHandler(queueService)
+    queueHandler.SetClientIPResolver(clientIPResolver)
+    socketHandler := handlers.NewSocketHandler(queueService, admissionService)
+    socketHandler.SetMaxConnections(config.WSMaxConnections)
+    socketHandler.SetAllowedOrigins(config.AllowedOrigins)
+
     // 設置 HTTP 路由
-    router := setupRouter(queueService, dashboard)
+    router := setupRouter(queueHandler, socketHandler, admissionService, dashboard, config.ServiceKeys)
 
     // 啟動 HTTP 服務器
     server := &http.Server{
         Addr:    ":" + config.Port,
         Handler: router,
     }
+    // 關閉時先結束狀態串流，否則 Shutdown 會等到逾時
+    server.RegisterOnShutdown(queueHandler.CloseStreams)
+
+    listener, err := net.Listen("tcp", server.Addr)
+    if err != nil {
+        log.Fatal("Failed to listen:", err)
+    }
+    // 負載平衡器以 PROXY protocol 傳遞來源位址
+    if config.ProxyProtocol {
+        listener = clientip.NewListener(listener, clientIPResolver)
+    }
 
     go func() {
         log.Printf("Starting server on port %s", config.Port)
-        if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+        if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
             log.Fatal("Failed to start server:", err)
         }
     }()
@@ -100,6 +203,8 @@ func main() {
 
     // 停止 Release Scheduler
     releaseScheduler.Stop()
+    lifecycleWorker.Stop()
+    statusBroker.Stop()
 
     // 關閉 HTTP 服務器
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -108,25 +213,37 @@ func main() {
     if err := server.Shutdown(ctx); err != nil {
         log.Fatal("Server forced to shutdown:", err)
     }
+    // WebSocket 連線已脫離 HTTP 服務器，送出關閉訊息並等待結束
+    if err := socketHandler.Shutdown(ctx); err != nil {
+        log.Println("WebSocket connections forced to close:", err)
+    }
 
     log.Println("Server exited")
 }
 
-func setupRouter(queueService *services.QueueService, dashboard *monitoring.Dashboard) *gin.Engine {
+func setupRouter(queueHandler *handlers.QueueHandler, socketHandler *handlers.SocketHandler, admissionService *services.AdmissionService, dashboard *monitoring.Dashboard, serviceKeys []string) *gin.Engine {
     router := gin.Default()
 
     // 添加指標中間件
     router.Use(ginMetricsMiddleware())
 
     // 創建 handlers
-    queueHandler := handlers.NewQueueHandler(queueService)
+    admissionHandler := handlers.NewAdmissionHandler(admissionService)
 
     // API 路由
     api := router.Group("/api/v1")
     {
         // 隊列相關 API
+        api.GET("/queue/challenge", queueHandler.GetChallenge)
         api.POST("/queue/enter", queueHandler.EnterQueue)
         api.GET("/queue/status", queueHandler.GetQueueStatus)
+        api.GET("/queue/stream", queueHandler.StreamQueueStatus)
+        api.GET("/queue/ws", socketHandler.ServeQueue)
+        api.POST("/queue/reserve", admissionHandler.Reserve)
+        api.DELETE("/queue/leave", queueHandler.LeaveQueue)
+        api.POST("/admission/verify", admissionHandler.Verify)
+        api.POST("/admission/complete", middleware.ServiceAuth(serviceKeys), admissionHandler.Complete)
+        api.POST("/admission/exit", middleware.ServiceAuth(serviceKeys), admissionHandler.Exit)
         
         // 儀表板 API
         api.GET("/dashboard", dashboardHandler(dashboard))
@@ -142,11 +259,39 @@ func setupRouter(queueService *services.QueueService, dashboard *monitoring.Dash
 }
 
 type Config struct {
-    DatabaseURL   string
-    RedisAddr     string
-    RedisPassword string
-    RedisDB       int
-    Port          string
+    DatabaseURL         string
+    RedisAddr           string
+    RedisPassword       string
+    RedisDB             int
+    Port                string
+    AdmissionKeyID      string
+    AdmissionSecret     string
+    AdmissionPrevKeyID  string
+    AdmissionPrevSecret string
+    AdmissionTokenTTL   int
+    AdmissionClockSkew  int
+    ServiceKeys         []string
+    SettlementGrace     int
+    EntryTokenKeys      map[string][]byte
+    ChallengeSecret     string
+    ChallengeTTL        int
+    Captcha             map[string]captchaConfig
+    CaptchaTimeout      int
+    TrustedProxies      []string
+    ProxyProtocol       bool
+    IPHashKeyID         string
+    IPHashSecret        string
+    IPHashPrevKeyID     string
+    IPHashPrevSecret    string
+    IPHashRotationHours int
+    IPHashGraceMinutes  int
+    WSMaxConnections    int
+    AllowedOrigins      []string
+}
+
+type captchaConfig struct {
+    Secret    string
+    VerifyURL string
 }
 
 func loadConfig() *Config {
@@ -156,7 +301,45 @@ func loadConfig() *Config {
         RedisPassword: getEnv("REDIS_PASSWORD", ""),
         RedisDB:       0,
         Port:          getEnv("PORT", "8080"),
+
+        AdmissionKeyID:      getEnv("ADMISSION_KEY_ID", "k1"),
+        AdmissionSecret:     getEnv("ADMISSION_SIGNING_SECRET", ""),
+        AdmissionPrevKeyID:  getEnv("ADMISSION_PREVIOUS_KEY_ID", ""),
+        AdmissionPrevSecret: getEnv("ADMISSION_PREVIOUS_SIGNING_SECRET", ""),
+        AdmissionTokenTTL:   getEnvInt("ADMISSION_TOKEN_TTL", 120),
+        AdmissionClockSkew:  getEnvInt("ADMISSION_CLOCK_SKEW", 5),
+        ServiceKeys:         getEnvList("ADMISSION_SERVICE_KEYS"),
+        SettlementGrace:     getEnvInt("ADMISSION_SETTLEMENT_GRACE", 600),
+        EntryTokenKeys:      getEnvKeySet("ENTRY_TOKEN_KEYS"),
+        ChallengeSecret:     getEnv("CHALLENGE_SECRET", ""),
+        ChallengeTTL:        getEnvInt("CHALLENGE_TTL", 120),
+        Captcha:             getEnvCaptcha(),
+        CaptchaTimeout:      getEnvInt("CAPTCHA_TIMEOUT", 5),
+        TrustedProxies:      strings.Split(getEnv("TRUSTED_PROXIES", "127.0.0.1,::1"), ","),
+        ProxyProtocol:       getEnv("PROXY_PROTOCOL", "") == "true",
+        IPHashKeyID:         getEnv("IP_HASH_KEY_ID", "k1"),
+        IPHashSecret:        getEnv("IP_HASH_SECRET", ""),
+        IPHashPrevKeyID:     getEnv("IP_HASH_PREVIOUS_KEY_ID", ""),
+        IPHashPrevSecret:    getEnv("IP_HASH_PREVIOUS_SECRET", ""),
+        IPHashRotationHours: getEnvInt("IP_HASH_ROTATION_HOURS", 24),
+        IPHashGraceMinutes:  getEnvInt("IP_HASH_GRACE_MINUTES", 60),
+        WSMaxConnections:    getEnvInt("WS_MAX_CONNECTIONS", 10000),
+        AllowedOrigins:      getEnvList("ALLOWED_ORIGINS"),
+    }
+}
+
+// getEnvCaptcha 讀取已設定 secret 的人機驗證服務
+func getEnvCaptcha() map[string]captchaConfig {
+    captcha := make(map[string]captchaConfig)
+    for provider, prefix := range map[string]string{services.CaptchaProviderHCaptcha: "HCAPTCHA", services.CaptchaProviderTurnstile: "TURNSTILE"} {
+        if secret := getEnv(prefix+"_SECRET", ""); secret != "" {
+            captcha[provider] = captchaConfig{
+                Secret:    secret,
+                VerifyURL: getEnv(prefix+"_VERIFY_URL", ""),
+            }
+        }
     }
+    return captcha
 }
 
 func getEnv(key, defaultValue string) string {
@@ -166,6 +349,38 @@ func getEnv(key, defaultValue string) string {
     return defaultValue
 }
 
+// getEnvKeySet 解析 "tenant1:secret1,tenant2:secret2" 格式的金鑰設定
+func getEnvKeySet(key string) map[string][]byte {
+    keySet := make(map[string][]byte)
+    for _, pair := range strings.Split(os.Getenv(key), ",") {
+        parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+        if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+            keySet[parts[0]] = []byte(parts[1])
+        }
+    }
+    return keySet
+}
+
+// getEnvList 解析以逗號分隔的設定，略過空白項目
+func getEnvList(key string) []string {
+    var list []string
+    for _, item := range strings.Split(os.Getenv(key), ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            list = append(list, item)
+        }
+    }
+    return list
+}
+
+func getEnvInt(key string, defaultValue int) int {
+    if value := os.Getenv(key); value != "" {
+        if parsed, err := strconv.Atoi(value); err == nil {
+            return parsed
+        }
+    }
+    return defaultValue
+}
+
 // Gin 指標中間件
 func ginMetricsMiddleware() gin.HandlerFunc {
     return func(c *gin.Context) {
@@ -2,21 +2,37 @@ package config
 
 import (
 	"log"
+	"sort"
+	"time"
+
+	"queue-system/pkg/iphash"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Server   ServerConfig   `mapstructure:"server"`
-	Database DatabaseConfig `mapstructure:"database"`
-	Redis    RedisConfig    `mapstructure:"redis"`
-	Queue    QueueConfig    `mapstructure:"queue"`
+	Server    ServerConfig    `mapstructure:"server"`
+	Database  DatabaseConfig  `mapstructure:"database"`
+	Redis     RedisConfig     `mapstructure:"redis"`
+	Queue     QueueConfig     `mapstructure:"queue"`
+	Admission AdmissionConfig `mapstructure:"admission"`
+	AntiBot   AntiBotConfig   `mapstructure:"anti_bot"`
+	IPHash    IPHashConfig    `mapstructure:"ip_hash"`
 }
 
 type ServerConfig struct {
 	Port         string `mapstructure:"port"`
 	ReadTimeout  int    `mapstructure:"read_timeout"`
 	WriteTimeout int    `mapstructure:"write_timeout"`
+	// 信任的反向代理（CIDR 或 IP），只有來自這些位址的 Forwarded / X-Forwarded-For 會被採用
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	// 信任的代理以 PROXY protocol（v1 / v2）傳遞來源位址
+	ProxyProtocol bool `mapstructure:"proxy_protocol"`
+	// 每個實例的 WebSocket 連線上限，超過時回傳 503
+	MaxWebSocketConns int `mapstructure:"max_websocket_conns"`
+	// 允許的前端來源（例如 https://shop.example.com）；未設定時 HTTP API 允許任何來源，
+	// WebSocket 只接受同源連線
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
 }
 
 type DatabaseConfig struct {
@@ -41,6 +57,131 @@ type QueueConfig struct {
 	MaxReleaseRate      int `mapstructure:"max_release_rate"`
 }
 
+type AdmissionConfig struct {
+	Issuer        string `mapstructure:"issuer"`
+	TokenTTL      int    `mapstructure:"token_ttl"`  // 秒
+	ClockSkew     int    `mapstructure:"clock_skew"` // 秒
+	SigningKeyID  string `mapstructure:"signing_key_id"`
+	SigningSecret string `mapstructure:"signing_secret"`
+	// 金鑰輪替期間仍接受的舊金鑰（kid -> secret）
+	VerificationKeys map[string]string `mapstructure:"verification_keys"`
+	// 各租戶簽發 entry token 的金鑰（tenant_id -> secret）
+	EntryTokenKeys map[string]string `mapstructure:"entry_token_keys"`
+	// 工作量證明挑戰的簽章金鑰，多個實例需相同；未設定時停用工作量證明
+	ChallengeSecret string `mapstructure:"challenge_secret"`
+	ChallengeTTL    int    `mapstructure:"challenge_ttl"` // 秒
+	// 商店後端呼叫 /admission/complete、/admission/exit 時以 Authorization: Bearer 帶入的服務金鑰
+	ServiceKeys []string `mapstructure:"service_keys"`
+	// token 過期後仍可確認購買或離開的秒數
+	SettlementGrace int `mapstructure:"settlement_grace"`
+}
+
+// KeySet 回傳目前簽發金鑰與所有仍有效的驗證金鑰
+func (c *AdmissionConfig) KeySet() map[string][]byte {
+	keySet := make(map[string][]byte, len(c.VerificationKeys)+1)
+	for kid, secret := range c.VerificationKeys {
+		keySet[kid] = []byte(secret)
+	}
+	keySet[c.SigningKeyID] = []byte(c.SigningSecret)
+	return keySet
+}
+
+// EntryKeySet 回傳各租戶的 entry token 驗證金鑰
+func (c *AdmissionConfig) EntryKeySet() map[string][]byte {
+	keySet := make(map[string][]byte, len(c.EntryTokenKeys))
+	for tenantID, secret := range c.EntryTokenKeys {
+		keySet[tenantID] = []byte(secret)
+	}
+	return keySet
+}
+
+// ChallengeLifetime 回傳挑戰有效時間，未設定時為 120 秒
+func (c *AdmissionConfig) ChallengeLifetime() time.Duration {
+	if c.ChallengeTTL <= 0 {
+		return 120 * time.Second
+	}
+	return time.Duration(c.ChallengeTTL) * time.Second
+}
+
+// SettlementGracePeriod 回傳 token 過期後仍可確認購買或離開的期間，未設定時為 10 分鐘
+func (c *AdmissionConfig) SettlementGracePeriod() time.Duration {
+	if c.SettlementGrace <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(c.SettlementGrace) * time.Second
+}
+
+type AntiBotConfig struct {
+	Timeout int `mapstructure:"timeout"` // 秒
+	// 人機驗證服務（hcaptcha、turnstile 或其他 siteverify 相容服務），活動以名稱選用
+	Providers map[string]CaptchaProviderConfig `mapstructure:"providers"`
+}
+
+type CaptchaProviderConfig struct {
+	Secret string `mapstructure:"secret"`
+	// 未設定時使用該服務的預設網址；測試時可指向本機的模擬服務
+	VerifyURL string `mapstructure:"verify_url"`
+}
+
+// VerifyTimeout 回傳呼叫驗證服務的逾時，未設定時為 5 秒
+func (c *AntiBotConfig) VerifyTimeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+type IPHashConfig struct {
+	// HMAC 金鑰，多個實例需相同；未設定時服務無法啟動
+	KeyID  string `mapstructure:"key_id"`
+	Secret string `mapstructure:"secret"`
+	// 更換 secret 後保留的舊 secret，只用於比對，key_id -> secret
+	PreviousSecrets map[string]string `mapstructure:"previous_secrets"`
+	RotationHours   int               `mapstructure:"rotation_hours"`
+	// 輪替後仍同時比對舊雜湊的分鐘數
+	GraceMinutes int `mapstructure:"grace_minutes"`
+}
+
+// Secrets 回傳 IP 雜湊的 secret，第一把為目前的 secret；key_id 未設定時為 k1
+func (c *IPHashConfig) Secrets() []iphash.Secret {
+	if c.Secret == "" {
+		return nil
+	}
+	keyID := c.KeyID
+	if keyID == "" {
+		keyID = "k1"
+	}
+	secrets := []iphash.Secret{{ID: keyID, Key: []byte(c.Secret)}}
+
+	previous := make([]string, 0, len(c.PreviousSecrets))
+	for id := range c.PreviousSecrets {
+		if id != keyID {
+			previous = append(previous, id)
+		}
+	}
+	sort.Strings(previous)
+	for _, id := range previous {
+		secrets = append(secrets, iphash.Secret{ID: id, Key: []byte(c.PreviousSecrets[id])})
+	}
+	return secrets
+}
+
+// Rotation 回傳金鑰輪替週期，未設定時為 24 小時
+func (c *IPHashConfig) Rotation() time.Duration {
+	if c.RotationHours <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.RotationHours) * time.Hour
+}
+
+// Grace 回傳輪替後的寬限期，未設定時為 1 小時
+func (c *IPHashConfig) Grace() time.Duration {
+	if c.GraceMinutes <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.GraceMinutes) * time.Minute
+}
+
 func Load() (*Config, error) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -36,9 +36,13 @@ func (h *AdminHandler) CreateActivity(c *gin.Context) {
 		statusCode := http.StatusInternalServerError
 		errorCode := "INTERNAL_ERROR"
 
-		if contains(err.Error(), "end_at must be after start_at") {
+		switch {
+		case contains(err.Error(), "end_at must be after start_at"):
 			statusCode = http.StatusBadRequest
 			errorCode = "INVALID_TIME_RANGE"
+		case contains(err.Error(), "invalid config"):
+			statusCode = http.StatusBadRequest
+			errorCode = "INVALID_CONFIG"
 		}
 
 		c.JSON(statusCode, gin.H{
@@ -125,6 +129,9 @@ func (h *AdminHandler) UpdateActivity(c *gin.Context) {
 		case contains(err.Error(), "no fields to update"):
 			statusCode = http.StatusBadRequest
 			errorCode = "NO_FIELDS_TO_UPDATE"
+		case contains(err.Error(), "invalid status transition"):
+			statusCode = http.StatusConflict
+			errorCode = "INVALID_STATUS_TRANSITION"
 		}
 
 		c.JSON(statusCode, gin.H{
@@ -168,3 +175,218 @@ func (h *AdminHandler) ListActivities(c *gin.Context) {
 		"data":    activities,
 	})
 }
+
+// POST /admin/activities/:id/allowlist
+func (h *AdminHandler) UploadAllowlist(c *gin.Context) {
+	activityID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_ACTIVITY_ID",
+			"message":    "Activity ID must be a valid integer",
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	var req services.AllowlistUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_REQUEST",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	resp, err := h.adminService.UploadAllowlist(c.Request.Context(), activityID, &req)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		errorCode := "INTERNAL_ERROR"
+
+		switch {
+		case contains(err.Error(), "activity not found"):
+			statusCode = http.StatusNotFound
+			errorCode = "ACTIVITY_NOT_FOUND"
+		case contains(err.Error(), "no allowlist entries"),
+			contains(err.Error(), "too many allowlist entries"),
+			contains(err.Error(), "invalid user hash"),
+			contains(err.Error(), "invalid invite code"):
+			statusCode = http.StatusBadRequest
+			errorCode = "INVALID_ALLOWLIST"
+		}
+
+		c.JSON(statusCode, gin.H{
+			"error":      errorCode,
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"data":    resp,
+	})
+}
+
+// GET /admin/activities/:id/allowlist
+func (h *AdminHandler) ListAllowlist(c *gin.Context) {
+	activityID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_ACTIVITY_ID",
+			"message":    "Activity ID must be a valid integer",
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	var req services.AllowlistListRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_REQUEST",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	entries, err := h.adminService.ListAllowlist(c.Request.Context(), activityID, &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":      "INTERNAL_ERROR",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    entries,
+	})
+}
+
+// DELETE /admin/activities/:id/allowlist/:entry_id
+func (h *AdminHandler) RevokeAllowlistEntry(c *gin.Context) {
+	activityID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_ACTIVITY_ID",
+			"message":    "Activity ID must be a valid integer",
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	entryID, err := strconv.ParseInt(c.Param("entry_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_REQUEST",
+			"message":    "Entry ID must be a valid integer",
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	err = h.adminService.RevokeAllowlistEntry(c.Request.Context(), activityID, entryID)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		errorCode := "INTERNAL_ERROR"
+
+		if contains(err.Error(), "allowlist entry not found") {
+			statusCode = http.StatusNotFound
+			errorCode = "ALLOWLIST_ENTRY_NOT_FOUND"
+		}
+
+		c.JSON(statusCode, gin.H{
+			"error":      errorCode,
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Allowlist entry revoked",
+	})
+}
+
+// GET /admin/activities/:id/risk
+func (h *AdminHandler) ListRiskEntries(c *gin.Context) {
+	activityID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_ACTIVITY_ID",
+			"message":    "Activity ID must be a valid integer",
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	var req services.RiskListRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_REQUEST",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	entries, err := h.adminService.ListRiskEntries(c.Request.Context(), activityID, &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":      "INTERNAL_ERROR",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    entries,
+	})
+}
+
+// GET /admin/activities/:id/risk/:session_id
+func (h *AdminHandler) GetSessionRisk(c *gin.Context) {
+	activityID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_ACTIVITY_ID",
+			"message":    "Activity ID must be a valid integer",
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	risk, err := h.adminService.GetSessionRisk(c.Request.Context(), activityID, c.Param("session_id"))
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		errorCode := "INTERNAL_ERROR"
+
+		switch {
+		case contains(err.Error(), "activity not found"):
+			statusCode = http.StatusNotFound
+			errorCode = "ACTIVITY_NOT_FOUND"
+		case contains(err.Error(), "risk assessment not found"):
+			statusCode = http.StatusNotFound
+			errorCode = "RISK_ASSESSMENT_NOT_FOUND"
+		}
+
+		c.JSON(statusCode, gin.H{
+			"error":      errorCode,
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    risk,
+	})
+}
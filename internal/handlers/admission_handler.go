@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"net/http"
+
+	"queue-system/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AdmissionHandler struct {
+	admissionService *services.AdmissionService
+}
+
+func NewAdmissionHandler(admissionService *services.AdmissionService) *AdmissionHandler {
+	return &AdmissionHandler{
+		admissionService: admissionService,
+	}
+}
+
+// POST /queue/reserve
+func (h *AdmissionHandler) Reserve(c *gin.Context) {
+	var req services.ReserveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_REQUEST",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	resp, err := h.admissionService.Reserve(c.Request.Context(), &req)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		errorCode := "INTERNAL_ERROR"
+
+		switch {
+		case contains(err.Error(), "activity not found"):
+			statusCode = http.StatusNotFound
+			errorCode = "ACTIVITY_NOT_FOUND"
+		case contains(err.Error(), "invalid sequence number"):
+			statusCode = http.StatusBadRequest
+			errorCode = "INVALID_SEQUENCE"
+		case contains(err.Error(), "not eligible for admission"):
+			statusCode = http.StatusConflict
+			errorCode = "NOT_ELIGIBLE"
+		case contains(err.Error(), "admission already issued"):
+			statusCode = http.StatusConflict
+			errorCode = "ADMISSION_ALREADY_ISSUED"
+		case contains(err.Error(), "activity sold out"):
+			statusCode = http.StatusConflict
+			errorCode = "SOLD_OUT"
+		}
+
+		c.JSON(statusCode, gin.H{
+			"error":      errorCode,
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    resp,
+	})
+}
+
+// POST /admission/verify
+func (h *AdmissionHandler) Verify(c *gin.Context) {
+	var req services.VerifyAdmissionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_REQUEST",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	resp, err := h.admissionService.Verify(c.Request.Context(), &req)
+	if err != nil {
+		statusCode, errorCode := admissionTokenError(err)
+
+		c.JSON(statusCode, gin.H{
+			"error":      errorCode,
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    resp,
+	})
+}
+
+// POST /admission/complete
+func (h *AdmissionHandler) Complete(c *gin.Context) {
+	var req services.CompleteAdmissionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_REQUEST",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	resp, err := h.admissionService.Complete(c.Request.Context(), &req)
+	if err != nil {
+		statusCode, errorCode := admissionTokenError(err)
+
+		switch {
+		case contains(err.Error(), "activity not found"):
+			statusCode = http.StatusNotFound
+			errorCode = "ACTIVITY_NOT_FOUND"
+		case contains(err.Error(), "purchase already completed"):
+			statusCode = http.StatusConflict
+			errorCode = "ALREADY_COMPLETED"
+		case contains(err.Error(), "insufficient stock"):
+			statusCode = http.StatusConflict
+			errorCode = "SOLD_OUT"
+		case contains(err.Error(), "quantity exceeds per-user limit"):
+			statusCode = http.StatusBadRequest
+			errorCode = "QUANTITY_LIMIT_EXCEEDED"
+		}
+
+		c.JSON(statusCode, gin.H{
+			"error":      errorCode,
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    resp,
+	})
+}
+
+// POST /admission/exit
+func (h *AdmissionHandler) Exit(c *gin.Context) {
+	var req services.ExitAdmissionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_REQUEST",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	resp, err := h.admissionService.Exit(c.Request.Context(), &req)
+	if err != nil {
+		statusCode, errorCode := admissionTokenError(err)
+
+		c.JSON(statusCode, gin.H{
+			"error":      errorCode,
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    resp,
+	})
+}
+
+// admissionTokenError 將 token 驗證錯誤對應到 HTTP 狀態碼與錯誤碼
+func admissionTokenError(err error) (int, string) {
+	switch {
+	case contains(err.Error(), "token expired"):
+		return http.StatusUnauthorized, "TOKEN_EXPIRED"
+	case contains(err.Error(), "token already used"):
+		return http.StatusConflict, "TOKEN_REPLAYED"
+	case contains(err.Error(), "replay check failed"):
+		return http.StatusInternalServerError, "INTERNAL_ERROR"
+	case contains(err.Error(), "admission:"):
+		return http.StatusUnauthorized, "INVALID_TOKEN"
+	}
+	return http.StatusInternalServerError, "INTERNAL_ERROR"
+}
@@ -1,23 +1,62 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"queue-system/internal/services"
+	"queue-system/pkg/clientip"
 
 	"github.com/gin-gonic/gin"
 )
 
 type QueueHandler struct {
 	queueService *services.QueueService
+	// 解析用戶端 IP，預設不信任任何代理
+	clientIP *clientip.Resolver
+	// 伺服器關閉時結束所有狀態串流
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
 func NewQueueHandler(queueService *services.QueueService) *QueueHandler {
 	return &QueueHandler{
 		queueService: queueService,
+		clientIP:     &clientip.Resolver{},
+		closing:      make(chan struct{}),
 	}
 }
 
+// CloseStreams 結束所有狀態串流，讓伺服器可以優雅關閉；用戶端會重新連線到其他實例
+func (h *QueueHandler) CloseStreams() {
+	h.closeOnce.Do(func() {
+		close(h.closing)
+	})
+}
+
+// streamContext 回傳在請求結束或伺服器關閉時取消的 context
+func (h *QueueHandler) streamContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	go func() {
+		select {
+		case <-h.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// SetClientIPResolver 設定信任的代理網段，只有來自這些網段的轉發 header 會被採用
+func (h *QueueHandler) SetClientIPResolver(resolver *clientip.Resolver) {
+	h.clientIP = resolver
+}
+
 // POST /queue/enter
 func (h *QueueHandler) EnterQueue(c *gin.Context) {
 	var req services.EnterQueueRequest
@@ -30,14 +69,20 @@ func (h *QueueHandler) EnterQueue(c *gin.Context) {
 		return
 	}
 
-	// 從 header 獲取 IP 地址
-	req.IPAddress = getClientIP(c)
+	// 從連線來源或信任代理的轉發 header 取得 IP 地址
+	req.IPAddress = h.clientIP.Resolve(c.Request)
 
 	resp, err := h.queueService.EnterQueue(c.Request.Context(), &req)
 	if err != nil {
 		statusCode := http.StatusInternalServerError
 		errorCode := "INTERNAL_ERROR"
 
+		// 被限流時附上 Retry-After 與 RateLimit-* header
+		var rateLimitErr *services.RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			rateLimitErr.Result.SetHeaders(c.Writer.Header())
+		}
+
 		// 根據錯誤類型返回不同狀態碼
 		switch {
 		case contains(err.Error(), "activity not found"):
@@ -46,12 +91,82 @@ func (h *QueueHandler) EnterQueue(c *gin.Context) {
 		case contains(err.Error(), "activity is not active"):
 			statusCode = http.StatusConflict
 			errorCode = "ACTIVITY_NOT_ACTIVE"
+		case contains(err.Error(), "activity is draining"):
+			statusCode = http.StatusConflict
+			errorCode = "ACTIVITY_DRAINING"
 		case contains(err.Error(), "rate limit exceeded"):
 			statusCode = http.StatusTooManyRequests
 			errorCode = "RATE_LIMIT_EXCEEDED"
 		case contains(err.Error(), "user already in queue"):
 			statusCode = http.StatusConflict
 			errorCode = "USER_ALREADY_IN_QUEUE"
+		case contains(err.Error(), "activity sold out"):
+			statusCode = http.StatusConflict
+			errorCode = "SOLD_OUT"
+		case contains(err.Error(), "lottery entry closed"):
+			statusCode = http.StatusConflict
+			errorCode = "LOTTERY_CLOSED"
+		case contains(err.Error(), "queue is full"):
+			statusCode = http.StatusServiceUnavailable
+			errorCode = "QUEUE_FULL"
+		case contains(err.Error(), "invalid entry token"):
+			statusCode = http.StatusUnauthorized
+			errorCode = "INVALID_ENTRY_TOKEN"
+		case contains(err.Error(), "invalid invite code"):
+			statusCode = http.StatusForbidden
+			errorCode = "INVALID_INVITE_CODE"
+		case contains(err.Error(), "challenge required"):
+			statusCode = http.StatusPreconditionRequired
+			errorCode = "CHALLENGE_REQUIRED"
+		case contains(err.Error(), "invalid challenge"):
+			statusCode = http.StatusForbidden
+			errorCode = "INVALID_CHALLENGE"
+		case contains(err.Error(), "captcha required"), contains(err.Error(), "captcha verification failed"):
+			statusCode = http.StatusPreconditionRequired
+			errorCode = "CAPTCHA_REQUIRED"
+		case contains(err.Error(), "captcha verification unavailable"):
+			statusCode = http.StatusServiceUnavailable
+			errorCode = "CAPTCHA_UNAVAILABLE"
+		}
+
+		c.JSON(statusCode, gin.H{
+			"error":      errorCode,
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	if resp.RateLimit != nil {
+		resp.RateLimit.SetHeaders(c.Writer.Header())
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    resp,
+	})
+}
+
+// GET /queue/challenge
+func (h *QueueHandler) GetChallenge(c *gin.Context) {
+	var req services.ChallengeRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_REQUEST",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	resp, err := h.queueService.GetChallenge(c.Request.Context(), &req)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		errorCode := "INTERNAL_ERROR"
+
+		if contains(err.Error(), "activity not found") {
+			statusCode = http.StatusNotFound
+			errorCode = "ACTIVITY_NOT_FOUND"
 		}
 
 		c.JSON(statusCode, gin.H{
@@ -108,20 +223,135 @@ func (h *QueueHandler) GetQueueStatus(c *gin.Context) {
 	})
 }
 
-// 輔助函數
-func getClientIP(c *gin.Context) string {
-	// 優先從 X-Forwarded-For 取得
-	if ip := c.GetHeader("X-Forwarded-For"); ip != "" {
-		return ip
+// 串流斷線後重新連線的預設等待時間（毫秒）
+const defaultStreamRetryMs = 2000
+
+// GET /queue/stream
+// 以 Server-Sent Events 推送隊列狀態，取代輪詢；輪到、過期或售完後結束串流
+func (h *QueueHandler) StreamQueueStatus(c *gin.Context) {
+	var req services.QueueStatusRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_REQUEST",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	ctx, cancel := h.streamContext(c)
+	defer cancel()
+
+	watcher, status, err := h.queueService.WatchQueueStatus(ctx, &req)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		errorCode := "INTERNAL_ERROR"
+
+		switch {
+		case contains(err.Error(), "activity not found"):
+			statusCode = http.StatusNotFound
+			errorCode = "ACTIVITY_NOT_FOUND"
+		case contains(err.Error(), "invalid sequence number"):
+			statusCode = http.StatusBadRequest
+			errorCode = "INVALID_SEQUENCE"
+		}
+
+		c.JSON(statusCode, gin.H{
+			"error":      errorCode,
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
 	}
-	// 其次從 X-Real-IP 取得
-	if ip := c.GetHeader("X-Real-IP"); ip != "" {
-		return ip
+	defer watcher.Close()
+
+	// 串流不受伺服器 WriteTimeout 限制
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // 關閉 nginx 緩衝
+	c.Status(http.StatusOK)
+
+	// 斷線後瀏覽器依 retry 重新連線；持續失敗時前端改回輪詢
+	retryMs := status.NextPollMs
+	if retryMs <= 0 {
+		retryMs = defaultStreamRetryMs
+	}
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", retryMs)
+
+	for {
+		data, _ := json.Marshal(status)
+		fmt.Fprintf(c.Writer, "event: status\ndata: %s\n\n", data)
+		c.Writer.Flush()
+
+		if status.IsFinal() {
+			return
+		}
+
+		// 等到狀態改變；期間沒有變化時送出心跳註解，避免代理關閉閒置連線
+		for {
+			next, err := watcher.Next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					data, _ := json.Marshal(gin.H{"error": "STREAM_ERROR", "message": err.Error()})
+					fmt.Fprintf(c.Writer, "event: error\ndata: %s\n\n", data)
+					c.Writer.Flush()
+				}
+				return
+			}
+			if next != nil {
+				status = next
+				break
+			}
+			fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			c.Writer.Flush()
+		}
 	}
-	// 最後從 RemoteAddr 取得
-	return c.ClientIP()
 }
 
+// DELETE /queue/leave
+func (h *QueueHandler) LeaveQueue(c *gin.Context) {
+	var req services.LeaveQueueRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_REQUEST",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	resp, err := h.queueService.LeaveQueue(c.Request.Context(), &req)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		errorCode := "INTERNAL_ERROR"
+
+		switch {
+		case contains(err.Error(), "activity not found"):
+			statusCode = http.StatusNotFound
+			errorCode = "ACTIVITY_NOT_FOUND"
+		case contains(err.Error(), "session not in queue"):
+			statusCode = http.StatusNotFound
+			errorCode = "SESSION_NOT_FOUND"
+		}
+
+		c.JSON(statusCode, gin.H{
+			"error":      errorCode,
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    resp,
+	})
+}
+
+// 輔助函數
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr ||
 		(len(s) > len(substr) &&
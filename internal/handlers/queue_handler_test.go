@@ -1,40 +1,98 @@
 package handlers
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 
 	"queue-system/internal/models"
 	"queue-system/internal/services"
+	"queue-system/pkg/keys"
 )
 
-// Mock QueueService
-type MockQueueService struct {
-	mock.Mock
+// testBackend 是以 miniredis 與 sqlmock 組成的隊列服務
+type testBackend struct {
+	mr       *miniredis.Miniredis
+	rdb      *redis.Client
+	db       *sql.DB
+	mock     sqlmock.Sqlmock
+	service  *services.QueueService
+	activity *models.Activity
 }
 
-func (m *MockQueueService) EnterQueue(ctx context.Context, req *models.EnterQueueRequest) (*models.EnterQueueResponse, error) {
-	args := m.Called(ctx, req)
-	if args.Get(0) == nil {
-		return nil, args.Error(1)
+func newTestBackend(t *testing.T) *testBackend {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	// 串流與狀態查詢的次數依時序而定，不要求順序
+	mock.MatchExpectationsInOrder(false)
+
+	now := time.Now()
+	activity := &models.Activity{
+		ID:           7,
+		TenantID:     "tenant1",
+		Name:         "drop",
+		SKU:          "sku-1",
+		InitialStock: 100,
+		StartAt:      now.Add(-time.Hour),
+		EndAt:        now.Add(time.Hour),
+		Status:       models.StatusActive,
+		Config:       models.ActivityConfig{ReleaseRate: 10, PollInterval: 2000},
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+
+	return &testBackend{
+		mr:       mr,
+		rdb:      rdb,
+		db:       db,
+		mock:     mock,
+		service:  services.NewQueueService(db, rdb),
+		activity: activity,
 	}
-	return args.Get(0).(*models.EnterQueueResponse), args.Error(1)
 }
 
-func (m *MockQueueService) GetQueueStatus(ctx context.Context, activityID int64, sessionID string) (*models.QueueStatusResponse, error) {
-	args := m.Called(ctx, activityID, sessionID)
-	if args.Get(0) == nil {
-		return nil, args.Error(1)
+// expectActivity 預期 times 次活動查詢
+func (b *testBackend) expectActivity(times int) {
+	config, _ := b.activity.Config.Value()
+	for i := 0; i < times; i++ {
+		b.mock.ExpectQuery("FROM activities").WithArgs(b.activity.ID).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "tenant_id", "name", "sku", "initial_stock", "start_at", "end_at", "status", "config_json", "created_at", "updated_at"}).
+				AddRow(b.activity.ID, b.activity.TenantID, b.activity.Name, b.activity.SKU, b.activity.InitialStock,
+					b.activity.StartAt, b.activity.EndAt, string(b.activity.Status), config, b.activity.CreatedAt, b.activity.UpdatedAt),
+		)
 	}
-	return args.Get(0).(*models.QueueStatusResponse), args.Error(1)
+}
+
+// seed 設定隊列進度並登記一個會話
+func (b *testBackend) seed(t *testing.T, queueSeq, releaseSeq, seq int, session string) {
+	t.Helper()
+
+	a := b.activity
+	require.NoError(t, b.mr.Set(keys.QueueSeqKey(a.TenantID, a.ID), strconv.Itoa(queueSeq)))
+	require.NoError(t, b.mr.Set(keys.ReleaseSeqKey(a.TenantID, a.ID), strconv.Itoa(releaseSeq)))
+	b.mr.HSet(keys.SessionTokenKey(a.TenantID, a.ID), strconv.Itoa(seq), session)
 }
 
 func TestEnterQueue(t *testing.T) {
@@ -43,99 +101,64 @@ func TestEnterQueue(t *testing.T) {
 	tests := []struct {
 		name           string
 		requestBody    map[string]interface{}
-		mockResponse   *models.EnterQueueResponse
-		mockError      error
 		expectedStatus int
-		expectedBody   map[string]interface{}
+		expectedError  string
 	}{
 		{
 			name: "成功進入隊列",
 			requestBody: map[string]interface{}{
-				"activity_id": 1,
+				"activity_id": 7,
 				"user_hash":   "test-user",
 				"fingerprint": "test-fingerprint",
 			},
-			mockResponse: &models.EnterQueueResponse{
-				RequestID:        "test-request-id",
-				Seq:              1,
-				EstimatedWait:    0,
-				PollingInterval:  2000,
-				SessionID:        "test-session-id",
-				QueueLength:      1,
-			},
-			mockError:      nil,
 			expectedStatus: http.StatusOK,
-			expectedBody: map[string]interface{}{
-				"success": true,
-				"data": map[string]interface{}{
-					"request_id":        "test-request-id",
-					"seq":               float64(1),
-					"estimated_wait":    float64(0),
-					"polling_interval":  float64(2000),
-					"session_id":        "test-session-id",
-					"queue_length":      float64(1),
-				},
-			},
 		},
 		{
 			name: "缺少必要參數",
 			requestBody: map[string]interface{}{
-				"activity_id": 1,
+				"activity_id": 7,
 				// 缺少 user_hash
 			},
-			mockResponse:   nil,
-			mockError:      nil,
 			expectedStatus: http.StatusBadRequest,
-			expectedBody: map[string]interface{}{
-				"success": false,
-				"error":   "INVALID_REQUEST",
-			},
+			expectedError:  "INVALID_REQUEST",
+		},
+		{
+			name:           "缺少 activity_id",
+			requestBody:    map[string]interface{}{"user_hash": "test-user"},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "INVALID_REQUEST",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// 設置 mock
-			mockService := new(MockQueueService)
-			if tt.mockResponse != nil {
-				mockService.On("EnterQueue", mock.Anything, mock.Anything).Return(tt.mockResponse, tt.mockError)
-			}
+			backend := newTestBackend(t)
+			backend.expectActivity(1)
+			handler := NewQueueHandler(backend.service)
 
-			// 創建 handler
-			handler := NewQueueHandler(mockService)
-
-			// 創建測試請求
 			body, _ := json.Marshal(tt.requestBody)
 			req, _ := http.NewRequest("POST", "/api/v1/queue/enter", bytes.NewBuffer(body))
 			req.Header.Set("Content-Type", "application/json")
 
-			// 創建 response recorder
 			w := httptest.NewRecorder()
-
-			// 設置 Gin context
 			c, _ := gin.CreateTestContext(w)
 			c.Request = req
 
-			// 執行 handler
 			handler.EnterQueue(c)
 
-			// 驗證結果
 			assert.Equal(t, tt.expectedStatus, w.Code)
 
 			var response map[string]interface{}
-			err := json.Unmarshal(w.Body.Bytes(), &response)
-			assert.NoError(t, err)
-
-			// 驗證回應結構
-			if tt.expectedBody["success"].(bool) {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			if tt.expectedError == "" {
 				assert.True(t, response["success"].(bool))
-				assert.NotNil(t, response["data"])
+				data := response["data"].(map[string]interface{})
+				assert.Equal(t, float64(1), data["seq"])
+				assert.Equal(t, float64(2000), data["polling_interval"])
+				assert.NotEmpty(t, data["session_id"])
 			} else {
-				assert.False(t, response["success"].(bool))
-				assert.NotNil(t, response["error"])
+				assert.Equal(t, tt.expectedError, response["error"])
 			}
-
-			mockService.AssertExpectations(t)
 		})
 	}
 }
@@ -145,68 +168,204 @@ func TestGetQueueStatus(t *testing.T) {
 
 	tests := []struct {
 		name           string
-		activityID     string
-		sessionID      string
-		mockResponse   *models.QueueStatusResponse
-		mockError      error
+		query          func(seq int64, session string) string
 		expectedStatus int
+		expectedError  string
 	}{
 		{
-			name:       "成功獲取隊列狀態",
-			activityID: "1",
-			sessionID:  "test-session-id",
-			mockResponse: &models.QueueStatusResponse{
-				ActivityID:     1,
-				SessionID:      "test-session-id",
-				Seq:            1,
-				Position:       1,
-				QueueLength:    5,
-				EstimatedWait:  10,
-				Status:         "waiting",
+			name: "成功獲取隊列狀態",
+			query: func(seq int64, session string) string {
+				return "activity_id=7&seq=" + strconv.FormatInt(seq, 10) + "&session_id=" + session
 			},
-			mockError:      nil,
 			expectedStatus: http.StatusOK,
 		},
 		{
-			name:           "無效的 activity_id",
-			activityID:     "invalid",
-			sessionID:      "test-session-id",
-			mockResponse:   nil,
-			mockError:      nil,
+			name: "無效的 activity_id",
+			query: func(seq int64, session string) string {
+				return "activity_id=invalid&seq=" + strconv.FormatInt(seq, 10) + "&session_id=" + session
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "INVALID_REQUEST",
+		},
+		{
+			name: "會話與序號不符",
+			query: func(seq int64, session string) string {
+				return "activity_id=7&seq=" + strconv.FormatInt(seq+1, 10) + "&session_id=" + session
+			},
 			expectedStatus: http.StatusBadRequest,
+			expectedError:  "INVALID_SEQUENCE",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// 設置 mock
-			mockService := new(MockQueueService)
-			if tt.mockResponse != nil {
-				activityID := int64(1)
-				mockService.On("GetQueueStatus", mock.Anything, activityID, tt.sessionID).Return(tt.mockResponse, tt.mockError)
-			}
+			backend := newTestBackend(t)
+			backend.expectActivity(2)
+			handler := NewQueueHandler(backend.service)
 
-			// 創建 handler
-			handler := NewQueueHandler(mockService)
+			// 先進入隊列取得序號與會話
+			entered, err := backend.service.EnterQueue(context.Background(), &services.EnterQueueRequest{
+				ActivityID: backend.activity.ID,
+				UserHash:   "test-user",
+			})
+			require.NoError(t, err)
 
-			// 創建測試請求
-			url := "/api/v1/queue/status?activity_id=" + tt.activityID + "&session_id=" + tt.sessionID
-			req, _ := http.NewRequest("GET", url, nil)
-
-			// 創建 response recorder
+			req, _ := http.NewRequest("GET", "/api/v1/queue/status?"+tt.query(entered.Seq, entered.SessionID), nil)
 			w := httptest.NewRecorder()
-
-			// 設置 Gin context
 			c, _ := gin.CreateTestContext(w)
 			c.Request = req
 
-			// 執行 handler
 			handler.GetQueueStatus(c)
 
-			// 驗證結果
 			assert.Equal(t, tt.expectedStatus, w.Code)
 
-			mockService.AssertExpectations(t)
+			var response map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			if tt.expectedError == "" {
+				assert.True(t, response["success"].(bool))
+				data := response["data"].(map[string]interface{})
+				assert.Equal(t, float64(1), data["position"])
+				assert.Equal(t, "waiting", data["state"])
+			} else {
+				assert.Equal(t, tt.expectedError, response["error"])
+			}
 		})
 	}
 }
+
+// sseEvent 是串流中的一個事件
+type sseEvent struct {
+	name string
+	data string
+}
+
+// readEvents 逐一讀取 SSE 事件，略過 retry 與心跳註解
+func readEvents(t *testing.T, body *bufio.Reader) <-chan sseEvent {
+	t.Helper()
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+		var event sseEvent
+		for {
+			line, err := body.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			case line == "" && event.name != "":
+				events <- event
+				event = sseEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) (sseEvent, bool) {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		return event, ok
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for stream event")
+		return sseEvent{}, false
+	}
+}
+
+// startStream 啟動串流伺服器並連線
+func startStream(t *testing.T, handler *QueueHandler, query string) *http.Response {
+	t.Helper()
+
+	router := gin.New()
+	router.GET("/queue/stream", handler.StreamQueueStatus)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + "/queue/stream?" + query)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestStreamQueueStatus_PushesOnRelease(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	backend := newTestBackend(t)
+	backend.seed(t, 20, 5, 8, "test-session-id")
+	// 連線查詢一次活動，快照載入一次
+	backend.expectActivity(2)
+
+	broker := services.NewStatusBroker(backend.rdb)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, broker.Start(ctx))
+	defer broker.Stop()
+	backend.service.SetStatusBroker(broker)
+
+	resp := startStream(t, NewQueueHandler(backend.service), "activity_id=7&seq=8&session_id=test-session-id")
+	events := readEvents(t, bufio.NewReader(resp.Body))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	event, ok := nextEvent(t, events)
+	require.True(t, ok)
+	assert.Equal(t, "status", event.name)
+	var status services.QueueStatusResponse
+	require.NoError(t, json.Unmarshal([]byte(event.data), &status))
+	assert.Equal(t, services.StateWaiting, status.State)
+	assert.Equal(t, int64(3), status.Position)
+
+	// 釋放到 seq 8 後推送 eligible 並結束串流
+	a := backend.activity
+	require.NoError(t, backend.mr.Set(keys.ReleaseSeqKey(a.TenantID, a.ID), "8"))
+	backend.mr.Publish(keys.QueueEventsChannel(a.TenantID, a.ID), "release")
+
+	event, ok = nextEvent(t, events)
+	require.True(t, ok)
+	require.NoError(t, json.Unmarshal([]byte(event.data), &status))
+	assert.Equal(t, services.StateEligible, status.State)
+
+	_, ok = nextEvent(t, events)
+	assert.False(t, ok, "stream should end after a final state")
+	assert.NoError(t, backend.mock.ExpectationsWereMet())
+}
+
+func TestStreamQueueStatus_InvalidSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	backend := newTestBackend(t)
+	backend.seed(t, 20, 5, 8, "test-session-id")
+	backend.expectActivity(1)
+
+	resp := startStream(t, NewQueueHandler(backend.service), "activity_id=7&seq=8&session_id=other-session")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var response map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	assert.Equal(t, "INVALID_SEQUENCE", response["error"])
+}
+
+func TestStreamQueueStatus_CloseStreams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	backend := newTestBackend(t)
+	backend.seed(t, 20, 5, 8, "test-session-id")
+	backend.expectActivity(1)
+
+	handler := NewQueueHandler(backend.service)
+	resp := startStream(t, handler, "activity_id=7&seq=8&session_id=test-session-id")
+	events := readEvents(t, bufio.NewReader(resp.Body))
+
+	event, ok := nextEvent(t, events)
+	require.True(t, ok)
+	assert.Equal(t, "status", event.name)
+
+	// 伺服器關閉時結束串流，不送出錯誤事件
+	handler.CloseStreams()
+	_, ok = nextEvent(t, events)
+	assert.False(t, ok)
+}
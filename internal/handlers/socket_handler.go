@@ -0,0 +1,507 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"queue-system/internal/middleware"
+	"queue-system/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket 傳輸：推送與 GET /queue/status 相同的狀態，並接受用戶端的離開、心跳與換取
+// admission token 訊息。每個連線只有一個寫入 goroutine；狀態只保留最新一筆，回覆佇列滿或
+// 寫入逾時的連線視為過慢而關閉，不會拖住狀態推送。
+
+const (
+	// 每個實例預設的最大連線數
+	defaultMaxSocketConns = 10000
+	// 連線數已滿時建議用戶端重試的秒數
+	socketRetryAfterSeconds = "5"
+	// 單次寫入的期限，超過即視為過慢的用戶端
+	socketWriteWait = 10 * time.Second
+	// 等待 pong 或任何訊息的期限
+	socketPongWait = 60 * time.Second
+	// 送出 ping 的間隔，需小於 socketPongWait
+	socketPingPeriod = socketPongWait * 9 / 10
+	// 用戶端訊息的大小上限
+	socketMaxMessageSize = 1024
+	// 待送出的回覆數上限
+	socketSendBuffer = 16
+	// 心跳查詢狀態的最短間隔；間隔內的心跳回傳最近的狀態，不再查詢
+	socketHeartbeatMinInterval = time.Second
+)
+
+// 用戶端送出的訊息類型
+const (
+	socketHeartbeat = "heartbeat"
+	socketLeave     = "leave"
+	socketReserve   = "reserve"
+)
+
+// 伺服器送出的訊息類型
+const (
+	socketStatus    = "status"
+	socketAdmission = "admission"
+	socketLeft      = "left"
+	socketError     = "error"
+)
+
+type socketRequest struct {
+	Type string `json:"type"`
+	// 用戶端自訂的識別碼，原樣帶回對應的回覆
+	ID string `json:"id,omitempty"`
+}
+
+type socketMessage struct {
+	Type    string      `json:"type"`
+	ID      string      `json:"id,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Message string      `json:"message,omitempty"`
+}
+
+// socketReply 為待送出的回覆；closeCode 不為 0 時送出後結束連線
+type socketReply struct {
+	message   socketMessage
+	closeCode int
+	closeText string
+}
+
+type SocketHandler struct {
+	queueService     *services.QueueService
+	admissionService *services.AdmissionService
+	upgrader         websocket.Upgrader
+	maxConns         int64
+	conns            atomic.Int64
+	// 伺服器關閉時通知所有連線
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func NewSocketHandler(queueService *services.QueueService, admissionService *services.AdmissionService) *SocketHandler {
+	return &SocketHandler{
+		queueService:     queueService,
+		admissionService: admissionService,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 4096,
+			// 未呼叫 SetAllowedOrigins 時只接受同源連線
+		},
+		maxConns: defaultMaxSocketConns,
+		closing:  make(chan struct{}),
+	}
+}
+
+// SetMaxConnections 設定本實例的最大連線數；超過時回傳 503，用戶端改用 SSE 或輪詢
+func (h *SocketHandler) SetMaxConnections(n int) {
+	if n > 0 {
+		h.maxConns = int64(n)
+	}
+}
+
+// SetAllowedOrigins 設定可建立連線的來源，與 CORS 設定相同；未帶 Origin 的非瀏覽器用戶端不受限制。
+// 未設定時只接受同源連線
+func (h *SocketHandler) SetAllowedOrigins(origins []string) {
+	if len(origins) == 0 {
+		h.upgrader.CheckOrigin = nil
+		return
+	}
+	h.upgrader.CheckOrigin = func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || middleware.OriginAllowed(origins, origin)
+	}
+}
+
+// Shutdown 通知所有連線伺服器即將關閉並等待結束；升級後的連線不在 http.Server.Shutdown 的追蹤範圍
+func (h *SocketHandler) Shutdown(ctx context.Context) error {
+	h.closeOnce.Do(func() {
+		close(h.closing)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GET /queue/ws
+// 以 WebSocket 推送隊列狀態並處理用戶端訊息
+func (h *SocketHandler) ServeQueue(c *gin.Context) {
+	var req services.QueueStatusRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "INVALID_REQUEST",
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	// 不允許的來源在查詢狀態前拒絕
+	if h.upgrader.CheckOrigin != nil && !h.upgrader.CheckOrigin(c.Request) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":      "ORIGIN_NOT_ALLOWED",
+			"message":    "origin not allowed",
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+
+	select {
+	case <-h.closing:
+		c.Header("Retry-After", socketRetryAfterSeconds)
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":      "SERVER_SHUTTING_DOWN",
+			"message":    "server is shutting down",
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	default:
+	}
+
+	if h.conns.Add(1) > h.maxConns {
+		h.conns.Add(-1)
+		c.Header("Retry-After", socketRetryAfterSeconds)
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":      "TOO_MANY_CONNECTIONS",
+			"message":    "connection limit reached",
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+	h.wg.Add(1)
+	defer func() {
+		h.conns.Add(-1)
+		h.wg.Done()
+	}()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	watcher, status, err := h.queueService.WatchQueueStatus(ctx, &req)
+	if err != nil {
+		statusCode, errorCode := socketErrorCode(err)
+
+		c.JSON(statusCode, gin.H{
+			"error":      errorCode,
+			"message":    err.Error(),
+			"request_id": c.GetString("request_id"),
+		})
+		return
+	}
+	defer watcher.Close()
+
+	// 升級失敗時 Upgrader 已回傳錯誤
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := &socketClient{
+		handler: h,
+		conn:    conn,
+		req:     req,
+		status:  make(chan *services.QueueStatusResponse, 1),
+		send:    make(chan socketReply, socketSendBuffer),
+		cancel:  cancel,
+	}
+	client.pushStatus(status)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		client.watch(ctx, watcher)
+	}()
+	go func() {
+		defer wg.Done()
+		client.read(ctx)
+	}()
+
+	client.write(ctx)
+
+	// 結束讀取與狀態追蹤後才關閉 watcher
+	cancel()
+	conn.Close()
+	wg.Wait()
+}
+
+// socketClient 為單一 WebSocket 連線
+type socketClient struct {
+	handler *SocketHandler
+	conn    *websocket.Conn
+	req     services.QueueStatusRequest
+	// 最新的狀態，尚未送出時以新狀態取代
+	status chan *services.QueueStatusResponse
+	send   chan socketReply
+	cancel context.CancelFunc
+	// 目前的序號；預排隊分配序號後隨狀態更新
+	seq atomic.Int64
+	// 最近取得的狀態與時間，供心跳合併查詢
+	mu         sync.Mutex
+	lastStatus *services.QueueStatusResponse
+	lastAt     time.Time
+}
+
+// remember 記錄最近取得的狀態
+func (cl *socketClient) remember(status *services.QueueStatusResponse) {
+	if status.Seq > 0 {
+		cl.seq.Store(status.Seq)
+	}
+	cl.mu.Lock()
+	cl.lastStatus, cl.lastAt = status, time.Now()
+	cl.mu.Unlock()
+}
+
+// recentStatus 回傳輪詢間隔（至少 socketHeartbeatMinInterval）內取得的狀態；已過期或尚無狀態時回傳 nil
+func (cl *socketClient) recentStatus() *services.QueueStatusResponse {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.lastStatus == nil {
+		return nil
+	}
+	interval := time.Duration(cl.lastStatus.NextPollMs) * time.Millisecond
+	if interval < socketHeartbeatMinInterval {
+		interval = socketHeartbeatMinInterval
+	}
+	if time.Since(cl.lastAt) >= interval {
+		return nil
+	}
+	return cl.lastStatus
+}
+
+// pushStatus 放入最新狀態；只有 watch 與建立連線時呼叫，單一寫入者下放入不會阻塞
+func (cl *socketClient) pushStatus(status *services.QueueStatusResponse) {
+	cl.remember(status)
+	select {
+	case <-cl.status:
+	default:
+	}
+	cl.status <- status
+}
+
+// reply 放入回覆；佇列已滿表示用戶端讀取過慢，直接關閉連線
+func (cl *socketClient) reply(r socketReply) {
+	select {
+	case cl.send <- r:
+	default:
+		cl.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer"),
+			time.Now().Add(socketWriteWait))
+		cl.cancel()
+	}
+}
+
+// watch 在狀態改變時放入最新狀態；過期或售完後不再追蹤
+func (cl *socketClient) watch(ctx context.Context, watcher *services.StatusWatcher) {
+	for {
+		next, err := watcher.Next(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				_, errorCode := socketErrorCode(err)
+				cl.reply(socketReply{
+					message:   socketMessage{Type: socketError, Error: errorCode, Message: err.Error()},
+					closeCode: websocket.CloseInternalServerErr,
+					closeText: errorCode,
+				})
+			}
+			return
+		}
+		if next == nil {
+			continue
+		}
+		cl.pushStatus(next)
+		if socketStatusEnded(next) {
+			return
+		}
+	}
+}
+
+// read 處理用戶端訊息；連線中斷或逾時未收到 pong 時結束連線
+func (cl *socketClient) read(ctx context.Context) {
+	defer cl.cancel()
+
+	cl.conn.SetReadLimit(socketMaxMessageSize)
+	cl.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	cl.conn.SetPongHandler(func(string) error {
+		return cl.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	for {
+		_, data, err := cl.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		cl.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+
+		var msg socketRequest
+		if err := json.Unmarshal(data, &msg); err != nil {
+			cl.reply(socketReply{message: socketMessage{Type: socketError, Error: "INVALID_REQUEST", Message: err.Error()}})
+			continue
+		}
+		cl.handle(ctx, &msg)
+	}
+}
+
+func (cl *socketClient) handle(ctx context.Context, msg *socketRequest) {
+	h := cl.handler
+
+	switch msg.Type {
+	case socketHeartbeat:
+		// 立即回傳目前狀態，同時更新等待者的在線心跳；輪詢間隔內重複的心跳回傳最近的狀態，
+		// 在線心跳由狀態追蹤的定期更新負責
+		if status := cl.recentStatus(); status != nil {
+			cl.reply(socketReply{message: socketMessage{Type: socketStatus, ID: msg.ID, Data: status}})
+			return
+		}
+		status, err := h.queueService.GetQueueStatus(ctx, &services.QueueStatusRequest{
+			ActivityID: cl.req.ActivityID,
+			Seq:        cl.seq.Load(),
+			SessionID:  cl.req.SessionID,
+			Streaming:  true,
+		})
+		if err != nil {
+			cl.replyError(msg, err)
+			return
+		}
+		cl.remember(status)
+		cl.reply(socketReply{message: socketMessage{Type: socketStatus, ID: msg.ID, Data: status}})
+
+	case socketLeave:
+		resp, err := h.queueService.LeaveQueue(ctx, &services.LeaveQueueRequest{
+			ActivityID: cl.req.ActivityID,
+			SessionID:  cl.req.SessionID,
+		})
+		if err != nil {
+			cl.replyError(msg, err)
+			return
+		}
+		cl.reply(socketReply{
+			message:   socketMessage{Type: socketLeft, ID: msg.ID, Data: resp},
+			closeCode: websocket.CloseNormalClosure,
+			closeText: "left queue",
+		})
+
+	case socketReserve:
+		resp, err := h.admissionService.Reserve(ctx, &services.ReserveRequest{
+			ActivityID: cl.req.ActivityID,
+			Seq:        cl.seq.Load(),
+			SessionID:  cl.req.SessionID,
+		})
+		if err != nil {
+			cl.replyError(msg, err)
+			return
+		}
+		// 取得 token 後用戶端前往結帳，不再需要狀態
+		cl.reply(socketReply{
+			message:   socketMessage{Type: socketAdmission, ID: msg.ID, Data: resp},
+			closeCode: websocket.CloseNormalClosure,
+			closeText: "admitted",
+		})
+
+	default:
+		cl.reply(socketReply{message: socketMessage{
+			Type:    socketError,
+			ID:      msg.ID,
+			Error:   "INVALID_REQUEST",
+			Message: "unknown message type: " + msg.Type,
+		}})
+	}
+}
+
+func (cl *socketClient) replyError(msg *socketRequest, err error) {
+	_, errorCode := socketErrorCode(err)
+	cl.reply(socketReply{message: socketMessage{Type: socketError, ID: msg.ID, Error: errorCode, Message: err.Error()}})
+}
+
+// write 為連線唯一的寫入者，依序送出狀態、回覆與 ping
+func (cl *socketClient) write(ctx context.Context) {
+	ticker := time.NewTicker(socketPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-cl.handler.closing:
+			// 用戶端收到 1001 後應重新連線到其他實例
+			cl.close(websocket.CloseGoingAway, "server shutting down")
+			return
+
+		case status := <-cl.status:
+			if err := cl.writeJSON(socketMessage{Type: socketStatus, Data: status}); err != nil {
+				return
+			}
+			if socketStatusEnded(status) {
+				cl.close(websocket.CloseNormalClosure, string(status.State))
+				return
+			}
+
+		case r := <-cl.send:
+			if err := cl.writeJSON(r.message); err != nil {
+				return
+			}
+			if r.closeCode != 0 {
+				cl.close(r.closeCode, r.closeText)
+				return
+			}
+
+		case <-ticker.C:
+			if err := cl.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (cl *socketClient) writeJSON(msg socketMessage) error {
+	cl.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	return cl.conn.WriteJSON(msg)
+}
+
+func (cl *socketClient) close(code int, text string) {
+	cl.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(socketWriteWait))
+}
+
+// socketStatusEnded 表示狀態不會再改變，送出後即可結束連線；輪到（eligible）時保留連線以換取 token
+func socketStatusEnded(status *services.QueueStatusResponse) bool {
+	return status.State == services.StateExpired || status.State == services.StateSoldOut
+}
+
+// socketErrorCode 將服務錯誤轉為錯誤碼，連線建立前以 HTTP 狀態碼回傳
+func socketErrorCode(err error) (int, string) {
+	switch {
+	case contains(err.Error(), "activity not found"):
+		return http.StatusNotFound, "ACTIVITY_NOT_FOUND"
+	case contains(err.Error(), "invalid sequence number"):
+		return http.StatusBadRequest, "INVALID_SEQUENCE"
+	case contains(err.Error(), "session not in queue"):
+		return http.StatusNotFound, "SESSION_NOT_FOUND"
+	case contains(err.Error(), "not eligible for admission"):
+		return http.StatusConflict, "NOT_ELIGIBLE"
+	case contains(err.Error(), "admission already issued"):
+		return http.StatusConflict, "ADMISSION_ALREADY_ISSUED"
+	case contains(err.Error(), "activity sold out"):
+		return http.StatusConflict, "SOLD_OUT"
+	}
+	return http.StatusInternalServerError, "INTERNAL_ERROR"
+}
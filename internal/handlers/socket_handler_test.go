@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"queue-system/internal/services"
+	"queue-system/pkg/keys"
+)
+
+// startSocket 啟動 WebSocket 伺服器，回傳連線網址
+func startSocket(t *testing.T, handler *SocketHandler) string {
+	t.Helper()
+
+	router := gin.New()
+	router.GET("/queue/ws", handler.ServeQueue)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/queue/ws"
+}
+
+// dialSocket 以指定的 Origin 建立連線
+func dialSocket(t *testing.T, url, query, origin string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(url+"?"+query, header)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// readSocket 讀取下一則訊息
+func readSocket(t *testing.T, conn *websocket.Conn) (socketMessage, services.QueueStatusResponse) {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var raw struct {
+		socketMessage
+		Data services.QueueStatusResponse `json:"data"`
+	}
+	require.NoError(t, conn.ReadJSON(&raw))
+	return raw.socketMessage, raw.Data
+}
+
+// readClose 讀到關閉訊框為止，回傳關閉碼
+func readClose(t *testing.T, conn *websocket.Conn) int {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			closeErr, ok := err.(*websocket.CloseError)
+			require.True(t, ok, "unexpected error: %v", err)
+			return closeErr.Code
+		}
+	}
+}
+
+func TestServeQueue_EnforcesAllowedOrigins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	backend := newTestBackend(t)
+	backend.seed(t, 20, 5, 8, "test-session-id")
+	backend.expectActivity(1)
+
+	handler := NewSocketHandler(backend.service, nil)
+	handler.SetAllowedOrigins([]string{"https://shop.example.com"})
+	url := startSocket(t, handler)
+	query := "activity_id=7&seq=8&session_id=test-session-id"
+
+	// 其他來源不能升級
+	_, resp, err := dialSocket(t, url, query, "https://evil.example.com")
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	conn, resp, err := dialSocket(t, url, query, "https://shop.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	msg, status := readSocket(t, conn)
+	assert.Equal(t, socketStatus, msg.Type)
+	assert.Equal(t, services.StateWaiting, status.State)
+	assert.Equal(t, int64(3), status.Position)
+}
+
+func TestServeQueue_PushesOnRelease(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	backend := newTestBackend(t)
+	backend.seed(t, 20, 5, 8, "test-session-id")
+	// 連線查詢一次活動，快照載入一次
+	backend.expectActivity(2)
+
+	broker := services.NewStatusBroker(backend.rdb)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, broker.Start(ctx))
+	defer broker.Stop()
+	backend.service.SetStatusBroker(broker)
+
+	conn, _, err := dialSocket(t, startSocket(t, NewSocketHandler(backend.service, nil)), "activity_id=7&seq=8&session_id=test-session-id", "")
+	require.NoError(t, err)
+
+	_, status := readSocket(t, conn)
+	assert.Equal(t, int64(3), status.Position)
+
+	// 剛取得狀態後的心跳回傳同一份狀態，不再查詢活動
+	require.NoError(t, conn.WriteJSON(socketRequest{Type: socketHeartbeat, ID: "hb-1"}))
+	msg, status := readSocket(t, conn)
+	assert.Equal(t, socketStatus, msg.Type)
+	assert.Equal(t, "hb-1", msg.ID)
+	assert.Equal(t, int64(3), status.Position)
+
+	// 釋放後推送新狀態
+	a := backend.activity
+	require.NoError(t, backend.mr.Set(keys.ReleaseSeqKey(a.TenantID, a.ID), "7"))
+	backend.mr.Publish(keys.QueueEventsChannel(a.TenantID, a.ID), "release")
+
+	msg, status = readSocket(t, conn)
+	assert.Equal(t, socketStatus, msg.Type)
+	assert.Equal(t, int64(1), status.Position)
+	assert.NoError(t, backend.mock.ExpectationsWereMet())
+}
+
+func TestSocketClient_ClosesSlowConsumer(t *testing.T) {
+	serverConn := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		serverConn <- conn
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &socketClient{
+		handler: NewSocketHandler(nil, nil),
+		conn:    <-serverConn,
+		send:    make(chan socketReply, socketSendBuffer),
+		cancel:  cancel,
+	}
+	defer client.conn.Close()
+
+	// 寫入者未跟上時回覆佇列填滿，下一則回覆關閉連線
+	for i := 0; i < socketSendBuffer; i++ {
+		client.reply(socketReply{message: socketMessage{Type: socketError}})
+	}
+	assert.NoError(t, ctx.Err())
+	client.reply(socketReply{message: socketMessage{Type: socketError}})
+	assert.Error(t, ctx.Err())
+
+	assert.Equal(t, websocket.CloseTryAgainLater, readClose(t, conn))
+}
+
+func TestServeQueue_Shutdown(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	backend := newTestBackend(t)
+	backend.seed(t, 20, 5, 8, "test-session-id")
+	backend.expectActivity(1)
+
+	handler := NewSocketHandler(backend.service, nil)
+	url := startSocket(t, handler)
+	query := "activity_id=7&seq=8&session_id=test-session-id"
+	conn, _, err := dialSocket(t, url, query, "")
+	require.NoError(t, err)
+	readSocket(t, conn)
+
+	// 關閉時送出 1001 並等待連線結束
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, handler.Shutdown(ctx))
+	assert.Equal(t, websocket.CloseGoingAway, readClose(t, conn))
+	assert.Zero(t, handler.conns.Load())
+
+	// 關閉後的新連線回傳 503
+	_, resp, err := dialSocket(t, url, query, "")
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, socketRetryAfterSeconds, resp.Header.Get("Retry-After"))
+}
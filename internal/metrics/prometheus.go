@@ -43,6 +43,14 @@ var (
         []string{"tenant_id", "activity_id", "method"},
     )
 
+    QueueAbandoned = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Name: "queue_abandoned_users",
+            Help: "Number of users who left the queue by tenant and activity",
+        },
+        []string{"tenant_id", "activity_id"},
+    )
+
     QueueWaitTime = prometheus.NewHistogramVec(
         prometheus.HistogramOpts{
             Name:    "queue_wait_time_seconds",
@@ -136,6 +144,7 @@ func (mc *MetricsCollector) RegisterMetrics() {
         QueueLength,
         QueueEnterTotal,
         QueueReleaseTotal,
+        QueueAbandoned,
         QueueWaitTime,
         SchedulerActive,
         SchedulerReleaseRate,
@@ -234,6 +243,13 @@ func (mc *MetricsCollector) collectQueueMetrics(ctx context.Context) {
             "status":      "success",
         }).Add(float64(enterTotal))
 
+        // 收集離開隊列人數
+        abandonTotalKey := keys.MetricsKey(tenantID, activityID, "abandon_total")
+        QueueAbandoned.With(prometheus.Labels{
+            "tenant_id":   tenantID,
+            "activity_id": activityIDStr,
+        }).Set(float64(mc.getRedisInt(ctx, abandonTotalKey)))
+
         // 收集釋放總數
         releaseTotalKey := keys.MetricsKey(tenantID, activityID, "release_total")
         releaseTotal := mc.getRedisInt(ctx, releaseTotalKey)
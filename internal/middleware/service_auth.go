@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServiceAuth 要求 Authorization: Bearer <key> 為設定的服務金鑰之一，供只允許商店後端呼叫的路由使用；
+// 未設定任何金鑰時一律拒絕
+func ServiceAuth(serviceKeys []string) gin.HandlerFunc {
+	keySet := make([][]byte, 0, len(serviceKeys))
+	for _, key := range serviceKeys {
+		if key = strings.TrimSpace(key); key != "" {
+			keySet = append(keySet, []byte(key))
+		}
+	}
+
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if ok && token != "" {
+			for _, key := range keySet {
+				if subtle.ConstantTimeCompare([]byte(token), key) == 1 {
+					c.Next()
+					return
+				}
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error":      "UNAUTHORIZED",
+			"message":    "valid service credential required",
+			"request_id": c.GetString("request_id"),
+		})
+	}
+}
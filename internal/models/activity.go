@@ -4,6 +4,7 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"math"
 	"time"
 )
 
@@ -24,10 +25,13 @@ type Activity struct {
 type ActivityStatus string
 
 const (
-	StatusDraft  ActivityStatus = "draft"
-	StatusActive ActivityStatus = "active"
-	StatusPaused ActivityStatus = "paused"
-	StatusEnded  ActivityStatus = "ended"
+	StatusDraft     ActivityStatus = "draft"
+	StatusScheduled ActivityStatus = "scheduled" // 已排程，start_at 時自動開始
+	StatusActive    ActivityStatus = "active"
+	StatusPaused    ActivityStatus = "paused"
+	StatusDraining  ActivityStatus = "draining" // 已過 end_at，不再接受新用戶
+	StatusEnded     ActivityStatus = "ended"
+	StatusArchived  ActivityStatus = "archived"
 )
 
 type ActivityConfig struct {
@@ -35,6 +39,208 @@ type ActivityConfig struct {
 	MaxConcurrent  int  `json:"max_concurrent"`
 	EnableThrottle bool `json:"enable_throttle"`
 	PollInterval   int  `json:"poll_interval"`
+	// 輪到後需在此秒數內換取 admission token，逾時名額會退回釋放配額；0 表示不限
+	ClaimTimeoutSeconds int `json:"claim_timeout_seconds"`
+	// 釋放模式：rate 依 release_rate 每秒釋放；concurrency 維持最多 max_concurrent 個用戶同時在 origin
+	ReleaseMode ReleaseMode `json:"release_mode,omitempty"`
+	// concurrency 模式下名額的租約秒數，逾時未完成結帳或離開即收回
+	LeaseTimeoutSeconds int `json:"lease_timeout_seconds,omitempty"`
+	// 等待中用戶超過此秒數未輪詢即視為離線，釋放時跳過；0 表示不檢查
+	HeartbeatGraceSeconds int `json:"heartbeat_grace_seconds,omitempty"`
+	// 開賣前此秒數內進入的用戶先預排隊，開賣時以隨機順序分配序號；0 表示停用
+	PreQueueWindowSeconds int `json:"pre_queue_window_seconds,omitempty"`
+	// 名額分配方式：fifo 先到先得；lottery 在報名期間登記，截止時抽籤決定順序
+	AllocationMode AllocationMode `json:"allocation_mode,omitempty"`
+	// lottery 模式下自 start_at 起的報名秒數，截止時抽籤
+	LotteryEntrySeconds int `json:"lottery_entry_seconds,omitempty"`
+	// 優先通道，各自有序號與釋放指標；未列出的 general 為預設通道
+	Lanes []LaneConfig `json:"lanes,omitempty"`
+	// 通道間分配釋放名額的方式：weighted 依權重；strict 依優先順序
+	LanePolicy LanePolicy `json:"lane_policy,omitempty"`
+	// 名單內用戶的處理方式：admit 立即輪到；lane 進入 allowlist_lane；未設定表示停用名單
+	AllowlistMode AllowlistMode `json:"allowlist_mode,omitempty"`
+	AllowlistLane string        `json:"allowlist_lane,omitempty"`
+	// 所有通道合計的等待人數上限；0 表示不限
+	MaxQueueSize int `json:"max_queue_size,omitempty"`
+	// 隊列已滿時的處理方式，未設定視為 reject
+	OverflowMode OverflowMode `json:"overflow_mode,omitempty"`
+	// redirect 模式下導向的活動
+	OverflowActivityID int64 `json:"overflow_activity_id,omitempty"`
+	// 暫停期間的輪詢間隔（毫秒）與顯示給等待者的訊息
+	PausePollInterval int    `json:"pause_poll_interval,omitempty"`
+	PauseMessage      string `json:"pause_message,omitempty"`
+	// end_at 後繼續釋放已在隊列中用戶的秒數，期間不接受新用戶；0 表示 end_at 即結束
+	DrainSeconds int `json:"drain_seconds,omitempty"`
+	// 工作量證明的基本難度（前導零位元數）；0 表示停用
+	PowDifficulty int `json:"pow_difficulty,omitempty"`
+	// 每秒進入人數超過此值時，每加倍一次難度加 1，最高 pow_max_difficulty
+	PowTargetRate    int `json:"pow_target_rate,omitempty"`
+	PowMaxDifficulty int `json:"pow_max_difficulty,omitempty"`
+	// 人機驗證服務（hcaptcha、turnstile）；未設定表示停用
+	CaptchaProvider string `json:"captcha_provider,omitempty"`
+	// always 每次進入都需驗證，on_risk 只在偵測到可疑請求時驗證；未設定視為 always
+	CaptchaMode CaptchaMode `json:"captcha_mode,omitempty"`
+	// 風險分數（0-100）達 risk_shadow_score 的用戶照常分配序號但不會被釋放；
+	// 達 risk_penalty_score 的用戶延後 risk_penalty_positions 個位置才釋放；0 表示停用
+	RiskShadowScore      int `json:"risk_shadow_score,omitempty"`
+	RiskPenaltyScore     int `json:"risk_penalty_score,omitempty"`
+	RiskPenaltyPositions int `json:"risk_penalty_positions,omitempty"`
+	// 計分門檻：同一指紋的 user_hash 數、同一子網段每分鐘的進入次數超過此值，或過快輪詢達此次數時開始計分；
+	// 0 使用預設值（3、30、3）
+	RiskFingerprintUsers int `json:"risk_fingerprint_users,omitempty"`
+	RiskSubnetBurst      int `json:"risk_subnet_burst,omitempty"`
+	RiskPollStrikes      int `json:"risk_poll_strikes,omitempty"`
+	// enable_throttle 開啟時套用的進入限流規則；未開啟或未設定時每個 IP 每 60 秒 10 次
+	ThrottlePolicies []ThrottlePolicy `json:"throttle_policies,omitempty"`
+	// 開賣後此秒數內使用各規則的 launch_rate / launch_burst
+	ThrottleLaunchSeconds int `json:"throttle_launch_seconds,omitempty"`
+	// 每個 admission token 最多可確認購買的數量；未設定視為 1
+	MaxPerUser int `json:"max_per_user,omitempty"`
+}
+
+type ThrottleKey string
+
+const (
+	ThrottleKeyIP          ThrottleKey = "ip"
+	ThrottleKeySubnet      ThrottleKey = "subnet" // IPv4 /24、IPv6 /64
+	ThrottleKeyFingerprint ThrottleKey = "fingerprint"
+	ThrottleKeyUserHash    ThrottleKey = "user_hash"
+)
+
+// ThrottlePolicy 限制同一 key 在 period_seconds 內最多進入 rate 次，可瞬間使用 burst 次（未設定時等於 rate）
+type ThrottlePolicy struct {
+	Key           ThrottleKey `json:"key"`
+	Rate          int         `json:"rate"`
+	PeriodSeconds int         `json:"period_seconds"`
+	Burst         int         `json:"burst,omitempty"`
+	// 開賣初期的限制；未設定時沿用 rate / burst
+	LaunchRate  int `json:"launch_rate,omitempty"`
+	LaunchBurst int `json:"launch_burst,omitempty"`
+}
+
+// DefaultLane 為未帶 entry token 的用戶進入的通道
+const DefaultLane = "general"
+
+type LaneConfig struct {
+	Name string `json:"name"`
+	// weighted 模式下的釋放權重，未設定視為 1
+	Weight int `json:"weight,omitempty"`
+	// strict 模式下數字越小越優先
+	Priority int `json:"priority,omitempty"`
+}
+
+type LanePolicy string
+
+const (
+	LanePolicyWeighted LanePolicy = "weighted"
+	LanePolicyStrict   LanePolicy = "strict"
+)
+
+// HasLane 檢查通道是否已設定；預設通道一律存在
+func (ac ActivityConfig) HasLane(name string) bool {
+	if name == DefaultLane {
+		return true
+	}
+	for _, lane := range ac.Lanes {
+		if lane.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AllLanes 回傳包含預設通道在內的所有通道
+func (ac ActivityConfig) AllLanes() []LaneConfig {
+	lanes := make([]LaneConfig, 0, len(ac.Lanes)+1)
+	hasDefault := false
+	for _, lane := range ac.Lanes {
+		if lane.Name == DefaultLane {
+			hasDefault = true
+		}
+		lanes = append(lanes, lane)
+	}
+	if !hasDefault {
+		// 預設通道排在最後、權重 1
+		lanes = append(lanes, LaneConfig{Name: DefaultLane, Weight: 1, Priority: math.MaxInt32})
+	}
+	return lanes
+}
+
+type AllowlistMode string
+
+const (
+	AllowlistModeAdmit AllowlistMode = "admit"
+	AllowlistModeLane  AllowlistMode = "lane"
+)
+
+// AllowlistAdmitLane 為 admit 模式名單用戶的內部通道，不能用作 lanes 的名稱
+const AllowlistAdmitLane = "allowlist"
+
+type OverflowMode string
+
+const (
+	OverflowModeReject   OverflowMode = "reject"
+	OverflowModeWaitlist OverflowMode = "waitlist"
+	OverflowModeRedirect OverflowMode = "redirect"
+)
+
+// IsWaitlistOverflow 回傳隊列滿後是否照常排入並標示為候補
+func (ac ActivityConfig) IsWaitlistOverflow() bool {
+	return ac.MaxQueueSize > 0 && ac.OverflowMode == OverflowModeWaitlist
+}
+
+type ReleaseMode string
+
+const (
+	ReleaseModeRate        ReleaseMode = "rate"
+	ReleaseModeConcurrency ReleaseMode = "concurrency"
+)
+
+type AllocationMode string
+
+const (
+	AllocationModeFIFO    AllocationMode = "fifo"
+	AllocationModeLottery AllocationMode = "lottery"
+)
+
+type CaptchaMode string
+
+const (
+	CaptchaModeAlways CaptchaMode = "always"
+	CaptchaModeOnRisk CaptchaMode = "on_risk"
+)
+
+// IsPaused 回傳活動是否暫停中
+func (a *Activity) IsPaused() bool {
+	return a.Status == StatusPaused
+}
+
+// IsLotteryMode 回傳是否以抽籤分配名額
+func (ac ActivityConfig) IsLotteryMode() bool {
+	return ac.AllocationMode == AllocationModeLottery
+}
+
+// DrawAt 回傳抽籤時間（報名截止）
+func (a *Activity) DrawAt() time.Time {
+	return a.StartAt.Add(time.Duration(a.Config.LotteryEntrySeconds) * time.Second)
+}
+
+// DrainDeadline 回傳排空截止時間，之後仍在等待的用戶視為過期
+func (a *Activity) DrainDeadline() time.Time {
+	return a.EndAt.Add(time.Duration(a.Config.DrainSeconds) * time.Second)
+}
+
+// PurchaseLimit 回傳每個 admission token 可確認的購買數量上限
+func (ac ActivityConfig) PurchaseLimit() int {
+	if ac.MaxPerUser > 0 {
+		return ac.MaxPerUser
+	}
+	return 1
+}
+
+// IsConcurrencyMode 回傳是否以同時在線人數控制釋放
+func (ac ActivityConfig) IsConcurrencyMode() bool {
+	return ac.ReleaseMode == ReleaseModeConcurrency && ac.MaxConcurrent > 0
 }
 
 // 實作 database/sql/driver.Valuer 介面
@@ -57,12 +263,45 @@ func (ac *ActivityConfig) Scan(value interface{}) error {
 }
 
 type QueueEntry struct {
-	ID          int64     `json:"id" db:"id"`
-	ActivityID  int64     `json:"activity_id" db:"activity_id"`
-	UserHash    string    `json:"user_hash" db:"user_hash"`
-	SessionID   string    `json:"session_id" db:"session_id"`
-	SeqNumber   int64     `json:"seq_number" db:"seq_number"`
-	Fingerprint string    `json:"fingerprint" db:"fingerprint"`
-	IPHash      string    `json:"ip_hash" db:"ip_hash"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	ID          int64      `json:"id" db:"id"`
+	ActivityID  int64      `json:"activity_id" db:"activity_id"`
+	UserHash    string     `json:"user_hash" db:"user_hash"`
+	SessionID   string     `json:"session_id" db:"session_id"`
+	SeqNumber   int64      `json:"seq_number" db:"seq_number"`
+	Fingerprint string     `json:"fingerprint" db:"fingerprint"`
+	IPHash      string     `json:"ip_hash" db:"ip_hash"`
+	IPHashKey   string     `json:"ip_hash_key,omitempty" db:"ip_hash_key"` // 計算 ip_hash 的金鑰週期
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	AbandonedAt *time.Time `json:"abandoned_at,omitempty" db:"abandoned_at"`
+	RiskScore   int        `json:"risk_score" db:"risk_score"`
+	RiskReasons []string   `json:"risk_reasons,omitempty" db:"risk_reasons"`
+	RiskAction  RiskAction `json:"risk_action" db:"risk_action"`
+}
+
+type RiskAction string
+
+const (
+	RiskActionAllow    RiskAction = "allow"
+	RiskActionPenalize RiskAction = "penalize" // 延後釋放
+	RiskActionShadow   RiskAction = "shadow"   // 不釋放
+)
+
+type AllowlistKind string
+
+const (
+	AllowlistKindUserHash   AllowlistKind = "user_hash"
+	AllowlistKindInviteCode AllowlistKind = "invite_code"
+)
+
+// AllowlistEntry 為活動名單中的一筆記錄；value_hash 為 SHA-256(user_hash) 或 SHA-256(邀請碼)
+type AllowlistEntry struct {
+	ID         int64         `json:"id" db:"id"`
+	ActivityID int64         `json:"activity_id" db:"activity_id"`
+	Kind       AllowlistKind `json:"kind" db:"kind"`
+	ValueHash  string        `json:"value_hash" db:"value_hash"`
+	MaxUses    int           `json:"max_uses" db:"max_uses"`
+	UsedCount  int           `json:"used_count" db:"used_count"`
+	ExpiresAt  *time.Time    `json:"expires_at,omitempty" db:"expires_at"`
+	RevokedAt  *time.Time    `json:"revoked_at,omitempty" db:"revoked_at"`
+	CreatedAt  time.Time     `json:"created_at" db:"created_at"`
 }
@@ -127,7 +127,8 @@ func (d *Dashboard) getOverviewStats(ctx context.Context) (*OverviewStats, error
         SELECT 
             COUNT(*) as total,
             COUNT(*) FILTER (WHERE status = 'active') as active
-        FROM activities`
+        FROM activities
+        WHERE status <> 'archived'`
 
     err := d.db.QueryRowContext(ctx, query).Scan(&stats.TotalActivities, &stats.ActiveActivities)
     if err != nil {
@@ -172,6 +173,7 @@ func (d *Dashboard) getActivityStats(ctx context.Context) ([]*ActivityStats, err
             id, tenant_id, name, status, config_json,
             created_at, start_at, end_at
         FROM activities 
+        WHERE status <> 'archived'
         ORDER BY created_at DESC
         LIMIT 50`
 
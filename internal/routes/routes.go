@@ -7,12 +7,12 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRoutes(queueHandler *handlers.QueueHandler, adminHandler *handlers.AdminHandler) *gin.Engine {
+func SetupRoutes(queueHandler *handlers.QueueHandler, adminHandler *handlers.AdminHandler, admissionHandler *handlers.AdmissionHandler, socketHandler *handlers.SocketHandler, serviceKeys, allowedOrigins []string) *gin.Engine {
 	r := gin.Default()
 
 	// 全域中間件
 	r.Use(middleware.RequestID())
-	r.Use(middleware.CORS())
+	r.Use(middleware.CORS(allowedOrigins))
 	r.Use(gin.Recovery())
 
 	// 健康檢查
@@ -26,10 +26,20 @@ func SetupRoutes(queueHandler *handlers.QueueHandler, adminHandler *handlers.Adm
 		// 隊列相關 API
 		queue := v1.Group("/queue")
 		{
+			queue.GET("/challenge", queueHandler.GetChallenge)
 			queue.POST("/enter", queueHandler.EnterQueue)
 			queue.GET("/status", queueHandler.GetQueueStatus)
+			queue.GET("/stream", queueHandler.StreamQueueStatus)
+			queue.GET("/ws", socketHandler.ServeQueue)
+			queue.POST("/reserve", admissionHandler.Reserve)
+			queue.DELETE("/leave", queueHandler.LeaveQueue)
 		}
 
+		// Admission token 驗證 API（供非 Go 服務使用）
+		v1.POST("/admission/verify", admissionHandler.Verify)
+		v1.POST("/admission/complete", middleware.ServiceAuth(serviceKeys), admissionHandler.Complete)
+		v1.POST("/admission/exit", middleware.ServiceAuth(serviceKeys), admissionHandler.Exit)
+
 		// Admin API
 		admin := v1.Group("/admin")
 		{
@@ -37,6 +47,11 @@ func SetupRoutes(queueHandler *handlers.QueueHandler, adminHandler *handlers.Adm
 			admin.GET("/activities", adminHandler.ListActivities)
 			admin.GET("/activities/:id/status", adminHandler.GetActivityStatus)
 			admin.PUT("/activities/:id", adminHandler.UpdateActivity)
+			admin.POST("/activities/:id/allowlist", adminHandler.UploadAllowlist)
+			admin.GET("/activities/:id/allowlist", adminHandler.ListAllowlist)
+			admin.DELETE("/activities/:id/allowlist/:entry_id", adminHandler.RevokeAllowlistEntry)
+			admin.GET("/activities/:id/risk", adminHandler.ListRiskEntries)
+			admin.GET("/activities/:id/risk/:session_id", adminHandler.GetSessionRisk)
 		}
 	}
 
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"queue-system/internal/models"
+	"queue-system/pkg/keys"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -15,6 +16,10 @@ import (
 type AdminService struct {
 	db    *sql.DB
 	redis *redis.Client
+	// 是否設定了挑戰簽章金鑰；未設定時不接受啟用工作量證明的活動
+	powEnabled bool
+	// 伺服器已設定的人機驗證服務；活動的 captcha_provider 須在其中
+	captchaProviders map[string]bool
 }
 
 func NewAdminService(db *sql.DB, redis *redis.Client) *AdminService {
@@ -24,6 +29,19 @@ func NewAdminService(db *sql.DB, redis *redis.Client) *AdminService {
 	}
 }
 
+// SetProofOfWorkEnabled 設定是否已配置挑戰簽章金鑰
+func (s *AdminService) SetProofOfWorkEnabled(enabled bool) {
+	s.powEnabled = enabled
+}
+
+// SetCaptchaProviders 設定伺服器已登記的人機驗證服務名稱
+func (s *AdminService) SetCaptchaProviders(providers []string) {
+	s.captchaProviders = make(map[string]bool, len(providers))
+	for _, provider := range providers {
+		s.captchaProviders[provider] = true
+	}
+}
+
 type CreateActivityRequest struct {
 	TenantID     string                `json:"tenant_id" binding:"required"`
 	Name         string                `json:"name" binding:"required"`
@@ -45,6 +63,16 @@ func (s *AdminService) CreateActivity(ctx context.Context, req *CreateActivityRe
 		return nil, fmt.Errorf("end_at must be after start_at")
 	}
 
+	if err := validateActivityConfig(req.Config); err != nil {
+		return nil, err
+	}
+	if req.Config.PowDifficulty > 0 && !s.powEnabled {
+		return nil, fmt.Errorf("invalid config: pow_difficulty requires a challenge secret")
+	}
+	if provider := req.Config.CaptchaProvider; provider != "" && !s.captchaProviders[provider] {
+		return nil, fmt.Errorf("invalid config: captcha_provider %q is not configured", provider)
+	}
+
 	// 設定預設配置
 	if req.Config.ReleaseRate == 0 {
 		req.Config.ReleaseRate = 10 // 預設每秒釋放 10 個
@@ -70,6 +98,41 @@ func (s *AdminService) CreateActivity(ctx context.Context, req *CreateActivityRe
 	return &resp, nil
 }
 
+// validateActivityConfig 檢查儲存前的活動配置
+func validateActivityConfig(config models.ActivityConfig) error {
+	seen := make(map[string]bool, len(config.Lanes))
+	for _, lane := range config.Lanes {
+		if lane.Name == models.AllowlistAdmitLane {
+			return fmt.Errorf("invalid config: lane name %q is reserved", lane.Name)
+		}
+		if !validLaneName(lane.Name) {
+			return fmt.Errorf("invalid config: lane name %q must be 1-%d letters, digits, '_' or '-'", lane.Name, maxLaneNameLength)
+		}
+		if seen[lane.Name] {
+			return fmt.Errorf("invalid config: duplicate lane name %q", lane.Name)
+		}
+		seen[lane.Name] = true
+	}
+
+	if config.AllowlistMode == models.AllowlistModeLane && !config.HasLane(config.AllowlistLane) {
+		return fmt.Errorf("invalid config: allowlist_lane %q is not a configured lane", config.AllowlistLane)
+	}
+
+	switch config.CaptchaMode {
+	case "", models.CaptchaModeAlways, models.CaptchaModeOnRisk:
+	default:
+		return fmt.Errorf("invalid config: unknown captcha_mode %q", config.CaptchaMode)
+	}
+	if config.CaptchaMode != "" && config.CaptchaProvider == "" {
+		return fmt.Errorf("invalid config: captcha_mode requires captcha_provider")
+	}
+
+	if config.RiskFingerprintUsers < 0 || config.RiskSubnetBurst < 0 || config.RiskPollStrikes < 0 {
+		return fmt.Errorf("invalid config: risk thresholds must not be negative")
+	}
+	return nil
+}
+
 type ActivityStatusResponse struct {
 	Activity      *models.Activity `json:"activity"`
 	QueueMetrics  QueueMetrics     `json:"queue_metrics"`
@@ -77,17 +140,27 @@ type ActivityStatusResponse struct {
 }
 
 type QueueMetrics struct {
-	QueueSeq    int64 `json:"queue_seq"`
-	ReleaseSeq  int64 `json:"release_seq"`
-	QueueLength int64 `json:"queue_length"`
-	ActiveUsers int64 `json:"active_users"`
+	QueueSeq       int64 `json:"queue_seq"`
+	ReleaseSeq     int64 `json:"release_seq"`
+	QueueLength    int64 `json:"queue_length"`
+	ActiveUsers    int64 `json:"active_users"`
+	RemainingStock int64 `json:"remaining_stock"`
+	ActiveLeases   int64 `json:"active_leases"`
+	// 尚未輪到的等待者（扣除已離開者）
+	TotalWaiters int64 `json:"total_waiters"`
+	// 寬限時間內仍在輪詢的等待者；未啟用心跳時等於 TotalWaiters
+	LiveWaiters int64 `json:"live_waiters"`
 }
 
 type RealtimeStats struct {
-	EnterTotal  int64     `json:"enter_total"`
-	EnterRate   float64   `json:"enter_rate"`   // 每秒進入數
-	ReleaseRate float64   `json:"release_rate"` // 每秒釋放數
-	LastUpdated time.Time `json:"last_updated"`
+	EnterTotal   int64     `json:"enter_total"`
+	AbandonTotal int64     `json:"abandon_total"`
+	EnterRate    float64   `json:"enter_rate"`   // 每秒進入數
+	ReleaseRate  float64   `json:"release_rate"` // 每秒釋放數
+	LastUpdated  time.Time `json:"last_updated"`
+	// 因風險分數被延後釋放與不釋放的人數
+	RiskPenalizedTotal int64 `json:"risk_penalized_total"`
+	RiskShadowedTotal  int64 `json:"risk_shadowed_total"`
 }
 
 func (s *AdminService) GetActivityStatus(ctx context.Context, activityID int64) (*ActivityStatusResponse, error) {
@@ -103,6 +176,27 @@ func (s *AdminService) GetActivityStatus(ctx context.Context, activityID int64)
 		return nil, fmt.Errorf("failed to get queue metrics: %w", err)
 	}
 
+	remainingStock, err := NewInventory(s.redis).Remaining(ctx, activity.TenantID, activityID, activity.InitialStock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get remaining stock: %w", err)
+	}
+	queueMetrics.RemainingStock = remainingStock
+
+	if activity.Config.IsConcurrencyMode() {
+		activeLeases, err := NewLeasePool(s.redis).Active(ctx, activity.TenantID, activityID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count active leases: %w", err)
+		}
+		queueMetrics.ActiveLeases = activeLeases
+	}
+
+	totalWaiters, liveWaiters, err := s.getWaiterCounts(ctx, activity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count waiters: %w", err)
+	}
+	queueMetrics.TotalWaiters = totalWaiters
+	queueMetrics.LiveWaiters = liveWaiters
+
 	// 3. 獲取即時統計
 	realtimeStats, err := s.getRealtimeStats(ctx, activity.TenantID, activityID)
 	if err != nil {
@@ -119,6 +213,8 @@ func (s *AdminService) GetActivityStatus(ctx context.Context, activityID int64)
 type UpdateActivityRequest struct {
 	Status      *models.ActivityStatus `json:"status,omitempty"`
 	ReleaseRate *int                   `json:"release_rate,omitempty"`
+	// 暫停期間顯示給等待者的訊息
+	PauseMessage *string `json:"pause_message,omitempty"`
 }
 
 func (s *AdminService) UpdateActivity(ctx context.Context, activityID int64, req *UpdateActivityRequest) error {
@@ -127,19 +223,43 @@ func (s *AdminService) UpdateActivity(ctx context.Context, activityID int64, req
 	args := []interface{}{}
 	argIndex := 1
 
+	// 狀態只能依生命週期切換，並需要原本的狀態判斷是否暫停或恢復
+	var current *models.Activity
 	if req.Status != nil {
+		activity, err := s.getActivity(ctx, activityID)
+		if err != nil {
+			return fmt.Errorf("activity not found")
+		}
+		current = activity
+
+		if *req.Status != current.Status && !canTransition(current.Status, *req.Status) {
+			return fmt.Errorf("invalid status transition: %s -> %s", current.Status, *req.Status)
+		}
+
 		setParts = append(setParts, fmt.Sprintf("status = $%d", argIndex))
 		args = append(args, *req.Status)
 		argIndex++
 	}
 
+	// 同一欄位只能指定一次，多個設定以巢狀 jsonb_set 更新
+	configExpr := "config_json"
 	if req.ReleaseRate != nil {
 		// 更新活動配置中的 release_rate
-		setParts = append(setParts, fmt.Sprintf("config_json = jsonb_set(config_json, '{release_rate}', $%d)", argIndex))
+		configExpr = fmt.Sprintf("jsonb_set(%s, '{release_rate}', $%d)", configExpr, argIndex)
 		args = append(args, *req.ReleaseRate)
 		argIndex++
 	}
 
+	if req.PauseMessage != nil {
+		configExpr = fmt.Sprintf("jsonb_set(%s, '{pause_message}', to_jsonb($%d::text))", configExpr, argIndex)
+		args = append(args, *req.PauseMessage)
+		argIndex++
+	}
+
+	if configExpr != "config_json" {
+		setParts = append(setParts, "config_json = "+configExpr)
+	}
+
 	if len(setParts) == 0 {
 		return fmt.Errorf("no fields to update")
 	}
@@ -150,11 +270,18 @@ func (s *AdminService) UpdateActivity(ctx context.Context, activityID int64, req
 
 	args = append(args, activityID)
 
+	// 讀取後狀態已被其他請求或生命週期切換改變時不更新
+	statusGuard := ""
+	if current != nil {
+		args = append(args, current.Status)
+		statusGuard = fmt.Sprintf(" AND status = $%d", argIndex+1)
+	}
+
 	query := fmt.Sprintf(`
         UPDATE activities 
         SET %s
-        WHERE id = $%d`,
-		joinStrings(setParts, ", "), argIndex)
+        WHERE id = $%d%s`,
+		joinStrings(setParts, ", "), argIndex, statusGuard)
 
 	result, err := s.db.ExecContext(ctx, query, args...)
 	if err != nil {
@@ -167,9 +294,24 @@ func (s *AdminService) UpdateActivity(ctx context.Context, activityID int64, req
 	}
 
 	if rowsAffected == 0 {
+		if current != nil {
+			return fmt.Errorf("invalid status transition: activity status changed concurrently")
+		}
 		return fmt.Errorf("activity not found")
 	}
 
+	if current != nil && *req.Status != current.Status {
+		s.onStatusChange(ctx, current, *req.Status)
+		go recordLifecycleEvent(context.Background(), s.db, s.redis, &LifecycleEvent{
+			ActivityID: current.ID,
+			TenantID:   current.TenantID,
+			From:       current.Status,
+			To:         *req.Status,
+			Source:     LifecycleSourceAdmin,
+			Timestamp:  time.Now(),
+		})
+	}
+
 	return nil
 }
 
@@ -249,17 +391,74 @@ func (s *AdminService) getQueueMetrics(ctx context.Context, tenantID string, act
 	}, nil
 }
 
+// getWaiterCounts 回傳各通道等待者總數與仍在線的人數
+func (s *AdminService) getWaiterCounts(ctx context.Context, activity *models.Activity) (int64, int64, error) {
+	var total, live int64
+	for _, lane := range activity.Config.AllLanes() {
+		laneTotal, laneLive, err := s.getLaneWaiterCounts(ctx, activity, laneScope(lane.Name))
+		if err != nil {
+			return 0, 0, err
+		}
+		total += laneTotal
+		live += laneLive
+	}
+	return total, live, nil
+}
+
+func (s *AdminService) getLaneWaiterCounts(ctx context.Context, activity *models.Activity, lane string) (int64, int64, error) {
+	pipe := s.redis.Pipeline()
+	queueSeqCmd := pipe.Get(ctx, keys.LaneKey(keys.QueueSeqKey(activity.TenantID, activity.ID), lane))
+	releaseSeqCmd := pipe.Get(ctx, keys.LaneKey(keys.ReleaseSeqKey(activity.TenantID, activity.ID), lane))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, 0, err
+	}
+
+	queueSeq := parseInt64(queueSeqCmd.Val(), 0)
+	releaseSeq := parseInt64(releaseSeqCmd.Val(), 0)
+
+	abandoned, err := s.redis.ZCount(ctx, keys.LaneKey(keys.AbandonedKey(activity.TenantID, activity.ID), lane),
+		"("+strconv.FormatInt(releaseSeq, 10), "+inf").Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	total := max(0, queueSeq-releaseSeq-abandoned)
+
+	grace := activity.Config.HeartbeatGraceSeconds
+	if grace <= 0 {
+		return total, total, nil
+	}
+
+	// 與排程器一致：沒有心跳記錄的等待者視為在線
+	cutoff := time.Now().Add(-time.Duration(grace) * time.Second).Unix()
+	stale, err := s.redis.ZCount(ctx, keys.LaneKey(keys.HeartbeatKey(activity.TenantID, activity.ID), lane),
+		"(0", "("+strconv.FormatInt(cutoff, 10)).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return total, max(0, total-stale), nil
+}
+
 func (s *AdminService) getRealtimeStats(ctx context.Context, tenantID string, activityID int64) (*RealtimeStats, error) {
 	// 獲取進入總數
 	enterTotalKey := fmt.Sprintf("t:%s:a:%d:metrics:enter_total", tenantID, activityID)
 	enterTotal := parseInt64(s.redis.Get(ctx, enterTotalKey).Val(), 0)
 
+	// 獲取離開隊列總數
+	abandonTotal := parseInt64(s.redis.Get(ctx, keys.MetricsKey(tenantID, activityID, "abandon_total")).Val(), 0)
+
+	penalizedTotal := parseInt64(s.redis.Get(ctx, keys.MetricsKey(tenantID, activityID, "risk_penalize_total")).Val(), 0)
+	shadowedTotal := parseInt64(s.redis.Get(ctx, keys.MetricsKey(tenantID, activityID, "risk_shadow_total")).Val(), 0)
+
 	// 這裡簡化處理，實際應該計算速率
 	return &RealtimeStats{
-		EnterTotal:  enterTotal,
-		EnterRate:   0, // 需要基於時間窗口計算
-		ReleaseRate: 0, // 需要基於時間窗口計算
-		LastUpdated: time.Now(),
+		EnterTotal:         enterTotal,
+		AbandonTotal:       abandonTotal,
+		EnterRate:          0, // 需要基於時間窗口計算
+		ReleaseRate:        0, // 需要基於時間窗口計算
+		LastUpdated:        time.Now(),
+		RiskPenalizedTotal: penalizedTotal,
+		RiskShadowedTotal:  shadowedTotal,
 	}, nil
 }
 
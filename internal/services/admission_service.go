@@ -0,0 +1,349 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/admission"
+	"queue-system/pkg/keys"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// token 過期後仍可確認購買的預設寬限期
+const defaultSettlementGrace = 10 * time.Minute
+
+// AdmissionService 為已輪到的用戶簽發 admission token，
+// 商店後端需驗證此 token 才允許進入結帳流程
+type AdmissionService struct {
+	queueService *QueueService
+	signer       *admission.Signer
+	verifier     *admission.Verifier
+	// 結帳在 token 過期前開始、過期後才完成時，仍接受確認的期間
+	settlementGrace time.Duration
+}
+
+func NewAdmissionService(queueService *QueueService, signer *admission.Signer, verifier *admission.Verifier) *AdmissionService {
+	return &AdmissionService{
+		queueService:    queueService,
+		signer:          signer,
+		verifier:        verifier,
+		settlementGrace: defaultSettlementGrace,
+	}
+}
+
+// SetSettlementGrace 設定 token 過期後仍可確認購買的期間；0 表示不放寬
+func (s *AdmissionService) SetSettlementGrace(grace time.Duration) {
+	if grace >= 0 {
+		s.settlementGrace = grace
+	}
+}
+
+type ReserveRequest struct {
+	ActivityID int64  `json:"activity_id" binding:"required"`
+	Seq        int64  `json:"seq" binding:"required"`
+	SessionID  string `json:"session_id" binding:"required"`
+}
+
+type ReserveResponse struct {
+	RequestID      string    `json:"request_id"`
+	AdmissionToken string    `json:"admission_token"`
+	TokenID        string    `json:"token_id"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+func (s *AdmissionService) Reserve(ctx context.Context, req *ReserveRequest) (*ReserveResponse, error) {
+	requestID := uuid.New().String()
+
+	// 1. 驗證活動
+	activity, err := s.queueService.getActivity(ctx, req.ActivityID)
+	if err != nil {
+		return nil, fmt.Errorf("activity not found: %w", err)
+	}
+
+	// 2. 確認用戶已輪到
+	status, err := s.queueService.buildQueueStatus(ctx, activity, &QueueStatusRequest{
+		ActivityID: req.ActivityID,
+		Seq:        req.Seq,
+		SessionID:  req.SessionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if status.State != StateEligible {
+		return nil, fmt.Errorf("not eligible for admission: state is %s", status.State)
+	}
+
+	// 3. 每個 seq 只簽發一次；重試時回傳同一個 token
+	lane := laneOfSession(req.SessionID)
+	if issued, err := s.loadIssuedAdmission(ctx, activity, lane, req.Seq); err != nil || issued != nil {
+		if issued != nil {
+			issued.RequestID = requestID
+		}
+		return issued, err
+	}
+
+	if s.queueService.isSoldOut(ctx, activity) {
+		return nil, fmt.Errorf("activity sold out")
+	}
+
+	// 4. 在領取期限內標記為已領取
+	if activity.Config.ClaimTimeoutSeconds > 0 {
+		if err := s.queueService.claimAdmission(ctx, activity.TenantID, activity.ID, lane, req.Seq); err != nil {
+			return nil, err
+		}
+	}
+
+	// 5. 簽發 admission token
+	token, claims, err := s.signer.Issue(admission.Claims{
+		TenantID:   activity.TenantID,
+		ActivityID: activity.ID,
+		Seq:        req.Seq,
+		Lane:       lane,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue admission token: %w", err)
+	}
+
+	resp := &ReserveResponse{
+		RequestID:      requestID,
+		AdmissionToken: token,
+		TokenID:        claims.ID,
+		ExpiresAt:      time.Unix(claims.ExpiresAt, 0),
+	}
+
+	// 同時送出的請求只有一個能寫入，其他回傳先寫入的 token
+	stored, err := s.storeIssuedAdmission(ctx, activity, lane, req.Seq, resp)
+	if err != nil {
+		return nil, err
+	}
+	if !stored {
+		issued, err := s.loadIssuedAdmission(ctx, activity, lane, req.Seq)
+		if err != nil {
+			return nil, err
+		}
+		issued.RequestID = requestID
+		return issued, nil
+	}
+
+	s.queueService.updateMetrics(ctx, activity.TenantID, activity.ID, "reserve")
+
+	return resp, nil
+}
+
+// issuedAdmission 為 seq 已簽發的 token
+type issuedAdmission struct {
+	Token     string `json:"token"`
+	TokenID   string `json:"jti"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// loadIssuedAdmission 回傳 seq 已簽發且尚未過期的 token；未簽發過時回傳 nil。
+// 已過期時不重新簽發，否則同一個 seq 可以取得多個 token 重複購買
+func (s *AdmissionService) loadIssuedAdmission(ctx context.Context, activity *models.Activity, lane string, seq int64) (*ReserveResponse, error) {
+	data, err := s.queueService.redis.HGet(ctx, keys.AdmissionIssuedKey(activity.TenantID, activity.ID), laneMember(lane, seq)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load issued admission: %w", err)
+	}
+
+	var issued issuedAdmission
+	if err := json.Unmarshal(data, &issued); err != nil {
+		return nil, fmt.Errorf("failed to load issued admission: %w", err)
+	}
+
+	expiresAt := time.Unix(issued.ExpiresAt, 0)
+	if !time.Now().Before(expiresAt) {
+		return nil, fmt.Errorf("admission already issued: token expired at %s", expiresAt.Format(time.RFC3339))
+	}
+
+	return &ReserveResponse{
+		AdmissionToken: issued.Token,
+		TokenID:        issued.TokenID,
+		ExpiresAt:      expiresAt,
+	}, nil
+}
+
+// storeIssuedAdmission 記錄 seq 的 token；已有記錄時回傳 false
+func (s *AdmissionService) storeIssuedAdmission(ctx context.Context, activity *models.Activity, lane string, seq int64, resp *ReserveResponse) (bool, error) {
+	data, err := json.Marshal(issuedAdmission{
+		Token:     resp.AdmissionToken,
+		TokenID:   resp.TokenID,
+		ExpiresAt: resp.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to record issued admission: %w", err)
+	}
+
+	key := keys.AdmissionIssuedKey(activity.TenantID, activity.ID)
+	stored, err := s.queueService.redis.HSetNX(ctx, key, laneMember(lane, seq), data).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to record issued admission: %w", err)
+	}
+	s.queueService.redis.Expire(ctx, key, 24*time.Hour)
+	return stored, nil
+}
+
+// verifyIssued 確認 token 是此 seq 實際簽發的 token。簽章金鑰由多個服務共用，
+// 能驗證 token 的服務也能自行簽發，確認購買與離開前需比對簽發記錄
+func (s *AdmissionService) verifyIssued(ctx context.Context, claims *admission.Claims) error {
+	data, err := s.queueService.redis.HGet(ctx, keys.AdmissionIssuedKey(claims.TenantID, claims.ActivityID), laneMember(claims.Lane, claims.Seq)).Bytes()
+	if err == redis.Nil {
+		return fmt.Errorf("admission: token not issued for this seq")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load issued admission: %w", err)
+	}
+
+	var issued issuedAdmission
+	if err := json.Unmarshal(data, &issued); err != nil {
+		return fmt.Errorf("failed to load issued admission: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(issued.TokenID), []byte(claims.ID)) != 1 {
+		return fmt.Errorf("admission: token not issued for this seq")
+	}
+	return nil
+}
+
+type VerifyAdmissionRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type VerifyAdmissionResponse struct {
+	Valid  bool              `json:"valid"`
+	Claims *admission.Claims `json:"claims"`
+}
+
+// Verify 提供非 Go 服務驗證 admission token，每個 token 只能驗證成功一次
+func (s *AdmissionService) Verify(ctx context.Context, req *VerifyAdmissionRequest) (*VerifyAdmissionResponse, error) {
+	claims, err := s.verifier.Verify(ctx, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	s.queueService.updateMetrics(ctx, claims.TenantID, claims.ActivityID, "admission_verified")
+
+	return &VerifyAdmissionResponse{
+		Valid:  true,
+		Claims: claims,
+	}, nil
+}
+
+type CompleteAdmissionRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Quantity int    `json:"quantity"`
+}
+
+type CompleteAdmissionResponse struct {
+	ActivityID     int64 `json:"activity_id"`
+	Seq            int64 `json:"seq"`
+	Quantity       int   `json:"quantity"`
+	RemainingStock int64 `json:"remaining_stock"`
+}
+
+// Complete 由商店後端在購買確認後呼叫，扣減庫存；同一個 token 只會扣減一次
+func (s *AdmissionService) Complete(ctx context.Context, req *CompleteAdmissionRequest) (*CompleteAdmissionResponse, error) {
+	if req.Quantity <= 0 {
+		req.Quantity = 1
+	}
+
+	// 1. 驗證 token（已在進入結帳時使用過，這裡不做重放檢查）；
+	// 結帳可能在 token 過期後才完成，過期後的寬限期內仍接受
+	claims, err := s.verifier.ParseWithGrace(req.Token, s.settlementGrace)
+	if err != nil {
+		return nil, err
+	}
+
+	activity, err := s.queueService.getActivity(ctx, claims.ActivityID)
+	if err != nil {
+		return nil, fmt.Errorf("activity not found: %w", err)
+	}
+	if activity.TenantID != claims.TenantID {
+		return nil, fmt.Errorf("activity not found: tenant mismatch")
+	}
+	if limit := activity.Config.PurchaseLimit(); req.Quantity > limit {
+		return nil, fmt.Errorf("quantity exceeds per-user limit of %d", limit)
+	}
+	if err := s.verifyIssued(ctx, claims); err != nil {
+		return nil, err
+	}
+
+	// 2. 確保每個 token 只確認一次購買
+	completedKey := keys.AdmissionCompletedKey(claims.ID)
+	first, err := s.queueService.redis.SetNX(ctx, completedKey, req.Quantity, 24*time.Hour).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to record purchase: %w", err)
+	}
+	if !first {
+		return nil, fmt.Errorf("purchase already completed")
+	}
+
+	// 3. 扣減庫存
+	remaining, err := NewInventory(s.queueService.redis).Decrement(ctx, activity.TenantID, activity.ID, activity.InitialStock, req.Quantity)
+	if err != nil {
+		s.queueService.redis.Del(ctx, completedKey)
+		return nil, err
+	}
+
+	// 4. 結帳完成，收回同時在線名額
+	if activity.Config.IsConcurrencyMode() {
+		if _, err := NewLeasePool(s.queueService.redis).Release(ctx, activity.TenantID, activity.ID, claims.Lane, claims.Seq); err != nil {
+			log.Printf("Failed to release lease for activity %d, seq %d: %v", activity.ID, claims.Seq, err)
+		}
+	}
+
+	s.queueService.updateMetrics(ctx, activity.TenantID, activity.ID, "purchase")
+
+	return &CompleteAdmissionResponse{
+		ActivityID:     activity.ID,
+		Seq:            claims.Seq,
+		Quantity:       req.Quantity,
+		RemainingStock: remaining,
+	}, nil
+}
+
+type ExitAdmissionRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ExitAdmissionResponse struct {
+	ActivityID    int64 `json:"activity_id"`
+	Seq           int64 `json:"seq"`
+	LeaseReleased bool  `json:"lease_released"`
+}
+
+// Exit 由商店後端在用戶未完成結帳就離開時呼叫，讓排程器可以釋放下一位
+func (s *AdmissionService) Exit(ctx context.Context, req *ExitAdmissionRequest) (*ExitAdmissionResponse, error) {
+	// 用戶可能在 token 過期後才離開結帳，與確認購買相同接受寬限期內的 token
+	claims, err := s.verifier.ParseWithGrace(req.Token, s.settlementGrace)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verifyIssued(ctx, claims); err != nil {
+		return nil, err
+	}
+
+	released, err := NewLeasePool(s.queueService.redis).Release(ctx, claims.TenantID, claims.ActivityID, claims.Lane, claims.Seq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to release lease: %w", err)
+	}
+
+	if released {
+		s.queueService.updateMetrics(ctx, claims.TenantID, claims.ActivityID, "exit")
+	}
+
+	return &ExitAdmissionResponse{
+		ActivityID:    claims.ActivityID,
+		Seq:           claims.Seq,
+		LeaseReleased: released,
+	}, nil
+}
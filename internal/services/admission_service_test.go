@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/admission"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRedis 啟動記憶體內的 Redis，測試結束時關閉
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return mr, rdb
+}
+
+func TestIssuedAdmission_OncePerSeq(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	ctx := context.Background()
+	s := NewAdmissionService(NewQueueService(nil, rdb), nil, nil)
+	activity := &models.Activity{ID: 1, TenantID: "tenant1"}
+
+	// 尚未簽發
+	issued, err := s.loadIssuedAdmission(ctx, activity, "", 42)
+	require.NoError(t, err)
+	assert.Nil(t, issued)
+
+	first := &ReserveResponse{AdmissionToken: "token-a", TokenID: "jti-a", ExpiresAt: time.Now().Add(time.Minute)}
+	stored, err := s.storeIssuedAdmission(ctx, activity, "", 42, first)
+	require.NoError(t, err)
+	assert.True(t, stored)
+
+	// 同一個 seq 的第二個 token 不會寫入，讀回第一個
+	second := &ReserveResponse{AdmissionToken: "token-b", TokenID: "jti-b", ExpiresAt: time.Now().Add(time.Minute)}
+	stored, err = s.storeIssuedAdmission(ctx, activity, "", 42, second)
+	require.NoError(t, err)
+	assert.False(t, stored)
+
+	issued, err = s.loadIssuedAdmission(ctx, activity, "", 42)
+	require.NoError(t, err)
+	require.NotNil(t, issued)
+	assert.Equal(t, "token-a", issued.AdmissionToken)
+	assert.Equal(t, "jti-a", issued.TokenID)
+
+	// 其他通道的相同 seq 不受影響
+	issued, err = s.loadIssuedAdmission(ctx, activity, "vip", 42)
+	require.NoError(t, err)
+	assert.Nil(t, issued)
+}
+
+func TestIssuedAdmission_ExpiredIsNotReissued(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	ctx := context.Background()
+	s := NewAdmissionService(NewQueueService(nil, rdb), nil, nil)
+	activity := &models.Activity{ID: 1, TenantID: "tenant1"}
+
+	expired := &ReserveResponse{AdmissionToken: "token-a", TokenID: "jti-a", ExpiresAt: time.Now().Add(-time.Second)}
+	_, err := s.storeIssuedAdmission(ctx, activity, "", 42, expired)
+	require.NoError(t, err)
+
+	_, err = s.loadIssuedAdmission(ctx, activity, "", 42)
+	assert.ErrorContains(t, err, "admission already issued")
+}
+
+func TestExitAdmission_RequiresIssuedToken(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	ctx := context.Background()
+	key := []byte("admission-signing-key-0123456789abcdef")
+	signer, err := admission.NewSigner("k1", key, "", time.Minute)
+	require.NoError(t, err)
+	verifier, err := admission.NewVerifier(admission.VerifierConfig{Keys: map[string][]byte{"k1": key}})
+	require.NoError(t, err)
+	s := NewAdmissionService(NewQueueService(nil, rdb), signer, verifier)
+	activity := &models.Activity{ID: 1, TenantID: "tenant1"}
+
+	leases := NewLeasePool(rdb)
+	require.NoError(t, leases.Acquire(ctx, activity.TenantID, activity.ID, "", []int64{42}, time.Minute))
+
+	// 以共用金鑰自行簽發、未經 Reserve 記錄的 token 不能釋放租約
+	forged, _, err := signer.Issue(admission.Claims{TenantID: activity.TenantID, ActivityID: activity.ID, Seq: 42})
+	require.NoError(t, err)
+	_, err = s.Exit(ctx, &ExitAdmissionRequest{Token: forged})
+	assert.EqualError(t, err, "admission: token not issued for this seq")
+
+	token, claims, err := signer.Issue(admission.Claims{TenantID: activity.TenantID, ActivityID: activity.ID, Seq: 42})
+	require.NoError(t, err)
+	_, err = s.storeIssuedAdmission(ctx, activity, "", 42, &ReserveResponse{
+		AdmissionToken: token, TokenID: claims.ID, ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	})
+	require.NoError(t, err)
+
+	_, err = s.Exit(ctx, &ExitAdmissionRequest{Token: forged})
+	assert.EqualError(t, err, "admission: token not issued for this seq")
+	active, err := leases.Active(ctx, activity.TenantID, activity.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), active)
+
+	resp, err := s.Exit(ctx, &ExitAdmissionRequest{Token: token})
+	require.NoError(t, err)
+	assert.True(t, resp.LeaseReleased)
+}
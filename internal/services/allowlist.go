@@ -0,0 +1,415 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+)
+
+// 活動名單：預售給指定客戶時，名單內的 user_hash 或持有邀請碼的用戶
+// 依 allowlist_mode 立即輪到（admit）或進入指定通道（lane）。
+// 名單與核銷記錄存在 Postgres，使用次數以條件式 UPDATE 原子扣減，並與核銷記錄寫在同一個交易中。
+// Redis 保存名單成員的快取，未列入名單的用戶不需查詢資料庫。
+
+// admit 模式的用戶進入此內部通道，由釋放排程器優先釋放；通道名稱保留，不能用於 lanes
+const allowlistAdmitLane = models.AllowlistAdmitLane
+
+// 名單快取的有效時間，上傳與撤銷時延長
+const allowlistCacheTTL = 7 * 24 * time.Hour
+
+// 單次上傳的名單上限
+const maxAllowlistUpload = 10000
+
+type AllowlistUploadRequest struct {
+	// SHA-256(user_hash) 的 hex 字串
+	UserHashes []string `json:"user_hashes"`
+	// 邀請碼原文，只保存雜湊
+	InviteCodes []string   `json:"invite_codes"`
+	MaxUses     int        `json:"max_uses"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+type AllowlistUploadResponse struct {
+	Added   int64 `json:"added"`
+	Skipped int64 `json:"skipped"` // 已存在的記錄
+}
+
+type AllowlistListRequest struct {
+	Kind   models.AllowlistKind `form:"kind"`
+	Limit  int                  `form:"limit"`
+	Offset int                  `form:"offset"`
+}
+
+// UploadAllowlist 批次新增名單，已存在的記錄保持不變
+func (s *AdminService) UploadAllowlist(ctx context.Context, activityID int64, req *AllowlistUploadRequest) (*AllowlistUploadResponse, error) {
+	activity, err := s.getActivity(ctx, activityID)
+	if err != nil {
+		return nil, fmt.Errorf("activity not found: %w", err)
+	}
+
+	total := len(req.UserHashes) + len(req.InviteCodes)
+	if total == 0 {
+		return nil, fmt.Errorf("no allowlist entries")
+	}
+	if total > maxAllowlistUpload {
+		return nil, fmt.Errorf("too many allowlist entries: max %d per upload", maxAllowlistUpload)
+	}
+
+	maxUses := req.MaxUses
+	if maxUses <= 0 {
+		maxUses = 1
+	}
+
+	values := make(map[models.AllowlistKind][]string, 2)
+	for _, userHash := range req.UserHashes {
+		userHash = strings.ToLower(strings.TrimSpace(userHash))
+		if !isSHA256Hex(userHash) {
+			return nil, fmt.Errorf("invalid user hash: %q", userHash)
+		}
+		values[models.AllowlistKindUserHash] = append(values[models.AllowlistKindUserHash], userHash)
+	}
+	for _, code := range req.InviteCodes {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			return nil, fmt.Errorf("invalid invite code: empty")
+		}
+		values[models.AllowlistKindInviteCode] = append(values[models.AllowlistKindInviteCode], hashAllowlistValue(code))
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload allowlist: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+        INSERT INTO allowlist_entries (activity_id, kind, value_hash, max_uses, expires_at)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (activity_id, kind, value_hash) DO NOTHING`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload allowlist: %w", err)
+	}
+	defer stmt.Close()
+
+	var resp AllowlistUploadResponse
+	for kind, hashes := range values {
+		for _, valueHash := range hashes {
+			result, err := stmt.ExecContext(ctx, activityID, kind, valueHash, maxUses, req.ExpiresAt)
+			if err != nil {
+				return nil, fmt.Errorf("failed to upload allowlist: %w", err)
+			}
+			if added, _ := result.RowsAffected(); added > 0 {
+				resp.Added++
+			} else {
+				resp.Skipped++
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to upload allowlist: %w", err)
+	}
+
+	// 新增的記錄加入快取；快取尚未載入時於下次進入時一併載入
+	members := make([]interface{}, 0, total)
+	for kind, hashes := range values {
+		for _, valueHash := range hashes {
+			members = append(members, allowlistMember(kind, valueHash))
+		}
+	}
+	cacheKey := keys.AllowlistKey(activity.TenantID, activityID)
+	pipe := s.redis.Pipeline()
+	pipe.SAdd(ctx, cacheKey, members...)
+	pipe.Expire(ctx, cacheKey, allowlistCacheTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		// 快取缺少成員會讓名單內用戶照常排隊，清除後重新載入
+		log.Printf("Failed to cache allowlist for activity %d: %v", activityID, err)
+		s.redis.Del(ctx, cacheKey)
+	}
+
+	return &resp, nil
+}
+
+// ListAllowlist 分頁列出名單
+func (s *AdminService) ListAllowlist(ctx context.Context, activityID int64, req *AllowlistListRequest) ([]*models.AllowlistEntry, error) {
+	limit := req.Limit
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	query := `
+        SELECT id, activity_id, kind, value_hash, max_uses, used_count, expires_at, revoked_at, created_at
+        FROM allowlist_entries
+        WHERE activity_id = $1
+        AND ($2 = '' OR kind = $2)
+        ORDER BY id
+        LIMIT $3 OFFSET $4`
+
+	rows, err := s.db.QueryContext(ctx, query, activityID, string(req.Kind), limit, max(0, int64(req.Offset)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query allowlist: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]*models.AllowlistEntry, 0)
+	for rows.Next() {
+		var entry models.AllowlistEntry
+		err := rows.Scan(
+			&entry.ID, &entry.ActivityID, &entry.Kind, &entry.ValueHash,
+			&entry.MaxUses, &entry.UsedCount, &entry.ExpiresAt, &entry.RevokedAt, &entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan allowlist entry: %w", err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// RevokeAllowlistEntry 撤銷名單記錄，已核銷的用戶不受影響
+func (s *AdminService) RevokeAllowlistEntry(ctx context.Context, activityID, entryID int64) error {
+	activity, err := s.getActivity(ctx, activityID)
+	if err != nil {
+		return fmt.Errorf("allowlist entry not found")
+	}
+
+	var kind models.AllowlistKind
+	var valueHash string
+	err = s.db.QueryRowContext(ctx, `
+        UPDATE allowlist_entries SET revoked_at = NOW()
+        WHERE id = $1 AND activity_id = $2 AND revoked_at IS NULL
+        RETURNING kind, value_hash`,
+		entryID, activityID).Scan(&kind, &valueHash)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("allowlist entry not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to revoke allowlist entry: %w", err)
+	}
+
+	// 核銷時仍以資料庫為準，快取移除失敗不影響撤銷
+	s.redis.SRem(ctx, keys.AllowlistKey(activity.TenantID, activityID), allowlistMember(kind, valueHash))
+	return nil
+}
+
+// allowlistRedemption 是尚未提交的核銷，提交時一併寫入核銷記錄
+type allowlistRedemption struct {
+	tx         *sql.Tx
+	entryID    int64
+	activityID int64
+}
+
+// redeemAllowlist 核銷邀請碼或名單中的 user_hash；未列入名單回傳 nil，
+// 邀請碼無效、已撤銷、過期或用完時回傳錯誤。回傳的核銷需以 commit 或 rollback 結束
+func (s *QueueService) redeemAllowlist(ctx context.Context, activity *models.Activity, req *EnterQueueRequest) (*allowlistRedemption, error) {
+	if activity.Config.AllowlistMode == "" {
+		return nil, nil
+	}
+
+	kind, value := models.AllowlistKindUserHash, req.UserHash
+	if req.InviteCode != "" {
+		kind, value = models.AllowlistKindInviteCode, strings.TrimSpace(req.InviteCode)
+	}
+	valueHash := hashAllowlistValue(value)
+
+	// 先查快取，未列入名單的用戶不查詢資料庫
+	listed, err := s.isAllowlisted(ctx, activity, kind, valueHash)
+	switch {
+	case err != nil && kind == models.AllowlistKindUserHash:
+		// 名單查詢失敗時讓用戶照常排隊
+		log.Printf("Failed to check allowlist for activity %d: %v", activity.ID, err)
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to redeem invite code: %w", err)
+	case !listed && kind == models.AllowlistKindInviteCode:
+		return nil, fmt.Errorf("invalid invite code")
+	case !listed:
+		return nil, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err == nil {
+		redemption := &allowlistRedemption{tx: tx, activityID: activity.ID}
+		err = tx.QueryRowContext(ctx, `
+            UPDATE allowlist_entries SET used_count = used_count + 1
+            WHERE activity_id = $1 AND kind = $2 AND value_hash = $3
+            AND revoked_at IS NULL
+            AND (expires_at IS NULL OR expires_at > NOW())
+            AND used_count < max_uses
+            RETURNING id`,
+			activity.ID, kind, valueHash).Scan(&redemption.entryID)
+		if err == nil {
+			return redemption, nil
+		}
+		tx.Rollback()
+	}
+
+	switch {
+	case kind == models.AllowlistKindInviteCode && err == sql.ErrNoRows:
+		return nil, fmt.Errorf("invalid invite code")
+	case kind == models.AllowlistKindInviteCode:
+		return nil, fmt.Errorf("failed to redeem invite code: %w", err)
+	case err != sql.ErrNoRows:
+		log.Printf("Failed to check allowlist for activity %d: %v", activity.ID, err)
+	}
+	return nil, nil
+}
+
+// commit 寫入核銷記錄並提交；失敗時使用次數一併回滾
+func (r *allowlistRedemption) commit(ctx context.Context, sessionID, userHash string) error {
+	_, err := r.tx.ExecContext(ctx, `
+        INSERT INTO allowlist_redemptions (entry_id, activity_id, session_id, user_hash)
+        VALUES ($1, $2, $3, $4)`,
+		r.entryID, r.activityID, sessionID, userHash)
+	if err != nil {
+		r.tx.Rollback()
+		return fmt.Errorf("failed to record allowlist redemption: %w", err)
+	}
+	if err := r.tx.Commit(); err != nil {
+		return fmt.Errorf("failed to record allowlist redemption: %w", err)
+	}
+	return nil
+}
+
+func (r *allowlistRedemption) rollback() {
+	r.tx.Rollback()
+}
+
+// releaseRedemption 在進入隊列失敗時刪除核銷記錄並退回使用次數
+func (s *QueueService) releaseRedemption(ctx context.Context, entryID int64, sessionID string) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Failed to release allowlist redemption %d: %v", entryID, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+        DELETE FROM allowlist_redemptions WHERE entry_id = $1 AND session_id = $2`,
+		entryID, sessionID)
+	if err == nil {
+		// 沒有核銷記錄時不退回，避免重複退回
+		if deleted, _ := result.RowsAffected(); deleted == 0 {
+			return
+		}
+		_, err = tx.ExecContext(ctx, `
+            UPDATE allowlist_entries SET used_count = used_count - 1
+            WHERE id = $1 AND used_count > 0`, entryID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to release allowlist redemption %d: %v", entryID, err)
+	}
+}
+
+// isAllowlisted 以快取檢查名單成員；快取尚未載入時從資料庫載入
+func (s *QueueService) isAllowlisted(ctx context.Context, activity *models.Activity, kind models.AllowlistKind, valueHash string) (bool, error) {
+	cacheKey := keys.AllowlistKey(activity.TenantID, activity.ID)
+	member := allowlistMember(kind, valueHash)
+
+	pipe := s.redis.Pipeline()
+	loaded := pipe.SIsMember(ctx, cacheKey, "")
+	listed := pipe.SIsMember(ctx, cacheKey, member)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	if loaded.Val() {
+		return listed.Val(), nil
+	}
+
+	if err := s.loadAllowlistCache(ctx, activity); err != nil {
+		return false, err
+	}
+	return s.redis.SIsMember(ctx, cacheKey, member).Result()
+}
+
+// 載入名單快取時每批寫入的成員數
+const allowlistCacheBatch = 1000
+
+// loadAllowlistCache 將未撤銷的名單記錄載入快取。與上傳同時進行時兩邊都會寫入，
+// 快取只會多出成員（核銷時由資料庫判斷），不會漏掉新上傳的記錄
+func (s *QueueService) loadAllowlistCache(ctx context.Context, activity *models.Activity) error {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT kind, value_hash FROM allowlist_entries
+        WHERE activity_id = $1 AND revoked_at IS NULL`, activity.ID)
+	if err != nil {
+		return fmt.Errorf("failed to load allowlist: %w", err)
+	}
+	defer rows.Close()
+
+	cacheKey := keys.AllowlistKey(activity.TenantID, activity.ID)
+	batch := make([]interface{}, 0, allowlistCacheBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := s.redis.SAdd(ctx, cacheKey, batch...).Err()
+		batch = batch[:0]
+		return err
+	}
+
+	for rows.Next() {
+		var kind models.AllowlistKind
+		var valueHash string
+		if err := rows.Scan(&kind, &valueHash); err != nil {
+			return fmt.Errorf("failed to load allowlist: %w", err)
+		}
+		batch = append(batch, allowlistMember(kind, valueHash))
+		if len(batch) == allowlistCacheBatch {
+			if err := flush(); err != nil {
+				return fmt.Errorf("failed to cache allowlist: %w", err)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load allowlist: %w", err)
+	}
+	if err := flush(); err != nil {
+		return fmt.Errorf("failed to cache allowlist: %w", err)
+	}
+
+	// 最後才標記已載入
+	pipe := s.redis.Pipeline()
+	pipe.SAdd(ctx, cacheKey, "")
+	pipe.Expire(ctx, cacheKey, allowlistCacheTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to cache allowlist: %w", err)
+	}
+	return nil
+}
+
+func allowlistMember(kind models.AllowlistKind, valueHash string) string {
+	return string(kind) + ":" + valueHash
+}
+
+// allowlistLane 回傳名單內用戶進入的通道
+func allowlistLane(activity *models.Activity) string {
+	if activity.Config.AllowlistMode == models.AllowlistModeLane && activity.Config.HasLane(activity.Config.AllowlistLane) {
+		return laneScope(activity.Config.AllowlistLane)
+	}
+	return allowlistAdmitLane
+}
+
+func hashAllowlistValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func isSHA256Hex(value string) bool {
+	if len(value) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
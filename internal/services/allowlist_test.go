@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAllowlistActivity() *models.Activity {
+	activity := newStreamActivity()
+	activity.Config.AllowlistMode = models.AllowlistModeAdmit
+	return activity
+}
+
+func TestRedeemAllowlist_UnlistedSkipsDatabase(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	s := NewQueueService(db, rdb)
+	activity := newAllowlistActivity()
+	listed := hashAllowlistValue("vip-user")
+
+	// 第一次進入載入快取，之後不再查詢資料庫
+	mock.ExpectQuery("SELECT kind, value_hash FROM allowlist_entries").WithArgs(activity.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"kind", "value_hash"}).AddRow(models.AllowlistKindUserHash, listed))
+
+	redemption, err := s.redeemAllowlist(ctx, activity, &EnterQueueRequest{UserHash: "someone"})
+	require.NoError(t, err)
+	assert.Nil(t, redemption)
+
+	redemption, err = s.redeemAllowlist(ctx, activity, &EnterQueueRequest{UserHash: "someone-else"})
+	require.NoError(t, err)
+	assert.Nil(t, redemption)
+
+	_, err = s.redeemAllowlist(ctx, activity, &EnterQueueRequest{UserHash: "someone", InviteCode: "guess"})
+	assert.EqualError(t, err, "invalid invite code")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRedeemAllowlist_RecordsInSameTransaction(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	s := NewQueueService(db, rdb)
+	activity := newAllowlistActivity()
+	rdb.SAdd(ctx, keys.AllowlistKey(activity.TenantID, activity.ID), "", allowlistMember(models.AllowlistKindUserHash, hashAllowlistValue("vip-user")))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE allowlist_entries SET used_count = used_count \\+ 1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(5)))
+	mock.ExpectExec("INSERT INTO allowlist_redemptions").WithArgs(int64(5), activity.ID, "allowlist.abc", "vip-user").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	redemption, err := s.redeemAllowlist(ctx, activity, &EnterQueueRequest{UserHash: "vip-user"})
+	require.NoError(t, err)
+	require.NotNil(t, redemption)
+	assert.Equal(t, int64(5), redemption.entryID)
+	require.NoError(t, redemption.commit(ctx, "allowlist.abc", "vip-user"))
+
+	// 分配序號失敗時刪除核銷記錄並退回次數
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM allowlist_redemptions").WithArgs(int64(5), "allowlist.abc").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE allowlist_entries SET used_count = used_count - 1").WithArgs(int64(5)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	s.releaseRedemption(ctx, 5, "allowlist.abc")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReleaseAllowlistAdmits(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	rs := NewReleaseScheduler(nil, rdb)
+	task := &SchedulerTask{ActivityID: 7, TenantID: "tenant1"}
+	cfg := &schedulerConfig{InitialStock: 2, AdmitAllowlist: true}
+	releaseKey := keys.LaneKey(keys.ReleaseSeqKey(task.TenantID, task.ActivityID), allowlistAdmitLane)
+	require.NoError(t, mr.Set(keys.LaneKey(keys.QueueSeqKey(task.TenantID, task.ActivityID), allowlistAdmitLane), "5"))
+
+	// 不超過剩餘庫存
+	require.NoError(t, rs.releaseAllowlistAdmits(ctx, task, cfg, time.Now()))
+	released, err := mr.Get(releaseKey)
+	require.NoError(t, err)
+	assert.Equal(t, "2", released)
+
+	// concurrency 模式下不超過空出的租約
+	cfg = &schedulerConfig{
+		InitialStock:   100,
+		ReleaseMode:    models.ReleaseModeConcurrency,
+		MaxConcurrent:  3,
+		AdmitAllowlist: true,
+	}
+	require.NoError(t, rs.releaseAllowlistAdmits(ctx, task, cfg, time.Now()))
+	released, err = mr.Get(releaseKey)
+	require.NoError(t, err)
+	assert.Equal(t, "5", released)
+
+	active, err := NewLeasePool(rdb).Active(ctx, task.TenantID, task.ActivityID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), active)
+}
+
+func TestValidateActivityConfig(t *testing.T) {
+	assert.NoError(t, validateActivityConfig(models.ActivityConfig{
+		Lanes:         []models.LaneConfig{{Name: "vip"}},
+		AllowlistMode: models.AllowlistModeLane,
+		AllowlistLane: "vip",
+	}))
+
+	err := validateActivityConfig(models.ActivityConfig{Lanes: []models.LaneConfig{{Name: models.AllowlistAdmitLane}}})
+	assert.ErrorContains(t, err, "is reserved")
+
+	err = validateActivityConfig(models.ActivityConfig{AllowlistMode: models.AllowlistModeLane, AllowlistLane: "vip"})
+	assert.ErrorContains(t, err, "is not a configured lane")
+}
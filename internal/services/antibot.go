@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/ratelimit"
+)
+
+// 人機驗證：活動設定 captcha_provider 時，EnterQueue 在分配序號前呼叫對應的 AntiBot。
+// captcha_mode 為 on_risk 時只在 riskSignal 觸發時要求驗證。
+
+var (
+	// ErrCaptchaRejected 表示驗證服務判定 token 無效
+	ErrCaptchaRejected = errors.New("captcha rejected")
+)
+
+// AntiBot 驗證前端人機驗證元件產生的 token
+type AntiBot interface {
+	// Verify 在 token 有效時回傳 nil，無效時回傳 ErrCaptchaRejected，
+	// 驗證服務無法使用時回傳其他錯誤
+	Verify(ctx context.Context, token, remoteIP string) error
+}
+
+// NoopAntiBot 不做任何驗證，未設定 captcha_provider 時使用
+type NoopAntiBot struct{}
+
+func (NoopAntiBot) Verify(ctx context.Context, token, remoteIP string) error {
+	return nil
+}
+
+const (
+	CaptchaProviderHCaptcha  = "hcaptcha"
+	CaptchaProviderTurnstile = "turnstile"
+)
+
+// 各驗證服務預設的 siteverify 網址
+var defaultVerifyURLs = map[string]string{
+	CaptchaProviderHCaptcha:  "https://api.hcaptcha.com/siteverify",
+	CaptchaProviderTurnstile: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+// SiteVerifyAntiBot 呼叫 hCaptcha / Turnstile 相容的 siteverify API
+type SiteVerifyAntiBot struct {
+	verifyURL string
+	secret    string
+	client    *http.Client
+}
+
+func NewSiteVerifyAntiBot(verifyURL, secret string, timeout time.Duration) *SiteVerifyAntiBot {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &SiteVerifyAntiBot{
+		verifyURL: verifyURL,
+		secret:    secret,
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+type siteVerifyResponse struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func (v *SiteVerifyAntiBot) Verify(ctx context.Context, token, remoteIP string) error {
+	form := url.Values{}
+	form.Set("secret", v.secret)
+	form.Set("response", token)
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, v.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to build siteverify request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := v.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("siteverify request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("siteverify returned status %d", resp.StatusCode)
+	}
+
+	var result siteVerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode siteverify response: %w", err)
+	}
+	if !result.Success {
+		return fmt.Errorf("%w: %s", ErrCaptchaRejected, strings.Join(result.ErrorCodes, ","))
+	}
+	return nil
+}
+
+// RegisterSiteVerify 以 siteverify API 登記驗證服務；verifyURL 為空時使用該服務的預設網址
+func (s *QueueService) RegisterSiteVerify(provider, verifyURL, secret string, timeout time.Duration) error {
+	if verifyURL == "" {
+		verifyURL = defaultVerifyURLs[provider]
+	}
+	if verifyURL == "" {
+		return fmt.Errorf("verify url is required for captcha provider %q", provider)
+	}
+	if secret == "" {
+		return fmt.Errorf("secret is required for captcha provider %q", provider)
+	}
+	s.RegisterAntiBot(provider, NewSiteVerifyAntiBot(verifyURL, secret, timeout))
+	return nil
+}
+
+// RegisterAntiBot 登記驗證服務，活動以 captcha_provider 選用
+func (s *QueueService) RegisterAntiBot(provider string, antiBot AntiBot) {
+	if s.antiBots == nil {
+		s.antiBots = make(map[string]AntiBot)
+	}
+	s.antiBots[provider] = antiBot
+}
+
+// antiBotFor 回傳活動使用的驗證服務；未設定時為 NoopAntiBot
+func (s *QueueService) antiBotFor(activity *models.Activity) (AntiBot, error) {
+	provider := activity.Config.CaptchaProvider
+	if provider == "" {
+		return NoopAntiBot{}, nil
+	}
+	antiBot, ok := s.antiBots[provider]
+	if !ok {
+		return nil, fmt.Errorf("captcha provider %q is not configured", provider)
+	}
+	return antiBot, nil
+}
+
+// verifyCaptcha 在分配序號前驗證人機驗證 token
+func (s *QueueService) verifyCaptcha(ctx context.Context, activity *models.Activity, req *EnterQueueRequest, risk *RiskAssessment, limit *ratelimit.Result) error {
+	antiBot, err := s.antiBotFor(activity)
+	if err != nil {
+		return err
+	}
+	if _, ok := antiBot.(NoopAntiBot); ok {
+		return nil
+	}
+
+	if activity.Config.CaptchaMode == models.CaptchaModeOnRisk && !riskSignal(risk, limit) {
+		return nil
+	}
+
+	if req.CaptchaToken == "" {
+		return fmt.Errorf("captcha required")
+	}
+
+	if err := antiBot.Verify(ctx, req.CaptchaToken, req.IPAddress); err != nil {
+		if errors.Is(err, ErrCaptchaRejected) {
+			s.updateMetrics(ctx, activity.TenantID, activity.ID, "captcha_failed")
+			return fmt.Errorf("captcha verification failed")
+		}
+		log.Printf("Captcha verification unavailable for activity %d: %v", activity.ID, err)
+		return fmt.Errorf("captcha verification unavailable")
+	}
+	return nil
+}
+
+// riskSignal 判斷進入請求是否可疑：風險分數大於 0，或已用掉一半以上的限流額度
+func riskSignal(risk *RiskAssessment, limit *ratelimit.Result) bool {
+	if risk.Score > 0 {
+		return true
+	}
+	if limit == nil || limit.Remaining < 0 {
+		return false
+	}
+	return limit.Remaining*2 < limit.Rule.Limit.Capacity()
+}
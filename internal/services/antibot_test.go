@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/pow"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSiteVerifyStub(t *testing.T, validToken string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "test-secret", r.PostForm.Get("secret"))
+		assert.Equal(t, "203.0.113.7", r.PostForm.Get("remoteip"))
+
+		resp := siteVerifyResponse{Success: r.PostForm.Get("response") == validToken}
+		if !resp.Success {
+			resp.ErrorCodes = []string{"invalid-input-response"}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestSiteVerifyAntiBot(t *testing.T) {
+	server := newSiteVerifyStub(t, "good-token")
+	defer server.Close()
+
+	antiBot := NewSiteVerifyAntiBot(server.URL, "test-secret", time.Second)
+	ctx := context.Background()
+
+	assert.NoError(t, antiBot.Verify(ctx, "good-token", "203.0.113.7"))
+
+	err := antiBot.Verify(ctx, "bad-token", "203.0.113.7")
+	assert.True(t, errors.Is(err, ErrCaptchaRejected))
+}
+
+func TestSiteVerifyAntiBotUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	antiBot := NewSiteVerifyAntiBot(server.URL, "test-secret", time.Second)
+
+	err := antiBot.Verify(context.Background(), "good-token", "203.0.113.7")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrCaptchaRejected))
+}
+
+func TestEnterActivity_CaptchaFailureKeepsChallenge(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	db, _, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	server := newSiteVerifyStub(t, "good-token")
+	defer server.Close()
+
+	ctx := context.Background()
+	// queue_entries 為非同步寫入，不檢查
+	s := NewQueueService(db, rdb)
+	require.NoError(t, s.SetChallengeKey(ctx, []byte("challenge-key-0123456789abcdef0123"), time.Minute))
+	require.NoError(t, s.RegisterSiteVerify("stub", server.URL, "test-secret", time.Second))
+
+	activity := newStreamActivity()
+	activity.Config.PowDifficulty = 4
+	activity.Config.CaptchaProvider = "stub"
+
+	token, _, err := s.challengeIssuer.Issue(activity.TenantID, activity.ID, 4)
+	require.NoError(t, err)
+	req := &EnterQueueRequest{
+		ActivityID:   activity.ID,
+		UserHash:     "user-a",
+		IPAddress:    "203.0.113.7",
+		Challenge:    token,
+		Solution:     pow.Solve(token, 4),
+		CaptchaToken: "bad-token",
+	}
+
+	// 人機驗證失敗時不消耗挑戰，重新驗證後可用同一組解答進入
+	_, err = s.enterActivity(ctx, "req-1", activity, req, nil)
+	assert.ErrorContains(t, err, "captcha verification failed")
+
+	req.CaptchaToken = "good-token"
+	resp, err := s.enterActivity(ctx, "req-2", activity, req, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), resp.Seq)
+
+	// 挑戰只能使用一次
+	req.UserHash = "user-b"
+	_, err = s.enterActivity(ctx, "req-3", activity, req, nil)
+	assert.ErrorContains(t, err, "invalid challenge")
+}
+
+func TestCreateActivity_RejectsUnconfiguredCaptchaProvider(t *testing.T) {
+	s := NewAdminService(nil, nil)
+	s.SetCaptchaProviders([]string{"turnstile"})
+
+	_, err := s.CreateActivity(context.Background(), &CreateActivityRequest{
+		StartAt: time.Now(),
+		EndAt:   time.Now().Add(time.Hour),
+		Config:  models.ActivityConfig{CaptchaProvider: "hcaptcha"},
+	})
+	assert.ErrorContains(t, err, `invalid config: captcha_provider "hcaptcha" is not configured`)
+}
+
+func TestValidateActivityConfig_CaptchaMode(t *testing.T) {
+	err := validateActivityConfig(models.ActivityConfig{CaptchaMode: models.CaptchaModeOnRisk})
+	assert.ErrorContains(t, err, "captcha_mode requires captcha_provider")
+
+	err = validateActivityConfig(models.ActivityConfig{CaptchaProvider: "turnstile", CaptchaMode: "sometimes"})
+	assert.ErrorContains(t, err, "unknown captcha_mode")
+
+	assert.NoError(t, validateActivityConfig(models.ActivityConfig{CaptchaProvider: "turnstile", CaptchaMode: models.CaptchaModeOnRisk}))
+}
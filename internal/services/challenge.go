@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+	"queue-system/pkg/pow"
+
+	"github.com/google/uuid"
+)
+
+// 工作量證明：活動設定 pow_difficulty 時，進入隊列前需先取得挑戰並解題。
+// 難度依最近 entryRateWindow 秒的平均進入速率調整，寫在挑戰的簽章內容中。
+
+// 計算進入速率的時間窗口（秒）
+const entryRateWindow = 10
+
+// 未設定 pow_max_difficulty 時，最多比基本難度高出的位元數
+const defaultPowDifficultyRange = 8
+
+// SetChallengeKey 設定挑戰簽章金鑰，多個實例需設定相同的金鑰才能互相驗證挑戰。
+// 未設定時停用工作量證明；已有活動啟用 pow_difficulty 時回傳錯誤
+func (s *QueueService) SetChallengeKey(ctx context.Context, key []byte, ttl time.Duration) error {
+	if len(key) == 0 {
+		count, err := s.countPowActivities(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check proof-of-work activities: %w", err)
+		}
+		if count > 0 {
+			return fmt.Errorf("challenge secret is required: %d activities enable proof of work", count)
+		}
+		log.Println("Challenge secret not configured, proof of work is disabled")
+		return nil
+	}
+
+	issuer, err := pow.NewIssuer(pow.Config{
+		Key:    key,
+		TTL:    ttl,
+		Replay: pow.NewRedisReplayStore(s.redis),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create challenge issuer: %w", err)
+	}
+	s.challengeIssuer = issuer
+	return nil
+}
+
+// countPowActivities 回傳尚未結束且啟用工作量證明的活動數
+func (s *QueueService) countPowActivities(ctx context.Context) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, `
+        SELECT COUNT(*)
+        FROM activities
+        WHERE status NOT IN ($1, $2)
+        AND COALESCE((config_json->>'pow_difficulty')::int, 0) > 0`,
+		models.StatusEnded, models.StatusArchived).Scan(&count)
+	return count, err
+}
+
+type ChallengeRequest struct {
+	ActivityID int64 `form:"activity_id" binding:"required"`
+}
+
+type ChallengeResponse struct {
+	RequestID string `json:"request_id"`
+	// 活動未啟用工作量證明時為 false，其餘欄位為空
+	Required   bool       `json:"required"`
+	Challenge  string     `json:"challenge,omitempty"`
+	Difficulty int        `json:"difficulty,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// GetChallenge 依目前進入速率簽發挑戰
+func (s *QueueService) GetChallenge(ctx context.Context, req *ChallengeRequest) (*ChallengeResponse, error) {
+	activity, err := s.getActivity(ctx, req.ActivityID)
+	if err != nil {
+		return nil, fmt.Errorf("activity not found: %w", err)
+	}
+
+	resp := &ChallengeResponse{RequestID: uuid.New().String()}
+	if activity.Config.PowDifficulty <= 0 {
+		return resp, nil
+	}
+	if s.challengeIssuer == nil {
+		return nil, fmt.Errorf("proof of work is not configured")
+	}
+
+	difficulty := powDifficulty(activity.Config, s.entryRate(ctx, activity))
+	token, challenge, err := s.challengeIssuer.Issue(activity.TenantID, activity.ID, difficulty)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue challenge: %w", err)
+	}
+
+	expiresAt := time.Unix(challenge.ExpiresAt, 0)
+	resp.Required = true
+	resp.Challenge = token
+	resp.Difficulty = difficulty
+	resp.ExpiresAt = &expiresAt
+	return resp, nil
+}
+
+// verifyChallenge 在活動啟用工作量證明時驗證挑戰解答
+func (s *QueueService) verifyChallenge(ctx context.Context, activity *models.Activity, req *EnterQueueRequest) error {
+	if activity.Config.PowDifficulty <= 0 {
+		return nil
+	}
+	if req.Challenge == "" || req.Solution == "" {
+		return fmt.Errorf("challenge required")
+	}
+	if s.challengeIssuer == nil {
+		return fmt.Errorf("proof of work is not configured")
+	}
+
+	if _, err := s.challengeIssuer.Verify(ctx, req.Challenge, req.Solution, activity.ID); err != nil {
+		s.updateMetrics(ctx, activity.TenantID, activity.ID, "challenge_failed")
+		return fmt.Errorf("invalid challenge: %w", err)
+	}
+
+	s.recordEntryRate(ctx, activity)
+	return nil
+}
+
+// entryRate 回傳最近 entryRateWindow 秒的平均每秒進入次數
+func (s *QueueService) entryRate(ctx context.Context, activity *models.Activity) float64 {
+	now := time.Now().Unix()
+	rateKeys := make([]string, 0, entryRateWindow)
+	for i := int64(1); i <= entryRateWindow; i++ {
+		rateKeys = append(rateKeys, keys.EntryRateKey(activity.TenantID, activity.ID, now-i))
+	}
+
+	values, err := s.redis.MGet(ctx, rateKeys...).Result()
+	if err != nil {
+		return 0
+	}
+
+	var total int64
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			total += parseInt64(str, 0)
+		}
+	}
+	return float64(total) / entryRateWindow
+}
+
+func (s *QueueService) recordEntryRate(ctx context.Context, activity *models.Activity) {
+	key := keys.EntryRateKey(activity.TenantID, activity.ID, time.Now().Unix())
+	pipe := s.redis.Pipeline()
+	pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, 2*entryRateWindow*time.Second)
+	pipe.Exec(ctx)
+}
+
+// powDifficulty 依進入速率計算難度：超過 pow_target_rate 後每加倍一次加 1
+func powDifficulty(config models.ActivityConfig, rate float64) int {
+	difficulty := config.PowDifficulty
+
+	maxDifficulty := config.PowMaxDifficulty
+	if maxDifficulty <= 0 {
+		maxDifficulty = difficulty + defaultPowDifficultyRange
+	}
+	if maxDifficulty > pow.MaxDifficulty {
+		maxDifficulty = pow.MaxDifficulty
+	}
+
+	if config.PowTargetRate > 0 && rate > float64(config.PowTargetRate) {
+		difficulty += int(math.Log2(rate / float64(config.PowTargetRate)))
+	}
+
+	if difficulty > maxDifficulty {
+		return maxDifficulty
+	}
+	return difficulty
+}
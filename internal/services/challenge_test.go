@@ -0,0 +1,48 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"queue-system/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetChallengeKey_RequiresSharedKey(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	s := NewQueueService(db, rdb)
+
+	// 沒有活動啟用工作量證明時可以不設定金鑰
+	mock.ExpectQuery("pow_difficulty").WithArgs(models.StatusEnded, models.StatusArchived).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	require.NoError(t, s.SetChallengeKey(ctx, nil, time.Minute))
+	assert.Nil(t, s.challengeIssuer)
+
+	mock.ExpectQuery("pow_difficulty").WithArgs(models.StatusEnded, models.StatusArchived).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	assert.ErrorContains(t, s.SetChallengeKey(ctx, nil, time.Minute), "challenge secret is required")
+
+	// 有金鑰時不檢查活動
+	require.NoError(t, s.SetChallengeKey(ctx, []byte("challenge-key-0123456789abcdef0123"), time.Minute))
+	assert.NotNil(t, s.challengeIssuer)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateActivity_RejectsPowWithoutKey(t *testing.T) {
+	s := NewAdminService(nil, nil)
+	_, err := s.CreateActivity(context.Background(), &CreateActivityRequest{
+		StartAt: time.Now(),
+		EndAt:   time.Now().Add(time.Hour),
+		Config:  models.ActivityConfig{PowDifficulty: 16},
+	})
+	assert.ErrorContains(t, err, "pow_difficulty requires a challenge secret")
+}
@@ -206,6 +206,9 @@ func (calc *ETACalculator) getHistoricalReleaseData(ctx context.Context, tenantI
 		return nil, err
 	}
 
+	// 暫停區間不計入釋放間隔：事件時間順延其後的暫停時長
+	pauseWindows, _ := calc.redis.ZRange(ctx, keys.PauseWindowsKey(tenantID, activityID), 0, -1).Result()
+
 	var releaseEvents []*ReleaseEvent
 	cutoffTime := time.Now().Add(-duration)
 
@@ -214,6 +217,7 @@ func (calc *ETACalculator) getHistoricalReleaseData(ctx context.Context, tenantI
 		if err := json.Unmarshal([]byte(eventStr), &event); err != nil {
 			continue
 		}
+		event.Timestamp = event.Timestamp.Add(pausedDurationSince(pauseWindows, event.Timestamp))
 
 		if event.Timestamp.After(cutoffTime) {
 			releaseEvents = append(releaseEvents, &event)
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"queue-system/pkg/keys"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Inventory 以 Redis 追蹤活動剩餘庫存，首次使用時以 initial_stock 初始化
+type Inventory struct {
+	redis *redis.Client
+}
+
+func NewInventory(redis *redis.Client) *Inventory {
+	return &Inventory{
+		redis: redis,
+	}
+}
+
+const stockTTL = 7 * 24 * time.Hour
+
+// Remaining 回傳剩餘庫存
+func (inv *Inventory) Remaining(ctx context.Context, tenantID string, activityID int64, initialStock int) (int64, error) {
+	result := inv.redis.Get(ctx, keys.StockKey(tenantID, activityID))
+	if result.Err() == redis.Nil {
+		return int64(initialStock), nil
+	}
+	if result.Err() != nil {
+		return 0, result.Err()
+	}
+
+	return result.Int64()
+}
+
+// decrementStockScript 在庫存足夠時扣減，不足時回傳 -1
+var decrementStockScript = redis.NewScript(`
+redis.call('SET', KEYS[1], ARGV[1], 'NX', 'EX', ARGV[3])
+local stock = tonumber(redis.call('GET', KEYS[1]))
+local quantity = tonumber(ARGV[2])
+if stock < quantity then
+	return -1
+end
+return redis.call('DECRBY', KEYS[1], quantity)
+`)
+
+// Decrement 扣減已確認購買的數量，回傳扣減後的剩餘庫存
+func (inv *Inventory) Decrement(ctx context.Context, tenantID string, activityID int64, initialStock int, quantity int) (int64, error) {
+	remaining, err := decrementStockScript.Run(ctx, inv.redis,
+		[]string{keys.StockKey(tenantID, activityID)},
+		initialStock, quantity, int(stockTTL.Seconds()),
+	).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrement stock: %w", err)
+	}
+
+	if remaining < 0 {
+		return 0, fmt.Errorf("insufficient stock")
+	}
+
+	return remaining, nil
+}
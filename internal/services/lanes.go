@@ -0,0 +1,261 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/admission"
+	"queue-system/pkg/keys"
+)
+
+// 優先通道：每個通道有獨立的序號與釋放指標（keys.LaneKey），
+// 排程器每次 tick 依 lane_policy 將釋放名額分給各通道。
+// 預設通道沿用原本不帶後綴的 key，未設定通道的活動行為不變。
+// 通道名稱寫在會話 token 的前綴（<lane>.<hex>）與 Redis key 中，
+// 因此只允許英數字、'_' 與 '-'（見 validLaneName）。
+// entry token 只能使用一次，且必須以 sub 綁定 user_hash；取得序號後才記為已使用。
+
+// 通道名稱的長度上限
+const maxLaneNameLength = 32
+
+// validLaneName 檢查通道名稱是否能安全地寫入會話 token 與 Redis key
+func validLaneName(name string) bool {
+	if name == "" || len(name) > maxLaneNameLength {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// SetEntryTokenKeys 設定各租戶簽發 entry token 的金鑰（tenant_id -> secret）；
+// entry token 的 kid 必須是租戶 ID
+func (s *QueueService) SetEntryTokenKeys(tenantKeys map[string][]byte, clockSkew time.Duration) error {
+	verifiers := make(map[string]*admission.Verifier, len(tenantKeys))
+	for tenantID, key := range tenantKeys {
+		verifier, err := admission.NewVerifier(admission.VerifierConfig{
+			Keys:      map[string][]byte{tenantID: key},
+			ClockSkew: clockSkew,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create entry token verifier for tenant %s: %w", tenantID, err)
+		}
+		verifiers[tenantID] = verifier
+	}
+	s.entryVerifiers = verifiers
+	s.entryTokenSkew = clockSkew
+	return nil
+}
+
+// resolveLane 依 entry token 決定進入的通道；未帶 token 時進入預設通道。
+// token 須帶 jti 與 sub 且尚未使用；回傳的 claims 在取得序號或完成登記後
+// 才以 markEntryTokenUsed 標記為已使用，之前的任何失敗都不會用掉 token
+func (s *QueueService) resolveLane(ctx context.Context, activity *models.Activity, req *EnterQueueRequest) (string, *admission.Claims, error) {
+	if req.EntryToken == "" {
+		return "", nil, nil
+	}
+
+	verifier, ok := s.entryVerifiers[activity.TenantID]
+	if !ok {
+		return "", nil, fmt.Errorf("invalid entry token")
+	}
+
+	claims, err := verifier.Parse(req.EntryToken)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid entry token")
+	}
+
+	if claims.ID == "" || claims.Subject == "" ||
+		claims.TenantID != activity.TenantID ||
+		(claims.ActivityID != 0 && claims.ActivityID != activity.ID) ||
+		claims.Subject != req.UserHash ||
+		!activity.Config.HasLane(claims.Lane) {
+		return "", nil, fmt.Errorf("invalid entry token")
+	}
+
+	used, err := s.redis.Exists(ctx, keys.EntryTokenReplayKey(activity.TenantID, claims.ID)).Result()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to verify entry token: %w", err)
+	}
+	if used > 0 {
+		return "", nil, fmt.Errorf("invalid entry token")
+	}
+
+	return laneScope(claims.Lane), claims, nil
+}
+
+// markEntryTokenUsed 將 entry token 記為已使用，保留到 token 過期（含時鐘誤差）為止。
+// 同一個 token 同時送出時 sub 綁定的 user_hash 已由去重擋下，這裡只記錄
+func (s *QueueService) markEntryTokenUsed(ctx context.Context, activity *models.Activity, claims *admission.Claims) {
+	if claims == nil {
+		return
+	}
+
+	ttl := time.Until(time.Unix(claims.ExpiresAt, 0).Add(s.entryTokenSkew))
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	if err := s.redis.SetNX(ctx, keys.EntryTokenReplayKey(activity.TenantID, claims.ID), 1, ttl).Err(); err != nil {
+		log.Printf("Failed to mark entry token used for activity %d: %v", activity.ID, err)
+	}
+}
+
+// laneReleaseRate 回傳通道每秒分到的釋放人數：weighted 依權重比例分配；
+// strict 的通道輪到時取得全部名額，不計入等待前面通道排空的時間
+func laneReleaseRate(activity *models.Activity, lane string) float64 {
+	rate := float64(activity.Config.ReleaseRate)
+	if len(activity.Config.Lanes) == 0 || activity.Config.LanePolicy == models.LanePolicyStrict {
+		return rate
+	}
+
+	weight := func(lane models.LaneConfig) int {
+		if lane.Weight <= 0 {
+			return 1
+		}
+		return lane.Weight
+	}
+	var total, own int
+	for _, l := range activity.Config.AllLanes() {
+		total += weight(l)
+		if l.Name == laneName(lane) {
+			own = weight(l)
+		}
+	}
+	if total == 0 || own == 0 {
+		return rate
+	}
+	return rate * float64(own) / float64(total)
+}
+
+// laneDisplayName 在活動設定了通道時回傳通道名稱，否則回傳空字串
+func (s *QueueService) laneDisplayName(activity *models.Activity, lane string) string {
+	if lane == "" && len(activity.Config.Lanes) == 0 {
+		return ""
+	}
+	return laneName(lane)
+}
+
+// laneScope 將通道名稱轉為 key 後綴；預設通道不加後綴
+func laneScope(name string) string {
+	if name == models.DefaultLane {
+		return ""
+	}
+	return name
+}
+
+// laneName 是 laneScope 的反向轉換
+func laneName(scope string) string {
+	if scope == "" {
+		return models.DefaultLane
+	}
+	return scope
+}
+
+// laneOfSession 從會話 token 前綴取出通道
+func laneOfSession(sessionID string) string {
+	if i := strings.IndexByte(sessionID, '.'); i >= 0 {
+		return sessionID[:i]
+	}
+	return ""
+}
+
+// laneMember 回傳租約池中的成員名稱；各通道序號會重複，因此加上通道前綴
+func laneMember(scope string, seq int64) string {
+	if scope == "" {
+		return strconv.FormatInt(seq, 10)
+	}
+	return scope + ":" + strconv.FormatInt(seq, 10)
+}
+
+// splitReleaseBudget 將釋放名額分給各通道，不超過各通道的待釋放人數。
+// weighted：依權重比例分配，通道排空後剩餘名額再分給其他通道；
+// strict：依 priority 由小到大，前面的通道排空才輪到後面的通道。
+func splitReleaseBudget(budget int64, lanes []models.LaneConfig, backlog map[string]int64, policy models.LanePolicy) map[string]int64 {
+	allocation := make(map[string]int64, len(lanes))
+	if budget <= 0 {
+		return allocation
+	}
+
+	if policy == models.LanePolicyStrict {
+		ordered := make([]models.LaneConfig, len(lanes))
+		copy(ordered, lanes)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].Priority < ordered[j].Priority
+		})
+
+		for _, lane := range ordered {
+			if budget <= 0 {
+				break
+			}
+			take := minInt64(budget, backlog[lane.Name])
+			if take > 0 {
+				allocation[lane.Name] = take
+				budget -= take
+			}
+		}
+		return allocation
+	}
+
+	weight := func(lane models.LaneConfig) int64 {
+		if lane.Weight <= 0 {
+			return 1
+		}
+		return int64(lane.Weight)
+	}
+
+	active := make([]models.LaneConfig, 0, len(lanes))
+	for _, lane := range lanes {
+		if backlog[lane.Name] > 0 {
+			active = append(active, lane)
+		}
+	}
+
+	for budget > 0 && len(active) > 0 {
+		var totalWeight int64
+		for _, lane := range active {
+			totalWeight += weight(lane)
+		}
+
+		var distributed int64
+		for _, lane := range active {
+			share := minInt64(budget*weight(lane)/totalWeight, backlog[lane.Name]-allocation[lane.Name])
+			allocation[lane.Name] += share
+			distributed += share
+		}
+
+		// 名額不足以按比例分配時，依權重高低逐一分配
+		if distributed == 0 {
+			sort.SliceStable(active, func(i, j int) bool {
+				return weight(active[i]) > weight(active[j])
+			})
+			for _, lane := range active {
+				if budget <= 0 {
+					break
+				}
+				allocation[lane.Name]++
+				budget--
+			}
+			break
+		}
+		budget -= distributed
+
+		remaining := active[:0]
+		for _, lane := range active {
+			if allocation[lane.Name] < backlog[lane.Name] {
+				remaining = append(remaining, lane)
+			}
+		}
+		active = remaining
+	}
+
+	return allocation
+}
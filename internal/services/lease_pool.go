@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"queue-system/pkg/keys"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// LeasePool 管理 concurrency 模式下用戶佔用 origin 的租約。
+// 租約在釋放時取得，於結帳完成、用戶離開或逾時後收回。
+type LeasePool struct {
+	redis *redis.Client
+}
+
+func NewLeasePool(redis *redis.Client) *LeasePool {
+	return &LeasePool{
+		redis: redis,
+	}
+}
+
+const defaultLeaseTimeout = 5 * time.Minute
+
+// Active 清除逾時租約後回傳目前持有的租約數
+func (lp *LeasePool) Active(ctx context.Context, tenantID string, activityID int64) (int64, error) {
+	key := keys.LeaseKey(tenantID, activityID)
+
+	pipe := lp.redis.Pipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(time.Now().Unix(), 10))
+	countCmd := pipe.ZCard(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	return countCmd.Val(), nil
+}
+
+// Acquire 為通道中被釋放的 seq 取得租約
+func (lp *LeasePool) Acquire(ctx context.Context, tenantID string, activityID int64, lane string, seqs []int64, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultLeaseTimeout
+	}
+	expiresAt := float64(time.Now().Add(timeout).Unix())
+
+	members := make([]*redis.Z, 0, len(seqs))
+	for _, seq := range seqs {
+		members = append(members, &redis.Z{Score: expiresAt, Member: laneMember(lane, seq)})
+	}
+	if len(members) == 0 {
+		return nil
+	}
+
+	key := keys.LeaseKey(tenantID, activityID)
+	pipe := lp.redis.Pipeline()
+	pipe.ZAdd(ctx, key, members...)
+	pipe.Expire(ctx, key, 24*time.Hour)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Release 收回通道中 seq 的租約，回傳是否確實持有租約
+func (lp *LeasePool) Release(ctx context.Context, tenantID string, activityID int64, lane string, seq int64) (bool, error) {
+	removed, err := lp.redis.ZRem(ctx, keys.LeaseKey(tenantID, activityID), laneMember(lane, seq)).Result()
+	if err != nil {
+		return false, err
+	}
+	return removed > 0, nil
+}
@@ -0,0 +1,426 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 活動生命週期：draft → scheduled → active ⇄ paused → draining → ended → archived。
+// 管理員只能依 activityTransitions 切換狀態；LifecycleWorker 依 start_at / end_at
+// 自動切換已排程與進行中的活動。每次切換寫入 activity_lifecycle_events 並推送到 Redis。
+// 每個實例都會啟動 LifecycleWorker，但只有持有主節點鎖（keys.LifecycleLeaderKey）的實例執行檢查。
+
+// activityTransitions 列出各狀態允許切換到的狀態
+var activityTransitions = map[models.ActivityStatus][]models.ActivityStatus{
+	models.StatusDraft:     {models.StatusScheduled, models.StatusArchived},
+	models.StatusScheduled: {models.StatusDraft, models.StatusActive, models.StatusEnded},
+	models.StatusActive:    {models.StatusPaused, models.StatusDraining, models.StatusEnded},
+	models.StatusPaused:    {models.StatusActive, models.StatusDraining, models.StatusEnded},
+	models.StatusDraining:  {models.StatusEnded},
+	models.StatusEnded:     {models.StatusArchived},
+}
+
+// canTransition 檢查狀態切換是否合法
+func canTransition(from, to models.ActivityStatus) bool {
+	for _, next := range activityTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// 依時間自動切換的規則，依序執行，同一輪內可連續切換
+var scheduledTransitions = []struct {
+	From models.ActivityStatus
+	To   models.ActivityStatus
+	Due  string
+}{
+	{models.StatusScheduled, models.StatusActive, "start_at <= NOW()"},
+	{models.StatusActive, models.StatusDraining, "end_at <= NOW()"},
+	{models.StatusPaused, models.StatusDraining, "end_at <= NOW()"},
+	{models.StatusDraining, models.StatusEnded, "end_at + make_interval(secs => COALESCE((config_json->>'drain_seconds')::int, 0)) <= NOW()"},
+}
+
+// 生命週期檢查間隔
+const lifecycleCheckInterval = time.Second
+
+// 主節點鎖的期限，每輪檢查時續約；主節點停止後其他實例在此時間內接手
+const lifecycleLeaderTTL = 5 * lifecycleCheckInterval
+
+const (
+	LifecycleSourceSchedule = "schedule"
+	LifecycleSourceAdmin    = "admin"
+)
+
+type LifecycleEvent struct {
+	ActivityID int64                 `json:"activity_id"`
+	TenantID   string                `json:"tenant_id"`
+	From       models.ActivityStatus `json:"from"`
+	To         models.ActivityStatus `json:"to"`
+	Source     string                `json:"source"`
+	Timestamp  time.Time             `json:"timestamp"`
+}
+
+type LifecycleWorker struct {
+	db       *sql.DB
+	redis    *redis.Client
+	queue    *QueueService
+	leaderID string
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewLifecycleWorker(db *sql.DB, redis *redis.Client) *LifecycleWorker {
+	hostname, _ := os.Hostname()
+	return &LifecycleWorker{
+		db:       db,
+		redis:    redis,
+		queue:    NewQueueService(db, redis),
+		leaderID: fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		stopChan: make(chan struct{}),
+	}
+}
+
+func (w *LifecycleWorker) Start(ctx context.Context) error {
+	log.Println("Starting Lifecycle Worker...")
+
+	// 啟動時先補上停機期間錯過的切換
+	w.advance(ctx)
+
+	w.wg.Add(1)
+	go w.run(ctx)
+
+	return nil
+}
+
+func (w *LifecycleWorker) Stop() {
+	log.Println("Stopping Lifecycle Worker...")
+	close(w.stopChan)
+	w.wg.Wait()
+
+	// 讓其他實例不必等到鎖過期即可接手
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := releaseLeaderScript.Run(ctx, w.redis, []string{keys.LifecycleLeaderKey()}, w.leaderID).Err(); err != nil {
+		log.Printf("Failed to release lifecycle leadership: %v", err)
+	}
+	log.Println("Lifecycle Worker stopped")
+}
+
+// acquireLeaderScript 取得或續約主節點鎖；其他實例持有時回傳 0
+var acquireLeaderScript = redis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if holder and holder ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+// releaseLeaderScript 只釋放自己持有的主節點鎖
+var releaseLeaderScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// isLeader 取得或續約主節點鎖，回傳本實例是否應執行本輪檢查
+func (w *LifecycleWorker) isLeader(ctx context.Context) bool {
+	held, err := acquireLeaderScript.Run(ctx, w.redis, []string{keys.LifecycleLeaderKey()},
+		w.leaderID, lifecycleLeaderTTL.Milliseconds()).Int64()
+	if err != nil {
+		log.Printf("Failed to acquire lifecycle leadership: %v", err)
+		return false
+	}
+	return held == 1
+}
+
+func (w *LifecycleWorker) run(ctx context.Context) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(lifecycleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.stopChan:
+			return
+		case <-ticker.C:
+			w.advance(ctx)
+		}
+	}
+}
+
+// advance 執行所有到期的狀態切換；非主節點的實例略過
+func (w *LifecycleWorker) advance(ctx context.Context) {
+	if !w.isLeader(ctx) {
+		return
+	}
+
+	for _, transition := range scheduledTransitions {
+		if err := w.transition(ctx, transition.From, transition.To, transition.Due); err != nil {
+			log.Printf("Failed to move activities from %s to %s: %v", transition.From, transition.To, err)
+		}
+	}
+
+	if err := w.endDrainedActivities(ctx); err != nil {
+		log.Printf("Failed to end drained activities: %v", err)
+	}
+
+	if err := w.drawDueLotteries(ctx); err != nil {
+		log.Printf("Failed to draw lotteries: %v", err)
+	}
+
+	if err := w.assignDuePreQueues(ctx); err != nil {
+		log.Printf("Failed to assign pre-queues: %v", err)
+	}
+}
+
+// assignDuePreQueues 為已開賣、仍有預排隊用戶未分配序號的活動分批分配序號
+func (w *LifecycleWorker) assignDuePreQueues(ctx context.Context) error {
+	rows, err := w.db.QueryContext(ctx, `
+        SELECT id, tenant_id, end_at, config_json
+        FROM activities
+        WHERE status IN ($1, $2, $3)
+        AND COALESCE((config_json->>'pre_queue_window_seconds')::int, 0) > 0
+        AND start_at <= NOW()`,
+		models.StatusActive, models.StatusPaused, models.StatusDraining)
+	if err != nil {
+		return err
+	}
+
+	var due []*models.Activity
+	for rows.Next() {
+		var activity models.Activity
+		if err := rows.Scan(&activity.ID, &activity.TenantID, &activity.EndAt, &activity.Config); err != nil {
+			rows.Close()
+			return err
+		}
+		if activity.Config.IsLotteryMode() {
+			continue
+		}
+		if !hasPendingPreQueue(ctx, w.redis, &activity) {
+			continue
+		}
+		due = append(due, &activity)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, activity := range due {
+		if err := w.queue.assignPreQueue(ctx, activity); err != nil {
+			log.Printf("Failed to assign pre-queue for activity %d: %v", activity.ID, err)
+		}
+	}
+	return nil
+}
+
+// drawDueLotteries 為報名已截止、尚未完成開獎的抽籤活動開獎；
+// 稽核記錄已寫入但仍有登記未分配序號時（開獎中斷）沿用記錄的結果繼續分配
+func (w *LifecycleWorker) drawDueLotteries(ctx context.Context) error {
+	rows, err := w.db.QueryContext(ctx, `
+        SELECT id, tenant_id, initial_stock, start_at, end_at, config_json,
+               EXISTS (SELECT 1 FROM lottery_draws d WHERE d.activity_id = activities.id)
+        FROM activities
+        WHERE status IN ($1, $2, $3)
+        AND config_json->>'allocation_mode' = $4
+        AND start_at + make_interval(secs => COALESCE((config_json->>'lottery_entry_seconds')::int, 0)) <= NOW()`,
+		models.StatusActive, models.StatusPaused, models.StatusDraining, models.AllocationModeLottery)
+	if err != nil {
+		return err
+	}
+
+	var due []*models.Activity
+	for rows.Next() {
+		var activity models.Activity
+		var recorded bool
+		if err := rows.Scan(&activity.ID, &activity.TenantID, &activity.InitialStock,
+			&activity.StartAt, &activity.EndAt, &activity.Config, &recorded); err != nil {
+			rows.Close()
+			return err
+		}
+		if recorded {
+			pending, err := w.redis.Exists(ctx, keys.LotteryEntriesKey(activity.TenantID, activity.ID)).Result()
+			if err != nil || pending == 0 {
+				continue
+			}
+		}
+		due = append(due, &activity)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, activity := range due {
+		if err := w.queue.drawLottery(ctx, activity); err != nil {
+			log.Printf("Failed to draw lottery for activity %d: %v", activity.ID, err)
+		}
+	}
+	return nil
+}
+
+// endDrainedActivities 在排空期截止前，隊列已全部釋放的活動提前結束
+func (w *LifecycleWorker) endDrainedActivities(ctx context.Context) error {
+	rows, err := w.db.QueryContext(ctx, `
+        SELECT id, tenant_id, config_json
+        FROM activities
+        WHERE status = $1`, models.StatusDraining)
+	if err != nil {
+		return err
+	}
+
+	var drained []*models.Activity
+	for rows.Next() {
+		var activity models.Activity
+		if err := rows.Scan(&activity.ID, &activity.TenantID, &activity.Config); err != nil {
+			rows.Close()
+			return err
+		}
+		if queueDrained(ctx, w.redis, &activity) {
+			drained = append(drained, &activity)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, activity := range drained {
+		if err := w.transitionByID(ctx, models.StatusDraining, models.StatusEnded, activity.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueDrained 檢查所有通道的等待者是否都已釋放
+func queueDrained(ctx context.Context, rdb *redis.Client, activity *models.Activity) bool {
+	lanes := activity.Config.AllLanes()
+	pipe := rdb.Pipeline()
+	queueSeqCmds := make([]*redis.StringCmd, len(lanes))
+	releaseSeqCmds := make([]*redis.StringCmd, len(lanes))
+	for i, lane := range lanes {
+		scope := laneScope(lane.Name)
+		queueSeqCmds[i] = pipe.Get(ctx, keys.LaneKey(keys.QueueSeqKey(activity.TenantID, activity.ID), scope))
+		releaseSeqCmds[i] = pipe.Get(ctx, keys.LaneKey(keys.ReleaseSeqKey(activity.TenantID, activity.ID), scope))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return false
+	}
+
+	for i, lane := range lanes {
+		if parseInt64(queueSeqCmds[i].Val(), 0) > parseInt64(releaseSeqCmds[i].Val(), 0) {
+			return false
+		}
+		// 延後釋放的風險用戶仍在等待；shadow 用戶不會被釋放，不影響排空
+		if countDeferred(ctx, rdb, activity.TenantID, activity.ID, laneScope(lane.Name)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// transition 以條件式 UPDATE 切換到期的活動，多個實例同時執行時每個活動只會切換一次。
+// due 只接受 scheduledTransitions 中的固定條件，不可帶入外部值
+func (w *LifecycleWorker) transition(ctx context.Context, from, to models.ActivityStatus, due string) error {
+	query := fmt.Sprintf(`
+        UPDATE activities
+        SET status = $1, updated_at = NOW()
+        WHERE status = $2
+        AND %s
+        RETURNING id, tenant_id, config_json`, due)
+
+	return w.applyTransition(ctx, from, to, query, to, from)
+}
+
+// transitionByID 切換單一活動，活動已不在 from 狀態時不做任何事
+func (w *LifecycleWorker) transitionByID(ctx context.Context, from, to models.ActivityStatus, activityID int64) error {
+	return w.applyTransition(ctx, from, to, `
+        UPDATE activities
+        SET status = $1, updated_at = NOW()
+        WHERE status = $2
+        AND id = $3
+        RETURNING id, tenant_id, config_json`, to, from, activityID)
+}
+
+// applyTransition 執行切換的 UPDATE，並為每個切換的活動寫入記錄
+func (w *LifecycleWorker) applyTransition(ctx context.Context, from, to models.ActivityStatus, query string, args ...interface{}) error {
+	rows, err := w.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var moved []*models.Activity
+	for rows.Next() {
+		var activity models.Activity
+		if err := rows.Scan(&activity.ID, &activity.TenantID, &activity.Config); err != nil {
+			return err
+		}
+		moved = append(moved, &activity)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, activity := range moved {
+		log.Printf("Activity %d moved from %s to %s", activity.ID, from, to)
+
+		// 離開暫停時結算暫停區間並順延期限，與管理員恢復相同
+		if from == models.StatusPaused {
+			if err := markResumed(ctx, w.redis, activity); err != nil {
+				log.Printf("Failed to update pause state for activity %d: %v", activity.ID, err)
+			}
+		}
+
+		recordLifecycleEvent(ctx, w.db, w.redis, &LifecycleEvent{
+			ActivityID: activity.ID,
+			TenantID:   activity.TenantID,
+			From:       from,
+			To:         to,
+			Source:     LifecycleSourceSchedule,
+			Timestamp:  time.Now(),
+		})
+	}
+	return nil
+}
+
+// recordLifecycleEvent 寫入切換記錄並推送到 Redis（用於即時監控）
+func recordLifecycleEvent(ctx context.Context, db *sql.DB, rdb *redis.Client, event *LifecycleEvent) {
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO activity_lifecycle_events (activity_id, tenant_id, from_status, to_status, source, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)`,
+		event.ActivityID, event.TenantID, event.From, event.To, event.Source, event.Timestamp)
+	if err != nil {
+		log.Printf("Failed to record lifecycle event for activity %d: %v", event.ActivityID, err)
+	}
+
+	eventKey := keys.LifecycleEventsKey(event.TenantID, event.ActivityID)
+	eventData, _ := json.Marshal(event)
+
+	pipe := rdb.Pipeline()
+	pipe.LPush(ctx, eventKey, eventData)
+	pipe.LTrim(ctx, eventKey, 0, 99)
+	pipe.Expire(ctx, eventKey, 7*24*time.Hour)
+	// 狀態串流重新載入活動（暫停、恢復、排空、結束）
+	publishQueueEvent(ctx, pipe, event.TenantID, event.ActivityID, queueEventActivity)
+	pipe.Exec(ctx)
+}
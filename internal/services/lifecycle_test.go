@@ -0,0 +1,100 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycleTransition_ClearsPauseState(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	w := NewLifecycleWorker(db, rdb)
+	activity := newStreamActivity()
+	config, _ := activity.Config.Value()
+
+	pausedAt := time.Now().Add(-time.Minute).Unix()
+	require.NoError(t, mr.Set(keys.PausedAtKey(activity.TenantID, activity.ID), fmt.Sprint(pausedAt)))
+	claimKey := keys.ClaimPendingKey(activity.TenantID, activity.ID)
+	deadline := float64(time.Now().Add(30 * time.Second).Unix())
+	_, err = mr.ZAdd(claimKey, deadline, "8")
+	require.NoError(t, err)
+
+	// 暫停中到期的活動切到 draining 時一併結算暫停
+	mock.ExpectQuery("UPDATE activities").WithArgs(models.StatusDraining, models.StatusPaused).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "config_json"}).AddRow(activity.ID, activity.TenantID, config))
+	mock.ExpectExec("INSERT INTO activity_lifecycle_events").WillReturnResult(sqlmock.NewResult(1, 1))
+	require.NoError(t, w.transition(ctx, models.StatusPaused, models.StatusDraining, "end_at <= NOW()"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.False(t, mr.Exists(keys.PausedAtKey(activity.TenantID, activity.ID)))
+	windows, err := rdb.ZRange(ctx, keys.PauseWindowsKey(activity.TenantID, activity.ID), 0, -1).Result()
+	require.NoError(t, err)
+	assert.Len(t, windows, 1)
+
+	score, err := mr.ZScore(claimKey, "8")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, score, deadline+60)
+}
+
+func TestEndDrainedActivities_TransitionsByID(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	w := NewLifecycleWorker(db, rdb)
+	activity := newStreamActivity()
+	config, _ := activity.Config.Value()
+	seedQueue(t, mr, activity, 20, 20, nil)
+
+	mock.ExpectQuery("SELECT id, tenant_id, config_json").WithArgs(models.StatusDraining).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "config_json"}).AddRow(activity.ID, activity.TenantID, config))
+	mock.ExpectQuery("AND id = \\$3").WithArgs(models.StatusEnded, models.StatusDraining, activity.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "config_json"}).AddRow(activity.ID, activity.TenantID, config))
+	mock.ExpectExec("INSERT INTO activity_lifecycle_events").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	require.NoError(t, w.endDrainedActivities(ctx))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLifecycleWorker_OnlyLeaderAdvances(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	leader := NewLifecycleWorker(db, rdb)
+	follower := NewLifecycleWorker(db, rdb)
+
+	assert.True(t, leader.isLeader(ctx))
+	assert.True(t, leader.isLeader(ctx))
+
+	// 非主節點的實例不查詢資料庫
+	follower.advance(ctx)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// 主節點停止後立即釋放鎖
+	leader.Stop()
+	assert.False(t, mr.Exists(keys.LifecycleLeaderKey()))
+	assert.True(t, follower.isLeader(ctx))
+
+	// 主節點中斷未釋放時，鎖過期後由其他實例接手
+	mr.FastForward(lifecycleLeaderTTL)
+	assert.True(t, leader.isLeader(ctx))
+	assert.False(t, follower.isLeader(ctx))
+}
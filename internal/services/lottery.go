@@ -0,0 +1,293 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 抽籤模式：start_at 起 lottery_entry_seconds 內報名的用戶只登記不分配序號，
+// 截止後由 LifecycleWorker 開獎：先關閉報名並保留序號區段，再以隨機種子洗牌決定序號，
+// 前 initial_stock 名中籤，其餘候補。種子與結果寫入 lottery_draws / lottery_results 後
+// 才分配序號，寫入失敗時下一輪重試；將報名者的 session_id 排序後
+// 以相同種子執行 seededShuffle 即可重現結果。
+
+// enterLottery 在報名期間登記用戶
+func (s *QueueService) enterLottery(ctx context.Context, requestID string, activity *models.Activity, req *EnterQueueRequest) (*EnterQueueResponse, error) {
+	drawAt := activity.DrawAt()
+	if !time.Now().Before(drawAt) {
+		return nil, fmt.Errorf("lottery entry closed")
+	}
+
+	entriesKey := keys.LotteryEntriesKey(activity.TenantID, activity.ID)
+
+	// 已報名的會話重新進入
+	if req.SessionID != "" && s.isRegistered(ctx, entriesKey, req.SessionID) {
+		return s.lotteryResponse(requestID, activity, req.SessionID), nil
+	}
+
+	ttl := time.Until(drawAt) + queueEntryTTL
+
+	sessionID, err := newSessionToken("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session token: %w", err)
+	}
+
+	code, err := s.registerEntrant(ctx, activity, req, sessionID, entriesKey,
+		keys.LotteryDrawnKey(activity.TenantID, activity.ID), "", ttl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register lottery entry: %w", err)
+	}
+
+	switch code {
+	case enterResultDuplicate:
+		return nil, fmt.Errorf("user already in queue")
+	case enterResultOpened:
+		return nil, fmt.Errorf("lottery entry closed")
+	}
+
+	s.updateMetrics(ctx, activity.TenantID, activity.ID, "lottery_entry")
+
+	return s.lotteryResponse(requestID, activity, sessionID), nil
+}
+
+func (s *QueueService) lotteryResponse(requestID string, activity *models.Activity, sessionID string) *EnterQueueResponse {
+	drawAt := activity.DrawAt()
+	return &EnterQueueResponse{
+		RequestID:       requestID,
+		PollingInterval: s.pollUntil(activity, drawAt),
+		SessionID:       sessionID,
+		State:           StateRegistered,
+		DrawAt:          &drawAt,
+	}
+}
+
+// 開獎鎖的期限，實例中斷時由下一輪接手
+const lotteryDrawLockTTL = time.Minute
+
+// closeLotteryScript 關閉報名並為登記者保留序號區段，只會生效一次；
+// 旗標的值為「起始序號:人數」，開獎中斷後重試時沿用同一區段。
+// 區段分配完成前已分配序號停在區段起點，釋放不會越過尚未分配的序號。
+// KEYS: 已開獎旗標、登記、queue_seq、已分配序號
+// ARGV: 旗標 TTL 秒數
+var closeLotteryScript = redis.NewScript(`
+local reserved = redis.call('GET', KEYS[1])
+if reserved then
+	return reserved
+end
+
+local count = redis.call('HLEN', KEYS[2])
+local base = redis.call('INCRBY', KEYS[3], count) - count
+reserved = base .. ':' .. count
+redis.call('SET', KEYS[1], reserved, 'EX', ARGV[1])
+if count > 0 then
+	redis.call('SET', KEYS[4], base, 'EX', ARGV[1])
+end
+return reserved
+`)
+
+// parseLotteryReservation 解析已開獎旗標中的「起始序號:人數」
+func parseLotteryReservation(reserved string) (int64, int64, error) {
+	var base, count int64
+	if _, err := fmt.Sscanf(reserved, "%d:%d", &base, &count); err != nil {
+		return 0, 0, fmt.Errorf("invalid lottery reservation %q: %w", reserved, err)
+	}
+	return base, count, nil
+}
+
+// drawLottery 在報名截止後開獎，由 LifecycleWorker 呼叫；重複呼叫是安全的：
+// 稽核記錄已寫入時沿用記錄的結果分配序號，不會重新抽籤
+func (s *QueueService) drawLottery(ctx context.Context, activity *models.Activity) error {
+	lockKey := keys.LotteryDrawLockKey(activity.TenantID, activity.ID)
+	locked, err := s.redis.SetNX(ctx, lockKey, 1, lotteryDrawLockTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	defer s.redis.Del(ctx, lockKey)
+
+	// 先關閉報名，之後讀到的登記名單即為完整的抽籤名單
+	entriesKey := keys.LotteryEntriesKey(activity.TenantID, activity.ID)
+	reserved, err := closeLotteryScript.Run(ctx, s.redis,
+		[]string{
+			keys.LotteryDrawnKey(activity.TenantID, activity.ID),
+			entriesKey,
+			keys.QueueSeqKey(activity.TenantID, activity.ID),
+			keys.AssignedSeqKey(activity.TenantID, activity.ID),
+		},
+		int((time.Until(activity.EndAt) + 24*time.Hour).Seconds()),
+	).Text()
+	if err != nil {
+		return fmt.Errorf("failed to close lottery entry: %w", err)
+	}
+
+	base, count, err := parseLotteryReservation(reserved)
+	if err != nil {
+		return err
+	}
+
+	drawn, recorded, err := s.loadLotteryResults(ctx, activity.ID)
+	if err != nil {
+		return fmt.Errorf("failed to load lottery results: %w", err)
+	}
+	if !recorded {
+		if drawn, err = s.drawEntrants(ctx, activity, entriesKey, base); err != nil {
+			return err
+		}
+	}
+
+	if err := s.assignEntrants(ctx, activity, entriesKey, drawn, base, count); err != nil {
+		return fmt.Errorf("failed to assign lottery seqs: %w", err)
+	}
+
+	log.Printf("Drew lottery for activity %d: %d entrants, %d winners",
+		activity.ID, len(drawn), min(activity.InitialStock, len(drawn)))
+	return nil
+}
+
+// drawEntrants 以新種子洗牌登記者並寫入稽核記錄，寫入失敗時不分配序號
+func (s *QueueService) drawEntrants(ctx context.Context, activity *models.Activity, entriesKey string, base int64) ([]assignedEntrant, error) {
+	entries, err := s.redis.HGetAll(ctx, entriesKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load lottery entries: %w", err)
+	}
+
+	tokens := make([]string, 0, len(entries))
+	for token := range entries {
+		tokens = append(tokens, token)
+	}
+
+	seed, err := newShuffleSeed()
+	if err != nil {
+		return nil, fmt.Errorf("failed to seed lottery draw: %w", err)
+	}
+
+	// 先排序，讓相同種子能重現相同結果
+	sort.Strings(tokens)
+	seededShuffle(tokens, seed)
+
+	drawn := make([]assignedEntrant, len(tokens))
+	for i, token := range tokens {
+		var entry preQueueEntry
+		if err := json.Unmarshal([]byte(entries[token]), &entry); err != nil {
+			return nil, fmt.Errorf("invalid lottery entry %s: %w", token, err)
+		}
+		drawn[i] = assignedEntrant{SessionID: token, Seq: base + int64(i) + 1, Entry: entry}
+	}
+
+	if err := s.recordLotteryDraw(ctx, activity, seed, drawn); err != nil {
+		return nil, fmt.Errorf("failed to record lottery draw: %w", err)
+	}
+	return drawn, nil
+}
+
+// recordLotteryDraw 將種子與開獎結果寫入資料庫以供稽核
+func (s *QueueService) recordLotteryDraw(ctx context.Context, activity *models.Activity, seed int64, drawn []assignedEntrant) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	winners := min(activity.InitialStock, len(drawn))
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO lottery_draws (activity_id, seed, entrant_count, winner_count, drawn_at)
+        VALUES ($1, $2, $3, $4, NOW())`,
+		activity.ID, seed, len(drawn), winners)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+        INSERT INTO lottery_results (activity_id, position, session_id, user_hash, won)
+        VALUES ($1, $2, $3, $4, $5)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, entrant := range drawn {
+		if _, err := stmt.ExecContext(ctx, activity.ID, entrant.Seq, entrant.SessionID, entrant.Entry.UserHash, i < winners); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// loadLotteryResults 讀取已寫入的開獎結果；尚未開獎時 recorded 為 false
+func (s *QueueService) loadLotteryResults(ctx context.Context, activityID int64) ([]assignedEntrant, bool, error) {
+	var recorded bool
+	err := s.db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM lottery_draws WHERE activity_id = $1)", activityID).Scan(&recorded)
+	if err != nil || !recorded {
+		return nil, false, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT position, session_id, user_hash
+        FROM lottery_results
+        WHERE activity_id = $1
+        ORDER BY position`, activityID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var drawn []assignedEntrant
+	for rows.Next() {
+		var entrant assignedEntrant
+		if err := rows.Scan(&entrant.Seq, &entrant.SessionID, &entrant.Entry.UserHash); err != nil {
+			return nil, false, err
+		}
+		drawn = append(drawn, entrant)
+	}
+	return drawn, true, rows.Err()
+}
+
+// resolveLotterySeq 回傳報名者開獎後的序號；尚未開獎時回傳 registered 狀態
+func (s *QueueService) resolveLotterySeq(ctx context.Context, requestID string, activity *models.Activity, sessionID string) (int64, *QueueStatusResponse) {
+	drawAt := activity.DrawAt()
+	if seq, err := s.getExistingSeq(ctx, activity.TenantID, activity.ID, sessionID); err == nil && seq > 0 {
+		return seq, nil
+	}
+
+	if !s.isRegistered(ctx, keys.LotteryEntriesKey(activity.TenantID, activity.ID), sessionID) {
+		return 0, nil
+	}
+
+	return 0, &QueueStatusResponse{
+		RequestID:  requestID,
+		State:      StateRegistered,
+		NextPollMs: s.pollUntil(activity, drawAt),
+		DrawAt:     &drawAt,
+	}
+}
+
+// lotteryState 回傳開獎後尚未輪到的用戶是中籤或候補；
+// 抽籤區段不一定從 0 開始，以區段內的名次比較庫存
+func (s *QueueService) lotteryState(ctx context.Context, activity *models.Activity, seq int64) QueueState {
+	var base int64
+	reserved, err := s.redis.Get(ctx, keys.LotteryDrawnKey(activity.TenantID, activity.ID)).Result()
+	if err == nil {
+		base, _, err = parseLotteryReservation(reserved)
+	}
+	if err != nil {
+		log.Printf("Failed to load lottery reservation for activity %d: %v", activity.ID, err)
+	}
+
+	if seq-base <= int64(activity.InitialStock) {
+		return StateWon
+	}
+	return StateLost
+}
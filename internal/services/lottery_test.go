@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newLotteryActivity() *models.Activity {
+	activity := newStreamActivity()
+	activity.InitialStock = 2
+	activity.StartAt = time.Now().Add(-time.Minute)
+	activity.Config.AllocationMode = models.AllocationModeLottery
+	activity.Config.LotteryEntrySeconds = 30
+	return activity
+}
+
+// registerLottery 登記 n 個報名者並回傳會話 token
+func registerLottery(t *testing.T, s *QueueService, activity *models.Activity, users ...string) []string {
+	t.Helper()
+
+	sessions := make([]string, len(users))
+	for i, user := range users {
+		sessionID, err := newSessionToken("")
+		require.NoError(t, err)
+		code, err := s.registerEntrant(context.Background(), activity, &EnterQueueRequest{UserHash: user}, sessionID,
+			keys.LotteryEntriesKey(activity.TenantID, activity.ID), keys.LotteryDrawnKey(activity.TenantID, activity.ID), "", time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, int64(enterResultOK), code)
+		sessions[i] = sessionID
+	}
+	return sessions
+}
+
+func expectLotteryRecorded(mock sqlmock.Sqlmock, activity *models.Activity, recorded bool) {
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM lottery_draws").WithArgs(activity.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(recorded))
+}
+
+func TestDrawLottery_RecordsBeforeAssigning(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	s := NewQueueService(db, rdb)
+	activity := newLotteryActivity()
+	sessions := registerLottery(t, s, activity, "user-a", "user-b", "user-c")
+
+	// 稽核記錄寫入失敗時不分配序號，報名維持關閉
+	expectLotteryRecorded(mock, activity, false)
+	mock.ExpectBegin().WillReturnError(errors.New("connection refused"))
+	require.Error(t, s.drawLottery(ctx, activity))
+
+	for _, session := range sessions {
+		_, err := s.getExistingSeq(ctx, activity.TenantID, activity.ID, session)
+		assert.Error(t, err)
+	}
+	// 已保留但尚未分配的序號不會被釋放
+	rs := NewReleaseScheduler(nil, rdb)
+	queueSeq, err := rs.getReleasableQueueSeq(ctx, activity.TenantID, activity.ID, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), queueSeq)
+	code, err := s.registerEntrant(ctx, activity, &EnterQueueRequest{UserHash: "user-late"}, "late-session",
+		keys.LotteryEntriesKey(activity.TenantID, activity.ID), keys.LotteryDrawnKey(activity.TenantID, activity.ID), "", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(enterResultOpened), code)
+
+	// 重試時寫入成功才分配序號
+	expectLotteryRecorded(mock, activity, false)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO lottery_draws").WithArgs(activity.ID, sqlmock.AnyArg(), 3, 2).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	prepared := mock.ExpectPrepare("INSERT INTO lottery_results")
+	for seq := int64(1); seq <= 3; seq++ {
+		prepared.ExpectExec().WithArgs(activity.ID, seq, sqlmock.AnyArg(), sqlmock.AnyArg(), seq <= 2).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+	require.NoError(t, s.drawLottery(ctx, activity))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	seen := map[int64]bool{}
+	for _, session := range sessions {
+		seq, err := s.getExistingSeq(ctx, activity.TenantID, activity.ID, session)
+		require.NoError(t, err)
+		seen[seq] = true
+	}
+	assert.Equal(t, map[int64]bool{1: true, 2: true, 3: true}, seen)
+	queueSeq, err = rs.getReleasableQueueSeq(ctx, activity.TenantID, activity.ID, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), queueSeq)
+
+	exists, err := rdb.Exists(ctx, keys.LotteryEntriesKey(activity.TenantID, activity.ID)).Result()
+	require.NoError(t, err)
+	assert.Zero(t, exists)
+}
+
+func TestDrawLottery_ResumesFromRecordedResults(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	s := NewQueueService(db, rdb)
+	activity := newLotteryActivity()
+	sessions := registerLottery(t, s, activity, "user-a", "user-b", "user-c")
+
+	// 前一次開獎已保留區段並寫入結果，但分配前中斷；其中一人在開獎後取消登記
+	require.NoError(t, mr.Set(keys.LotteryDrawnKey(activity.TenantID, activity.ID), "0:3"))
+	require.NoError(t, mr.Set(keys.QueueSeqKey(activity.TenantID, activity.ID), "3"))
+	require.True(t, s.leaveRegistration(ctx, activity, keys.LotteryEntriesKey(activity.TenantID, activity.ID), sessions[0]))
+
+	expectLotteryRecorded(mock, activity, true)
+	mock.ExpectQuery("FROM lottery_results").WithArgs(activity.ID).WillReturnRows(
+		sqlmock.NewRows([]string{"position", "session_id", "user_hash"}).
+			AddRow(int64(1), sessions[2], "user-c").
+			AddRow(int64(2), sessions[0], "user-a").
+			AddRow(int64(3), sessions[1], "user-b"))
+	require.NoError(t, s.drawLottery(ctx, activity))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	seq, err := s.getExistingSeq(ctx, activity.TenantID, activity.ID, sessions[2])
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), seq)
+	seq, err = s.getExistingSeq(ctx, activity.TenantID, activity.ID, sessions[1])
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), seq)
+
+	// 取消登記的序號記為離開，後方的位置不受影響
+	abandoned, err := rdb.ZRange(ctx, keys.AbandonedKey(activity.TenantID, activity.ID), 0, -1).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, abandoned)
+}
+
+func TestLotteryState_RelativeToReservedBlock(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	s := NewQueueService(nil, rdb)
+	activity := newLotteryActivity()
+
+	// 報名前已有其他用戶取得序號，抽籤區段從 5 之後開始
+	require.NoError(t, mr.Set(keys.LotteryDrawnKey(activity.TenantID, activity.ID), "5:3"))
+	assert.Equal(t, StateWon, s.lotteryState(ctx, activity, 6))
+	assert.Equal(t, StateWon, s.lotteryState(ctx, activity, 7))
+	assert.Equal(t, StateLost, s.lotteryState(ctx, activity, 8))
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 暫停與恢復：暫停期間排程器不釋放、不回收逾時名額，等待者保留原本的序號，
+// 輪詢回傳 paused 狀態與較慢的輪詢間隔。恢復時從原本的 release_seq 繼續，
+// 待領取期限與心跳順延暫停的時長，暫停區間記錄在 PauseWindowsKey 供 ETA 扣除。
+
+// 暫停期間預設的輪詢間隔（毫秒）
+const defaultPausePollInterval = 10000
+
+const defaultPauseMessage = "The activity is paused. Your place in the queue is kept."
+
+// 暫停記錄保留時間
+const pauseStateTTL = 7 * 24 * time.Hour
+
+// 恢復時每批順延的成員數，避免單一腳本長時間阻塞 Redis
+const shiftBatchSize = 500
+
+// shiftScoresScript 將指定成員的分數加上 ARGV[1]；ARGV[2] > 0 時分數不超過 ARGV[2]。
+// 已不在 ZSET 中的成員略過
+var shiftScoresScript = redis.NewScript(`
+local cap = tonumber(ARGV[2])
+for i = 3, #ARGV do
+	local score = redis.call('ZSCORE', KEYS[1], ARGV[i])
+	if score then
+		score = tonumber(score) + tonumber(ARGV[1])
+		if cap > 0 and score > cap then
+			score = cap
+		end
+		redis.call('ZADD', KEYS[1], 'XX', score, ARGV[i])
+	end
+end
+return 0
+`)
+
+// shiftScores 分批順延 ZSET 中所有成員的分數：先以 ZSCAN 取得成員（ZSCAN 可能重複回傳，
+// 以 map 去重），再每 shiftBatchSize 個成員執行一次腳本
+func shiftScores(ctx context.Context, rdb *redis.Client, key string, offset, limit int64) error {
+	seen := make(map[string]struct{})
+	var members []interface{}
+	var cursor uint64
+	for {
+		// ZSCAN 回傳 member、score 交錯的清單
+		values, next, err := rdb.ZScan(ctx, key, cursor, "", shiftBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(values); i += 2 {
+			if _, ok := seen[values[i]]; !ok {
+				seen[values[i]] = struct{}{}
+				members = append(members, values[i])
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	for start := 0; start < len(members); start += shiftBatchSize {
+		batch := members[start:min(start+shiftBatchSize, len(members))]
+		args := append([]interface{}{offset, limit}, batch...)
+		if err := shiftScoresScript.Run(ctx, rdb, []string{key}, args...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markPaused 記錄暫停開始時間；重複暫停時保留第一次的時間
+func (s *AdminService) markPaused(ctx context.Context, activity *models.Activity) error {
+	return s.redis.SetNX(ctx, keys.PausedAtKey(activity.TenantID, activity.ID), time.Now().Unix(), pauseStateTTL).Err()
+}
+
+// markResumed 記錄暫停區間，並將待領取期限與心跳順延暫停的時長。
+// 離開 paused 的切換（恢復、排程或管理員切到 draining / ended）都要呼叫
+func markResumed(ctx context.Context, rdb *redis.Client, activity *models.Activity) error {
+	pausedAtKey := keys.PausedAtKey(activity.TenantID, activity.ID)
+	pausedAt, err := rdb.GetDel(ctx, pausedAtKey).Int64()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get pause start: %w", err)
+	}
+
+	now := time.Now().Unix()
+	paused := now - pausedAt
+	if paused <= 0 {
+		return nil
+	}
+
+	windowsKey := keys.PauseWindowsKey(activity.TenantID, activity.ID)
+	pipe := rdb.Pipeline()
+	pipe.ZAdd(ctx, windowsKey, &redis.Z{Score: float64(pausedAt), Member: fmt.Sprintf("%d:%d", pausedAt, now)})
+	pipe.Expire(ctx, windowsKey, pauseStateTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record pause window: %w", err)
+	}
+
+	for _, lane := range activity.Config.AllLanes() {
+		scope := laneScope(lane.Name)
+
+		if err := shiftScores(ctx, rdb,
+			keys.LaneKey(keys.ClaimPendingKey(activity.TenantID, activity.ID), scope), paused, 0); err != nil {
+			return fmt.Errorf("failed to extend claim deadlines: %w", err)
+		}
+
+		// 暫停中仍在輪詢的用戶心跳不晚於現在
+		if err := shiftScores(ctx, rdb,
+			keys.LaneKey(keys.HeartbeatKey(activity.TenantID, activity.ID), scope), paused, now); err != nil {
+			return fmt.Errorf("failed to extend heartbeats: %w", err)
+		}
+	}
+
+	log.Printf("Activity %d resumed after %ds pause", activity.ID, paused)
+	return nil
+}
+
+// onStatusChange 在狀態切換到 paused 或從 paused 恢復時更新暫停記錄
+func (s *AdminService) onStatusChange(ctx context.Context, activity *models.Activity, status models.ActivityStatus) {
+	var err error
+	switch {
+	case status == models.StatusPaused && activity.Status != models.StatusPaused:
+		err = s.markPaused(ctx, activity)
+	case status != models.StatusPaused && activity.Status == models.StatusPaused:
+		err = markResumed(ctx, s.redis, activity)
+	}
+	if err != nil {
+		log.Printf("Failed to update pause state for activity %d: %v", activity.ID, err)
+	}
+}
+
+// pausePollInterval 回傳暫停期間的輪詢間隔
+func pausePollInterval(activity *models.Activity) int {
+	if activity.Config.PausePollInterval > 0 {
+		return activity.Config.PausePollInterval
+	}
+	return defaultPausePollInterval
+}
+
+// pauseMessage 回傳暫停期間顯示給等待者的訊息
+func pauseMessage(activity *models.Activity) string {
+	if activity.Config.PauseMessage != "" {
+		return activity.Config.PauseMessage
+	}
+	return defaultPauseMessage
+}
+
+// applyPauseToEntry 讓暫停中進入或重新進入的用戶得知暫停狀態
+func applyPauseToEntry(activity *models.Activity, resp *EnterQueueResponse) {
+	if !activity.IsPaused() {
+		return
+	}
+	resp.State = StatePaused
+	resp.EstimatedWait = -1
+	resp.PollingInterval = pausePollInterval(activity)
+	resp.Message = pauseMessage(activity)
+}
+
+// pausedDurationSince 回傳 at 之後開始的暫停區間總時長，用於從釋放歷史中扣除暫停時間
+func pausedDurationSince(windows []string, at time.Time) time.Duration {
+	var total time.Duration
+	for _, window := range windows {
+		start, end, ok := strings.Cut(window, ":")
+		if !ok {
+			continue
+		}
+		startAt, err1 := strconv.ParseInt(start, 10, 64)
+		endAt, err2 := strconv.ParseInt(end, 10, 64)
+		if err1 != nil || err2 != nil || endAt <= startAt || startAt < at.Unix() {
+			continue
+		}
+		total += time.Duration(endAt-startAt) * time.Second
+	}
+	return total
+}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShiftScores_ShiftsEveryMemberOnce(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+
+	// 超過一批的成員，每個只順延一次
+	total := shiftBatchSize*2 + 7
+	for i := 0; i < total; i++ {
+		_, err := mr.ZAdd("claims", float64(1000+i), fmt.Sprint(i))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, shiftScores(ctx, rdb, "claims", 60, 0))
+	for _, i := range []int{0, shiftBatchSize, total - 1} {
+		score, err := mr.ZScore("claims", fmt.Sprint(i))
+		require.NoError(t, err)
+		assert.Equal(t, float64(1060+i), score)
+	}
+
+	// 有上限時分數不超過上限
+	require.NoError(t, shiftScores(ctx, rdb, "claims", 60, 1500))
+	score, err := mr.ZScore("claims", "0")
+	require.NoError(t, err)
+	assert.Equal(t, float64(1120), score)
+	score, err = mr.ZScore("claims", fmt.Sprint(total-1))
+	require.NoError(t, err)
+	assert.Equal(t, float64(1500), score)
+}
@@ -0,0 +1,556 @@
+package services
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 預排隊：開賣前 pre_queue_window_seconds 內進入的用戶先登記、不分配序號，
+// 登記時決定通道（entry token、名單）並抽出隨機數決定開賣後的順序。
+// 開賣後第一個進入或查詢狀態的請求（或 LifecycleWorker）關閉各通道的登記並保留一段序號，
+// 排在開賣後才進入的用戶之前；LifecycleWorker 再依順序分批分配，每次腳本只處理 assignChunkSize 人。
+// 區段分配完成前以 keys.AssignedSeqKey 記錄已分配的最大序號，釋放不會越過尚未分配的序號。
+// 重複呼叫是安全的。
+
+// 每次腳本分配序號的人數上限，避免單一腳本長時間阻塞 Redis
+const assignChunkSize = 500
+
+// preQueueEntry 為登記時保存的資料，分配序號時用來寫入 queue_entries
+type preQueueEntry struct {
+	UserHash    string `json:"user_hash"`
+	Fingerprint string `json:"fingerprint"`
+	IPHash      string `json:"ip_hash"`
+	IPHashKey   string `json:"ip_hash_key,omitempty"`
+	EnteredAt   int64  `json:"entered_at"`
+}
+
+// isPreQueueOpen 檢查目前是否在開賣前的預排隊時段
+func (s *QueueService) isPreQueueOpen(activity *models.Activity, now time.Time) bool {
+	window := time.Duration(activity.Config.PreQueueWindowSeconds) * time.Second
+	return window > 0 &&
+		!activity.Config.IsLotteryMode() &&
+		(activity.Status == models.StatusScheduled || activity.Status == models.StatusActive) &&
+		!now.Before(activity.StartAt.Add(-window)) &&
+		now.Before(activity.StartAt)
+}
+
+// registerEntrantScript 在單一往返內完成用戶去重與登記（預排隊、抽籤共用）。
+// 已分配序號後回傳 enterResultOpened，由呼叫端決定後續處理。
+// KEYS: 用戶去重、登記、已分配旗標、會話所屬用戶、順序（可省略）
+// ARGV: user_hash、session token、登記資料、TTL 秒數、順序分數
+var registerEntrantScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	return 3
+end
+
+if redis.call('SISMEMBER', KEYS[1], ARGV[1]) == 1 then
+	return 1
+end
+
+redis.call('SADD', KEYS[1], ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+redis.call('HSET', KEYS[2], ARGV[2], ARGV[3])
+redis.call('EXPIRE', KEYS[2], ARGV[4])
+redis.call('SET', KEYS[4], ARGV[1], 'EX', ARGV[4])
+if KEYS[5] then
+	redis.call('ZADD', KEYS[5], ARGV[5], ARGV[2])
+	redis.call('EXPIRE', KEYS[5], ARGV[4])
+end
+return 0
+`)
+
+// registerEntrant 以呼叫端發放的會話 token 登記尚未分配序號的用戶，回傳腳本結果碼；
+// orderKey 不為空時同時以隨機分數記錄分配順序
+func (s *QueueService) registerEntrant(ctx context.Context, activity *models.Activity, req *EnterQueueRequest, sessionID, entriesKey, assignedKey, orderKey string, ttl time.Duration) (int64, error) {
+	ipHash, ipHashKey := s.hashIP(req.IPAddress)
+	entry, err := json.Marshal(preQueueEntry{
+		UserHash:    req.UserHash,
+		Fingerprint: req.Fingerprint,
+		IPHash:      ipHash,
+		IPHashKey:   ipHashKey,
+		EnteredAt:   time.Now().Unix(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	scriptKeys := []string{
+		keys.UserDedupeKey(activity.TenantID, activity.ID),
+		entriesKey,
+		assignedKey,
+		keys.SessionUserKey(activity.TenantID, activity.ID, sessionID),
+	}
+	args := []interface{}{req.UserHash, sessionID, string(entry), int(ttl.Seconds())}
+	if orderKey != "" {
+		score, err := newShuffleSeed()
+		if err != nil {
+			return 0, err
+		}
+		scriptKeys = append(scriptKeys, orderKey)
+		args = append(args, score)
+	}
+
+	code, err := registerEntrantScript.Run(ctx, s.redis, scriptKeys, args...).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if code == enterResultOK {
+		s.recordRiskSignals(ctx, activity, req)
+	}
+
+	return code, nil
+}
+
+// enterPreQueue 在預排隊時段登記用戶；回傳 nil 表示已開放，應改走一般排隊
+func (s *QueueService) enterPreQueue(ctx context.Context, requestID string, activity *models.Activity, req *EnterQueueRequest) (*EnterQueueResponse, error) {
+	entriesKey := keys.PreQueueKey(activity.TenantID, activity.ID)
+
+	// 已登記的會話重新進入
+	if req.SessionID != "" && s.isRegistered(ctx, entriesKey, req.SessionID) {
+		return s.preQueueResponse(requestID, activity, req.SessionID), nil
+	}
+
+	// 與一般排隊相同，登記時即依 entry token 與名單決定通道，開賣後在該通道分配序號
+	lane, entryToken, err := s.resolveLane(ctx, activity, req)
+	if err != nil {
+		return nil, err
+	}
+
+	redemption, err := s.redeemAllowlist(ctx, activity, req)
+	if err != nil {
+		return nil, err
+	}
+	if redemption != nil {
+		lane, entryToken = allowlistLane(activity), nil
+	}
+
+	sessionID, err := newSessionToken(lane)
+	if err != nil {
+		if redemption != nil {
+			redemption.rollback()
+		}
+		return nil, fmt.Errorf("failed to generate session token: %w", err)
+	}
+
+	var allowlistEntryID int64
+	if redemption != nil {
+		if err := redemption.commit(ctx, sessionID, req.UserHash); err != nil {
+			return nil, err
+		}
+		allowlistEntryID = redemption.entryID
+	}
+
+	// 登記需保留到開賣後才會被分配序號
+	ttl := time.Until(activity.StartAt) + queueEntryTTL
+
+	code, err := s.registerEntrant(ctx, activity, req, sessionID, entriesKey,
+		keys.LaneKey(keys.PreQueueOpenedKey(activity.TenantID, activity.ID), lane),
+		keys.LaneKey(keys.PreQueueOrderKey(activity.TenantID, activity.ID), lane), ttl)
+	if allowlistEntryID > 0 && (err != nil || code != enterResultOK) {
+		s.releaseRedemption(ctx, allowlistEntryID, sessionID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to register pre-queue: %w", err)
+	}
+
+	switch code {
+	case enterResultDuplicate:
+		return nil, fmt.Errorf("user already in queue")
+	case enterResultOpened:
+		return nil, nil
+	}
+
+	s.markEntryTokenUsed(ctx, activity, entryToken)
+	s.updateMetrics(ctx, activity.TenantID, activity.ID, "pre_queue")
+	if allowlistEntryID > 0 {
+		s.updateMetrics(ctx, activity.TenantID, activity.ID, "allowlist_redeemed")
+	}
+
+	return s.preQueueResponse(requestID, activity, sessionID), nil
+}
+
+func (s *QueueService) preQueueResponse(requestID string, activity *models.Activity, sessionID string) *EnterQueueResponse {
+	opensAt := activity.StartAt
+	return &EnterQueueResponse{
+		RequestID:       requestID,
+		PollingInterval: s.pollUntil(activity, activity.StartAt),
+		SessionID:       sessionID,
+		State:           StatePreQueue,
+		OpensAt:         &opensAt,
+	}
+}
+
+// pollUntil 讓尚未分配序號的用戶在指定時間後才再次輪詢，並加上隨機抖動避免同時湧入
+func (s *QueueService) pollUntil(activity *models.Activity, at time.Time) int {
+	pollInterval := activity.Config.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = 2000
+	}
+
+	untilOpen := int(time.Until(at).Milliseconds())
+	if untilOpen < 0 {
+		untilOpen = 0
+	}
+
+	return untilOpen + rand.Intn(pollInterval)
+}
+
+func (s *QueueService) isRegistered(ctx context.Context, entriesKey, sessionID string) bool {
+	registered, err := s.redis.HExists(ctx, entriesKey, sessionID).Result()
+	return err == nil && registered
+}
+
+// assignedEntrant 為分配到序號的登記用戶
+type assignedEntrant struct {
+	SessionID string
+	Seq       int64
+	Entry     preQueueEntry
+}
+
+// recordAssigned 將分配到序號的登記資料寫入 queue_entries（非同步）；
+// 登記資料無法解析時只記錄錯誤，序號照常有效
+func (s *QueueService) recordAssigned(activity *models.Activity, token string, seq int64, raw string) (preQueueEntry, bool) {
+	var entry preQueueEntry
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		log.Printf("Failed to decode entry of session %s for activity %d: %v", token, activity.ID, err)
+		return entry, false
+	}
+
+	go s.recordQueueEntry(context.Background(), &models.QueueEntry{
+		ActivityID:  activity.ID,
+		UserHash:    entry.UserHash,
+		SessionID:   token,
+		SeqNumber:   seq,
+		Fingerprint: entry.Fingerprint,
+		IPHash:      entry.IPHash,
+		IPHashKey:   entry.IPHashKey,
+		CreatedAt:   time.Unix(entry.EnteredAt, 0),
+	})
+	return entry, true
+}
+
+// assignEntrantsScript 依呼叫端指定的序號為登記用戶分配序號，重複執行是安全的；
+// 登記已取消的序號記為離開，讓後方的位置保持正確，並推進已分配序號（區段分配中才存在）。
+// 回傳 {token, seq, 登記資料, ...}。
+// KEYS: 登記、會話 token、離開的序號、已分配序號
+// ARGV: 序號 TTL 秒數、用戶序號鍵前綴、token、seq...
+var assignEntrantsScript = redis.NewScript(`
+local result = {}
+for i = 3, #ARGV, 2 do
+	local token, seq = ARGV[i], tonumber(ARGV[i + 1])
+	local entry = redis.call('HGET', KEYS[1], token)
+	if entry then
+		redis.call('HDEL', KEYS[1], token)
+		redis.call('SET', ARGV[2] .. token, seq, 'EX', ARGV[1])
+		redis.call('HSET', KEYS[2], seq, token)
+		table.insert(result, token)
+		table.insert(result, seq)
+		table.insert(result, entry)
+	elseif redis.call('HGET', KEYS[2], seq) ~= token then
+		redis.call('ZADD', KEYS[3], seq, seq)
+	end
+end
+if #ARGV >= 4 then
+	redis.call('SET', KEYS[4], ARGV[#ARGV], 'XX', 'KEEPTTL')
+end
+return result
+`)
+
+// assignEntrants 依 entrants 的序號分批分配並寫入 queue_entries，完成後刪除登記與已分配序號。
+// entrants 依序佔用保留區段 base+1 起的序號，區段中其餘的序號記為離開
+func (s *QueueService) assignEntrants(ctx context.Context, activity *models.Activity, entriesKey string, entrants []assignedEntrant, base, count int64) error {
+	sessionTokenKey := keys.SessionTokenKey(activity.TenantID, activity.ID)
+	abandonedKey := keys.AbandonedKey(activity.TenantID, activity.ID)
+	assignedSeqKey := keys.AssignedSeqKey(activity.TenantID, activity.ID)
+
+	for start := 0; start < len(entrants); start += assignChunkSize {
+		chunk := entrants[start:min(start+assignChunkSize, len(entrants))]
+
+		args := make([]interface{}, 0, 2*len(chunk)+2)
+		args = append(args,
+			int(queueEntryTTL.Seconds()),
+			keys.UserQueueKey(activity.TenantID, activity.ID, ""),
+		)
+		for _, entrant := range chunk {
+			args = append(args, entrant.SessionID, entrant.Seq)
+		}
+
+		values, err := assignEntrantsScript.Run(ctx, s.redis,
+			[]string{entriesKey, sessionTokenKey, abandonedKey, assignedSeqKey},
+			args...,
+		).Slice()
+		if err != nil {
+			return err
+		}
+		s.recordAssignedValues(activity, values)
+	}
+
+	pipe := s.redis.TxPipeline()
+	for seq := base + int64(len(entrants)) + 1; seq <= base+count; seq++ {
+		pipe.ZAdd(ctx, abandonedKey, &redis.Z{Score: float64(seq), Member: seq})
+	}
+	pipe.Expire(ctx, abandonedKey, 24*time.Hour)
+	pipe.Expire(ctx, sessionTokenKey, queueEntryTTL)
+	pipe.Del(ctx, entriesKey, assignedSeqKey)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// recordAssignedValues 解析分配腳本回傳的 {token, seq, 登記資料, ...} 並寫入 queue_entries
+func (s *QueueService) recordAssignedValues(activity *models.Activity, values []interface{}) {
+	for i := 0; i+2 < len(values); i += 3 {
+		token, _ := values[i].(string)
+		seq, _ := values[i+1].(int64)
+		raw, _ := values[i+2].(string)
+		s.recordAssigned(activity, token, seq, raw)
+	}
+}
+
+// openPreQueueScript 關閉單一通道的預排隊登記並為登記者保留序號區段，只會生效一次；
+// 區段分配完成前已分配序號停在區段起點。
+// KEYS: 已開放旗標、順序、queue_seq、已分配序號
+// ARGV: 旗標 TTL 秒數
+var openPreQueueScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+
+local count = redis.call('ZCARD', KEYS[2])
+local base = redis.call('INCRBY', KEYS[3], count) - count
+redis.call('HSET', KEYS[1], 'base', base, 'assigned', 0)
+redis.call('EXPIRE', KEYS[1], ARGV[1])
+if count > 0 then
+	redis.call('SET', KEYS[4], base, 'EX', ARGV[1])
+end
+return 1
+`)
+
+// assignPreQueueScript 依順序為單一通道的下一批預排隊用戶分配保留區段中的序號；
+// 登記已取消的序號記為離開，並推進已分配序號，全部分配後刪除。
+// 回傳 {本批人數, token, seq, 登記資料, ...}；尚未開放時回傳 nil。
+// KEYS: 已開放旗標、順序、登記、會話 token、離開的序號、已分配序號
+// ARGV: 批次人數、序號 TTL 秒數、用戶序號鍵前綴
+var assignPreQueueScript = redis.NewScript(`
+local base = redis.call('HGET', KEYS[1], 'base')
+if not base then
+	return false
+end
+base = tonumber(base)
+local assigned = tonumber(redis.call('HGET', KEYS[1], 'assigned'))
+
+local popped = redis.call('ZPOPMIN', KEYS[2], ARGV[1])
+local result = {#popped / 2}
+for i = 1, #popped, 2 do
+	local token = popped[i]
+	assigned = assigned + 1
+	local seq = base + assigned
+	local entry = redis.call('HGET', KEYS[3], token)
+	if entry then
+		redis.call('HDEL', KEYS[3], token)
+		redis.call('SET', ARGV[3] .. token, seq, 'EX', ARGV[2])
+		redis.call('HSET', KEYS[4], seq, token)
+		table.insert(result, token)
+		table.insert(result, seq)
+		table.insert(result, entry)
+	else
+		redis.call('ZADD', KEYS[5], seq, seq)
+	end
+end
+
+redis.call('HSET', KEYS[1], 'assigned', assigned)
+if #popped > 0 then
+	redis.call('EXPIRE', KEYS[4], ARGV[2])
+	redis.call('EXPIRE', KEYS[5], 86400)
+end
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	redis.call('DEL', KEYS[6])
+else
+	redis.call('SET', KEYS[6], base + assigned, 'KEEPTTL')
+end
+return result
+`)
+
+// preQueueLanes 回傳預排隊登記可能進入的通道：各設定通道，以及名單用戶的通道
+func preQueueLanes(activity *models.Activity) []string {
+	lanes := make([]string, 0, len(activity.Config.Lanes)+2)
+	for _, lane := range activity.Config.AllLanes() {
+		lanes = append(lanes, laneScope(lane.Name))
+	}
+	if activity.Config.AllowlistMode == models.AllowlistModeAdmit {
+		lanes = append(lanes, allowlistAdmitLane)
+	}
+	return lanes
+}
+
+// hasPendingPreQueue 檢查是否仍有通道的預排隊用戶尚未分配序號
+func hasPendingPreQueue(ctx context.Context, rdb *redis.Client, activity *models.Activity) bool {
+	for _, lane := range preQueueLanes(activity) {
+		pending, err := rdb.Exists(ctx, keys.LaneKey(keys.PreQueueOrderKey(activity.TenantID, activity.ID), lane)).Result()
+		if err == nil && pending > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// openPreQueue 在開賣後關閉各通道的預排隊登記並保留序號區段；已開放過的通道直接略過。
+// 序號由 LifecycleWorker 呼叫 assignPreQueue 分批分配
+func (s *QueueService) openPreQueue(ctx context.Context, activity *models.Activity) {
+	if activity.Config.PreQueueWindowSeconds <= 0 || activity.Config.IsLotteryMode() {
+		return
+	}
+
+	for _, lane := range preQueueLanes(activity) {
+		openedKey := keys.LaneKey(keys.PreQueueOpenedKey(activity.TenantID, activity.ID), lane)
+		if opened, err := s.redis.Exists(ctx, openedKey).Result(); err != nil || opened > 0 {
+			continue
+		}
+
+		opened, err := openPreQueueScript.Run(ctx, s.redis,
+			[]string{
+				openedKey,
+				keys.LaneKey(keys.PreQueueOrderKey(activity.TenantID, activity.ID), lane),
+				keys.LaneKey(keys.QueueSeqKey(activity.TenantID, activity.ID), lane),
+				keys.LaneKey(keys.AssignedSeqKey(activity.TenantID, activity.ID), lane),
+			},
+			int((time.Until(activity.EndAt) + 24*time.Hour).Seconds()),
+		).Int64()
+		if err != nil {
+			log.Printf("Failed to open pre-queue for activity %d: %v", activity.ID, err)
+			continue
+		}
+
+		if opened == 1 {
+			log.Printf("Opened pre-queue for activity %d (lane %q)", activity.ID, laneName(lane))
+		}
+	}
+}
+
+// assignPreQueue 開放預排隊後，依各通道的登記順序每批 assignChunkSize 人分配序號直到全部分配完
+func (s *QueueService) assignPreQueue(ctx context.Context, activity *models.Activity) error {
+	s.openPreQueue(ctx, activity)
+
+	entriesKey := keys.PreQueueKey(activity.TenantID, activity.ID)
+	assigned := 0
+	for _, lane := range preQueueLanes(activity) {
+		count, err := s.assignPreQueueLane(ctx, activity, entriesKey, lane)
+		if err != nil {
+			return err
+		}
+		assigned += count
+	}
+
+	if err := s.redis.Del(ctx, entriesKey).Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Assigned pre-queue seqs for activity %d: %d users", activity.ID, assigned)
+	return nil
+}
+
+// assignPreQueueLane 分批分配單一通道保留區段中的序號，回傳分配的人數
+func (s *QueueService) assignPreQueueLane(ctx context.Context, activity *models.Activity, entriesKey, lane string) (int, error) {
+	scriptKeys := []string{
+		keys.LaneKey(keys.PreQueueOpenedKey(activity.TenantID, activity.ID), lane),
+		keys.LaneKey(keys.PreQueueOrderKey(activity.TenantID, activity.ID), lane),
+		entriesKey,
+		keys.LaneKey(keys.SessionTokenKey(activity.TenantID, activity.ID), lane),
+		keys.LaneKey(keys.AbandonedKey(activity.TenantID, activity.ID), lane),
+		keys.LaneKey(keys.AssignedSeqKey(activity.TenantID, activity.ID), lane),
+	}
+
+	assigned := 0
+	for {
+		values, err := assignPreQueueScript.Run(ctx, s.redis, scriptKeys,
+			assignChunkSize,
+			int(queueEntryTTL.Seconds()),
+			keys.UserQueueKey(activity.TenantID, activity.ID, ""),
+		).Slice()
+		if err == redis.Nil {
+			return assigned, fmt.Errorf("pre-queue is not open")
+		}
+		if err != nil {
+			return assigned, err
+		}
+
+		if len(values) == 0 {
+			return assigned, fmt.Errorf("unexpected pre-queue assign result")
+		}
+		s.recordAssignedValues(activity, values[1:])
+		assigned += len(values) / 3
+		if popped, _ := values[0].(int64); popped < assignChunkSize {
+			return assigned, nil
+		}
+	}
+}
+
+// resolvePreQueueSeq 回傳預排隊會話的序號；尚未開放時回傳 pre_queue 狀態
+func (s *QueueService) resolvePreQueueSeq(ctx context.Context, requestID string, activity *models.Activity, sessionID string) (int64, *QueueStatusResponse) {
+	if activity.Config.PreQueueWindowSeconds <= 0 {
+		return 0, nil
+	}
+
+	if !time.Now().Before(activity.StartAt) {
+		s.openPreQueue(ctx, activity)
+	}
+
+	if seq, err := s.getExistingSeq(ctx, activity.TenantID, activity.ID, sessionID); err == nil && seq > 0 {
+		return seq, nil
+	}
+
+	if !s.isRegistered(ctx, keys.PreQueueKey(activity.TenantID, activity.ID), sessionID) {
+		return 0, nil
+	}
+
+	opensAt := activity.StartAt
+	return 0, &QueueStatusResponse{
+		RequestID:  requestID,
+		State:      StatePreQueue,
+		NextPollMs: s.pollUntil(activity, activity.StartAt),
+		OpensAt:    &opensAt,
+	}
+}
+
+// leaveRegistration 取消尚未分配序號的登記
+func (s *QueueService) leaveRegistration(ctx context.Context, activity *models.Activity, entriesKey, sessionID string) bool {
+	removed, err := s.redis.HDel(ctx, entriesKey, sessionID).Result()
+	if err != nil || removed == 0 {
+		return false
+	}
+
+	sessionUserKey := keys.SessionUserKey(activity.TenantID, activity.ID, sessionID)
+	if userHash, err := s.redis.Get(ctx, sessionUserKey).Result(); err == nil {
+		s.redis.SRem(ctx, keys.UserDedupeKey(activity.TenantID, activity.ID), userHash)
+	}
+	s.redis.Del(ctx, sessionUserKey)
+	return true
+}
+
+// newShuffleSeed 以 crypto/rand 產生洗牌種子，避免開放順序可被預測
+func newShuffleSeed() (int64, error) {
+	var buf [8]byte
+	if _, err := crand.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(buf[:]) >> 1), nil
+}
+
+// seededShuffle 以指定種子做 Fisher-Yates 洗牌，相同種子與輸入得到相同結果
+func seededShuffle(items []string, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	for i := len(items) - 1; i > 0; i-- {
+		j := rng.Intn(i + 1)
+		items[i], items[j] = items[j], items[i]
+	}
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/admission"
+	"queue-system/pkg/keys"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPreQueueActivity() *models.Activity {
+	activity := newStreamActivity()
+	activity.StartAt = time.Now().Add(-time.Second)
+	activity.Config.PreQueueWindowSeconds = 600
+	return activity
+}
+
+func TestAssignPreQueue_AssignsInChunks(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	db, _, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	// queue_entries 為非同步寫入，不檢查
+	s := NewQueueService(db, rdb)
+	activity := newPreQueueActivity()
+
+	// 超過一批的登記者，順序分數即為預期序號
+	total := assignChunkSize + 3
+	entriesKey := keys.PreQueueKey(activity.TenantID, activity.ID)
+	orderKey := keys.PreQueueOrderKey(activity.TenantID, activity.ID)
+	for i := 1; i <= total; i++ {
+		token := fmt.Sprintf("session-%d", i)
+		mr.HSet(entriesKey, token, `{"user_hash":"user"}`)
+		_, err := mr.ZAdd(orderKey, float64(i), token)
+		require.NoError(t, err)
+	}
+	// 開賣前取消登記的用戶仍佔用序號，記為離開
+	mr.HDel(entriesKey, "session-2")
+
+	// 開放時保留區段，之後進入的用戶排在區段之後
+	s.openPreQueue(ctx, activity)
+	queueSeq, err := mr.Get(keys.QueueSeqKey(activity.TenantID, activity.ID))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(total), queueSeq)
+
+	require.NoError(t, s.assignPreQueue(ctx, activity))
+
+	for _, i := range []int{1, assignChunkSize, total} {
+		seq, err := s.getExistingSeq(ctx, activity.TenantID, activity.ID, fmt.Sprintf("session-%d", i))
+		require.NoError(t, err)
+		assert.Equal(t, int64(i), seq)
+	}
+	abandoned, err := rdb.ZRange(ctx, keys.AbandonedKey(activity.TenantID, activity.ID), 0, -1).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, abandoned)
+
+	assert.False(t, mr.Exists(entriesKey))
+	assert.False(t, mr.Exists(orderKey))
+
+	// 重複呼叫不會重新分配
+	require.NoError(t, s.assignPreQueue(ctx, activity))
+	seq, err := s.getExistingSeq(ctx, activity.TenantID, activity.ID, "session-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), seq)
+}
+
+func TestEnterPreQueue_ClosedAfterOpen(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	db, _, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	// queue_entries 為非同步寫入，不檢查
+	s := NewQueueService(db, rdb)
+	activity := newPreQueueActivity()
+	activity.StartAt = time.Now().Add(time.Minute)
+
+	resp, err := s.enterPreQueue(ctx, "req-1", activity, &EnterQueueRequest{UserHash: "user-a"})
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, StatePreQueue, resp.State)
+	sessionID := resp.SessionID
+
+	activity.StartAt = time.Now().Add(-time.Second)
+	s.openPreQueue(ctx, activity)
+
+	// 開放後不再登記，改走一般排隊
+	resp, err = s.enterPreQueue(ctx, "req-2", activity, &EnterQueueRequest{UserHash: "user-b"})
+	require.NoError(t, err)
+	assert.Nil(t, resp)
+
+	require.NoError(t, s.assignPreQueue(ctx, activity))
+	seq, err := s.getExistingSeq(ctx, activity.TenantID, activity.ID, sessionID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), seq)
+}
+
+func TestAssignPreQueue_HoldsReleaseUntilAssigned(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	db, _, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	// queue_entries 為非同步寫入，不檢查
+	s := NewQueueService(db, rdb)
+	rs := NewReleaseScheduler(nil, rdb)
+	activity := newPreQueueActivity()
+
+	entriesKey := keys.PreQueueKey(activity.TenantID, activity.ID)
+	orderKey := keys.PreQueueOrderKey(activity.TenantID, activity.ID)
+	for i := 1; i <= 3; i++ {
+		token := fmt.Sprintf("session-%d", i)
+		mr.HSet(entriesKey, token, `{"user_hash":"user"}`)
+		_, err := mr.ZAdd(orderKey, float64(i), token)
+		require.NoError(t, err)
+	}
+
+	// 保留區段後、分配前，開賣後進入的用戶已取得區段之後的序號，但尚未分配的序號不會被釋放
+	s.openPreQueue(ctx, activity)
+	_, err = rdb.Incr(ctx, keys.QueueSeqKey(activity.TenantID, activity.ID)).Result()
+	require.NoError(t, err)
+	queueSeq, err := rs.getReleasableQueueSeq(ctx, activity.TenantID, activity.ID, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), queueSeq)
+
+	// 全部分配後不再限制
+	require.NoError(t, s.assignPreQueue(ctx, activity))
+	assert.False(t, mr.Exists(keys.AssignedSeqKey(activity.TenantID, activity.ID)))
+	queueSeq, err = rs.getReleasableQueueSeq(ctx, activity.TenantID, activity.ID, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), queueSeq)
+}
+
+func TestEnterPreQueue_ResolvesLane(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	db, _, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	// queue_entries 為非同步寫入，不檢查
+	s := NewQueueService(db, rdb)
+	key := []byte("tenant1-entry-key-0123456789abcdef")
+	require.NoError(t, s.SetEntryTokenKeys(map[string][]byte{"tenant1": key}, 0))
+	signer, err := admission.NewSigner("tenant1", key, "", time.Minute)
+	require.NoError(t, err)
+
+	activity := newPreQueueActivity()
+	activity.StartAt = time.Now().Add(time.Minute)
+	activity.Config.Lanes = []models.LaneConfig{{Name: "vip", Weight: 3}}
+	token, _, err := signer.Issue(admission.Claims{TenantID: activity.TenantID, Lane: "vip", Subject: "user-a"})
+	require.NoError(t, err)
+
+	// 無效的 entry token 在登記時就拒絕
+	_, err = s.enterPreQueue(ctx, "req-1", activity, &EnterQueueRequest{UserHash: "user-b", EntryToken: token})
+	assert.EqualError(t, err, "invalid entry token")
+
+	vip, err := s.enterPreQueue(ctx, "req-2", activity, &EnterQueueRequest{UserHash: "user-a", EntryToken: token})
+	require.NoError(t, err)
+	require.NotNil(t, vip)
+	assert.Equal(t, "vip", laneOfSession(vip.SessionID))
+	general, err := s.enterPreQueue(ctx, "req-3", activity, &EnterQueueRequest{UserHash: "user-b"})
+	require.NoError(t, err)
+	require.NotNil(t, general)
+
+	// 登記後 token 記為已使用
+	_, _, err = s.resolveLane(ctx, activity, &EnterQueueRequest{UserHash: "user-a", EntryToken: token})
+	assert.EqualError(t, err, "invalid entry token")
+
+	// 開賣後各通道分別保留區段並分配序號
+	activity.StartAt = time.Now().Add(-time.Second)
+	require.NoError(t, s.assignPreQueue(ctx, activity))
+	for _, session := range []string{vip.SessionID, general.SessionID} {
+		seq, err := s.getExistingSeq(ctx, activity.TenantID, activity.ID, session)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), seq)
+	}
+	vipSeq, err := rdb.Get(ctx, keys.LaneKey(keys.QueueSeqKey(activity.TenantID, activity.ID), "vip")).Result()
+	require.NoError(t, err)
+	assert.Equal(t, "1", vipSeq)
+}
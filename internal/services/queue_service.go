@@ -2,16 +2,23 @@ package services
 
 import (
 	"context"
-	"crypto/sha256"
+	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
+	"sync"
 	"time"
 
 	"queue-system/internal/models"
+	"queue-system/pkg/admission"
+	"queue-system/pkg/iphash"
 	"queue-system/pkg/keys"
+	"queue-system/pkg/pow"
+	"queue-system/pkg/ratelimit"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
@@ -20,12 +27,28 @@ import (
 type QueueService struct {
 	db    *sql.DB
 	redis *redis.Client
+	// 各租戶的 entry token 驗證器與容許的時鐘誤差，由 SetEntryTokenKeys 設定
+	entryVerifiers map[string]*admission.Verifier
+	entryTokenSkew time.Duration
+	// 工作量證明挑戰的簽發與驗證，由 SetChallengeKey 設定
+	challengeIssuer *pow.Issuer
+	// 人機驗證服務，依活動的 captcha_provider 選用，由 RegisterAntiBot 設定
+	antiBots map[string]AntiBot
+	// 進入限流，規則依活動的 throttle_policies
+	limiter *ratelimit.Limiter
+	// IP 雜湊，由 SetIPHashKey 設定；未設定時不保存 IP 雜湊，也不套用依 IP 的限流
+	ipHasher *iphash.Hasher
+	// 隊列事件分派，供狀態串流使用，由 SetStatusBroker 設定
+	statusBroker *StatusBroker
+	// 各活動所有通道合計的等待人數，輪詢時共用，見 cachedWaitingCount
+	waitingCounts sync.Map
 }
 
 func NewQueueService(db *sql.DB, redis *redis.Client) *QueueService {
 	return &QueueService{
-		db:    db,
-		redis: redis,
+		db:      db,
+		redis:   redis,
+		limiter: ratelimit.NewLimiter(redis),
 	}
 }
 
@@ -33,7 +56,18 @@ type EnterQueueRequest struct {
 	ActivityID  int64  `json:"activity_id" binding:"required"`
 	UserHash    string `json:"user_hash" binding:"required"`
 	Fingerprint string `json:"fingerprint"`
-	IPAddress   string `json:"-"` // 從 header 取得，不從 body
+	// 先前進入時取得的會話 token，重新進入時帶上可沿用原序號
+	SessionID string `json:"session_id"`
+	// 商店簽發的 entry token，用來指定優先通道
+	EntryToken string `json:"entry_token"`
+	// 預售邀請碼
+	InviteCode string `json:"invite_code"`
+	// GET /queue/challenge 取得的挑戰與解答（活動啟用工作量證明時必填）
+	Challenge string `json:"challenge"`
+	Solution  string `json:"solution"`
+	// 人機驗證元件產生的 token（活動啟用 captcha_provider 時使用）
+	CaptchaToken string `json:"captcha_token"`
+	IPAddress    string `json:"-"` // 從 header 取得，不從 body
 }
 
 type EnterQueueResponse struct {
@@ -43,6 +77,18 @@ type EnterQueueResponse struct {
 	PollingInterval int    `json:"polling_interval"`
 	SessionID       string `json:"session_id"`
 	QueueLength     int64  `json:"queue_length"`
+	// 預排隊為 pre_queue、抽籤報名為 registered，此時尚未分配序號
+	State   QueueState `json:"state,omitempty"`
+	OpensAt *time.Time `json:"opens_at,omitempty"`
+	DrawAt  *time.Time `json:"draw_at,omitempty"`
+	Lane    string     `json:"lane,omitempty"`
+	// 隊列已滿時：waitlist 模式的候補位置；redirect 模式導向的活動
+	WaitlistPosition   int64 `json:"waitlist_position,omitempty"`
+	RedirectActivityID int64 `json:"redirect_activity_id,omitempty"`
+	// 活動暫停時顯示給用戶的訊息
+	Message string `json:"message,omitempty"`
+	// 限流結果，由 handler 寫入 RateLimit-* header；未啟用限流時為 nil
+	RateLimit *ratelimit.Result `json:"-"`
 }
 
 func (s *QueueService) EnterQueue(ctx context.Context, req *EnterQueueRequest) (*EnterQueueResponse, error) {
@@ -54,151 +100,653 @@ func (s *QueueService) EnterQueue(ctx context.Context, req *EnterQueueRequest) (
 		return nil, fmt.Errorf("activity not found: %w", err)
 	}
 
+	// 啟用限流時先檢查，被拒絕的請求不再做後續驗證
+	limit, err := s.checkThrottle(ctx, activity, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.enterActivity(ctx, requestID, activity, req, limit)
+	if resp != nil {
+		resp.RateLimit = limit
+	}
+	return resp, err
+}
+
+// enterActivity 在通過限流後處理進入請求
+func (s *QueueService) enterActivity(ctx context.Context, requestID string, activity *models.Activity, req *EnterQueueRequest, limit *ratelimit.Result) (*EnterQueueResponse, error) {
+	// 讀取風險訊號並評分，高風險用戶在分配序號後暫緩釋放
+	risk := s.assessEntry(ctx, activity, req)
+
+	// 啟用人機驗證時需帶上有效的 captcha token
+	if err := s.verifyCaptcha(ctx, activity, req, risk, limit); err != nil {
+		return nil, err
+	}
+
+	// 啟用工作量證明時需解出挑戰；挑戰驗證後即失效，放在人機驗證之後，
+	// 人機驗證失敗時原本的解答仍可重送
+	if err := s.verifyChallenge(ctx, activity, req); err != nil {
+		return nil, err
+	}
+
+	// 開賣前的預排隊時段只登記，不分配序號
+	if s.isPreQueueOpen(activity, time.Now()) {
+		resp, err := s.enterPreQueue(ctx, requestID, activity, req)
+		if err != nil || resp != nil {
+			return resp, err
+		}
+	}
+
+	// 排空中只服務已在隊列中的用戶
+	if activity.Status == models.StatusDraining {
+		return nil, fmt.Errorf("activity is draining")
+	}
+
 	if !s.isActivityActive(activity) {
 		return nil, fmt.Errorf("activity is not active")
 	}
 
+	if s.isSoldOut(ctx, activity) {
+		return nil, fmt.Errorf("activity sold out")
+	}
+
+	// 抽籤模式只在報名期間登記
+	if activity.Config.IsLotteryMode() {
+		return s.enterLottery(ctx, requestID, activity, req)
+	}
+
+	// 預排隊用戶先分配序號，開賣後才進入的用戶排在其後
+	s.openPreQueue(ctx, activity)
+
 	// 2. 檢查用戶是否已在隊列中
-	sessionID := s.generateSessionID(req.UserHash, req.ActivityID)
-	existingSeq, err := s.getExistingSeq(ctx, activity.TenantID, req.ActivityID, sessionID)
-	if err == nil && existingSeq > 0 {
-		// 用戶已在隊列中，返回現有序號
-		queueLength, _ := s.getQueueLength(ctx, activity.TenantID, req.ActivityID)
-		return &EnterQueueResponse{
-			RequestID:       requestID,
-			Seq:             existingSeq,
-			EstimatedWait:   s.calculateETA(existingSeq, activity),
-			PollingInterval: activity.Config.PollInterval,
-			SessionID:       sessionID,
-			QueueLength:     queueLength,
-		}, nil
-	}
-
-	// 3. IP 節流檢查
-	if err := s.checkIPThrottle(ctx, activity.TenantID, req.ActivityID, req.IPAddress); err != nil {
+	if req.SessionID != "" {
+		existingSeq, err := s.getExistingSeq(ctx, activity.TenantID, req.ActivityID, req.SessionID)
+		if err == nil && existingSeq > 0 {
+			// 用戶已在隊列中，返回現有序號
+			return s.existingEntryResponse(ctx, requestID, activity, req.SessionID, existingSeq), nil
+		}
+		// 預排隊用戶在分批分配完成前仍保留登記，稍後再輪詢取得序號
+		if activity.Config.PreQueueWindowSeconds > 0 && s.isRegistered(ctx, keys.PreQueueKey(activity.TenantID, activity.ID), req.SessionID) {
+			return s.preQueueResponse(requestID, activity, req.SessionID), nil
+		}
+	}
+
+	// 依 entry token 決定通道
+	lane, entryToken, err := s.resolveLane(ctx, activity, req)
+	if err != nil {
 		return nil, err
 	}
 
-	// 4. 用戶去重檢查（防止同一用戶多個分頁）
-	if err := s.checkUserDedupe(ctx, activity.TenantID, req.ActivityID, req.UserHash); err != nil {
+	// 名單內用戶或持有邀請碼者改走名單通道
+	redemption, err := s.redeemAllowlist(ctx, activity, req)
+	if err != nil {
 		return nil, err
 	}
+	if redemption != nil {
+		// 改走名單通道時不使用 entry token
+		lane, entryToken = allowlistLane(activity), nil
+	}
 
-	// 5. 分配序號並記錄
-	seq, err := s.assignSequenceNumber(ctx, activity.TenantID, req.ActivityID, sessionID)
+	sessionID, err := newSessionToken(lane)
+	if err != nil {
+		if redemption != nil {
+			redemption.rollback()
+		}
+		return nil, fmt.Errorf("failed to generate session token: %w", err)
+	}
+
+	// 核銷與核銷記錄一併提交後才分配序號
+	var allowlistEntryID int64
+	if redemption != nil {
+		if err := redemption.commit(ctx, sessionID, req.UserHash); err != nil {
+			return nil, err
+		}
+		allowlistEntryID = redemption.entryID
+	}
+
+	// 名單內用戶與 waitlist 模式不受隊列上限限制
+	var maxQueueSize int64
+	if allowlistEntryID == 0 && !activity.Config.IsWaitlistOverflow() {
+		maxQueueSize = int64(activity.Config.MaxQueueSize)
+	}
+
+	// 3. 用戶去重、隊列容量檢查與分配序號（單一 Lua 腳本，原子執行）
+	result, err := s.admitToQueue(ctx, activity, lane, sessionID, req, maxQueueSize)
+	if allowlistEntryID > 0 && (err != nil || result.Code != enterResultOK) {
+		s.releaseRedemption(ctx, allowlistEntryID, sessionID)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to assign sequence number: %w", err)
 	}
 
+	switch result.Code {
+	case enterResultDuplicate:
+		return nil, fmt.Errorf("user already in queue")
+	case enterResultFull:
+		if activity.Config.OverflowMode == models.OverflowModeRedirect && activity.Config.OverflowActivityID > 0 {
+			return &EnterQueueResponse{
+				RequestID:          requestID,
+				State:              StateRedirected,
+				RedirectActivityID: activity.Config.OverflowActivityID,
+			}, nil
+		}
+		return nil, fmt.Errorf("queue is full")
+	}
+
+	seq := result.Seq
+	s.markEntryTokenUsed(ctx, activity, entryToken)
+	s.touchHeartbeat(ctx, activity, lane, seq)
+	s.recordRiskSignals(ctx, activity, req)
+
+	// 名單內用戶不受風險處置
+	if allowlistEntryID > 0 {
+		risk = &RiskAssessment{Action: models.RiskActionAllow}
+	}
+	s.applyRisk(ctx, activity, lane, sessionID, seq, risk)
+
+	if allowlistEntryID > 0 {
+		s.updateMetrics(ctx, activity.TenantID, activity.ID, "allowlist_redeemed")
+	}
+
 	// 6. 記錄到資料庫（非同步）
+	ipHash, ipHashKey := s.hashIP(req.IPAddress)
 	go s.recordQueueEntry(context.Background(), &models.QueueEntry{
 		ActivityID:  req.ActivityID,
 		UserHash:    req.UserHash,
 		SessionID:   sessionID,
 		SeqNumber:   seq,
 		Fingerprint: req.Fingerprint,
-		IPHash:      s.hashIP(req.IPAddress),
+		IPHash:      ipHash,
+		IPHashKey:   ipHashKey,
 		CreatedAt:   time.Now(),
+		RiskScore:   risk.Score,
+		RiskReasons: risk.Reasons,
+		RiskAction:  risk.Action,
 	})
 
 	// 7. 更新統計
 	s.updateMetrics(ctx, activity.TenantID, req.ActivityID, "enter")
 
-	queueLength, _ := s.getQueueLength(ctx, activity.TenantID, req.ActivityID)
+	queueLength, _ := s.getQueueLength(ctx, activity.TenantID, req.ActivityID, lane)
+	position := s.positionOf(ctx, activity, lane, seq)
 
-	return &EnterQueueResponse{
+	resp := &EnterQueueResponse{
 		RequestID:       requestID,
 		Seq:             seq,
-		EstimatedWait:   s.calculateETA(seq, activity),
+		EstimatedWait:   s.calculateETA(position, activity, lane),
 		PollingInterval: activity.Config.PollInterval,
 		SessionID:       sessionID,
 		QueueLength:     queueLength,
-	}, nil
+		Lane:            s.laneDisplayName(activity, lane),
+	}
+	if risk.Action == models.RiskActionPenalize || risk.Action == models.RiskActionShadow {
+		resp.EstimatedWait = s.calculateETA(position+riskPenaltyPositions(activity), activity, lane)
+	}
+	if lane == allowlistAdmitLane {
+		// 由釋放排程器在下一次釋放時優先放行
+		resp.EstimatedWait = 0
+	} else if activity.Config.IsWaitlistOverflow() {
+		// 剛進入的用戶排在所有等待者之後，以所有通道合計的人數比較上限
+		waiting, err := s.countWaiting(ctx, activity)
+		if err == nil && waiting > int64(activity.Config.MaxQueueSize) {
+			resp.State = StateWaitlisted
+			resp.WaitlistPosition = waiting - int64(activity.Config.MaxQueueSize)
+		}
+	}
+	applyPauseToEntry(activity, resp)
+	return resp, nil
+}
+
+// existingEntryResponse 為已在隊列中的會話回傳現有序號
+func (s *QueueService) existingEntryResponse(ctx context.Context, requestID string, activity *models.Activity, sessionID string, seq int64) *EnterQueueResponse {
+	lane := laneOfSession(sessionID)
+	queueLength, _ := s.getQueueLength(ctx, activity.TenantID, activity.ID, lane)
+	resp := &EnterQueueResponse{
+		RequestID:       requestID,
+		Seq:             seq,
+		EstimatedWait:   s.calculateETA(s.positionOf(ctx, activity, lane, seq), activity, lane),
+		PollingInterval: activity.Config.PollInterval,
+		SessionID:       sessionID,
+		QueueLength:     queueLength,
+		Lane:            s.laneDisplayName(activity, lane),
+	}
+	applyPauseToEntry(activity, resp)
+	return resp
 }
 
 type QueueStatusRequest struct {
-	ActivityID int64  `form:"activity_id" binding:"required"`
-	Seq        int64  `form:"seq" binding:"required"`
-	SessionID  string `form:"session_id" binding:"required"`
+	ActivityID int64 `form:"activity_id" binding:"required"`
+	// 預排隊中尚未分配序號時可省略
+	Seq       int64  `form:"seq"`
+	SessionID string `form:"session_id" binding:"required"`
+	// 由狀態串流發出的查詢，不檢查輪詢節奏
+	Streaming bool `form:"-"`
 }
 
 type QueueStatusResponse struct {
-	RequestID   string      `json:"request_id"`
-	ReleaseSeq  int64       `json:"release_seq"`
-	QueueSeq    int64       `json:"queue_seq"`
-	Position    int64       `json:"position"`
-	ETA         int         `json:"eta"`
-	ETADetails  *ETAResult  `json:"eta_details,omitempty"`
-	State       QueueState  `json:"state"`
-	QueueLength int64       `json:"queue_length"`
-	NextPollMs  int         `json:"next_poll_ms"`
+	RequestID   string     `json:"request_id"`
+	Seq         int64      `json:"seq"`
+	ReleaseSeq  int64      `json:"release_seq"`
+	QueueSeq    int64      `json:"queue_seq"`
+	Position    int64      `json:"position"`
+	ETA         int        `json:"eta"`
+	ETADetails  *ETAResult `json:"eta_details,omitempty"`
+	State       QueueState `json:"state"`
+	QueueLength int64      `json:"queue_length"`
+	NextPollMs  int        `json:"next_poll_ms"`
+	// 需在此時間前換取 admission token（僅在設定領取期限時回傳）
+	ClaimExpiresAt *time.Time `json:"claim_expires_at,omitempty"`
+	// 預排隊中的開賣時間
+	OpensAt *time.Time `json:"opens_at,omitempty"`
+	// 抽籤報名中的開獎時間
+	DrawAt *time.Time `json:"draw_at,omitempty"`
+	// 所在通道；設定優先通道時 position、queue_length 皆以通道內計算
+	Lane string `json:"lane,omitempty"`
+	// 等待人數已達 max_queue_size，新用戶無法進入
+	QueueFull bool `json:"queue_full,omitempty"`
+	// waitlist 模式下超出上限的候補位置
+	WaitlistPosition int64 `json:"waitlist_position,omitempty"`
+	// 活動暫停時顯示給用戶的訊息
+	Message string `json:"message,omitempty"`
+	// 排空中的截止時間，之前未輪到的用戶會過期
+	DrainDeadline *time.Time `json:"drain_deadline,omitempty"`
 }
 
 type QueueState string
 
 const (
-	StateWaiting  QueueState = "waiting"
-	StateEligible QueueState = "eligible"
-	StateExpired  QueueState = "expired"
+	StatePreQueue   QueueState = "pre_queue"
+	StateRegistered QueueState = "registered" // 抽籤已報名，尚未開獎
+	StateWon        QueueState = "won"        // 中籤，等待輪到
+	StateLost       QueueState = "lost"       // 未中籤，候補中
+	StateWaiting    QueueState = "waiting"
+	StateEligible   QueueState = "eligible"
+	StateExpired    QueueState = "expired"
+	StateSoldOut    QueueState = "sold_out"
+	StateWaitlisted QueueState = "waitlisted" // 隊列已滿後進入，排在上限之外
+	StateRedirected QueueState = "redirected" // 隊列已滿，導向 overflow 活動
+	StatePaused     QueueState = "paused"     // 活動暫停，保留位置
 )
 
 func (s *QueueService) GetQueueStatus(ctx context.Context, req *QueueStatusRequest) (*QueueStatusResponse, error) {
-	requestID := uuid.New().String()
-
 	// 1. 驗證活動
 	activity, err := s.getActivity(ctx, req.ActivityID)
 	if err != nil {
 		return nil, fmt.Errorf("activity not found: %w", err)
 	}
 
-	// 2. 驗證用戶序號
-	userSeq, err := s.getExistingSeq(ctx, activity.TenantID, req.ActivityID, req.SessionID)
-	if err != nil || userSeq != req.Seq {
+	return s.buildQueueStatus(ctx, activity, req)
+}
+
+// buildQueueStatus 依已載入的活動計算用戶的隊列狀態
+func (s *QueueService) buildQueueStatus(ctx context.Context, activity *models.Activity, req *QueueStatusRequest) (*QueueStatusResponse, error) {
+	requestID := uuid.New().String()
+
+	// 預排隊、抽籤報名的用戶以會話 token 查詢，分配後取得序號
+	if req.Seq == 0 {
+		var seq int64
+		var pending *QueueStatusResponse
+		if activity.Config.IsLotteryMode() {
+			seq, pending = s.resolveLotterySeq(ctx, requestID, activity, req.SessionID)
+		} else {
+			seq, pending = s.resolvePreQueueSeq(ctx, requestID, activity, req.SessionID)
+		}
+		if pending != nil {
+			return pending, nil
+		}
+		if seq == 0 {
+			return nil, fmt.Errorf("invalid sequence number")
+		}
+		resolved := *req
+		resolved.Seq = seq
+		req = &resolved
+	}
+
+	// 2. 驗證會話 token 與序號相符（序號在所屬通道內）
+	lane := laneOfSession(req.SessionID)
+	if !s.validSessionToken(ctx, activity.TenantID, req.ActivityID, lane, req.Seq, req.SessionID) {
 		return nil, fmt.Errorf("invalid sequence number")
 	}
 
-	// 3. 獲取當前釋放序號
-	releaseSeq, err := s.getReleaseSeq(ctx, activity.TenantID, req.ActivityID)
+	progress, err := s.loadProgress(ctx, activity, lane, req.Seq)
+	if err != nil {
+		return nil, err
+	}
+	return s.statusFromProgress(ctx, requestID, activity, req, lane, progress, true), nil
+}
+
+// queueProgress 是計算單一會話狀態所需的隊列進度；輪詢時逐項查詢，
+// 狀態串流則由同一實例共用的活動快照推導（見 queueSnapshot）
+type queueProgress struct {
+	releaseSeq     int64
+	queueSeq       int64
+	abandonedAhead int64 // seq 前方已離開的人數
+	queueLength    int64 // 通道內仍在等待的人數
+	waiting        int64 // 所有通道合計的等待人數，未設定 max_queue_size 時為 0
+	holdDue        float64
+	held           bool // 風險暫緩中，holdDue 為暫緩目標
+	soldOut        bool
+	queueFull      bool
+}
+
+// loadProgress 查詢單一會話所需的隊列進度
+func (s *QueueService) loadProgress(ctx context.Context, activity *models.Activity, lane string, seq int64) (*queueProgress, error) {
+	// 獲取當前釋放序號
+	releaseSeq, err := s.getReleaseSeq(ctx, activity.TenantID, activity.ID, lane)
 	if err != nil {
 		releaseSeq = 0 // 預設值
 	}
 
-	// 4. 獲取隊列總長度
-	queueSeq, err := s.getCurrentQueueSeq(ctx, activity.TenantID, req.ActivityID)
+	// 獲取隊列總長度
+	queueSeq, err := s.getCurrentQueueSeq(ctx, activity.TenantID, activity.ID, lane)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get queue length: %w", err)
 	}
 
-	// 5. 計算位置和狀態
+	p := &queueProgress{
+		releaseSeq:  releaseSeq,
+		queueSeq:    queueSeq,
+		queueLength: queueSeq - releaseSeq - s.countAbandoned(ctx, activity.TenantID, activity.ID, lane, releaseSeq, queueSeq+1),
+		soldOut:     s.isSoldOut(ctx, activity),
+	}
+	if limit := activity.Config.MaxQueueSize; limit > 0 {
+		// 查詢失敗時視為未滿
+		p.waiting, _ = s.cachedWaitingCount(ctx, activity)
+		p.queueFull = p.waiting >= int64(limit)
+	}
+	if seq > releaseSeq {
+		p.abandonedAhead = s.countAbandoned(ctx, activity.TenantID, activity.ID, lane, releaseSeq, seq)
+	}
+	p.holdDue, p.held = s.riskHold(ctx, activity, lane, seq)
+	return p, nil
+}
+
+// statusFromProgress 依隊列進度計算會話狀態；touch 為 false 時不更新在線心跳，
+// 供事件觸發的串流更新使用，心跳由串流的定期更新負責
+func (s *QueueService) statusFromProgress(ctx context.Context, requestID string, activity *models.Activity, req *QueueStatusRequest, lane string, p *queueProgress, touch bool) *QueueStatusResponse {
+	releaseSeq := p.releaseSeq
+
+	// 計算位置和狀態（扣除前方已離開的用戶）
 	position := req.Seq - releaseSeq
+	if position > 0 {
+		position -= p.abandonedAhead
+	}
 	var state QueueState
 	var nextPollMs int
 
+	var claimExpiresAt *time.Time
+	var waitlistPosition int64
+	var message string
+
+	// 風險暫緩中的用戶依暫緩目標顯示位置，回應與一般等待者相同
+	if p.held {
+		position = heldPosition(req.Seq, releaseSeq, p.holdDue, riskPenaltyPositions(activity))
+	}
+	eta := s.calculateETA(position, activity, lane)
+
 	if position <= 0 {
 		state = StateEligible
 		nextPollMs = 0 // 立即可以請求 reservation
+
+		// 逾時未領取的名額已被回收
+		if activity.Config.ClaimTimeoutSeconds > 0 {
+			expired, deadline := s.getClaimState(ctx, activity.TenantID, req.ActivityID, lane, req.Seq)
+			if expired {
+				state = StateExpired
+				nextPollMs = activity.Config.PollInterval
+			}
+			claimExpiresAt = deadline
+		}
+
+		// 輪到時已離線，名額已讓給後方用戶
+		if activity.Config.HeartbeatGraceSeconds > 0 && s.isInactive(ctx, activity, lane, req.Seq) {
+			state = StateExpired
+			nextPollMs = activity.Config.PollInterval
+			claimExpiresAt = nil
+		}
 	} else {
 		state = StateWaiting
 		nextPollMs = activity.Config.PollInterval
+
+		// 輪詢同時作為心跳，並檢查輪詢節奏
+		if touch {
+			s.touchHeartbeat(ctx, activity, lane, req.Seq)
+		}
+		if !req.Streaming {
+			s.trackPollCadence(ctx, activity, lane, req.SessionID, req.Seq)
+		}
+
+		// 售完後仍在等待的用戶不會再被釋放
+		if p.soldOut {
+			state = StateSoldOut
+		} else if activity.IsPaused() {
+			// 暫停中不釋放，ETA 無法估計，放慢輪詢
+			state = StatePaused
+			nextPollMs = pausePollInterval(activity)
+			message = pauseMessage(activity)
+			eta = -1
+		} else if activity.Config.IsLotteryMode() {
+			state = s.lotteryState(ctx, activity, req.Seq)
+		} else if activity.Config.IsWaitlistOverflow() {
+			// 上限為所有通道合計：前方人數以其他通道的等待者加上本通道的位置計算
+			ahead := p.waiting - p.queueLength + position
+			if ahead > int64(activity.Config.MaxQueueSize) {
+				state = StateWaitlisted
+				waitlistPosition = ahead - int64(activity.Config.MaxQueueSize)
+			}
+		}
 	}
 
-	// 6. 檢查是否過期（活動結束）
-	if time.Now().After(activity.EndAt) {
+	// 檢查是否過期：end_at 後的排空期內仍照常釋放已在隊列中的用戶，
+	// 排空期截止或活動已結束時，尚未輪到的用戶才過期
+	now := time.Now()
+	ended := activity.Status == models.StatusEnded || activity.Status == models.StatusArchived
+	var drainDeadline *time.Time
+	if now.After(activity.DrainDeadline()) || (position > 0 && ended) {
 		state = StateExpired
+	} else if now.After(activity.EndAt) || activity.Status == models.StatusDraining {
+		deadline := activity.DrainDeadline()
+		drainDeadline = &deadline
 	}
 
 	return &QueueStatusResponse{
-		RequestID:   requestID,
-		ReleaseSeq:  releaseSeq,
-		QueueSeq:    queueSeq,
-		Position:    max(0, position),
-		ETA:         s.calculateETA(req.Seq, activity),
-		State:       state,
-		QueueLength: queueSeq - releaseSeq,
-		NextPollMs:  nextPollMs,
+		RequestID:        requestID,
+		Seq:              req.Seq,
+		ReleaseSeq:       releaseSeq,
+		QueueSeq:         p.queueSeq,
+		Position:         max(0, position),
+		ETA:              eta,
+		State:            state,
+		QueueLength:      p.queueLength,
+		NextPollMs:       nextPollMs,
+		ClaimExpiresAt:   claimExpiresAt,
+		Lane:             s.laneDisplayName(activity, lane),
+		QueueFull:        p.queueFull,
+		WaitlistPosition: waitlistPosition,
+		Message:          message,
+		DrainDeadline:    drainDeadline,
+	}
+}
+
+// 等待人數快取的有效時間；輪詢只用來顯示 queue_full 與 waitlist 位置，容許短暫落差
+const waitingCountTTL = time.Second
+
+type waitingCountEntry struct {
+	count    int64
+	loadedAt time.Time
+}
+
+// cachedWaitingCount 回傳所有通道合計的等待人數，同一實例在 waitingCountTTL 內共用一次查詢
+func (s *QueueService) cachedWaitingCount(ctx context.Context, activity *models.Activity) (int64, error) {
+	if v, ok := s.waitingCounts.Load(activity.ID); ok {
+		if entry := v.(waitingCountEntry); time.Since(entry.loadedAt) < waitingCountTTL {
+			return entry.count, nil
+		}
+	}
+
+	count, err := s.countWaiting(ctx, activity)
+	if err != nil {
+		return 0, err
+	}
+	s.waitingCounts.Store(activity.ID, waitingCountEntry{count: count, loadedAt: time.Now()})
+	return count, nil
+}
+
+// waitingCountScript 計算多個通道合計的等待人數，只扣除尚未越過的已離開序號。
+// KEYS: 依序為各通道的 queue_seq、release_seq、已離開集合
+var waitingCountScript = redis.NewScript(`
+local waiting = 0
+for i = 1, #KEYS, 3 do
+	local queueSeq = tonumber(redis.call('GET', KEYS[i]) or '0')
+	local releaseSeq = tonumber(redis.call('GET', KEYS[i + 1]) or '0')
+	waiting = waiting + queueSeq - releaseSeq - redis.call('ZCOUNT', KEYS[i + 2], '(' .. releaseSeq, queueSeq)
+end
+return waiting
+`)
+
+// countWaiting 查詢所有通道合計的等待人數，與進入時的容量檢查及串流快照的計算方式相同
+func (s *QueueService) countWaiting(ctx context.Context, activity *models.Activity) (int64, error) {
+	lanes := activity.Config.AllLanes()
+	scriptKeys := make([]string, 0, 3*len(lanes))
+	for _, lane := range lanes {
+		scope := laneScope(lane.Name)
+		scriptKeys = append(scriptKeys,
+			keys.LaneKey(keys.QueueSeqKey(activity.TenantID, activity.ID), scope),
+			keys.LaneKey(keys.ReleaseSeqKey(activity.TenantID, activity.ID), scope),
+			keys.LaneKey(keys.AbandonedKey(activity.TenantID, activity.ID), scope))
+	}
+	return waitingCountScript.Run(ctx, s.redis, scriptKeys).Int64()
+}
+
+type LeaveQueueRequest struct {
+	ActivityID int64  `form:"activity_id" binding:"required"`
+	SessionID  string `form:"session_id" binding:"required"`
+}
+
+type LeaveQueueResponse struct {
+	RequestID string `json:"request_id"`
+	Seq       int64  `json:"seq"`
+	Released  bool   `json:"released"` // 離開前是否已輪到
+}
+
+func (s *QueueService) LeaveQueue(ctx context.Context, req *LeaveQueueRequest) (*LeaveQueueResponse, error) {
+	requestID := uuid.New().String()
+
+	// 1. 驗證活動與會話
+	activity, err := s.getActivity(ctx, req.ActivityID)
+	if err != nil {
+		return nil, fmt.Errorf("activity not found: %w", err)
+	}
+
+	seq, err := s.getExistingSeq(ctx, activity.TenantID, req.ActivityID, req.SessionID)
+	if err != nil {
+		// 尚未分配序號的預排隊或抽籤報名，直接取消登記
+		entriesKey := keys.PreQueueKey(activity.TenantID, req.ActivityID)
+		if activity.Config.IsLotteryMode() {
+			entriesKey = keys.LotteryEntriesKey(activity.TenantID, req.ActivityID)
+		}
+		if s.leaveRegistration(ctx, activity, entriesKey, req.SessionID) {
+			s.updateMetrics(ctx, activity.TenantID, req.ActivityID, "abandon")
+			return &LeaveQueueResponse{RequestID: requestID}, nil
+		}
+		return nil, fmt.Errorf("session not in queue")
+	}
+
+	lane := laneOfSession(req.SessionID)
+	releaseSeq, err := s.getReleaseSeq(ctx, activity.TenantID, req.ActivityID, lane)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get release seq: %w", err)
+	}
+
+	// 2. 標記離開：尚未輪到的讓排程器跳過，已輪到的交還名額；風險暫緩中的 seq 未佔用名額
+	held := s.removeRiskHold(ctx, activity, lane, seq)
+	released := seq <= releaseSeq && !held
+	if released {
+		s.returnAdmission(ctx, activity, lane, seq)
+	} else if seq > releaseSeq {
+		abandonedKey := keys.LaneKey(keys.AbandonedKey(activity.TenantID, req.ActivityID), lane)
+		s.redis.ZAdd(ctx, abandonedKey, &redis.Z{Score: float64(seq), Member: seq})
+		s.redis.Expire(ctx, abandonedKey, 24*time.Hour)
+		s.redis.ZRem(ctx, keys.LaneKey(keys.HeartbeatKey(activity.TenantID, req.ActivityID), lane), seq)
+	}
+
+	// 3. 移除會話與去重記錄，讓用戶之後可以重新排隊
+	sessionUserKey := keys.SessionUserKey(activity.TenantID, req.ActivityID, req.SessionID)
+	if userHash, err := s.redis.Get(ctx, sessionUserKey).Result(); err == nil {
+		s.redis.SRem(ctx, keys.UserDedupeKey(activity.TenantID, req.ActivityID), userHash)
+	}
+	s.redis.Del(ctx, keys.UserQueueKey(activity.TenantID, req.ActivityID, req.SessionID), sessionUserKey)
+	s.redis.HDel(ctx, keys.LaneKey(keys.SessionTokenKey(activity.TenantID, req.ActivityID), lane), strconv.FormatInt(seq, 10))
+
+	// 4. 記錄離開
+	go s.recordAbandonment(context.Background(), req.ActivityID, req.SessionID)
+	s.updateMetrics(ctx, activity.TenantID, req.ActivityID, "abandon")
+
+	return &LeaveQueueResponse{
+		RequestID: requestID,
+		Seq:       seq,
+		Released:  released,
 	}, nil
 }
 
+// returnAdmission 交還已輪到用戶的名額
+func (s *QueueService) returnAdmission(ctx context.Context, activity *models.Activity, lane string, seq int64) {
+	if activity.Config.IsConcurrencyMode() {
+		if _, err := NewLeasePool(s.redis).Release(ctx, activity.TenantID, activity.ID, lane, seq); err != nil {
+			log.Printf("Failed to release lease for activity %d, seq %d: %v", activity.ID, seq, err)
+		}
+		return
+	}
+
+	// rate 模式下，尚未領取的名額退回釋放配額
+	if activity.Config.ClaimTimeoutSeconds > 0 {
+		removed, err := s.redis.ZRem(ctx, keys.LaneKey(keys.ClaimPendingKey(activity.TenantID, activity.ID), lane), strconv.FormatInt(seq, 10)).Result()
+		if err == nil && removed > 0 {
+			creditKey := keys.ReleaseCreditKey(activity.TenantID, activity.ID)
+			s.redis.Incr(ctx, creditKey)
+			s.redis.Expire(ctx, creditKey, 24*time.Hour)
+		}
+	}
+}
+
+// touchHeartbeat 記錄等待中用戶的最後輪詢時間
+func (s *QueueService) touchHeartbeat(ctx context.Context, activity *models.Activity, lane string, seq int64) {
+	if activity.Config.HeartbeatGraceSeconds <= 0 {
+		return
+	}
+
+	key := keys.LaneKey(keys.HeartbeatKey(activity.TenantID, activity.ID), lane)
+	pipe := s.redis.Pipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(time.Now().Unix()), Member: seq})
+	pipe.Expire(ctx, key, 24*time.Hour)
+	pipe.Exec(ctx)
+}
+
+// isInactive 檢查 seq 是否因離線被釋放流程跳過
+func (s *QueueService) isInactive(ctx context.Context, activity *models.Activity, lane string, seq int64) bool {
+	inactive, err := s.redis.SIsMember(ctx, keys.LaneKey(keys.InactiveKey(activity.TenantID, activity.ID), lane), seq).Result()
+	return err == nil && inactive
+}
+
+// countAbandoned 回傳 (fromSeq, toSeq) 之間已離開的人數
+func (s *QueueService) countAbandoned(ctx context.Context, tenantID string, activityID int64, lane string, fromSeq, toSeq int64) int64 {
+	count, err := s.redis.ZCount(ctx, keys.LaneKey(keys.AbandonedKey(tenantID, activityID), lane),
+		"("+strconv.FormatInt(fromSeq, 10), "("+strconv.FormatInt(toSeq, 10)).Result()
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+func (s *QueueService) recordAbandonment(ctx context.Context, activityID int64, sessionID string) {
+	query := `
+        UPDATE queue_entries
+        SET abandoned_at = NOW()
+        WHERE activity_id = $1 AND session_id = $2 AND abandoned_at IS NULL`
+
+	s.db.ExecContext(ctx, query, activityID, sessionID)
+}
+
 // 輔助方法
 func (s *QueueService) getActivity(ctx context.Context, activityID int64) (*models.Activity, error) {
 	query := `
@@ -222,15 +770,38 @@ func (s *QueueService) getActivity(ctx context.Context, activityID int64) (*mode
 
 func (s *QueueService) isActivityActive(activity *models.Activity) bool {
 	now := time.Now()
-	return activity.Status == models.StatusActive &&
+	// 暫停中仍可進入隊列，只是不會被釋放；
+	// 已排程的活動在 start_at 後、生命週期切換前即可進入
+	return (activity.Status == models.StatusActive || activity.IsPaused() || activity.Status == models.StatusScheduled) &&
 		now.After(activity.StartAt) &&
 		now.Before(activity.EndAt)
 }
 
-func (s *QueueService) generateSessionID(userHash string, activityID int64) string {
-	data := fmt.Sprintf("%s:%d:%d", userHash, activityID, time.Now().Unix()/3600) // 每小時更新
-	hash := sha256.Sum256([]byte(data))
-	return hex.EncodeToString(hash[:])[:16] // 取前16個字符
+func (s *QueueService) isSoldOut(ctx context.Context, activity *models.Activity) bool {
+	remaining, err := NewInventory(s.redis).Remaining(ctx, activity.TenantID, activity.ID, activity.InitialStock)
+	return err == nil && remaining <= 0
+}
+
+// newSessionToken 產生隨機、不可預測的會話 token，進入隊列時發放一次；
+// 非預設通道的 token 以通道名稱為前綴
+func newSessionToken(lane string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	if lane != "" {
+		return lane + "." + hex.EncodeToString(buf), nil
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// validSessionToken 以常數時間比對 seq 對應的會話 token
+func (s *QueueService) validSessionToken(ctx context.Context, tenantID string, activityID int64, lane string, seq int64, sessionID string) bool {
+	stored, err := s.redis.HGet(ctx, keys.LaneKey(keys.SessionTokenKey(tenantID, activityID), lane), strconv.FormatInt(seq, 10)).Result()
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(sessionID)) == 1
 }
 
 func (s *QueueService) getExistingSeq(ctx context.Context, tenantID string, activityID int64, sessionID string) (int64, error) {
@@ -243,81 +814,150 @@ func (s *QueueService) getExistingSeq(ctx context.Context, tenantID string, acti
 	return strconv.ParseInt(result.Val(), 10, 64)
 }
 
-func (s *QueueService) assignSequenceNumber(ctx context.Context, tenantID string, activityID int64, sessionID string) (int64, error) {
-	// 使用 Redis 事務確保原子性
-	pipe := s.redis.TxPipeline()
-
-	// 增加隊列序號
-	queueSeqKey := keys.QueueSeqKey(tenantID, activityID)
-	incrCmd := pipe.Incr(ctx, queueSeqKey)
+// EnterQueue 腳本的結果碼
+const (
+	enterResultOK        = 0
+	enterResultDuplicate = 1
+	enterResultFull      = 2
+	enterResultOpened    = 3 // 預排隊已開放
+)
 
-	// 設定用戶序號，TTL 4小時
-	userQueueKey := keys.UserQueueKey(tenantID, activityID, sessionID)
+// 用戶序號與去重記錄的 TTL
+const queueEntryTTL = 4 * time.Hour
+
+// enterQueueScript 在單一往返內完成用戶去重、容量檢查與分配序號，
+// 避免兩個分頁同時通過去重檢查。回傳 {結果碼, seq}。
+// KEYS: 用戶去重、queue_seq、release_seq、已離開集合、用戶序號、會話所屬用戶、活躍用戶、會話 token，
+// 之後為其他通道的 queue_seq、release_seq、已離開集合（僅在檢查容量時）
+// ARGV: user_hash、session token、TTL 秒數、隊列容量上限（0 不限）
+var enterQueueScript = redis.NewScript(`
+if redis.call('SISMEMBER', KEYS[1], ARGV[1]) == 1 then
+	return {1, 0}
+end
+
+local function backlog(queueKey, releaseKey, abandonedKey)
+	local queueSeq = tonumber(redis.call('GET', queueKey) or '0')
+	local releaseSeq = tonumber(redis.call('GET', releaseKey) or '0')
+	return queueSeq - releaseSeq - redis.call('ZCOUNT', abandonedKey, '(' .. releaseSeq, queueSeq)
+end
+
+local maxSize = tonumber(ARGV[4])
+if maxSize > 0 then
+	-- KEYS[9] 起依序為其他通道的 queue_seq、release_seq、abandoned
+	local waiting = backlog(KEYS[2], KEYS[3], KEYS[4])
+	for i = 9, #KEYS, 3 do
+		waiting = waiting + backlog(KEYS[i], KEYS[i + 1], KEYS[i + 2])
+	end
+	if waiting >= maxSize then
+		return {2, 0}
+	end
+end
+
+redis.call('SADD', KEYS[1], ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+local seq = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[5], seq, 'EX', ARGV[3])
+redis.call('SET', KEYS[6], ARGV[1], 'EX', ARGV[3])
+redis.call('PFADD', KEYS[7], ARGV[2])
+redis.call('HSET', KEYS[8], seq, ARGV[2])
+redis.call('EXPIRE', KEYS[8], ARGV[3])
+return {0, seq}
+`)
+
+type enterResult struct {
+	Code int64
+	Seq  int64
+}
 
-	_, err := pipe.Exec(ctx)
-	if err != nil {
-		return 0, err
+// admitToQueue 執行 enterQueueScript，序號在指定通道內分配；maxQueueSize 為 0 表示不限制隊列長度
+func (s *QueueService) admitToQueue(ctx context.Context, activity *models.Activity, lane string, sessionID string, req *EnterQueueRequest, maxQueueSize int64) (*enterResult, error) {
+	tenantID, activityID := activity.TenantID, activity.ID
+
+	scriptKeys := []string{
+		keys.UserDedupeKey(tenantID, activityID),
+		keys.LaneKey(keys.QueueSeqKey(tenantID, activityID), lane),
+		keys.LaneKey(keys.ReleaseSeqKey(tenantID, activityID), lane),
+		keys.LaneKey(keys.AbandonedKey(tenantID, activityID), lane),
+		keys.UserQueueKey(tenantID, activityID, sessionID),
+		keys.SessionUserKey(tenantID, activityID, sessionID),
+		keys.ActiveUsersKey(tenantID, activityID),
+		keys.LaneKey(keys.SessionTokenKey(tenantID, activityID), lane),
 	}
 
-	seq := incrCmd.Val()
-
-	// 設定用戶序號和 TTL
-	s.redis.Set(ctx, userQueueKey, seq, 4*time.Hour)
+	// 隊列上限以所有通道合計，附上其他通道的 key
+	if maxQueueSize > 0 {
+		for _, other := range activity.Config.AllLanes() {
+			scope := laneScope(other.Name)
+			if scope == lane {
+				continue
+			}
+			scriptKeys = append(scriptKeys,
+				keys.LaneKey(keys.QueueSeqKey(tenantID, activityID), scope),
+				keys.LaneKey(keys.ReleaseSeqKey(tenantID, activityID), scope),
+				keys.LaneKey(keys.AbandonedKey(tenantID, activityID), scope),
+			)
+		}
+	}
 
-	// 更新活躍用戶統計
-	activeUsersKey := keys.ActiveUsersKey(tenantID, activityID)
-	s.redis.PFAdd(ctx, activeUsersKey, sessionID)
+	values, err := enterQueueScript.Run(ctx, s.redis, scriptKeys,
+		req.UserHash, sessionID, int(queueEntryTTL.Seconds()), maxQueueSize,
+	).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 2 {
+		return nil, fmt.Errorf("unexpected enter queue result: %v", values)
+	}
 
-	return seq, nil
+	return &enterResult{Code: values[0], Seq: values[1]}, nil
 }
 
-func (s *QueueService) checkIPThrottle(ctx context.Context, tenantID string, activityID int64, ipAddress string) error {
-	if ipAddress == "" {
-		return nil // 跳過檢查
-	}
+// getClaimState 回傳 seq 是否已逾時未領取，以及尚未領取時的領取期限
+func (s *QueueService) getClaimState(ctx context.Context, tenantID string, activityID int64, lane string, seq int64) (bool, *time.Time) {
+	member := strconv.FormatInt(seq, 10)
 
-	ipHash := s.hashIP(ipAddress)
-	key := keys.IPThrottleKey(tenantID, activityID, ipHash)
+	pipe := s.redis.Pipeline()
+	expiredCmd := pipe.SIsMember(ctx, keys.LaneKey(keys.ClaimExpiredKey(tenantID, activityID), lane), member)
+	deadlineCmd := pipe.ZScore(ctx, keys.LaneKey(keys.ClaimPendingKey(tenantID, activityID), lane), member)
+	pipe.Exec(ctx)
 
-	// 使用滑動窗口限制：60秒內最多10次請求
-	count, err := s.redis.Incr(ctx, key).Result()
-	if err != nil {
-		return fmt.Errorf("throttle check failed: %w", err)
+	if expiredCmd.Val() {
+		return true, nil
 	}
-
-	if count == 1 {
-		s.redis.Expire(ctx, key, 60*time.Second)
+	if deadlineCmd.Err() != nil {
+		return false, nil
 	}
 
-	if count > 10 {
-		return fmt.Errorf("rate limit exceeded")
-	}
-
-	return nil
+	deadline := time.Unix(int64(deadlineCmd.Val()), 0)
+	return false, &deadline
 }
 
-func (s *QueueService) checkUserDedupe(ctx context.Context, tenantID string, activityID int64, userHash string) error {
-	key := keys.UserDedupeKey(tenantID, activityID)
+// claimAdmission 將 seq 從待領取中移除；已被回收時回傳錯誤
+func (s *QueueService) claimAdmission(ctx context.Context, tenantID string, activityID int64, lane string, seq int64) error {
+	member := strconv.FormatInt(seq, 10)
 
-	// 檢查用戶是否已存在
-	exists, err := s.redis.SIsMember(ctx, key, userHash).Result()
+	removed, err := s.redis.ZRem(ctx, keys.LaneKey(keys.ClaimPendingKey(tenantID, activityID), lane), member).Result()
 	if err != nil {
-		return fmt.Errorf("dedupe check failed: %w", err)
+		return fmt.Errorf("failed to claim admission: %w", err)
 	}
-
-	if exists {
-		return fmt.Errorf("user already in queue")
+	if removed > 0 {
+		return nil
 	}
 
-	// 添加用戶到去重集合，TTL 4小時
-	s.redis.SAdd(ctx, key, userHash)
-	s.redis.Expire(ctx, key, 4*time.Hour)
+	// 不在待領取中：可能已領取過，或剛被排程器回收
+	expired, err := s.redis.SIsMember(ctx, keys.LaneKey(keys.ClaimExpiredKey(tenantID, activityID), lane), member).Result()
+	if err != nil {
+		return fmt.Errorf("failed to claim admission: %w", err)
+	}
+	if expired {
+		return fmt.Errorf("not eligible for admission: claim window expired")
+	}
 
 	return nil
 }
 
-func (s *QueueService) getReleaseSeq(ctx context.Context, tenantID string, activityID int64) (int64, error) {
-	key := keys.ReleaseSeqKey(tenantID, activityID)
+func (s *QueueService) getReleaseSeq(ctx context.Context, tenantID string, activityID int64, lane string) (int64, error) {
+	key := keys.LaneKey(keys.ReleaseSeqKey(tenantID, activityID), lane)
 	result := s.redis.Get(ctx, key)
 	if result.Err() == redis.Nil {
 		return 0, nil // 預設值
@@ -329,8 +969,8 @@ func (s *QueueService) getReleaseSeq(ctx context.Context, tenantID string, activ
 	return strconv.ParseInt(result.Val(), 10, 64)
 }
 
-func (s *QueueService) getCurrentQueueSeq(ctx context.Context, tenantID string, activityID int64) (int64, error) {
-	key := keys.QueueSeqKey(tenantID, activityID)
+func (s *QueueService) getCurrentQueueSeq(ctx context.Context, tenantID string, activityID int64, lane string) (int64, error) {
+	key := keys.LaneKey(keys.QueueSeqKey(tenantID, activityID), lane)
 	result := s.redis.Get(ctx, key)
 	if result.Err() == redis.Nil {
 		return 0, nil
@@ -342,13 +982,13 @@ func (s *QueueService) getCurrentQueueSeq(ctx context.Context, tenantID string,
 	return strconv.ParseInt(result.Val(), 10, 64)
 }
 
-func (s *QueueService) getQueueLength(ctx context.Context, tenantID string, activityID int64) (int64, error) {
-	queueSeq, err := s.getCurrentQueueSeq(ctx, tenantID, activityID)
+func (s *QueueService) getQueueLength(ctx context.Context, tenantID string, activityID int64, lane string) (int64, error) {
+	queueSeq, err := s.getCurrentQueueSeq(ctx, tenantID, activityID, lane)
 	if err != nil {
 		return 0, err
 	}
 
-	releaseSeq, err := s.getReleaseSeq(ctx, tenantID, activityID)
+	releaseSeq, err := s.getReleaseSeq(ctx, tenantID, activityID, lane)
 	if err != nil {
 		return 0, err
 	}
@@ -356,29 +996,140 @@ func (s *QueueService) getQueueLength(ctx context.Context, tenantID string, acti
 	return max(0, queueSeq-releaseSeq), nil
 }
 
-func (s *QueueService) calculateETA(userSeq int64, activity *models.Activity) int {
-	if activity.Config.ReleaseRate <= 0 {
+// calculateETA 依前方仍在等待的人數估計等待秒數。position 已扣除離開的用戶，
+// 逾時回收的 seq 在 release_seq 之前，不影響位置；回收退回的配額會在下一次釋放額外放行，
+// 估計不計入，因此有回收時實際等待可能略短
+func (s *QueueService) calculateETA(position int64, activity *models.Activity, lane string) int {
+	rate := laneReleaseRate(activity, lane)
+	if rate <= 0 {
 		return -1 // 未知
 	}
+	if position <= 0 {
+		return 0
+	}
+
+	return int(float64(position) / rate)
+}
+
+// positionOf 回傳 seq 在通道內的位置，扣除前方已離開的用戶
+func (s *QueueService) positionOf(ctx context.Context, activity *models.Activity, lane string, seq int64) int64 {
+	releaseSeq, err := s.getReleaseSeq(ctx, activity.TenantID, activity.ID, lane)
+	if err != nil || seq <= releaseSeq {
+		return 0
+	}
+	return seq - releaseSeq - s.countAbandoned(ctx, activity.TenantID, activity.ID, lane, releaseSeq, seq)
+}
+
+// SetIPHashKey 設定 IP 雜湊的 secret 與輪替週期；secrets 的第一把為目前的 secret，
+// 其餘為更換前的舊 secret。多個實例需設定相同的 secret，限流計數才會合併
+func (s *QueueService) SetIPHashKey(secrets []iphash.Secret, rotation, grace time.Duration) error {
+	if len(secrets) == 0 || len(secrets[0].Key) == 0 {
+		return fmt.Errorf("ip hash secret is required")
+	}
 
-	// 簡化計算：假設當前 release_seq = 0
-	return int(userSeq / int64(activity.Config.ReleaseRate))
+	hasher, err := iphash.New(secrets, rotation, grace)
+	if err != nil {
+		return fmt.Errorf("failed to create ip hasher: %w", err)
+	}
+	s.ipHasher = hasher
+	return nil
 }
 
-func (s *QueueService) hashIP(ip string) string {
-	hash := sha256.Sum256([]byte(ip + "salt")) // 實際應用中使用配置的 salt
-	return hex.EncodeToString(hash[:])[:16]
+// 每批重新雜湊的舊記錄數
+const ipHashBackfillBatch = 1000
+
+// BackfillIPHashes 將升級前以固定鹽值計算、可被窮舉還原的 ip_hash 以目前的 secret 重新雜湊。
+// 原始 IP 未保存，同一 IP 的舊雜湊仍對應到相同的新值。回傳更新的筆數
+func (s *QueueService) BackfillIPHashes(ctx context.Context) (int64, error) {
+	var total int64
+	for {
+		rows, err := s.db.QueryContext(ctx, `
+            SELECT id, ip_hash
+            FROM queue_entries
+            WHERE ip_hash IS NOT NULL AND ip_hash_key IS NULL
+            ORDER BY id
+            LIMIT $1`, ipHashBackfillBatch)
+		if err != nil {
+			return total, err
+		}
+
+		legacy := make(map[int64]string)
+		for rows.Next() {
+			var id int64
+			var hash string
+			if err := rows.Scan(&id, &hash); err != nil {
+				rows.Close()
+				return total, err
+			}
+			legacy[id] = hash
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+		if len(legacy) == 0 {
+			return total, nil
+		}
+
+		updated, err := s.rehashIPs(ctx, legacy)
+		total += updated
+		if err != nil {
+			return total, err
+		}
+		if len(legacy) < ipHashBackfillBatch {
+			return total, nil
+		}
+	}
+}
+
+// rehashIPs 在同一個交易內更新一批舊雜湊；其他實例已更新的記錄略過
+func (s *QueueService) rehashIPs(ctx context.Context, legacy map[int64]string) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+        UPDATE queue_entries
+        SET ip_hash = $1, ip_hash_key = $2
+        WHERE id = $3 AND ip_hash_key IS NULL`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var updated int64
+	for id, hash := range legacy {
+		rehashed, keyID := s.ipHasher.Rehash(hash)
+		result, err := stmt.ExecContext(ctx, rehashed, keyID, id)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := result.RowsAffected()
+		updated += n
+	}
+
+	return updated, tx.Commit()
+}
+
+// hashIP 回傳 IP 以目前金鑰計算的雜湊與金鑰 ID
+func (s *QueueService) hashIP(ip string) (string, string) {
+	return s.ipHasher.Hash(ip, time.Now())
 }
 
 func (s *QueueService) recordQueueEntry(ctx context.Context, entry *models.QueueEntry) {
 	query := `
-        INSERT INTO queue_entries (activity_id, user_hash, session_id, seq_number, fingerprint, ip_hash, created_at)
-        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        INSERT INTO queue_entries (activity_id, user_hash, session_id, seq_number, fingerprint, ip_hash, ip_hash_key,
+                                   created_at, risk_score, risk_reasons, risk_action)
+        VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8, $9, $10, $11)
         ON CONFLICT (activity_id, session_id) DO NOTHING`
 
+	reasons, _ := json.Marshal(entry.RiskReasons)
 	s.db.ExecContext(ctx, query,
 		entry.ActivityID, entry.UserHash, entry.SessionID,
-		entry.SeqNumber, entry.Fingerprint, entry.IPHash, entry.CreatedAt)
+		entry.SeqNumber, entry.Fingerprint, entry.IPHash, entry.IPHashKey,
+		entry.CreatedAt, entry.RiskScore, reasons, entry.RiskAction)
 }
 
 func (s *QueueService) updateMetrics(ctx context.Context, tenantID string, activityID int64, action string) {
@@ -408,9 +1159,13 @@ func (s *QueueService) GetQueueStatusWithETA(ctx context.Context, req *QueueStat
 		return nil, fmt.Errorf("failed to get activity: %w", err)
 	}
 
-	// 計算 ETA
+	// 計算 ETA；以回應中的位置換算，風險暫緩中的用戶與顯示的位置一致
+	etaSeq := req.Seq
+	if resp.Position > 0 {
+		etaSeq = resp.ReleaseSeq + resp.Position
+	}
 	etaCalc := NewETACalculator(s.redis)
-	eta, err := etaCalc.CalculateETA(ctx, activity, req.Seq)
+	eta, err := etaCalc.CalculateETA(ctx, activity, etaSeq)
 	if err != nil {
 		log.Printf("Failed to calculate ETA for activity %d, seq %d: %v", req.ActivityID, req.Seq, err)
 		// 使用基本 ETA 作為回退
@@ -423,8 +1178,10 @@ func (s *QueueService) GetQueueStatusWithETA(ctx context.Context, req *QueueStat
 		}
 	}
 
-	// 添加 ETA 資訊到回應
-	resp.ETADetails = eta
+	// 添加 ETA 資訊到回應（暫停中無法估計）
+	if resp.State != StatePaused {
+		resp.ETADetails = eta
+	}
 
 	return resp, nil
 }
@@ -1,9 +1,21 @@
 package services
 
 import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
 	"testing"
+	"time"
 
+	"queue-system/internal/models"
+	"queue-system/pkg/admission"
+	"queue-system/pkg/iphash"
+	"queue-system/pkg/keys"
+
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestQueueService_GenerateSessionID(t *testing.T) {
@@ -29,6 +41,390 @@ func TestQueueService_HashIP(t *testing.T) {
 	assert.Len(t, hash, 16)
 }
 
+func TestSeededShuffle_Reproducible(t *testing.T) {
+	items := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+	first := append([]string(nil), items...)
+	second := append([]string(nil), items...)
+	seededShuffle(first, 42)
+	seededShuffle(second, 42)
+
+	// 相同種子得到相同順序，且不遺漏任何項目
+	assert.Equal(t, first, second)
+	assert.ElementsMatch(t, items, first)
+}
+
+func TestSplitReleaseBudget(t *testing.T) {
+	lanes := []models.LaneConfig{
+		{Name: "vip", Weight: 3, Priority: 1},
+		{Name: "general", Weight: 1, Priority: 2},
+	}
+
+	// 依權重分配
+	got := splitReleaseBudget(8, lanes, map[string]int64{"vip": 100, "general": 100}, models.LanePolicyWeighted)
+	assert.Equal(t, int64(6), got["vip"])
+	assert.Equal(t, int64(2), got["general"])
+
+	// 通道排空後，剩餘名額分給其他通道
+	got = splitReleaseBudget(8, lanes, map[string]int64{"vip": 1, "general": 100}, models.LanePolicyWeighted)
+	assert.Equal(t, int64(1), got["vip"])
+	assert.Equal(t, int64(7), got["general"])
+
+	// 名額少於通道數時優先給權重高的通道
+	got = splitReleaseBudget(1, lanes, map[string]int64{"vip": 5, "general": 5}, models.LanePolicyWeighted)
+	assert.Equal(t, int64(1), got["vip"])
+	assert.Equal(t, int64(0), got["general"])
+
+	// strict：前面的通道排空才輪到後面的通道
+	got = splitReleaseBudget(8, lanes, map[string]int64{"vip": 5, "general": 100}, models.LanePolicyStrict)
+	assert.Equal(t, int64(5), got["vip"])
+	assert.Equal(t, int64(3), got["general"])
+}
+
+func TestResolveLane_SingleUseBoundToSubject(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	ctx := context.Background()
+	s := NewQueueService(nil, rdb)
+	key := []byte("tenant1-entry-key-0123456789abcdef")
+	require.NoError(t, s.SetEntryTokenKeys(map[string][]byte{"tenant1": key}, 0))
+	signer, err := admission.NewSigner("tenant1", key, "", time.Minute)
+	require.NoError(t, err)
+
+	activity := newStreamActivity()
+	activity.Config.Lanes = []models.LaneConfig{{Name: "vip", Weight: 3}}
+	issue := func(claims admission.Claims) string {
+		claims.TenantID = activity.TenantID
+		claims.Lane = "vip"
+		token, _, err := signer.Issue(claims)
+		require.NoError(t, err)
+		return token
+	}
+
+	// 未綁定 user_hash 的 token 不接受
+	_, _, err = s.resolveLane(ctx, activity, &EnterQueueRequest{UserHash: "user-a", EntryToken: issue(admission.Claims{})})
+	assert.EqualError(t, err, "invalid entry token")
+
+	// 其他用戶不能使用
+	token := issue(admission.Claims{Subject: "user-a"})
+	_, _, err = s.resolveLane(ctx, activity, &EnterQueueRequest{UserHash: "user-b", EntryToken: token})
+	assert.EqualError(t, err, "invalid entry token")
+
+	// 檢查通過但尚未取得序號前不會用掉 token
+	lane, claims, err := s.resolveLane(ctx, activity, &EnterQueueRequest{UserHash: "user-a", EntryToken: token})
+	require.NoError(t, err)
+	assert.Equal(t, "vip", lane)
+	require.NotNil(t, claims)
+	_, _, err = s.resolveLane(ctx, activity, &EnterQueueRequest{UserHash: "user-a", EntryToken: token})
+	require.NoError(t, err)
+
+	// 同一個 token 只能使用一次
+	s.markEntryTokenUsed(ctx, activity, claims)
+	_, _, err = s.resolveLane(ctx, activity, &EnterQueueRequest{UserHash: "user-a", EntryToken: token})
+	assert.EqualError(t, err, "invalid entry token")
+}
+
+func TestEnterActivity_EntryTokenSurvivesFailedEntry(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	db, _, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	// queue_entries 為非同步寫入，不檢查
+	s := NewQueueService(db, rdb)
+	key := []byte("tenant1-entry-key-0123456789abcdef")
+	require.NoError(t, s.SetEntryTokenKeys(map[string][]byte{"tenant1": key}, 0))
+	signer, err := admission.NewSigner("tenant1", key, "", time.Minute)
+	require.NoError(t, err)
+
+	activity := newStreamActivity()
+	activity.Config.Lanes = []models.LaneConfig{{Name: "vip", Weight: 3}}
+	token, _, err := signer.Issue(admission.Claims{TenantID: activity.TenantID, Lane: "vip", Subject: "user-a"})
+	require.NoError(t, err)
+	req := &EnterQueueRequest{ActivityID: activity.ID, UserHash: "user-a", EntryToken: token}
+
+	// 隊列已滿時進入失敗，token 仍可重試
+	seedQueue(t, mr, activity, 10, 0, nil)
+	_, err = s.enterActivity(ctx, "req-1", activity, req, nil)
+	assert.EqualError(t, err, "queue is full")
+
+	seedQueue(t, mr, activity, 10, 10, nil)
+	resp, err := s.enterActivity(ctx, "req-2", activity, req, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "vip", resp.Lane)
+
+	// 取得序號後 token 記為已使用
+	_, err = s.enterActivity(ctx, "req-3", activity, req, nil)
+	assert.EqualError(t, err, "invalid entry token")
+}
+
+func TestValidateActivityConfig_LaneNames(t *testing.T) {
+	for _, name := range []string{"", "vip.gold", "vip:gold", "vip gold", strings.Repeat("a", maxLaneNameLength+1)} {
+		err := validateActivityConfig(models.ActivityConfig{Lanes: []models.LaneConfig{{Name: name}}})
+		assert.ErrorContains(t, err, "invalid config", "lane %q", name)
+	}
+
+	err := validateActivityConfig(models.ActivityConfig{Lanes: []models.LaneConfig{{Name: "vip"}, {Name: "vip"}}})
+	assert.ErrorContains(t, err, "duplicate lane name")
+
+	assert.NoError(t, validateActivityConfig(models.ActivityConfig{Lanes: []models.LaneConfig{{Name: "vip-1"}, {Name: "member_2"}}}))
+}
+
+func TestCalculateETA_UsesLaneShare(t *testing.T) {
+	s := &QueueService{}
+	activity := newStreamActivity()
+	assert.Equal(t, 10, s.calculateETA(100, activity, ""))
+
+	// weighted：vip 分到 3/4 的釋放名額，general 分到 1/4
+	activity.Config.Lanes = []models.LaneConfig{{Name: "vip", Weight: 3}}
+	assert.Equal(t, 13, s.calculateETA(100, activity, "vip"))
+	assert.Equal(t, 40, s.calculateETA(100, activity, ""))
+
+	// strict：輪到時取得全部名額
+	activity.Config.LanePolicy = models.LanePolicyStrict
+	assert.Equal(t, 10, s.calculateETA(100, activity, ""))
+}
+
+func TestQueueStatus_ETACountsOnlyWaitingAhead(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	s := NewQueueService(nil, rdb)
+	activity := newStreamActivity()
+	activity.Config.ReleaseRate = 1
+
+	// 已釋放 5 個，其中 4、5 逾時被回收；前方的 7、9 已離開
+	seedQueue(t, mr, activity, 20, 5, nil)
+	_, err := mr.SAdd(keys.ClaimExpiredKey(activity.TenantID, activity.ID), "4", "5")
+	require.NoError(t, err)
+	for _, seq := range []float64{7, 9} {
+		_, err := mr.ZAdd(keys.AbandonedKey(activity.TenantID, activity.ID), seq, fmt.Sprint(seq))
+		require.NoError(t, err)
+	}
+
+	p, err := s.loadProgress(ctx, activity, "", 12)
+	require.NoError(t, err)
+	resp := s.statusFromProgress(ctx, "req", activity, &QueueStatusRequest{ActivityID: activity.ID, Seq: 12}, "", p, false)
+	assert.Equal(t, int64(5), resp.Position)
+	assert.Equal(t, 5, resp.ETA)
+	assert.Equal(t, int64(5), s.positionOf(ctx, activity, "", 12))
+
+	// 已輪到的用戶不需等待
+	p, err = s.loadProgress(ctx, activity, "", 3)
+	require.NoError(t, err)
+	resp = s.statusFromProgress(ctx, "req", activity, &QueueStatusRequest{ActivityID: activity.ID, Seq: 3}, "", p, false)
+	assert.Zero(t, resp.ETA)
+}
+
+func TestIsSHA256Hex(t *testing.T) {
+	assert.True(t, isSHA256Hex(hashAllowlistValue("user_123")))
+	assert.False(t, isSHA256Hex("user_123"))
+	assert.False(t, isSHA256Hex(hashAllowlistValue("user_123")[:63]+"z"))
+}
+
+func TestPausedDurationSince(t *testing.T) {
+	windows := []string{"1000:1060", "2000:2030", "invalid"}
+
+	assert.Equal(t, 90*time.Second, pausedDurationSince(windows, time.Unix(900, 0)))
+	assert.Equal(t, 30*time.Second, pausedDurationSince(windows, time.Unix(1500, 0)))
+	assert.Equal(t, time.Duration(0), pausedDurationSince(windows, time.Unix(2500, 0)))
+}
+
+func TestCanTransition(t *testing.T) {
+	assert.True(t, canTransition(models.StatusDraft, models.StatusScheduled))
+	assert.True(t, canTransition(models.StatusActive, models.StatusPaused))
+	assert.True(t, canTransition(models.StatusPaused, models.StatusActive))
+	assert.True(t, canTransition(models.StatusDraining, models.StatusEnded))
+	assert.False(t, canTransition(models.StatusDraft, models.StatusActive))
+	assert.False(t, canTransition(models.StatusEnded, models.StatusActive))
+	assert.False(t, canTransition(models.StatusArchived, models.StatusDraft))
+	assert.False(t, canTransition(models.StatusActive, "unknown"))
+}
+
+func TestPowDifficulty(t *testing.T) {
+	config := models.ActivityConfig{PowDifficulty: 16, PowTargetRate: 100}
+
+	assert.Equal(t, 16, powDifficulty(config, 0))
+	assert.Equal(t, 16, powDifficulty(config, 150))
+	assert.Equal(t, 17, powDifficulty(config, 200))
+	assert.Equal(t, 19, powDifficulty(config, 800))
+	assert.Equal(t, 24, powDifficulty(config, 1e9))
+
+	config.PowMaxDifficulty = 18
+	assert.Equal(t, 18, powDifficulty(config, 800))
+
+	config.PowTargetRate = 0
+	assert.Equal(t, 16, powDifficulty(config, 1e9))
+}
+
+func TestScoreRisk(t *testing.T) {
+	thresholds := activityRiskThresholds(models.ActivityConfig{})
+	score, reasons := scoreRisk(thresholds, RiskSignals{FingerprintUsers: 1, SubnetEntries: 5})
+	assert.Equal(t, 0, score)
+	assert.Empty(t, reasons)
+
+	score, reasons = scoreRisk(thresholds, RiskSignals{FingerprintUsers: 5, SubnetEntries: 40})
+	assert.Equal(t, 70, score)
+	assert.Equal(t, []string{RiskReasonFingerprintReuse, RiskReasonSubnetBurst}, reasons)
+
+	score, reasons = scoreRisk(thresholds, RiskSignals{FingerprintUsers: 50, SubnetEntries: 500, PollStrikes: 10, MissingFingerprint: true})
+	assert.Equal(t, 100, score)
+	assert.Len(t, reasons, 4)
+
+	// 活動自訂門檻
+	thresholds = activityRiskThresholds(models.ActivityConfig{RiskFingerprintUsers: 10, RiskSubnetBurst: 100, RiskPollStrikes: 20})
+	score, reasons = scoreRisk(thresholds, RiskSignals{FingerprintUsers: 5, SubnetEntries: 40, PollStrikes: 10})
+	assert.Equal(t, 0, score)
+	assert.Empty(t, reasons)
+
+	score, reasons = scoreRisk(thresholds, RiskSignals{FingerprintUsers: 11, SubnetEntries: 301})
+	assert.Equal(t, 70, score)
+	assert.Equal(t, []string{RiskReasonFingerprintReuse, RiskReasonSubnetBurst}, reasons)
+}
+
+func TestRiskAction(t *testing.T) {
+	config := models.ActivityConfig{RiskPenaltyScore: 40, RiskShadowScore: 80}
+
+	assert.Equal(t, models.RiskActionAllow, riskAction(config, 39))
+	assert.Equal(t, models.RiskActionPenalize, riskAction(config, 40))
+	assert.Equal(t, models.RiskActionShadow, riskAction(config, 80))
+	assert.Equal(t, models.RiskActionAllow, riskAction(models.ActivityConfig{}, 100))
+}
+
+func TestClientSubnet(t *testing.T) {
+	assert.Equal(t, "203.0.113.0/24", clientSubnet("203.0.113.77"))
+	assert.Equal(t, "2001:db8:1:2::/64", clientSubnet("2001:db8:1:2:3:4:5:6"))
+	assert.Equal(t, "", clientSubnet("not-an-ip"))
+}
+
+func TestHeldPosition(t *testing.T) {
+	// penalize：以延後目標計算位置
+	assert.Equal(t, int64(510), heldPosition(20, 10, 520, 500))
+	assert.Equal(t, int64(1), heldPosition(20, 600, 520, 500))
+
+	// shadow：與 penalize 一樣延後，越過目標後再延後一輪，不會停在第 1 位
+	assert.Equal(t, int64(510), heldPosition(20, 10, math.Inf(1), 500))
+	assert.Equal(t, int64(1), heldPosition(20, 519, math.Inf(1), 500))
+	assert.Equal(t, int64(500), heldPosition(20, 520, math.Inf(1), 500))
+	assert.Equal(t, int64(490), heldPosition(20, 1030, math.Inf(1), 500))
+}
+
+func TestAssessEntry_CountsOnlyAdmittedEntries(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	ctx := context.Background()
+	s := NewQueueService(nil, rdb)
+	require.NoError(t, s.SetIPHashKey([]iphash.Secret{{ID: "k1", Key: []byte("ip-hash-secret-0123456789")}}, 0, time.Hour))
+	activity := newStreamActivity()
+	activity.Config.RiskSubnetBurst = 2
+	req := &EnterQueueRequest{UserHash: "user-a", Fingerprint: "fp", IPAddress: "203.0.113.7"}
+
+	// 評估時計入本次進入，但未取得序號前不寫入計數
+	for i := 0; i < 5; i++ {
+		risk := s.assessEntry(ctx, activity, req)
+		assert.Equal(t, int64(1), risk.Signals.SubnetEntries)
+		assert.Equal(t, int64(1), risk.Signals.FingerprintUsers)
+	}
+
+	s.recordRiskSignals(ctx, activity, req)
+	s.recordRiskSignals(ctx, activity, &EnterQueueRequest{UserHash: "user-b", Fingerprint: "fp", IPAddress: "203.0.113.8"})
+
+	// 已記錄的用戶不重複計入指紋
+	risk := s.assessEntry(ctx, activity, req)
+	assert.Equal(t, int64(2), risk.Signals.FingerprintUsers)
+	assert.Equal(t, int64(3), risk.Signals.SubnetEntries)
+	assert.Equal(t, []string{RiskReasonSubnetBurst}, risk.Reasons)
+}
+
+func TestEscalateRisk_KeepsUndecodableAssessment(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	s := NewQueueService(nil, rdb)
+	activity := newStreamActivity()
+	activity.Config.RiskPenaltyScore = 10
+
+	scoresKey := keys.RiskScoresKey(activity.TenantID, activity.ID)
+	mr.HSet(scoresKey, "session-a", "not-json")
+	s.escalateRisk(ctx, activity, "", "session-a", 8, 5)
+
+	data, err := rdb.HGet(ctx, scoresKey, "session-a").Result()
+	require.NoError(t, err)
+	assert.Equal(t, "not-json", data)
+	assert.False(t, mr.Exists(keys.RiskHoldKey(activity.TenantID, activity.ID)))
+}
+
+func TestListRiskEntries_KeepsUndecodableReasons(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	s := NewAdminService(db, nil)
+	columns := []string{"id", "activity_id", "user_hash", "session_id", "seq_number", "fingerprint", "ip_hash",
+		"ip_hash_key", "created_at", "abandoned_at", "risk_score", "risk_reasons", "risk_action"}
+	mock.ExpectQuery("FROM queue_entries").WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(1, 7, "user-a", "session-a", 3, "", "", "", time.Now(), nil, 80, []byte("not-json"), models.RiskActionShadow).
+		AddRow(2, 7, "user-b", "session-b", 4, "", "", "", time.Now(), nil, 40, []byte(`["subnet_burst"]`), models.RiskActionAllow))
+
+	// 原因無法解讀的記錄仍列出分數與處置
+	entries, err := s.ListRiskEntries(context.Background(), 7, &RiskListRequest{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 80, entries[0].RiskScore)
+	assert.Empty(t, entries[0].RiskReasons)
+	assert.Equal(t, []string{"subnet_burst"}, entries[1].RiskReasons)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestThrottleRules(t *testing.T) {
+	s := &QueueService{}
+	require.NoError(t, s.SetIPHashKey([]iphash.Secret{{ID: "k1", Key: []byte("ip-hash-secret-0123456789")}}, 0, time.Hour))
+	startAt := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	activity := &models.Activity{
+		ID:       1,
+		TenantID: "tenant1",
+		StartAt:  startAt,
+		Config: models.ActivityConfig{
+			ThrottlePolicies: []models.ThrottlePolicy{
+				{Key: models.ThrottleKeyIP, Rate: 10, PeriodSeconds: 60, LaunchRate: 2, LaunchBurst: 1},
+				{Key: models.ThrottleKeyFingerprint, Rate: 5, PeriodSeconds: 60},
+			},
+			ThrottleLaunchSeconds: 30,
+		},
+	}
+	req := &EnterQueueRequest{UserHash: "user1", IPAddress: "203.0.113.77"}
+
+	// 未開啟 enable_throttle 時忽略自訂規則，仍套用每個 IP 每分鐘 10 次
+	rules := s.throttleRules(activity, req, startAt.Add(10*time.Second))
+	if assert.Len(t, rules, 1) {
+		assert.Equal(t, 10, rules[0].Limit.Rate)
+		assert.Equal(t, time.Minute, rules[0].Limit.Period)
+	}
+
+	activity.Config.EnableThrottle = true
+
+	// 開賣初期使用 launch 限制；沒有指紋時略過指紋規則
+	rules = s.throttleRules(activity, req, startAt.Add(10*time.Second))
+	if assert.Len(t, rules, 1) {
+		ipHash, _ := s.ipHasher.Hash(req.IPAddress, startAt)
+		assert.Equal(t, "ratelimit:tenant1:1:ip:"+ipHash, rules[0].Key)
+		assert.Equal(t, 2, rules[0].Limit.Rate)
+		assert.Equal(t, 1, rules[0].Limit.Burst)
+	}
+
+	req.Fingerprint = "fp"
+	rules = s.throttleRules(activity, req, startAt.Add(30*time.Second))
+	if assert.Len(t, rules, 2) {
+		assert.Equal(t, 10, rules[0].Limit.Rate)
+		assert.Equal(t, time.Minute, rules[0].Limit.Period)
+		assert.Equal(t, 5, rules[1].Limit.Rate)
+	}
+
+	// 未設定規則時沿用每個 IP 每分鐘 10 次
+	activity.Config.ThrottlePolicies = nil
+	rules = s.throttleRules(activity, req, startAt)
+	if assert.Len(t, rules, 1) {
+		assert.Equal(t, 10, rules[0].Limit.Rate)
+	}
+}
+
 // 輔助函數，用於測試
 func generateTestSessionID(userHash string, activityID int64) string {
 	// 簡化的 sessionID 生成邏輯
@@ -45,3 +441,120 @@ func generateTestIPHash(ip string) string {
 	}
 	return ip + "0000000000000000"[len(ip):16]
 }
+
+func TestSetIPHashKey_RequiresSecret(t *testing.T) {
+	s := &QueueService{}
+	assert.ErrorContains(t, s.SetIPHashKey(nil, 0, time.Hour), "ip hash secret is required")
+	assert.Error(t, s.SetIPHashKey([]iphash.Secret{{ID: "k1", Key: []byte("short")}}, 0, time.Hour))
+	assert.Nil(t, s.ipHasher)
+}
+
+func TestBackfillIPHashes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	s := NewQueueService(db, nil)
+	require.NoError(t, s.SetIPHashKey([]iphash.Secret{{ID: "k2", Key: []byte("ip-hash-secret-0123456789")}}, 0, time.Hour))
+	rehashed, keyID := s.ipHasher.Rehash("legacy-hash")
+	assert.Equal(t, "k2.legacy", keyID)
+
+	// 舊雜湊以目前的 secret 重算，不清除
+	mock.ExpectQuery("WHERE ip_hash IS NOT NULL AND ip_hash_key IS NULL").WithArgs(ipHashBackfillBatch).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "ip_hash"}).AddRow(int64(3), "legacy-hash"))
+	mock.ExpectBegin()
+	mock.ExpectPrepare("UPDATE queue_entries").
+		ExpectExec().WithArgs(rehashed, "k2.legacy", int64(3)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	updated, err := s.BackfillIPHashes(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), updated)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func newWaitlistActivity() *models.Activity {
+	activity := newStreamActivity()
+	activity.Config.OverflowMode = models.OverflowModeWaitlist
+	activity.Config.Lanes = []models.LaneConfig{{Name: "vip", Weight: 1}}
+	return activity
+}
+
+func TestWaitlist_ComparesGlobalCount(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	s := NewQueueService(nil, rdb)
+	activity := newWaitlistActivity()
+
+	// 預設通道 8 人、vip 通道 6 人，合計 14 人超過上限 10
+	seedQueue(t, mr, activity, 8, 0, nil)
+	require.NoError(t, mr.Set(keys.LaneKey(keys.QueueSeqKey(activity.TenantID, activity.ID), "vip"), "6"))
+
+	status := func(seq int64) *QueueStatusResponse {
+		p, err := s.loadProgress(ctx, activity, "", seq)
+		require.NoError(t, err)
+		return s.statusFromProgress(ctx, "req", activity, &QueueStatusRequest{ActivityID: activity.ID, Seq: seq}, "", p, false)
+	}
+
+	// 本通道位置 5 未達上限，但加上 vip 通道的 6 人已排在上限之外
+	resp := status(5)
+	assert.Equal(t, StateWaitlisted, resp.State)
+	assert.Equal(t, int64(1), resp.WaitlistPosition)
+	assert.True(t, resp.QueueFull)
+
+	resp = status(3)
+	assert.Equal(t, StateWaiting, resp.State)
+	assert.Zero(t, resp.WaitlistPosition)
+}
+
+func TestWaitlist_EnterComparesGlobalCount(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	db, _, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	// queue_entries 為非同步寫入，不檢查
+	s := NewQueueService(db, rdb)
+	activity := newWaitlistActivity()
+
+	// vip 通道已有 10 人，預設通道的第一位進入者排在上限之外
+	require.NoError(t, mr.Set(keys.LaneKey(keys.QueueSeqKey(activity.TenantID, activity.ID), "vip"), "10"))
+	resp, err := s.enterActivity(ctx, "req", activity, &EnterQueueRequest{ActivityID: activity.ID, UserHash: "user-a"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), resp.Seq)
+	assert.Equal(t, int64(1), resp.QueueLength)
+	assert.Equal(t, StateWaitlisted, resp.State)
+	assert.Equal(t, int64(1), resp.WaitlistPosition)
+}
+
+func TestCachedWaitingCount(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	s := NewQueueService(nil, rdb)
+	activity := newWaitlistActivity()
+
+	// 已越過的離開者不扣除
+	seedQueue(t, mr, activity, 8, 2, nil)
+	abandonedKey := keys.AbandonedKey(activity.TenantID, activity.ID)
+	for _, seq := range []float64{1, 5} {
+		_, err := mr.ZAdd(abandonedKey, seq, fmt.Sprint(seq))
+		require.NoError(t, err)
+	}
+	require.NoError(t, mr.Set(keys.LaneKey(keys.QueueSeqKey(activity.TenantID, activity.ID), "vip"), "4"))
+
+	count, err := s.cachedWaitingCount(ctx, activity)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), count)
+
+	// 有效期內的輪詢共用同一次查詢
+	require.NoError(t, mr.Set(keys.LaneKey(keys.QueueSeqKey(activity.TenantID, activity.ID), "vip"), "6"))
+	count, err = s.cachedWaitingCount(ctx, activity)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), count)
+
+	s.waitingCounts.Store(activity.ID, waitingCountEntry{count: 9, loadedAt: time.Now().Add(-waitingCountTTL)})
+	count, err = s.cachedWaitingCount(ctx, activity)
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), count)
+}
@@ -8,11 +8,13 @@ import (
 	"log"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+
 	"github.com/go-redis/redis/v8"
-	    "queue-system/internal/models"
-    "queue-system/pkg/keys"
 )
 
 type ReleaseScheduler struct {
@@ -27,12 +29,35 @@ type ReleaseScheduler struct {
 type SchedulerTask struct {
 	ActivityID    int64
 	TenantID      string
-	ReleaseRate   int
 	StopChan      chan struct{}
 	LastRelease   time.Time
 	TotalReleased int64
+	// 監控協程整份替換設定，釋放協程每次執行只讀取一份快照
+	cfg atomic.Pointer[schedulerConfig]
+}
+
+// schedulerConfig 是排程任務的設定快照，建立後不再修改
+type schedulerConfig struct {
+	ReleaseRate   int
+	ClaimTimeout  time.Duration
+	InitialStock  int
+	ReleaseMode   models.ReleaseMode
+	MaxConcurrent int
+	LeaseTimeout  time.Duration
+	// 超過此時間未輪詢的等待者視為離線
+	HeartbeatGrace time.Duration
+	// 包含預設通道在內的所有通道與分配方式
+	Lanes      []models.LaneConfig
+	LanePolicy models.LanePolicy
+	// admit 模式的名單用戶在各通道之前優先釋放
+	AdmitAllowlist bool
 }
 
+// 需要排程釋放的活動：進行中、暫停中，以及 end_at 後排空期內的活動
+const schedulableActivityCondition = `status IN ('active', 'paused', 'draining')
+        AND start_at <= NOW()
+        AND end_at + make_interval(secs => COALESCE((config_json->>'drain_seconds')::int, 0)) > NOW()`
+
 type ReleaseEvent struct {
 	ActivityID   int64     `json:"activity_id"`
 	TenantID     string    `json:"tenant_id"`
@@ -41,6 +66,7 @@ type ReleaseEvent struct {
 	ReleaseCount int64     `json:"release_count"`
 	Timestamp    time.Time `json:"timestamp"`
 	ReleaseRate  int       `json:"release_rate"`
+	Lane         string    `json:"lane,omitempty"`
 }
 
 func NewReleaseScheduler(db *sql.DB, redis *redis.Client) *ReleaseScheduler {
@@ -91,11 +117,9 @@ func (rs *ReleaseScheduler) Stop() {
 
 func (rs *ReleaseScheduler) loadActiveActivities(ctx context.Context) error {
 	query := `
-        SELECT id, tenant_id, config_json
+        SELECT id, tenant_id, initial_stock, config_json
         FROM activities 
-        WHERE status = 'active' 
-        AND start_at <= NOW() 
-        AND end_at > NOW()`
+        WHERE ` + schedulableActivityCondition
 
 	rows, err := rs.db.QueryContext(ctx, query)
 	if err != nil {
@@ -106,15 +130,16 @@ func (rs *ReleaseScheduler) loadActiveActivities(ctx context.Context) error {
 	for rows.Next() {
 		var activityID int64
 		var tenantID string
+		var initialStock int
 		var config models.ActivityConfig
 
-		if err := rows.Scan(&activityID, &tenantID, &config); err != nil {
+		if err := rows.Scan(&activityID, &tenantID, &initialStock, &config); err != nil {
 			log.Printf("Failed to scan activity %d: %v", activityID, err)
 			continue
 		}
 
-		if config.ReleaseRate > 0 {
-			if err := rs.startActivityScheduler(ctx, activityID, tenantID, config.ReleaseRate); err != nil {
+		if config.ReleaseRate > 0 || config.IsConcurrencyMode() {
+			if err := rs.startActivityScheduler(ctx, activityID, tenantID, initialStock, config); err != nil {
 				log.Printf("Failed to start scheduler for activity %d: %v", activityID, err)
 			}
 		}
@@ -123,7 +148,7 @@ func (rs *ReleaseScheduler) loadActiveActivities(ctx context.Context) error {
 	return nil
 }
 
-func (rs *ReleaseScheduler) startActivityScheduler(ctx context.Context, activityID int64, tenantID string, releaseRate int) error {
+func (rs *ReleaseScheduler) startActivityScheduler(ctx context.Context, activityID int64, tenantID string, initialStock int, config models.ActivityConfig) error {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
@@ -132,20 +157,22 @@ func (rs *ReleaseScheduler) startActivityScheduler(ctx context.Context, activity
 		return nil
 	}
 
-	// 獲取當前 release_seq
-	currentSeq, err := rs.getCurrentReleaseSeq(ctx, tenantID, activityID)
-	if err != nil {
-		log.Printf("Failed to get current release seq for activity %d: %v", activityID, err)
-		currentSeq = 0
+	task := &SchedulerTask{
+		ActivityID:  activityID,
+		TenantID:    tenantID,
+		StopChan:    make(chan struct{}),
+		LastRelease: time.Now(),
 	}
+	task.setConfig(newSchedulerConfig(initialStock, config))
 
-	task := &SchedulerTask{
-		ActivityID:    activityID,
-		TenantID:      tenantID,
-		ReleaseRate:   releaseRate,
-		StopChan:      make(chan struct{}),
-		LastRelease:   time.Now(),
-		TotalReleased: currentSeq,
+	// 獲取各通道當前 release_seq
+	for _, lane := range task.config().Lanes {
+		currentSeq, err := rs.getCurrentReleaseSeq(ctx, tenantID, activityID, laneScope(lane.Name))
+		if err != nil {
+			log.Printf("Failed to get current release seq for activity %d: %v", activityID, err)
+			continue
+		}
+		task.TotalReleased += currentSeq
 	}
 
 	rs.running[activityID] = task
@@ -154,7 +181,7 @@ func (rs *ReleaseScheduler) startActivityScheduler(ctx context.Context, activity
 	rs.wg.Add(1)
 	go rs.runActivityScheduler(ctx, task)
 
-	log.Printf("Started release scheduler for activity %d (rate: %d/sec)", activityID, releaseRate)
+	log.Printf("Started release scheduler for activity %d (rate: %d/sec)", activityID, config.ReleaseRate)
 	return nil
 }
 
@@ -167,12 +194,7 @@ func (rs *ReleaseScheduler) runActivityScheduler(ctx context.Context, task *Sche
 		log.Printf("Stopped release scheduler for activity %d", task.ActivityID)
 	}()
 
-	// 計算釋放間隔（毫秒）
-	releaseInterval := time.Duration(1000/task.ReleaseRate) * time.Millisecond
-	if releaseInterval < 10*time.Millisecond {
-		releaseInterval = 10 * time.Millisecond // 最小間隔 10ms
-	}
-
+	releaseInterval := task.config().releaseInterval()
 	ticker := time.NewTicker(releaseInterval)
 	defer ticker.Stop()
 
@@ -188,77 +210,180 @@ func (rs *ReleaseScheduler) runActivityScheduler(ctx context.Context, task *Sche
 			if err := rs.performRelease(ctx, task); err != nil {
 				log.Printf("Release failed for activity %d: %v", task.ActivityID, err)
 			}
+
+			// 釋放速率或模式變更後調整間隔
+			if interval := task.config().releaseInterval(); interval != releaseInterval {
+				releaseInterval = interval
+				ticker.Reset(releaseInterval)
+			}
 		}
 	}
 }
 
 func (rs *ReleaseScheduler) performRelease(ctx context.Context, task *SchedulerTask) error {
 	// 檢查活動是否仍然活躍
-	if !rs.isActivityStillActive(ctx, task.ActivityID) {
+	status, ok := rs.getActivityStatus(ctx, task.ActivityID)
+	if !ok {
 		log.Printf("Activity %d is no longer active, stopping scheduler", task.ActivityID)
 		close(task.StopChan)
 		return nil
 	}
 
-	// 獲取當前隊列長度
-	queueSeq, err := rs.getCurrentQueueSeq(ctx, task.TenantID, task.ActivityID)
-	if err != nil {
-		return fmt.Errorf("failed to get queue seq: %w", err)
+	// 暫停中不釋放也不回收；持續更新 LastRelease，恢復後不會補發暫停期間的名額
+	if status == models.StatusPaused {
+		task.LastRelease = time.Now()
+		return nil
 	}
 
-	releaseSeq, err := rs.getCurrentReleaseSeq(ctx, task.TenantID, task.ActivityID)
-	if err != nil {
-		return fmt.Errorf("failed to get release seq: %w", err)
+	cfg := task.config()
+
+	// 回收逾時未領取的名額
+	if cfg.ClaimTimeout > 0 {
+		if _, err := rs.expireUnclaimedAdmissions(ctx, task, cfg); err != nil {
+			log.Printf("Failed to expire unclaimed admissions for activity %d: %v", task.ActivityID, err)
+		}
+	}
+
+	now := time.Now()
+
+	// 名單 admit 通道優先釋放
+	if cfg.AdmitAllowlist {
+		if err := rs.releaseAllowlistAdmits(ctx, task, cfg, now); err != nil {
+			log.Printf("Failed to admit allowlisted users for activity %d: %v", task.ActivityID, err)
+		}
+	}
+
+	// 獲取各通道的隊列長度
+	queueSeqs := make(map[string]int64, len(cfg.Lanes))
+	releaseSeqs := make(map[string]int64, len(cfg.Lanes))
+	backlog := make(map[string]int64, len(cfg.Lanes))
+	var queueLength int64
+
+	for _, lane := range cfg.Lanes {
+		scope := laneScope(lane.Name)
+
+		queueSeq, err := rs.getReleasableQueueSeq(ctx, task.TenantID, task.ActivityID, scope)
+		if err != nil {
+			return fmt.Errorf("failed to get queue seq: %w", err)
+		}
+
+		releaseSeq, err := rs.getCurrentReleaseSeq(ctx, task.TenantID, task.ActivityID, scope)
+		if err != nil {
+			return fmt.Errorf("failed to get release seq: %w", err)
+		}
+
+		queueSeqs[lane.Name] = queueSeq
+		releaseSeqs[lane.Name] = releaseSeq
+		if queueSeq > releaseSeq {
+			backlog[lane.Name] = queueSeq - releaseSeq
+			queueLength += queueSeq - releaseSeq
+		} else if deferred := countDeferred(ctx, rs.redis, task.TenantID, task.ActivityID, scope); deferred > 0 {
+			// 隊列已越過所有序號，剩下延後釋放的風險用戶
+			backlog[lane.Name] = deferred
+			queueLength += deferred
+		}
 	}
 
 	// 計算需要釋放的數量
-	queueLength := queueSeq - releaseSeq
 	if queueLength <= 0 {
 		return nil // 沒有人在排隊
 	}
 
-	// 計算本次釋放數量（基於時間間隔和速率）
-	now := time.Now()
-	timeSinceLastRelease := now.Sub(task.LastRelease)
-	expectedReleases := int64(float64(task.ReleaseRate) * timeSinceLastRelease.Seconds())
+	// 售完後不再釋放，單次釋放也不超過剩餘庫存
+	remainingStock, err := NewInventory(rs.redis).Remaining(ctx, task.TenantID, task.ActivityID, cfg.InitialStock)
+	if err != nil {
+		return fmt.Errorf("failed to get remaining stock: %w", err)
+	}
+	if remainingStock <= 0 {
+		return nil
+	}
+	queueLength = minInt64(queueLength, remainingStock)
+
+	var expectedReleases, credit int64
+
+	if cfg.isConcurrencyMode() {
+		// 只釋放空出的租約數量
+		activeLeases, err := NewLeasePool(rs.redis).Active(ctx, task.TenantID, task.ActivityID)
+		if err != nil {
+			return fmt.Errorf("failed to count active leases: %w", err)
+		}
+
+		expectedReleases = int64(cfg.MaxConcurrent) - activeLeases
+		if expectedReleases <= 0 {
+			return nil
+		}
+	} else {
+		// 計算本次釋放數量（基於時間間隔和速率）
+		timeSinceLastRelease := now.Sub(task.LastRelease)
+		expectedReleases = int64(float64(cfg.ReleaseRate) * timeSinceLastRelease.Seconds())
 
-	if expectedReleases <= 0 {
-		expectedReleases = 1 // 至少釋放 1 個
+		if expectedReleases <= 0 {
+			expectedReleases = 1 // 至少釋放 1 個
+		}
+
+		// 加上退回的名額
+		credit = rs.takeReleaseCredit(ctx, task.TenantID, task.ActivityID)
 	}
 
 	// 不能超過隊列長度
-	releaseCount := int(minInt64(expectedReleases, queueLength))
+	releaseCount := int(minInt64(expectedReleases+credit, queueLength))
 	if releaseCount <= 0 {
 		return nil
 	}
 
-	// 執行釋放
-	newReleaseSeq := releaseSeq + int64(releaseCount)
-	if err := rs.updateReleaseSeq(ctx, task.TenantID, task.ActivityID, newReleaseSeq); err != nil {
-		return fmt.Errorf("failed to update release seq: %w", err)
+	// 隊列不足以用完的退回名額留到下次
+	if unused := expectedReleases + credit - int64(releaseCount); unused > 0 && credit > 0 {
+		rs.returnReleaseCredit(ctx, task.TenantID, task.ActivityID, minInt64(unused, credit))
 	}
 
-	// 記錄釋放事件
-	event := &ReleaseEvent{
-		ActivityID:   task.ActivityID,
-		TenantID:     task.TenantID,
-		PrevSeq:      releaseSeq,
-		NewSeq:       newReleaseSeq,
-		ReleaseCount: int64(releaseCount),
-		Timestamp:    now,
-		ReleaseRate:  task.ReleaseRate,
+	// 依通道設定分配本次名額
+	allocation := splitReleaseBudget(int64(releaseCount), cfg.Lanes, backlog, cfg.LanePolicy)
+
+	releaseCount = 0
+	for _, lane := range cfg.Lanes {
+		want := allocation[lane.Name]
+		if want <= 0 {
+			continue
+		}
+		scope := laneScope(lane.Name)
+		releaseSeq := releaseSeqs[lane.Name]
+
+		// 挑出仍在排隊的 seq，已離開的不計入釋放數量
+		newReleaseSeq, released, err := rs.selectReleasable(ctx, task, cfg, scope, releaseSeq, queueSeqs[lane.Name], want)
+		if err != nil {
+			return fmt.Errorf("failed to select releasable seqs: %w", err)
+		}
+
+		// 執行釋放
+		if err := rs.updateReleaseSeq(ctx, task.TenantID, task.ActivityID, scope, newReleaseSeq); err != nil {
+			return fmt.Errorf("failed to update release seq: %w", err)
+		}
+
+		rs.onReleased(ctx, task, cfg, scope, released, now)
+		releaseCount += len(released)
+		task.TotalReleased += newReleaseSeq - releaseSeq
+
+		// 記錄釋放事件
+		event := &ReleaseEvent{
+			ActivityID:   task.ActivityID,
+			TenantID:     task.TenantID,
+			PrevSeq:      releaseSeq,
+			NewSeq:       newReleaseSeq,
+			ReleaseCount: int64(len(released)),
+			Timestamp:    now,
+			ReleaseRate:  cfg.ReleaseRate,
+			Lane:         scope,
+		}
+		go rs.recordReleaseEvent(context.Background(), event)
 	}
 
-	// 異步記錄事件和更新指標
-	go rs.recordReleaseEvent(context.Background(), event)
+	// 異步更新指標
 	go rs.updateReleaseMetrics(context.Background(), task.TenantID, task.ActivityID, int64(releaseCount))
 
 	// 更新任務狀態
 	task.LastRelease = now
-	task.TotalReleased = newReleaseSeq
 
-	log.Printf("Released %d positions for activity %d (new release_seq: %d)",
-		releaseCount, task.ActivityID, newReleaseSeq)
+	log.Printf("Released %d positions for activity %d", releaseCount, task.ActivityID)
 
 	return nil
 }
@@ -286,11 +411,9 @@ func (rs *ReleaseScheduler) monitorActivities(ctx context.Context) {
 func (rs *ReleaseScheduler) syncActiveActivities(ctx context.Context) error {
 	// 獲取當前活躍活動
 	query := `
-        SELECT id, tenant_id, config_json
+        SELECT id, tenant_id, initial_stock, config_json
         FROM activities 
-        WHERE status = 'active' 
-        AND start_at <= NOW() 
-        AND end_at > NOW()`
+        WHERE ` + schedulableActivityCondition
 
 	rows, err := rs.db.QueryContext(ctx, query)
 	if err != nil {
@@ -303,9 +426,10 @@ func (rs *ReleaseScheduler) syncActiveActivities(ctx context.Context) error {
 	for rows.Next() {
 		var activityID int64
 		var tenantID string
+		var initialStock int
 		var config models.ActivityConfig
 
-		if err := rows.Scan(&activityID, &tenantID, &config); err != nil {
+		if err := rows.Scan(&activityID, &tenantID, &initialStock, &config); err != nil {
 			continue
 		}
 
@@ -316,8 +440,8 @@ func (rs *ReleaseScheduler) syncActiveActivities(ctx context.Context) error {
 		_, exists := rs.running[activityID]
 		rs.mu.RUnlock()
 
-		if !exists && config.ReleaseRate > 0 {
-			if err := rs.startActivityScheduler(ctx, activityID, tenantID, config.ReleaseRate); err != nil {
+		if !exists && (config.ReleaseRate > 0 || config.IsConcurrencyMode()) {
+			if err := rs.startActivityScheduler(ctx, activityID, tenantID, initialStock, config); err != nil {
 				log.Printf("Failed to start scheduler for new activity %d: %v", activityID, err)
 			}
 		} else if exists {
@@ -326,10 +450,12 @@ func (rs *ReleaseScheduler) syncActiveActivities(ctx context.Context) error {
 			task := rs.running[activityID]
 			rs.mu.RUnlock()
 
-			if task != nil && task.ReleaseRate != config.ReleaseRate {
-				log.Printf("Updating release rate for activity %d: %d -> %d",
-					activityID, task.ReleaseRate, config.ReleaseRate)
-				task.ReleaseRate = config.ReleaseRate
+			if task != nil {
+				if current := task.config(); current.ReleaseRate != config.ReleaseRate {
+					log.Printf("Updating release rate for activity %d: %d -> %d",
+						activityID, current.ReleaseRate, config.ReleaseRate)
+				}
+				task.setConfig(newSchedulerConfig(initialStock, config))
 			}
 		}
 	}
@@ -381,7 +507,7 @@ func (rs *ReleaseScheduler) updateSchedulerMetrics(ctx context.Context) {
 
 		// 更新當前釋放速率
 		key = keys.MetricsKey(task.TenantID, activityID, "current_release_rate")
-		rs.redis.Set(ctx, key, task.ReleaseRate, time.Hour)
+		rs.redis.Set(ctx, key, task.config().ReleaseRate, time.Hour)
 	}
 	rs.mu.RUnlock()
 
@@ -412,7 +538,9 @@ func (rs *ReleaseScheduler) UpdateReleaseRate(ctx context.Context, activityID in
 	}
 
 	// 更新記憶體中的速率
-	task.ReleaseRate = newRate
+	cfg := *task.config()
+	cfg.ReleaseRate = newRate
+	task.setConfig(&cfg)
 
 	log.Printf("Updated release rate for activity %d to %d/sec", activityID, newRate)
 	return nil
@@ -427,36 +555,88 @@ func (rs *ReleaseScheduler) ManualRelease(ctx context.Context, activityID int64,
 		return fmt.Errorf("scheduler not running for activity %d", activityID)
 	}
 
-	releaseSeq, err := rs.getCurrentReleaseSeq(ctx, task.TenantID, activityID)
-	if err != nil {
-		return fmt.Errorf("failed to get current release seq: %w", err)
+	cfg := task.config()
+
+	// 只有一個通道時沿用原本的行為（可超前隊列）；有多個通道時依設定分配給有人排隊的通道
+	releaseSeqs := make(map[string]int64, len(cfg.Lanes))
+	allocation := map[string]int64{cfg.Lanes[0].Name: count}
+	if len(cfg.Lanes) > 1 {
+		backlog := make(map[string]int64, len(cfg.Lanes))
+		for _, lane := range cfg.Lanes {
+			scope := laneScope(lane.Name)
+			queueSeq, err := rs.getCurrentQueueSeq(ctx, task.TenantID, activityID, scope)
+			if err != nil {
+				return fmt.Errorf("failed to get queue seq: %w", err)
+			}
+			releaseSeq, err := rs.getCurrentReleaseSeq(ctx, task.TenantID, activityID, scope)
+			if err != nil {
+				return fmt.Errorf("failed to get current release seq: %w", err)
+			}
+			releaseSeqs[lane.Name] = releaseSeq
+			backlog[lane.Name] = queueSeq - releaseSeq
+		}
+		allocation = splitReleaseBudget(count, cfg.Lanes, backlog, cfg.LanePolicy)
 	}
 
-	newReleaseSeq := releaseSeq + count
-	if err := rs.updateReleaseSeq(ctx, task.TenantID, activityID, newReleaseSeq); err != nil {
-		return fmt.Errorf("failed to update release seq: %w", err)
-	}
+	for _, lane := range cfg.Lanes {
+		laneCount := allocation[lane.Name]
+		if laneCount <= 0 {
+			continue
+		}
+		scope := laneScope(lane.Name)
+
+		releaseSeq, ok := releaseSeqs[lane.Name]
+		if !ok {
+			var err error
+			releaseSeq, err = rs.getCurrentReleaseSeq(ctx, task.TenantID, activityID, scope)
+			if err != nil {
+				return fmt.Errorf("failed to get current release seq: %w", err)
+			}
+		}
 
-	// 記錄手動釋放事件
-	event := &ReleaseEvent{
-		ActivityID:   activityID,
-		TenantID:     task.TenantID,
-		PrevSeq:      releaseSeq,
-		NewSeq:       newReleaseSeq,
-		ReleaseCount: count,
-		Timestamp:    time.Now(),
-		ReleaseRate:  -1, // 標記為手動釋放
-	}
+		newReleaseSeq := releaseSeq + laneCount
+		if err := rs.updateReleaseSeq(ctx, task.TenantID, activityID, scope, newReleaseSeq); err != nil {
+			return fmt.Errorf("failed to update release seq: %w", err)
+		}
 
-	go rs.recordReleaseEvent(context.Background(), event)
+		abandoned, err := rs.getAbandonedSeqs(ctx, task, scope, releaseSeq, newReleaseSeq)
+		if err != nil {
+			log.Printf("Failed to get abandoned seqs for activity %d: %v", activityID, err)
+		}
+		held, err := rs.getHeldSeqs(ctx, task, scope, releaseSeq, newReleaseSeq)
+		if err != nil {
+			log.Printf("Failed to get held seqs for activity %d: %v", activityID, err)
+		}
+		released := make([]int64, 0, laneCount)
+		for seq := releaseSeq + 1; seq <= newReleaseSeq; seq++ {
+			if !abandoned[seq] && !held[seq] {
+				released = append(released, seq)
+			}
+		}
+		rs.onReleased(ctx, task, cfg, scope, released, time.Now())
+
+		// 記錄手動釋放事件
+		event := &ReleaseEvent{
+			ActivityID:   activityID,
+			TenantID:     task.TenantID,
+			PrevSeq:      releaseSeq,
+			NewSeq:       newReleaseSeq,
+			ReleaseCount: laneCount,
+			Timestamp:    time.Now(),
+			ReleaseRate:  -1, // 標記為手動釋放
+			Lane:         scope,
+		}
+
+		go rs.recordReleaseEvent(context.Background(), event)
+	}
 
 	log.Printf("Manual release: %d positions for activity %d", count, activityID)
 	return nil
 }
 
 // 輔助方法
-func (rs *ReleaseScheduler) getCurrentQueueSeq(ctx context.Context, tenantID string, activityID int64) (int64, error) {
-	key := keys.QueueSeqKey(tenantID, activityID)
+func (rs *ReleaseScheduler) getCurrentQueueSeq(ctx context.Context, tenantID string, activityID int64, lane string) (int64, error) {
+	key := keys.LaneKey(keys.QueueSeqKey(tenantID, activityID), lane)
 	result := rs.redis.Get(ctx, key)
 	if result.Err() == redis.Nil {
 		return 0, nil
@@ -467,8 +647,26 @@ func (rs *ReleaseScheduler) getCurrentQueueSeq(ctx context.Context, tenantID str
 	return strconv.ParseInt(result.Val(), 10, 64)
 }
 
-func (rs *ReleaseScheduler) getCurrentReleaseSeq(ctx context.Context, tenantID string, activityID int64) (int64, error) {
-	key := keys.ReleaseSeqKey(tenantID, activityID)
+// getReleasableQueueSeq 回傳可以釋放到的 queue_seq：預排隊保留的序號區段尚未分配完成時，
+// 不超過已分配的最大序號，避免尚未有主人的序號被釋放而讓用戶錯過領取期限
+func (rs *ReleaseScheduler) getReleasableQueueSeq(ctx context.Context, tenantID string, activityID int64, lane string) (int64, error) {
+	queueSeq, err := rs.getCurrentQueueSeq(ctx, tenantID, activityID, lane)
+	if err != nil {
+		return 0, err
+	}
+
+	assignedSeq, err := rs.redis.Get(ctx, keys.LaneKey(keys.AssignedSeqKey(tenantID, activityID), lane)).Int64()
+	if err == redis.Nil {
+		return queueSeq, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return minInt64(queueSeq, assignedSeq), nil
+}
+
+func (rs *ReleaseScheduler) getCurrentReleaseSeq(ctx context.Context, tenantID string, activityID int64, lane string) (int64, error) {
+	key := keys.LaneKey(keys.ReleaseSeqKey(tenantID, activityID), lane)
 	result := rs.redis.Get(ctx, key)
 	if result.Err() == redis.Nil {
 		return 0, nil
@@ -479,23 +677,403 @@ func (rs *ReleaseScheduler) getCurrentReleaseSeq(ctx context.Context, tenantID s
 	return strconv.ParseInt(result.Val(), 10, 64)
 }
 
-func (rs *ReleaseScheduler) updateReleaseSeq(ctx context.Context, tenantID string, activityID int64, newSeq int64) error {
-	key := keys.ReleaseSeqKey(tenantID, activityID)
+func (rs *ReleaseScheduler) updateReleaseSeq(ctx context.Context, tenantID string, activityID int64, lane string, newSeq int64) error {
+	key := keys.LaneKey(keys.ReleaseSeqKey(tenantID, activityID), lane)
 	return rs.redis.Set(ctx, key, newSeq, 24*time.Hour).Err()
 }
 
-func (rs *ReleaseScheduler) isActivityStillActive(ctx context.Context, activityID int64) bool {
+// expireClaimsScript 將超過領取期限的 seq 從待領取移到逾時集合，並收回其租約；
+// rate 模式下把名額退回釋放配額。ARGV[5] 為租約成員的通道前綴。
+// 與領取時的 ZREM 互斥，確保同一個 seq 不會同時被領取又被回收。
+var expireClaimsScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, seq in ipairs(expired) do
+	redis.call('ZREM', KEYS[1], seq)
+	redis.call('SADD', KEYS[2], seq)
+	redis.call('ZREM', KEYS[4], ARGV[5] .. seq)
+end
+if #expired > 0 then
+	redis.call('EXPIRE', KEYS[2], ARGV[3])
+	if ARGV[4] == '1' then
+		redis.call('INCRBY', KEYS[3], #expired)
+		redis.call('EXPIRE', KEYS[3], ARGV[3])
+	end
+end
+return #expired
+`)
+
+func (rs *ReleaseScheduler) expireUnclaimedAdmissions(ctx context.Context, task *SchedulerTask, cfg *schedulerConfig) (int64, error) {
+	// concurrency 模式收回租約即可空出名額，不需要額外配額
+	creditFlag := 1
+	if cfg.isConcurrencyMode() {
+		creditFlag = 0
+	}
+
+	scopes := make([]string, 0, len(cfg.Lanes)+1)
+	for _, lane := range cfg.Lanes {
+		scopes = append(scopes, laneScope(lane.Name))
+	}
+	if cfg.AdmitAllowlist {
+		scopes = append(scopes, allowlistAdmitLane)
+	}
+
+	var count int64
+	for _, scope := range scopes {
+		leasePrefix := ""
+		if scope != "" {
+			leasePrefix = scope + ":"
+		}
+		// 名單用戶不佔用速率配額，逾時也不退回配額
+		laneCredit := creditFlag
+		if scope == allowlistAdmitLane {
+			laneCredit = 0
+		}
+
+		expired, err := expireClaimsScript.Run(ctx, rs.redis,
+			[]string{
+				keys.LaneKey(keys.ClaimPendingKey(task.TenantID, task.ActivityID), scope),
+				keys.LaneKey(keys.ClaimExpiredKey(task.TenantID, task.ActivityID), scope),
+				keys.ReleaseCreditKey(task.TenantID, task.ActivityID),
+				keys.LeaseKey(task.TenantID, task.ActivityID),
+			},
+			time.Now().Unix(), 1000, int((24 * time.Hour).Seconds()), laneCredit, leasePrefix,
+		).Int64()
+		if err != nil {
+			return count, err
+		}
+		count += expired
+	}
+
+	if count > 0 {
+		go rs.updateReclaimMetrics(context.Background(), task.TenantID, task.ActivityID, count)
+		log.Printf("Reclaimed %d unclaimed admissions for activity %d", count, task.ActivityID)
+	}
+
+	return count, nil
+}
+
+// releaseAllowlistAdmits 釋放 admit 通道中所有等待的名單用戶：不受釋放速率限制，
+// 但與一般通道相同受剩餘庫存與同時在線上限約束，並記錄領取期限與租約
+func (rs *ReleaseScheduler) releaseAllowlistAdmits(ctx context.Context, task *SchedulerTask, cfg *schedulerConfig, now time.Time) error {
+	queueSeq, err := rs.getReleasableQueueSeq(ctx, task.TenantID, task.ActivityID, allowlistAdmitLane)
+	if err != nil {
+		return fmt.Errorf("failed to get queue seq: %w", err)
+	}
+	releaseSeq, err := rs.getCurrentReleaseSeq(ctx, task.TenantID, task.ActivityID, allowlistAdmitLane)
+	if err != nil {
+		return fmt.Errorf("failed to get release seq: %w", err)
+	}
+	if queueSeq <= releaseSeq {
+		return nil
+	}
+
+	remainingStock, err := NewInventory(rs.redis).Remaining(ctx, task.TenantID, task.ActivityID, cfg.InitialStock)
+	if err != nil {
+		return fmt.Errorf("failed to get remaining stock: %w", err)
+	}
+	want := minInt64(queueSeq-releaseSeq, remainingStock)
+
+	if cfg.isConcurrencyMode() {
+		activeLeases, err := NewLeasePool(rs.redis).Active(ctx, task.TenantID, task.ActivityID)
+		if err != nil {
+			return fmt.Errorf("failed to count active leases: %w", err)
+		}
+		want = minInt64(want, int64(cfg.MaxConcurrent)-activeLeases)
+	}
+	if want <= 0 {
+		return nil
+	}
+
+	newReleaseSeq, released, err := rs.selectReleasable(ctx, task, cfg, allowlistAdmitLane, releaseSeq, queueSeq, want)
+	if err != nil {
+		return fmt.Errorf("failed to select releasable seqs: %w", err)
+	}
+	if err := rs.updateReleaseSeq(ctx, task.TenantID, task.ActivityID, allowlistAdmitLane, newReleaseSeq); err != nil {
+		return fmt.Errorf("failed to update release seq: %w", err)
+	}
+	rs.onReleased(ctx, task, cfg, allowlistAdmitLane, released, now)
+
+	go rs.recordReleaseEvent(context.Background(), &ReleaseEvent{
+		ActivityID:   task.ActivityID,
+		TenantID:     task.TenantID,
+		PrevSeq:      releaseSeq,
+		NewSeq:       newReleaseSeq,
+		ReleaseCount: int64(len(released)),
+		Timestamp:    now,
+		ReleaseRate:  cfg.ReleaseRate,
+		Lane:         allowlistAdmitLane,
+	})
+	go rs.updateReleaseMetrics(context.Background(), task.TenantID, task.ActivityID, int64(len(released)))
+	return nil
+}
+
+// selectReleasable 從 releaseSeq 之後挑出 want 個仍在排隊的 seq，
+// 回傳新的 release_seq 與實際被釋放的 seq；已離開的 seq 會被跳過但不計入數量
+func (rs *ReleaseScheduler) selectReleasable(ctx context.Context, task *SchedulerTask, cfg *schedulerConfig, lane string, releaseSeq, queueSeq, want int64) (int64, []int64, error) {
+	cursor := releaseSeq
+
+	// 延後目標已越過的風險暫緩用戶優先釋放
+	released, err := rs.popDueHolds(ctx, task, lane, strconv.FormatInt(releaseSeq, 10), want)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for int64(len(released)) < want && cursor < queueSeq {
+		end := minInt64(cursor+want-int64(len(released)), queueSeq)
+
+		abandoned, err := rs.getAbandonedSeqs(ctx, task, lane, cursor, end)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		var stale map[int64]bool
+		if cfg.HeartbeatGrace > 0 {
+			stale, err = rs.getStaleSeqs(ctx, task, lane, cursor, end, cfg.HeartbeatGrace)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+
+		held, err := rs.getHeldSeqs(ctx, task, lane, cursor, end)
+		if err != nil {
+			return 0, nil, err
+		}
+		for seq := range held {
+			delete(stale, seq)
+		}
+
+		for seq := cursor + 1; seq <= end; seq++ {
+			if !abandoned[seq] && !stale[seq] && !held[seq] {
+				released = append(released, seq)
+			}
+		}
+		rs.markInactive(ctx, task, lane, stale)
+		cursor = end
+	}
+
+	// 仍有名額時釋放延後目標在本次範圍內的用戶；隊列已無人等待時不必等到延後目標
+	if remaining := want - int64(len(released)); remaining > 0 {
+		maxDue := strconv.FormatInt(cursor, 10)
+		if cursor >= queueSeq {
+			maxDue = "(+inf"
+		}
+		due, err := rs.popDueHolds(ctx, task, lane, maxDue, remaining)
+		if err != nil {
+			return 0, nil, err
+		}
+		released = append(released, due...)
+	}
+
+	// 已越過的離開記錄不再需要
+	if cursor > releaseSeq {
+		rs.redis.ZRemRangeByScore(ctx, keys.LaneKey(keys.AbandonedKey(task.TenantID, task.ActivityID), lane),
+			"-inf", strconv.FormatInt(cursor, 10))
+		if cfg.HeartbeatGrace > 0 {
+			rs.clearHeartbeats(ctx, task, lane, releaseSeq, cursor)
+		}
+	}
+
+	return cursor, released, nil
+}
+
+// getAbandonedSeqs 回傳 (fromSeq, toSeq] 中已離開隊列的 seq
+func (rs *ReleaseScheduler) getAbandonedSeqs(ctx context.Context, task *SchedulerTask, lane string, fromSeq, toSeq int64) (map[int64]bool, error) {
+	members, err := rs.redis.ZRangeByScore(ctx, keys.LaneKey(keys.AbandonedKey(task.TenantID, task.ActivityID), lane), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(fromSeq, 10),
+		Max: strconv.FormatInt(toSeq, 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	abandoned := make(map[int64]bool, len(members))
+	for _, member := range members {
+		abandoned[parseInt64(member, 0)] = true
+	}
+	return abandoned, nil
+}
+
+// popDueHoldsScript 取出並移除延後目標不超過 ARGV[1] 的暫緩 seq，最多 ARGV[2] 個
+var popDueHoldsScript = redis.NewScript(`
+local seqs = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, seq in ipairs(seqs) do
+	redis.call('ZREM', KEYS[1], seq)
+end
+return seqs
+`)
+
+// popDueHolds 取出可以釋放的風險延後用戶
+func (rs *ReleaseScheduler) popDueHolds(ctx context.Context, task *SchedulerTask, lane string, maxDue string, count int64) ([]int64, error) {
+	if count <= 0 {
+		return make([]int64, 0), nil
+	}
+
+	members, err := popDueHoldsScript.Run(ctx, rs.redis,
+		[]string{keys.LaneKey(keys.RiskHoldKey(task.TenantID, task.ActivityID), lane)},
+		maxDue, count,
+	).StringSlice()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	due := make([]int64, 0, count)
+	for _, member := range members {
+		due = append(due, parseInt64(member, 0))
+	}
+	return due, nil
+}
+
+// getHeldSeqs 回傳 (fromSeq, toSeq] 中因風險暫緩、輪到時不釋放的 seq
+func (rs *ReleaseScheduler) getHeldSeqs(ctx context.Context, task *SchedulerTask, lane string, fromSeq, toSeq int64) (map[int64]bool, error) {
+	if toSeq <= fromSeq {
+		return nil, nil
+	}
+
+	members := make([]string, 0, toSeq-fromSeq)
+	for seq := fromSeq + 1; seq <= toSeq; seq++ {
+		members = append(members, strconv.FormatInt(seq, 10))
+	}
+
+	scores, err := rs.redis.ZMScore(ctx, keys.LaneKey(keys.RiskHoldKey(task.TenantID, task.ActivityID), lane), members...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	held := make(map[int64]bool)
+	for i, due := range scores {
+		if due > 0 {
+			held[fromSeq+1+int64(i)] = true
+		}
+	}
+	return held, nil
+}
+
+// getStaleSeqs 回傳 (fromSeq, toSeq] 中超過寬限時間未輪詢的 seq
+// 沒有心跳記錄的 seq（例如舊版客戶端）視為在線
+func (rs *ReleaseScheduler) getStaleSeqs(ctx context.Context, task *SchedulerTask, lane string, fromSeq, toSeq int64, grace time.Duration) (map[int64]bool, error) {
+	if toSeq <= fromSeq {
+		return nil, nil
+	}
+
+	members := make([]string, 0, toSeq-fromSeq)
+	for seq := fromSeq + 1; seq <= toSeq; seq++ {
+		members = append(members, strconv.FormatInt(seq, 10))
+	}
+
+	scores, err := rs.redis.ZMScore(ctx, keys.LaneKey(keys.HeartbeatKey(task.TenantID, task.ActivityID), lane), members...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := float64(time.Now().Add(-grace).Unix())
+	stale := make(map[int64]bool)
+	for i, lastSeen := range scores {
+		if lastSeen > 0 && lastSeen < cutoff {
+			stale[fromSeq+1+int64(i)] = true
+		}
+	}
+	return stale, nil
+}
+
+// markInactive 記錄因離線被跳過的 seq，讓用戶回來輪詢時得知名額已失效
+func (rs *ReleaseScheduler) markInactive(ctx context.Context, task *SchedulerTask, lane string, stale map[int64]bool) {
+	if len(stale) == 0 {
+		return
+	}
+
+	members := make([]interface{}, 0, len(stale))
+	for seq := range stale {
+		members = append(members, seq)
+	}
+
+	key := keys.LaneKey(keys.InactiveKey(task.TenantID, task.ActivityID), lane)
+	pipe := rs.redis.Pipeline()
+	pipe.SAdd(ctx, key, members...)
+	pipe.Expire(ctx, key, 24*time.Hour)
+	pipe.IncrBy(ctx, keys.MetricsKey(task.TenantID, task.ActivityID, "inactive_total"), int64(len(stale)))
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to mark inactive seqs for activity %d: %v", task.ActivityID, err)
+	}
+}
+
+// clearHeartbeats 移除 (fromSeq, toSeq] 的心跳記錄，已越過的 seq 不再需要判斷存活
+func (rs *ReleaseScheduler) clearHeartbeats(ctx context.Context, task *SchedulerTask, lane string, fromSeq, toSeq int64) {
+	members := make([]interface{}, 0, toSeq-fromSeq)
+	for seq := fromSeq + 1; seq <= toSeq; seq++ {
+		members = append(members, seq)
+	}
+	rs.redis.ZRem(ctx, keys.LaneKey(keys.HeartbeatKey(task.TenantID, task.ActivityID), lane), members...)
+}
+
+// onReleased 為被釋放的 seq 記錄領取期限與租約
+func (rs *ReleaseScheduler) onReleased(ctx context.Context, task *SchedulerTask, cfg *schedulerConfig, lane string, released []int64, releasedAt time.Time) {
+	if len(released) == 0 {
+		return
+	}
+
+	if cfg.ClaimTimeout > 0 {
+		rs.trackPendingClaims(ctx, task, lane, released, releasedAt.Add(cfg.ClaimTimeout))
+	}
+
+	if cfg.isConcurrencyMode() {
+		if err := NewLeasePool(rs.redis).Acquire(ctx, task.TenantID, task.ActivityID, lane, released, cfg.LeaseTimeout); err != nil {
+			log.Printf("Failed to acquire leases for activity %d: %v", task.ActivityID, err)
+		}
+	}
+}
+
+// trackPendingClaims 記錄被釋放 seq 的領取期限
+func (rs *ReleaseScheduler) trackPendingClaims(ctx context.Context, task *SchedulerTask, lane string, released []int64, claimDeadline time.Time) {
+	deadline := float64(claimDeadline.Unix())
+
+	members := make([]*redis.Z, 0, len(released))
+	for _, seq := range released {
+		members = append(members, &redis.Z{Score: deadline, Member: seq})
+	}
+	if len(members) == 0 {
+		return
+	}
+
+	key := keys.LaneKey(keys.ClaimPendingKey(task.TenantID, task.ActivityID), lane)
+	pipe := rs.redis.Pipeline()
+	pipe.ZAdd(ctx, key, members...)
+	pipe.Expire(ctx, key, 24*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to track pending claims for activity %d: %v", task.ActivityID, err)
+	}
+}
+
+func (rs *ReleaseScheduler) takeReleaseCredit(ctx context.Context, tenantID string, activityID int64) int64 {
+	val, err := rs.redis.GetSet(ctx, keys.ReleaseCreditKey(tenantID, activityID), 0).Result()
+	if err != nil {
+		return 0
+	}
+	return parseInt64(val, 0)
+}
+
+func (rs *ReleaseScheduler) returnReleaseCredit(ctx context.Context, tenantID string, activityID int64, count int64) {
+	key := keys.ReleaseCreditKey(tenantID, activityID)
+	rs.redis.IncrBy(ctx, key, count)
+	rs.redis.Expire(ctx, key, 24*time.Hour)
+}
+
+func (rs *ReleaseScheduler) updateReclaimMetrics(ctx context.Context, tenantID string, activityID int64, count int64) {
+	key := keys.MetricsKey(tenantID, activityID, "claim_expired_total")
+	rs.redis.IncrBy(ctx, key, count)
+	rs.redis.Expire(ctx, key, 24*time.Hour)
+}
+
+// getActivityStatus 回傳排程中活動的狀態；活動已結束或排空期已過時 ok 為 false
+func (rs *ReleaseScheduler) getActivityStatus(ctx context.Context, activityID int64) (models.ActivityStatus, bool) {
 	query := `
-        SELECT COUNT(*) 
+        SELECT status 
         FROM activities 
         WHERE id = $1 
-        AND status = 'active' 
-        AND start_at <= NOW() 
-        AND end_at > NOW()`
+        AND ` + schedulableActivityCondition
 
-	var count int
-	err := rs.db.QueryRowContext(ctx, query, activityID).Scan(&count)
-	return err == nil && count > 0
+	var status models.ActivityStatus
+	err := rs.db.QueryRowContext(ctx, query, activityID).Scan(&status)
+	return status, err == nil
 }
 
 func (rs *ReleaseScheduler) recordReleaseEvent(ctx context.Context, event *ReleaseEvent) {
@@ -507,6 +1085,10 @@ func (rs *ReleaseScheduler) recordReleaseEvent(ctx context.Context, event *Relea
 	pipe.LPush(ctx, eventKey, eventData)
 	pipe.LTrim(ctx, eventKey, 0, 99) // 只保留最近 100 個事件
 	pipe.Expire(ctx, eventKey, time.Hour)
+	// 通知狀態串流重新計算位置
+	if event.NewSeq > event.PrevSeq {
+		publishQueueEvent(ctx, pipe, event.TenantID, event.ActivityID, queueEventRelease)
+	}
 	pipe.Exec(ctx)
 }
 
@@ -522,6 +1104,48 @@ func (rs *ReleaseScheduler) updateReleaseMetrics(ctx context.Context, tenantID s
 	rs.redis.Expire(ctx, hourKey, 2*time.Hour)
 }
 
+// concurrency 模式下檢查空出租約的間隔
+const concurrencyCheckInterval = 100 * time.Millisecond
+
+func newSchedulerConfig(initialStock int, config models.ActivityConfig) *schedulerConfig {
+	return &schedulerConfig{
+		ReleaseRate:    config.ReleaseRate,
+		ClaimTimeout:   time.Duration(config.ClaimTimeoutSeconds) * time.Second,
+		InitialStock:   initialStock,
+		ReleaseMode:    config.ReleaseMode,
+		MaxConcurrent:  config.MaxConcurrent,
+		LeaseTimeout:   time.Duration(config.LeaseTimeoutSeconds) * time.Second,
+		HeartbeatGrace: time.Duration(config.HeartbeatGraceSeconds) * time.Second,
+		Lanes:          config.AllLanes(),
+		LanePolicy:     config.LanePolicy,
+		AdmitAllowlist: config.AllowlistMode == models.AllowlistModeAdmit,
+	}
+}
+
+func (task *SchedulerTask) config() *schedulerConfig {
+	return task.cfg.Load()
+}
+
+func (task *SchedulerTask) setConfig(cfg *schedulerConfig) {
+	task.cfg.Store(cfg)
+}
+
+func (cfg *schedulerConfig) isConcurrencyMode() bool {
+	return cfg.ReleaseMode == models.ReleaseModeConcurrency && cfg.MaxConcurrent > 0
+}
+
+// releaseInterval 計算釋放間隔：rate 模式依速率，concurrency 模式定期檢查空出的租約
+func (cfg *schedulerConfig) releaseInterval() time.Duration {
+	interval := concurrencyCheckInterval
+	if cfg.ReleaseRate > 0 && !cfg.isConcurrencyMode() {
+		interval = time.Duration(1000/cfg.ReleaseRate) * time.Millisecond
+	}
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond // 最小間隔 10ms
+	}
+	return interval
+}
+
 func minInt64(a, b int64) int64 {
 	if a < b {
 		return a
@@ -0,0 +1,216 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newReclaimActivity() *models.Activity {
+	activity := newStreamActivity()
+	activity.Config.ClaimTimeoutSeconds = 60
+	return activity
+}
+
+func newReclaimTask(activity *models.Activity) *SchedulerTask {
+	task := &SchedulerTask{
+		ActivityID:  activity.ID,
+		TenantID:    activity.TenantID,
+		StopChan:    make(chan struct{}),
+		LastRelease: time.Now(),
+	}
+	task.setConfig(newSchedulerConfig(activity.InitialStock, activity.Config))
+	return task
+}
+
+// seedPendingClaims 以相對現在的秒數設定各 seq 的領取期限
+func seedPendingClaims(t *testing.T, mr *miniredis.Miniredis, activity *models.Activity, deadlines map[int64]int) {
+	t.Helper()
+
+	now := time.Now()
+	for seq, offset := range deadlines {
+		deadline := float64(now.Add(time.Duration(offset) * time.Second).Unix())
+		_, err := mr.ZAdd(keys.ClaimPendingKey(activity.TenantID, activity.ID), deadline, fmt.Sprint(seq))
+		require.NoError(t, err)
+	}
+}
+
+func releaseCredit(t *testing.T, mr *miniredis.Miniredis, activity *models.Activity) string {
+	t.Helper()
+
+	credit, err := mr.Get(keys.ReleaseCreditKey(activity.TenantID, activity.ID))
+	if err == miniredis.ErrKeyNotFound {
+		return "0"
+	}
+	require.NoError(t, err)
+	return credit
+}
+
+func TestExpireUnclaimedAdmissions_ReclaimsPastDeadlineOnly(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	rs := NewReleaseScheduler(nil, rdb)
+	s := NewQueueService(nil, rdb)
+	activity := newReclaimActivity()
+
+	seedPendingClaims(t, mr, activity, map[int64]int{6: -120, 7: -60, 8: 60})
+
+	task := newReclaimTask(activity)
+	count, err := rs.expireUnclaimedAdmissions(ctx, task, task.config())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	expired, err := mr.Members(keys.ClaimExpiredKey(activity.TenantID, activity.ID))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"6", "7"}, expired)
+	pending, err := mr.ZMembers(keys.ClaimPendingKey(activity.TenantID, activity.ID))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"8"}, pending)
+	assert.Equal(t, "2", releaseCredit(t, mr, activity))
+
+	// 已回收的 seq 不能再領取，期限內的照常領取
+	assert.ErrorContains(t, s.claimAdmission(ctx, activity.TenantID, activity.ID, "", 6), "claim window expired")
+	assert.NoError(t, s.claimAdmission(ctx, activity.TenantID, activity.ID, "", 8))
+}
+
+func TestExpireUnclaimedAdmissions_OldestDeadlineFirst(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	rs := NewReleaseScheduler(nil, rdb)
+	activity := newReclaimActivity()
+
+	// 超過單批上限時先回收期限最早的 seq
+	deadlines := make(map[int64]int, 1001)
+	for seq := int64(1); seq <= 1000; seq++ {
+		deadlines[seq] = -120
+	}
+	deadlines[1001] = -60
+	seedPendingClaims(t, mr, activity, deadlines)
+	task := newReclaimTask(activity)
+
+	count, err := rs.expireUnclaimedAdmissions(ctx, task, task.config())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), count)
+	pending, err := mr.ZMembers(keys.ClaimPendingKey(activity.TenantID, activity.ID))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1001"}, pending)
+
+	// 下一輪回收剩下的
+	count, err = rs.expireUnclaimedAdmissions(ctx, task, task.config())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, "1001", releaseCredit(t, mr, activity))
+}
+
+func TestExpireUnclaimedAdmissions_ReclaimsOnce(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	rs := NewReleaseScheduler(nil, rdb)
+	s := NewQueueService(nil, rdb)
+	activity := newReclaimActivity()
+	task := newReclaimTask(activity)
+
+	seedPendingClaims(t, mr, activity, map[int64]int{6: -60, 7: -60, 8: -60})
+
+	// 回收前已領取或已退回的 seq 不再回收，也不重複退回配額
+	require.NoError(t, s.claimAdmission(ctx, activity.TenantID, activity.ID, "", 7))
+	s.returnAdmission(ctx, activity, "", 8)
+	assert.Equal(t, "1", releaseCredit(t, mr, activity))
+
+	count, err := rs.expireUnclaimedAdmissions(ctx, task, task.config())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, "2", releaseCredit(t, mr, activity))
+
+	// 再跑一次不會重複回收
+	count, err = rs.expireUnclaimedAdmissions(ctx, task, task.config())
+	require.NoError(t, err)
+	assert.Zero(t, count)
+	assert.Equal(t, "2", releaseCredit(t, mr, activity))
+
+	// 回收後的退回不再增加配額
+	s.returnAdmission(ctx, activity, "", 6)
+	assert.Equal(t, "2", releaseCredit(t, mr, activity))
+
+	expired, err := mr.Members(keys.ClaimExpiredKey(activity.TenantID, activity.ID))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"6"}, expired)
+}
+
+func TestPerformRelease_ReclaimsBeforeReleasing(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	rs := NewReleaseScheduler(db, rdb)
+	activity := newReclaimActivity()
+	task := newReclaimTask(activity)
+
+	seedQueue(t, mr, activity, 20, 5, nil)
+	seedPendingClaims(t, mr, activity, map[int64]int{4: -60, 5: -30})
+
+	mock.ExpectQuery("SELECT status").WithArgs(activity.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(models.StatusActive))
+
+	// 同一輪先回收逾時名額，再連同配額一起釋放：1 個速率名額加 2 個退回名額
+	require.NoError(t, rs.performRelease(ctx, task))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	releaseSeq, err := mr.Get(keys.ReleaseSeqKey(activity.TenantID, activity.ID))
+	require.NoError(t, err)
+	assert.Equal(t, "8", releaseSeq)
+	assert.Equal(t, "0", releaseCredit(t, mr, activity))
+
+	pending, err := mr.ZMembers(keys.ClaimPendingKey(activity.TenantID, activity.ID))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"6", "7", "8"}, pending)
+	expired, err := mr.Members(keys.ClaimExpiredKey(activity.TenantID, activity.ID))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"4", "5"}, expired)
+}
+
+func TestSyncActiveActivities_SwapsConfigSnapshot(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	rs := NewReleaseScheduler(db, rdb)
+	activity := newReclaimActivity()
+	task := newReclaimTask(activity)
+	rs.running[activity.ID] = task
+
+	before := task.config()
+	assert.Equal(t, 100*time.Millisecond, before.releaseInterval())
+
+	mock.ExpectQuery("SELECT id, tenant_id, initial_stock, config_json").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "initial_stock", "config_json"}).
+			AddRow(activity.ID, activity.TenantID, 50,
+				[]byte(`{"release_rate":50,"claim_timeout_seconds":30,"lanes":[{"name":"vip"}]}`)))
+
+	require.NoError(t, rs.syncActiveActivities(ctx))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// 舊快照維持不變，新設定整份替換
+	assert.Equal(t, activity.InitialStock, before.InitialStock)
+	assert.Equal(t, 60*time.Second, before.ClaimTimeout)
+	assert.Len(t, before.Lanes, 1)
+
+	after := task.config()
+	assert.Equal(t, 50, after.InitialStock)
+	assert.Equal(t, 30*time.Second, after.ClaimTimeout)
+	assert.Len(t, after.Lanes, 2)
+	assert.Equal(t, 20*time.Millisecond, after.releaseInterval())
+}
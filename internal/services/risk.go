@@ -0,0 +1,508 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 風險評估：依瀏覽器指紋被多少 user_hash 使用、同一子網段的進入爆量與不可能的輪詢節奏計分。
+// 高風險用戶不回傳錯誤，而是照常分配序號後暫緩釋放（shadow 永不釋放、penalize 延後若干位置），
+// 回應與一般等待者相同，機器人無法從回應得知已被識別。評估結果保存在 RiskScoresKey 與 queue_entries。
+
+const (
+	RiskReasonFingerprintReuse   = "fingerprint_reuse"
+	RiskReasonSubnetBurst        = "subnet_burst"
+	RiskReasonPollCadence        = "poll_cadence"
+	RiskReasonMissingFingerprint = "missing_fingerprint"
+)
+
+const (
+	// 同一指紋的 user_hash 超過門檻（risk_fingerprint_users）開始計分，每多一個加 riskFingerprintWeight
+	defaultRiskFingerprintUsers = 3
+	riskFingerprintWeight       = 20
+	riskFingerprintMax          = 60
+	// 同一子網段（IPv4 /24、IPv6 /64）每分鐘進入次數超過門檻（risk_subnet_burst）計分，超過三倍加重
+	defaultRiskSubnetBurst = 30
+	riskSubnetScore        = 30
+	riskSubnetHeavyScore   = 50
+	// 輪詢間隔短於 poll_interval / riskPollFraction 記一次，達門檻（risk_poll_strikes）次開始計分
+	riskPollFraction       = 4
+	defaultRiskPollStrikes = 3
+	riskPollWeight         = 10
+	riskPollMax            = 50
+	// 未帶瀏覽器指紋
+	riskMissingFingerprintScore = 10
+
+	riskMaxScore = 100
+
+	// 未設定 risk_penalty_positions 時延後的位置數
+	defaultRiskPenaltyPositions = 500
+
+	// 風險狀態保留時間
+	riskStateTTL = 24 * time.Hour
+
+	// 非同步寫回 queue_entries 的期限，資料庫緩慢時不累積協程
+	riskEntryWriteTimeout = 5 * time.Second
+)
+
+// RiskSignals 為計分依據的原始訊號
+type RiskSignals struct {
+	FingerprintUsers   int64 `json:"fingerprint_users"`
+	SubnetEntries      int64 `json:"subnet_entries"`
+	PollStrikes        int64 `json:"poll_strikes"`
+	MissingFingerprint bool  `json:"missing_fingerprint,omitempty"`
+}
+
+// RiskAssessment 為單一會話的風險評估結果
+type RiskAssessment struct {
+	Score     int               `json:"score"`
+	Reasons   []string          `json:"reasons"`
+	Action    models.RiskAction `json:"action"`
+	Signals   RiskSignals       `json:"signals"`
+	Seq       int64             `json:"seq,omitempty"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// pollCadenceScript 記錄輪詢時間；與上次輪詢相隔少於 ARGV[2] 毫秒時累計一次並回傳次數，否則回傳 0
+var pollCadenceScript = redis.NewScript(`
+local last = tonumber(redis.call('HGET', KEYS[1], 'last'))
+redis.call('HSET', KEYS[1], 'last', ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+if last and tonumber(ARGV[1]) - last < tonumber(ARGV[2]) then
+	return redis.call('HINCRBY', KEYS[1], 'strikes', 1)
+end
+return 0
+`)
+
+// riskThresholds 為活動的計分門檻
+type riskThresholds struct {
+	fingerprintUsers int64
+	subnetBurst      int64
+	pollStrikes      int64
+}
+
+// activityRiskThresholds 回傳活動設定的計分門檻，未設定的使用預設值
+func activityRiskThresholds(config models.ActivityConfig) riskThresholds {
+	t := riskThresholds{
+		fingerprintUsers: defaultRiskFingerprintUsers,
+		subnetBurst:      defaultRiskSubnetBurst,
+		pollStrikes:      defaultRiskPollStrikes,
+	}
+	if config.RiskFingerprintUsers > 0 {
+		t.fingerprintUsers = int64(config.RiskFingerprintUsers)
+	}
+	if config.RiskSubnetBurst > 0 {
+		t.subnetBurst = int64(config.RiskSubnetBurst)
+	}
+	if config.RiskPollStrikes > 0 {
+		t.pollStrikes = int64(config.RiskPollStrikes)
+	}
+	return t
+}
+
+// scoreRisk 依訊號與門檻計算風險分數與原因
+func scoreRisk(t riskThresholds, signals RiskSignals) (int, []string) {
+	score := 0
+	reasons := make([]string, 0)
+
+	if signals.FingerprintUsers > t.fingerprintUsers {
+		score += int(minInt64((signals.FingerprintUsers-t.fingerprintUsers)*riskFingerprintWeight, riskFingerprintMax))
+		reasons = append(reasons, RiskReasonFingerprintReuse)
+	}
+
+	if signals.SubnetEntries > 3*t.subnetBurst {
+		score += riskSubnetHeavyScore
+		reasons = append(reasons, RiskReasonSubnetBurst)
+	} else if signals.SubnetEntries > t.subnetBurst {
+		score += riskSubnetScore
+		reasons = append(reasons, RiskReasonSubnetBurst)
+	}
+
+	if signals.PollStrikes >= t.pollStrikes {
+		score += int(minInt64(signals.PollStrikes*riskPollWeight, riskPollMax))
+		reasons = append(reasons, RiskReasonPollCadence)
+	}
+
+	if signals.MissingFingerprint {
+		score += riskMissingFingerprintScore
+		reasons = append(reasons, RiskReasonMissingFingerprint)
+	}
+
+	if score > riskMaxScore {
+		score = riskMaxScore
+	}
+	return score, reasons
+}
+
+// riskAction 依活動設定的門檻決定處置
+func riskAction(config models.ActivityConfig, score int) models.RiskAction {
+	if config.RiskShadowScore > 0 && score >= config.RiskShadowScore {
+		return models.RiskActionShadow
+	}
+	if config.RiskPenaltyScore > 0 && score >= config.RiskPenaltyScore {
+		return models.RiskActionPenalize
+	}
+	return models.RiskActionAllow
+}
+
+// riskSeverity 用於比較處置輕重，評估只會升級不會降級
+func riskSeverity(action models.RiskAction) int {
+	switch action {
+	case models.RiskActionShadow:
+		return 2
+	case models.RiskActionPenalize:
+		return 1
+	}
+	return 0
+}
+
+func riskPenaltyPositions(activity *models.Activity) int64 {
+	if activity.Config.RiskPenaltyPositions > 0 {
+		return int64(activity.Config.RiskPenaltyPositions)
+	}
+	return defaultRiskPenaltyPositions
+}
+
+// clientSubnet 回傳 IP 所屬的子網段：IPv4 取 /24，IPv6 取 /64；無法解析時回傳空字串
+func clientSubnet(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+func hashFingerprint(fingerprint string) string {
+	hash := sha256.Sum256([]byte(fingerprint))
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// assessEntry 讀取進入訊號並計算風險分數，訊號已計入本次進入。計數只在取得序號或完成登記後
+// 由 recordRiskSignals 寫入，重複進入與被拒絕的請求不會推高計數
+func (s *QueueService) assessEntry(ctx context.Context, activity *models.Activity, req *EnterQueueRequest) *RiskAssessment {
+	signals := RiskSignals{MissingFingerprint: req.Fingerprint == ""}
+
+	pipe := s.redis.Pipeline()
+	var fingerprintCmd *redis.IntCmd
+	var memberCmd *redis.BoolCmd
+	if req.Fingerprint != "" {
+		fingerprintKey := keys.RiskFingerprintKey(activity.TenantID, activity.ID, hashFingerprint(req.Fingerprint))
+		fingerprintCmd = pipe.SCard(ctx, fingerprintKey)
+		memberCmd = pipe.SIsMember(ctx, fingerprintKey, req.UserHash)
+	}
+	subnetKeys := s.riskSubnetKeys(activity, req.IPAddress, time.Now())
+	subnetCmds := make([]*redis.StringCmd, len(subnetKeys))
+	for i, subnetKey := range subnetKeys {
+		subnetCmds[i] = pipe.Get(ctx, subnetKey)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		log.Printf("Failed to read risk signals for activity %d: %v", activity.ID, err)
+	}
+
+	if fingerprintCmd != nil {
+		signals.FingerprintUsers = fingerprintCmd.Val()
+		if !memberCmd.Val() {
+			signals.FingerprintUsers++
+		}
+	}
+	if len(subnetCmds) > 0 {
+		signals.SubnetEntries = 1
+		for _, cmd := range subnetCmds {
+			signals.SubnetEntries += parseInt64(cmd.Val(), 0)
+		}
+	}
+
+	score, reasons := scoreRisk(activityRiskThresholds(activity.Config), signals)
+	return &RiskAssessment{
+		Score:     score,
+		Reasons:   reasons,
+		Action:    riskAction(activity.Config, score),
+		Signals:   signals,
+		UpdatedAt: time.Now(),
+	}
+}
+
+// recordRiskSignals 記錄已取得序號或完成登記的進入，計入之後的評估
+func (s *QueueService) recordRiskSignals(ctx context.Context, activity *models.Activity, req *EnterQueueRequest) {
+	pipe := s.redis.Pipeline()
+	if req.Fingerprint != "" {
+		fingerprintKey := keys.RiskFingerprintKey(activity.TenantID, activity.ID, hashFingerprint(req.Fingerprint))
+		pipe.SAdd(ctx, fingerprintKey, req.UserHash)
+		pipe.Expire(ctx, fingerprintKey, riskStateTTL)
+	}
+	if subnetKeys := s.riskSubnetKeys(activity, req.IPAddress, time.Now()); len(subnetKeys) > 0 {
+		pipe.Incr(ctx, subnetKeys[0])
+		pipe.Expire(ctx, subnetKeys[0], 2*time.Minute)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record risk signals for activity %d: %v", activity.ID, err)
+	}
+}
+
+// riskSubnetKeys 回傳子網段每分鐘進入計數的鍵，第一個以目前的金鑰計算；
+// 金鑰輪替的寬限期內一併列出舊雜湊的鍵，計數不會因換金鑰歸零
+func (s *QueueService) riskSubnetKeys(activity *models.Activity, ip string, now time.Time) []string {
+	subnet := clientSubnet(ip)
+	if subnet == "" {
+		return nil
+	}
+	hashes := s.ipHasher.Candidates(subnet, now)
+	subnetKeys := make([]string, len(hashes))
+	for i, subnetHash := range hashes {
+		subnetKeys[i] = keys.RiskSubnetKey(activity.TenantID, activity.ID, subnetHash, now.Unix()/60)
+	}
+	return subnetKeys
+}
+
+// applyRisk 保存已分配序號會話的評估結果，高風險者暫緩釋放
+func (s *QueueService) applyRisk(ctx context.Context, activity *models.Activity, lane, sessionID string, seq int64, risk *RiskAssessment) {
+	if risk.Score == 0 {
+		return
+	}
+	risk.Seq = seq
+
+	data, _ := json.Marshal(risk)
+	scoresKey := keys.RiskScoresKey(activity.TenantID, activity.ID)
+	pipe := s.redis.Pipeline()
+	pipe.HSet(ctx, scoresKey, sessionID, data)
+	pipe.Expire(ctx, scoresKey, riskStateTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to save risk assessment for activity %d: %v", activity.ID, err)
+	}
+
+	s.holdForRisk(ctx, activity, lane, seq, risk.Action)
+}
+
+// holdForRisk 讓排程器跳過高風險的 seq：shadow 永不釋放，penalize 在 release_seq 越過 seq + 延後位置數後才釋放
+func (s *QueueService) holdForRisk(ctx context.Context, activity *models.Activity, lane string, seq int64, action models.RiskAction) {
+	var due float64
+	switch action {
+	case models.RiskActionShadow:
+		due = math.Inf(1)
+	case models.RiskActionPenalize:
+		due = float64(seq + riskPenaltyPositions(activity))
+	default:
+		return
+	}
+
+	holdKey := keys.LaneKey(keys.RiskHoldKey(activity.TenantID, activity.ID), lane)
+	pipe := s.redis.Pipeline()
+	pipe.ZAdd(ctx, holdKey, &redis.Z{Score: due, Member: seq})
+	pipe.Expire(ctx, holdKey, riskStateTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to hold seq %d for activity %d: %v", seq, activity.ID, err)
+		return
+	}
+
+	s.updateMetrics(ctx, activity.TenantID, activity.ID, "risk_"+string(action))
+}
+
+// riskHold 回傳 seq 的暫緩目標；未暫緩時 held 為 false
+func (s *QueueService) riskHold(ctx context.Context, activity *models.Activity, lane string, seq int64) (float64, bool) {
+	due, err := s.redis.ZScore(ctx, keys.LaneKey(keys.RiskHoldKey(activity.TenantID, activity.ID), lane), strconv.FormatInt(seq, 10)).Result()
+	if err != nil {
+		return 0, false
+	}
+	return due, true
+}
+
+// removeRiskHold 移除暫緩記錄，回傳 seq 是否仍在暫緩中
+func (s *QueueService) removeRiskHold(ctx context.Context, activity *models.Activity, lane string, seq int64) bool {
+	removed, err := s.redis.ZRem(ctx, keys.LaneKey(keys.RiskHoldKey(activity.TenantID, activity.ID), lane), strconv.FormatInt(seq, 10)).Result()
+	return err == nil && removed > 0
+}
+
+// countDeferred 回傳通道中等待延後釋放（非 shadow）的風險用戶數
+func countDeferred(ctx context.Context, rdb *redis.Client, tenantID string, activityID int64, lane string) int64 {
+	count, err := rdb.ZCount(ctx, keys.LaneKey(keys.RiskHoldKey(tenantID, activityID), lane), "-inf", "(+inf").Result()
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// heldPosition 回傳暫緩中用戶顯示的位置，至少為 1：penalize 以暫緩目標計算；
+// shadow 與 penalize 一樣先延後 penalty 個位置，release_seq 每越過目標一次再延後一輪，位置不會停在第 1 位
+func heldPosition(seq, releaseSeq int64, due float64, penalty int64) int64 {
+	target := seq + penalty
+	if !math.IsInf(due, 1) {
+		target = int64(due)
+	} else if penalty > 0 && target <= releaseSeq {
+		target += ((releaseSeq-target)/penalty + 1) * penalty
+	}
+	if target <= releaseSeq {
+		return 1
+	}
+	return target - releaseSeq
+}
+
+// trackPollCadence 記錄等待中用戶的輪詢節奏，過快的輪詢累計到一定次數後重新評分
+func (s *QueueService) trackPollCadence(ctx context.Context, activity *models.Activity, lane, sessionID string, seq int64) {
+	minGap := activity.Config.PollInterval / riskPollFraction
+	if minGap <= 0 {
+		return
+	}
+
+	strikes, err := pollCadenceScript.Run(ctx, s.redis,
+		[]string{keys.RiskPollKey(activity.TenantID, activity.ID, sessionID)},
+		time.Now().UnixMilli(), minGap, int(riskStateTTL.Seconds()),
+	).Int64()
+	if err != nil || strikes < activityRiskThresholds(activity.Config).pollStrikes {
+		return
+	}
+
+	s.escalateRisk(ctx, activity, lane, sessionID, seq, strikes)
+}
+
+// escalateRisk 以新的輪詢訊號重新評分，處置加重時暫緩釋放並更新資料庫記錄
+func (s *QueueService) escalateRisk(ctx context.Context, activity *models.Activity, lane, sessionID string, seq int64, pollStrikes int64) {
+	scoresKey := keys.RiskScoresKey(activity.TenantID, activity.ID)
+
+	risk := &RiskAssessment{Action: models.RiskActionAllow}
+	data, err := s.redis.HGet(ctx, scoresKey, sessionID).Bytes()
+	if err != nil && err != redis.Nil {
+		log.Printf("Failed to load risk assessment for activity %d: %v", activity.ID, err)
+		return
+	}
+	// 無法解讀的記錄不覆寫，避免遺失先前的訊號與處置
+	if err == nil {
+		if err := json.Unmarshal(data, risk); err != nil {
+			log.Printf("Failed to decode risk assessment for activity %d: %v", activity.ID, err)
+			return
+		}
+	}
+	previous := risk.Action
+
+	risk.Signals.PollStrikes = pollStrikes
+	risk.Score, risk.Reasons = scoreRisk(activityRiskThresholds(activity.Config), risk.Signals)
+	risk.Seq = seq
+	risk.UpdatedAt = time.Now()
+	if action := riskAction(activity.Config, risk.Score); riskSeverity(action) > riskSeverity(previous) {
+		risk.Action = action
+	}
+
+	data, _ = json.Marshal(risk)
+	pipe := s.redis.Pipeline()
+	pipe.HSet(ctx, scoresKey, sessionID, data)
+	pipe.Expire(ctx, scoresKey, riskStateTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to save risk assessment for activity %d: %v", activity.ID, err)
+	}
+
+	if risk.Action != previous {
+		s.holdForRisk(ctx, activity, lane, seq, risk.Action)
+	}
+
+	go s.updateEntryRisk(context.Background(), activity.ID, sessionID, risk)
+}
+
+func (s *QueueService) updateEntryRisk(ctx context.Context, activityID int64, sessionID string, risk *RiskAssessment) {
+	ctx, cancel := context.WithTimeout(ctx, riskEntryWriteTimeout)
+	defer cancel()
+
+	reasons, _ := json.Marshal(risk.Reasons)
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE queue_entries
+        SET risk_score = $1, risk_reasons = $2, risk_action = $3
+        WHERE activity_id = $4 AND session_id = $5`,
+		risk.Score, reasons, risk.Action, activityID, sessionID)
+	if err != nil {
+		log.Printf("Failed to update risk for activity %d: %v", activityID, err)
+	}
+}
+
+type RiskListRequest struct {
+	MinScore int               `form:"min_score"`
+	Action   models.RiskAction `form:"action"`
+	Limit    int               `form:"limit"`
+	Offset   int               `form:"offset"`
+}
+
+// ListRiskEntries 依風險分數由高到低列出活動的隊列記錄
+func (s *AdminService) ListRiskEntries(ctx context.Context, activityID int64, req *RiskListRequest) ([]*models.QueueEntry, error) {
+	limit := req.Limit
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	minScore := req.MinScore
+	if minScore <= 0 {
+		minScore = 1
+	}
+
+	query := `
+        SELECT id, activity_id, user_hash, session_id, seq_number, COALESCE(fingerprint, ''), COALESCE(ip_hash, ''),
+               COALESCE(ip_hash_key, ''), created_at, abandoned_at, risk_score, risk_reasons, risk_action
+        FROM queue_entries
+        WHERE activity_id = $1
+        AND risk_score >= $2
+        AND ($3 = '' OR risk_action = $3)
+        ORDER BY risk_score DESC, id
+        LIMIT $4 OFFSET $5`
+
+	rows, err := s.db.QueryContext(ctx, query, activityID, minScore, string(req.Action), limit, max(0, int64(req.Offset)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query risk entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]*models.QueueEntry, 0)
+	for rows.Next() {
+		var entry models.QueueEntry
+		var reasons []byte
+		err := rows.Scan(
+			&entry.ID, &entry.ActivityID, &entry.UserHash, &entry.SessionID, &entry.SeqNumber,
+			&entry.Fingerprint, &entry.IPHash, &entry.IPHashKey, &entry.CreatedAt, &entry.AbandonedAt,
+			&entry.RiskScore, &reasons, &entry.RiskAction,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan risk entry: %w", err)
+		}
+		// 無法解讀的原因只記錄錯誤，分數與處置照常列出
+		if len(reasons) > 0 {
+			if err := json.Unmarshal(reasons, &entry.RiskReasons); err != nil {
+				log.Printf("Failed to decode risk reasons of entry %d for activity %d: %v", entry.ID, activityID, err)
+			}
+		}
+		entries = append(entries, &entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// GetSessionRisk 回傳會話目前的風險評估（含輪詢節奏的更新）
+func (s *AdminService) GetSessionRisk(ctx context.Context, activityID int64, sessionID string) (*RiskAssessment, error) {
+	activity, err := s.getActivity(ctx, activityID)
+	if err != nil {
+		return nil, fmt.Errorf("activity not found: %w", err)
+	}
+
+	data, err := s.redis.HGet(ctx, keys.RiskScoresKey(activity.TenantID, activity.ID), sessionID).Bytes()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("risk assessment not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get risk assessment: %w", err)
+	}
+
+	var risk RiskAssessment
+	if err := json.Unmarshal(data, &risk); err != nil {
+		return nil, fmt.Errorf("failed to decode risk assessment: %w", err)
+	}
+	return &risk, nil
+}
@@ -0,0 +1,462 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// 即時狀態推送：release_seq 前進或活動狀態改變時在 Redis 發布事件，每個實例以單一 pattern
+// 訂閱並分派給本機的串流連線（SSE、WebSocket），連線收到事件後才重新計算狀態，取代定期輪詢。
+// 每個活動在本機只維護一份隊列快照，每個事件只查詢一次 Redis，各連線的位置由快照推導。
+
+// 隊列事件類型
+const (
+	queueEventRelease  = "release"  // release_seq 前進
+	queueEventActivity = "activity" // 活動狀態或設定改變，需重新載入活動
+)
+
+const (
+	// 同一連線兩次計算狀態的最短間隔，釋放頻繁時合併事件
+	streamMinRefresh = time.Second
+	// 沒有事件時完整重新計算狀態的間隔（驗證會話、更新在線心跳），同時作為連線心跳
+	streamRefreshInterval = 15 * time.Second
+	// 重新載入活動的間隔，涵蓋沒有發布事件的設定變更
+	streamActivityTTL = 30 * time.Second
+)
+
+// StatusBroker 訂閱所有活動的隊列事件，分派給本機的狀態串流
+type StatusBroker struct {
+	redis       *redis.Client
+	pubsub      *redis.PubSub
+	mu          sync.Mutex
+	subscribers map[string]map[*statusSubscription]struct{}
+	// 各活動的隊列快照，最後一個訂閱者離開時移除
+	snapshots map[string]*snapshotEntry
+	stopChan  chan struct{}
+	wg        sync.WaitGroup
+}
+
+// statusSubscription 只保留「有新事件」的旗標，串流處理較慢時多個事件會合併為一次
+type statusSubscription struct {
+	notify chan struct{}
+}
+
+// snapshotEntry 快取單一活動的隊列快照；事件只標記過期，由第一個取用的連線重新計算
+type snapshotEntry struct {
+	mu       sync.Mutex
+	snapshot *queueSnapshot
+	stale    atomic.Bool // 隊列進度已改變
+	reload   atomic.Bool // 活動狀態或設定已改變
+}
+
+func NewStatusBroker(redis *redis.Client) *StatusBroker {
+	return &StatusBroker{
+		redis:       redis,
+		subscribers: make(map[string]map[*statusSubscription]struct{}),
+		snapshots:   make(map[string]*snapshotEntry),
+		stopChan:    make(chan struct{}),
+	}
+}
+
+func (b *StatusBroker) Start(ctx context.Context) error {
+	log.Println("Starting Status Broker...")
+
+	b.pubsub = b.redis.PSubscribe(ctx, keys.QueueEventsPattern())
+	if _, err := b.pubsub.Receive(ctx); err != nil {
+		return fmt.Errorf("failed to subscribe queue events: %w", err)
+	}
+
+	b.wg.Add(1)
+	go b.run(ctx)
+	return nil
+}
+
+func (b *StatusBroker) Stop() {
+	log.Println("Stopping Status Broker...")
+	close(b.stopChan)
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	b.wg.Wait()
+	log.Println("Status Broker stopped")
+}
+
+func (b *StatusBroker) run(ctx context.Context) {
+	defer b.wg.Done()
+
+	messages := b.pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.stopChan:
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			b.dispatch(msg.Channel, msg.Payload)
+		}
+	}
+}
+
+func (b *StatusBroker) dispatch(channel, event string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if entry := b.snapshots[channel]; entry != nil {
+		if event == queueEventActivity {
+			entry.reload.Store(true)
+		}
+		entry.stale.Store(true)
+	}
+	for sub := range b.subscribers[channel] {
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *StatusBroker) subscribe(channel string) *statusSubscription {
+	sub := &statusSubscription{notify: make(chan struct{}, 1)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[channel] == nil {
+		b.subscribers[channel] = make(map[*statusSubscription]struct{})
+	}
+	b.subscribers[channel][sub] = struct{}{}
+	return sub
+}
+
+func (b *StatusBroker) unsubscribe(channel string, sub *statusSubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers[channel], sub)
+	if len(b.subscribers[channel]) == 0 {
+		delete(b.subscribers, channel)
+		delete(b.snapshots, channel)
+	}
+}
+
+// snapshot 回傳活動目前的隊列快照，過期時重新計算；同時取用的連線等待同一次計算
+func (b *StatusBroker) snapshot(ctx context.Context, s *QueueService, channel string, activityID int64) (*queueSnapshot, error) {
+	b.mu.Lock()
+	entry := b.snapshots[channel]
+	if entry == nil {
+		entry = &snapshotEntry{}
+		b.snapshots[channel] = entry
+	}
+	b.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	reload := entry.reload.Swap(false)
+	stale := entry.stale.Swap(false)
+	current := entry.snapshot
+	if current != nil && !reload && time.Since(current.activityLoadedAt) > streamActivityTTL {
+		reload = true
+	}
+	if current != nil && !reload && !stale {
+		return current, nil
+	}
+
+	var activity *models.Activity
+	loadedAt := time.Now()
+	if current != nil && !reload {
+		activity, loadedAt = current.activity, current.activityLoadedAt
+	} else {
+		var err error
+		if activity, err = s.getActivity(ctx, activityID); err != nil {
+			entry.reload.Store(reload)
+			entry.stale.Store(stale)
+			return nil, fmt.Errorf("activity not found: %w", err)
+		}
+	}
+
+	snap, err := s.loadQueueSnapshot(ctx, activity)
+	if err != nil {
+		entry.reload.Store(reload)
+		entry.stale.Store(stale)
+		return nil, err
+	}
+	snap.activityLoadedAt = loadedAt
+	entry.snapshot = snap
+	return snap, nil
+}
+
+// queueSnapshot 是活動在某一時刻的隊列進度，同一實例上的串流連線共用
+type queueSnapshot struct {
+	activity         *models.Activity
+	activityLoadedAt time.Time
+	lanes            map[string]*laneSnapshot // 以通道 scope 為鍵
+	soldOut          bool
+	waiting          int64 // 所有通道合計的等待人數
+}
+
+type laneSnapshot struct {
+	releaseSeq int64
+	queueSeq   int64
+	abandoned  []int64 // 尚未越過的已離開 seq，遞增排序
+	holds      map[int64]float64
+}
+
+// loadQueueSnapshot 以一次 pipeline 讀取所有通道的隊列進度
+func (s *QueueService) loadQueueSnapshot(ctx context.Context, activity *models.Activity) (*queueSnapshot, error) {
+	scopes := make([]string, 0, len(activity.Config.Lanes)+2)
+	for _, lane := range activity.Config.AllLanes() {
+		scopes = append(scopes, laneScope(lane.Name))
+	}
+	// admit 模式的名單通道不計入等待人數
+	waitingLanes := len(scopes)
+	if activity.Config.AllowlistMode == models.AllowlistModeAdmit {
+		scopes = append(scopes, allowlistAdmitLane)
+	}
+
+	pipe := s.redis.Pipeline()
+	queueSeqCmds := make([]*redis.StringCmd, len(scopes))
+	releaseSeqCmds := make([]*redis.StringCmd, len(scopes))
+	abandonedCmds := make([]*redis.ZSliceCmd, len(scopes))
+	holdCmds := make([]*redis.ZSliceCmd, len(scopes))
+	for i, scope := range scopes {
+		queueSeqCmds[i] = pipe.Get(ctx, keys.LaneKey(keys.QueueSeqKey(activity.TenantID, activity.ID), scope))
+		releaseSeqCmds[i] = pipe.Get(ctx, keys.LaneKey(keys.ReleaseSeqKey(activity.TenantID, activity.ID), scope))
+		abandonedCmds[i] = pipe.ZRangeWithScores(ctx, keys.LaneKey(keys.AbandonedKey(activity.TenantID, activity.ID), scope), 0, -1)
+		holdCmds[i] = pipe.ZRangeWithScores(ctx, keys.LaneKey(keys.RiskHoldKey(activity.TenantID, activity.ID), scope), 0, -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to load queue snapshot: %w", err)
+	}
+
+	snap := &queueSnapshot{
+		activity: activity,
+		lanes:    make(map[string]*laneSnapshot, len(scopes)),
+		soldOut:  s.isSoldOut(ctx, activity),
+	}
+	for i, scope := range scopes {
+		l := &laneSnapshot{
+			releaseSeq: parseInt64(releaseSeqCmds[i].Val(), 0),
+			queueSeq:   parseInt64(queueSeqCmds[i].Val(), 0),
+			holds:      make(map[int64]float64, len(holdCmds[i].Val())),
+		}
+		// ZSET 依分數（即 seq）遞增排列
+		for _, z := range abandonedCmds[i].Val() {
+			if seq := int64(z.Score); seq > l.releaseSeq && seq <= l.queueSeq {
+				l.abandoned = append(l.abandoned, seq)
+			}
+		}
+		for _, z := range holdCmds[i].Val() {
+			member, _ := z.Member.(string)
+			l.holds[parseInt64(member, 0)] = z.Score
+		}
+		snap.lanes[scope] = l
+		if i < waitingLanes {
+			snap.waiting += l.queueSeq - l.releaseSeq - int64(len(l.abandoned))
+		}
+	}
+	return snap, nil
+}
+
+// progress 由快照推導單一會話的隊列進度
+func (snap *queueSnapshot) progress(lane string, seq int64) *queueProgress {
+	l := snap.lanes[lane]
+	if l == nil {
+		l = &laneSnapshot{}
+	}
+
+	p := &queueProgress{
+		releaseSeq:  l.releaseSeq,
+		queueSeq:    l.queueSeq,
+		queueLength: l.queueSeq - l.releaseSeq - int64(len(l.abandoned)),
+		soldOut:     snap.soldOut,
+	}
+	if limit := snap.activity.Config.MaxQueueSize; limit > 0 {
+		p.waiting = snap.waiting
+		p.queueFull = snap.waiting >= int64(limit)
+	}
+	if seq > l.releaseSeq {
+		p.abandonedAhead = int64(sort.Search(len(l.abandoned), func(i int) bool { return l.abandoned[i] >= seq }))
+	}
+	p.holdDue, p.held = l.holds[seq]
+	return p
+}
+
+// SetStatusBroker 設定隊列事件的分派；未設定時狀態串流只依 streamRefreshInterval 定期更新
+func (s *QueueService) SetStatusBroker(broker *StatusBroker) {
+	s.statusBroker = broker
+}
+
+// publishQueueEvent 通知訂閱該活動的狀態串流
+func publishQueueEvent(ctx context.Context, rdb redis.Cmdable, tenantID string, activityID int64, event string) {
+	rdb.Publish(ctx, keys.QueueEventsChannel(tenantID, activityID), event)
+}
+
+// StatusWatcher 追蹤單一會話的隊列狀態，只在狀態改變時回傳，供 SSE / WebSocket 連線使用。
+// 事件觸發的更新由活動快照推導；定期更新則完整計算，驗證會話並更新在線心跳
+type StatusWatcher struct {
+	s           *QueueService
+	req         QueueStatusRequest
+	activity    *models.Activity
+	loadedAt    time.Time
+	channel     string
+	sub         *statusSubscription
+	last        []byte
+	refreshedAt time.Time
+}
+
+// WatchQueueStatus 驗證會話並回傳目前狀態；結束時需呼叫 Close
+func (s *QueueService) WatchQueueStatus(ctx context.Context, req *QueueStatusRequest) (*StatusWatcher, *QueueStatusResponse, error) {
+	activity, err := s.getActivity(ctx, req.ActivityID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("activity not found: %w", err)
+	}
+
+	w := &StatusWatcher{
+		s:        s,
+		req:      *req,
+		activity: activity,
+		loadedAt: time.Now(),
+		channel:  keys.QueueEventsChannel(activity.TenantID, activity.ID),
+	}
+	// 推送由伺服器驅動，不列入輪詢節奏的風險評估
+	w.req.Streaming = true
+
+	if s.statusBroker != nil {
+		w.sub = s.statusBroker.subscribe(w.channel)
+	}
+	status, _, err := w.refresh(ctx, true)
+	if err != nil {
+		w.Close()
+		return nil, nil, err
+	}
+	return w, status, nil
+}
+
+// Next 等到狀態改變後回傳；RefreshInterval 內沒有變化時回傳 nil，呼叫端可藉此送出心跳
+func (w *StatusWatcher) Next(ctx context.Context) (*QueueStatusResponse, error) {
+	timer := time.NewTimer(w.RefreshInterval())
+	defer timer.Stop()
+
+	var notify <-chan struct{}
+	if w.sub != nil {
+		notify = w.sub.notify
+	}
+
+	for {
+		timedOut := false
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			timedOut = true
+		case <-notify:
+			// 合併短時間內的多個事件
+			if wait := streamMinRefresh - time.Since(w.refreshedAt); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		status, changed, err := w.refresh(ctx, timedOut)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			return status, nil
+		}
+		if timedOut {
+			return nil, nil
+		}
+	}
+}
+
+// RefreshInterval 回傳沒有事件時重新計算狀態的間隔；啟用離線偵測時縮短到寬限期的一半
+func (w *StatusWatcher) RefreshInterval() time.Duration {
+	interval := streamRefreshInterval
+	if grace := time.Duration(w.activity.Config.HeartbeatGraceSeconds) * time.Second / 2; grace > 0 && grace < interval {
+		interval = grace
+	}
+	if interval < streamMinRefresh {
+		interval = streamMinRefresh
+	}
+	return interval
+}
+
+func (w *StatusWatcher) Close() {
+	if w.sub != nil {
+		w.s.statusBroker.unsubscribe(w.channel, w.sub)
+		w.sub = nil
+	}
+}
+
+// refresh 重新計算狀態，回傳是否與上次不同；full 為 false 時由活動快照推導
+func (w *StatusWatcher) refresh(ctx context.Context, full bool) (*QueueStatusResponse, bool, error) {
+	var snap *queueSnapshot
+	if w.sub != nil {
+		var err error
+		if snap, err = w.s.statusBroker.snapshot(ctx, w.s, w.channel, w.req.ActivityID); err != nil {
+			return nil, false, err
+		}
+		w.activity = snap.activity
+	} else if time.Since(w.loadedAt) > streamActivityTTL {
+		activity, err := w.s.getActivity(ctx, w.req.ActivityID)
+		if err != nil {
+			return nil, false, fmt.Errorf("activity not found: %w", err)
+		}
+		w.activity = activity
+		w.loadedAt = time.Now()
+	}
+
+	var status *QueueStatusResponse
+	if full || snap == nil || w.req.Seq == 0 {
+		var err error
+		if status, err = w.s.buildQueueStatus(ctx, w.activity, &w.req); err != nil {
+			return nil, false, err
+		}
+		// 預排隊、抽籤分配序號後改以序號追蹤
+		if w.req.Seq == 0 && status.Seq > 0 {
+			w.req.Seq = status.Seq
+		}
+	} else {
+		lane := laneOfSession(w.req.SessionID)
+		status = w.s.statusFromProgress(ctx, uuid.New().String(), w.activity, &w.req, lane, snap.progress(lane, w.req.Seq), false)
+	}
+	w.refreshedAt = time.Now()
+
+	// request_id 每次不同，比較時排除
+	snapshot := *status
+	snapshot.RequestID = ""
+	encoded, _ := json.Marshal(snapshot)
+	if bytes.Equal(encoded, w.last) {
+		return status, false, nil
+	}
+	w.last = encoded
+	return status, true, nil
+}
+
+// IsFinal 表示狀態不會再因等待而改變：已輪到、已過期或已售完，串流可以結束
+func (r *QueueStatusResponse) IsFinal() bool {
+	switch r.State {
+	case StateEligible, StateExpired, StateSoldOut:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"queue-system/internal/models"
+	"queue-system/pkg/keys"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expectActivity 預期一次 getActivity 查詢並回傳指定活動
+func expectActivity(mock sqlmock.Sqlmock, activity *models.Activity) {
+	config, _ := activity.Config.Value()
+	mock.ExpectQuery("FROM activities").WithArgs(activity.ID).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "tenant_id", "name", "sku", "initial_stock", "start_at", "end_at", "status", "config_json", "created_at", "updated_at"}).
+			AddRow(activity.ID, activity.TenantID, activity.Name, activity.SKU, activity.InitialStock,
+				activity.StartAt, activity.EndAt, string(activity.Status), config, activity.CreatedAt, activity.UpdatedAt),
+	)
+}
+
+func newStreamActivity() *models.Activity {
+	now := time.Now()
+	return &models.Activity{
+		ID:           7,
+		TenantID:     "tenant1",
+		Name:         "drop",
+		SKU:          "sku-1",
+		InitialStock: 100,
+		StartAt:      now.Add(-time.Hour),
+		EndAt:        now.Add(time.Hour),
+		Status:       models.StatusActive,
+		Config:       models.ActivityConfig{ReleaseRate: 10, PollInterval: 2000, MaxQueueSize: 10},
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+}
+
+// seedQueue 設定預設通道的隊列進度與會話 token
+func seedQueue(t *testing.T, mr *miniredis.Miniredis, activity *models.Activity, queueSeq, releaseSeq int64, sessions map[int64]string) {
+	t.Helper()
+
+	require.NoError(t, mr.Set(keys.QueueSeqKey(activity.TenantID, activity.ID), strconv.FormatInt(queueSeq, 10)))
+	require.NoError(t, mr.Set(keys.ReleaseSeqKey(activity.TenantID, activity.ID), strconv.FormatInt(releaseSeq, 10)))
+	for seq, session := range sessions {
+		mr.HSet(keys.SessionTokenKey(activity.TenantID, activity.ID), strconv.FormatInt(seq, 10), session)
+	}
+}
+
+func TestQueueSnapshot_MatchesPerSessionProgress(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	s := NewQueueService(nil, rdb)
+	activity := newStreamActivity()
+
+	seedQueue(t, mr, activity, 20, 5, nil)
+	abandonedKey := keys.AbandonedKey(activity.TenantID, activity.ID)
+	for _, seq := range []float64{3, 7, 9, 15} {
+		_, err := mr.ZAdd(abandonedKey, seq, strconv.FormatFloat(seq, 'f', 0, 64))
+		require.NoError(t, err)
+	}
+	holdKey := keys.RiskHoldKey(activity.TenantID, activity.ID)
+	_, err := mr.ZAdd(holdKey, 18, "12")
+	require.NoError(t, err)
+	_, err = mr.ZAdd(holdKey, math.Inf(1), "13")
+	require.NoError(t, err)
+
+	snap, err := s.loadQueueSnapshot(ctx, activity)
+	require.NoError(t, err)
+	// 20 - 5 - 已越過以外的 3 個離開者
+	assert.Equal(t, int64(12), snap.waiting)
+
+	for seq := int64(1); seq <= 20; seq++ {
+		want, err := s.loadProgress(ctx, activity, "", seq)
+		require.NoError(t, err)
+		assert.Equal(t, want, snap.progress("", seq), "seq %d", seq)
+	}
+}
+
+func TestStatusWatcher_SharesSnapshotPerEvent(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	s := NewQueueService(db, rdb)
+	broker := NewStatusBroker(rdb)
+	s.SetStatusBroker(broker)
+	activity := newStreamActivity()
+	channel := keys.QueueEventsChannel(activity.TenantID, activity.ID)
+	seedQueue(t, mr, activity, 20, 5, map[int64]string{8: "session-a", 12: "session-b"})
+
+	// 兩個連線各查詢一次活動，快照只載入一次
+	expectActivity(mock, activity)
+	expectActivity(mock, activity)
+	expectActivity(mock, activity)
+
+	first, status, err := s.WatchQueueStatus(ctx, &QueueStatusRequest{ActivityID: activity.ID, Seq: 8, SessionID: "session-a"})
+	require.NoError(t, err)
+	defer first.Close()
+	assert.Equal(t, int64(3), status.Position)
+
+	second, status, err := s.WatchQueueStatus(ctx, &QueueStatusRequest{ActivityID: activity.ID, Seq: 12, SessionID: "session-b"})
+	require.NoError(t, err)
+	defer second.Close()
+	assert.Equal(t, int64(7), status.Position)
+	shared := broker.snapshots[channel].snapshot
+
+	// 釋放事件後兩個連線共用同一份新快照
+	require.NoError(t, mr.Set(keys.ReleaseSeqKey(activity.TenantID, activity.ID), "9"))
+	broker.dispatch(channel, queueEventRelease)
+	first.refreshedAt, second.refreshedAt = time.Time{}, time.Time{}
+
+	status, err = first.Next(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, status)
+	assert.Equal(t, StateEligible, status.State)
+	refreshed := broker.snapshots[channel].snapshot
+	assert.NotSame(t, shared, refreshed)
+
+	status, err = second.Next(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, status)
+	assert.Equal(t, int64(3), status.Position)
+	assert.Same(t, refreshed, broker.snapshots[channel].snapshot)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	first.Close()
+	second.Close()
+	assert.Empty(t, broker.snapshots)
+}
+
+func TestStatusWatcher_ActivityEventReloads(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	s := NewQueueService(db, rdb)
+	broker := NewStatusBroker(rdb)
+	s.SetStatusBroker(broker)
+	activity := newStreamActivity()
+	channel := keys.QueueEventsChannel(activity.TenantID, activity.ID)
+	seedQueue(t, mr, activity, 20, 5, map[int64]string{12: "session-b"})
+
+	expectActivity(mock, activity)
+	expectActivity(mock, activity)
+	watcher, status, err := s.WatchQueueStatus(ctx, &QueueStatusRequest{ActivityID: activity.ID, Seq: 12, SessionID: "session-b"})
+	require.NoError(t, err)
+	defer watcher.Close()
+	assert.Equal(t, StateWaiting, status.State)
+
+	// 釋放事件不重新載入活動
+	broker.dispatch(channel, queueEventRelease)
+	watcher.refreshedAt = time.Time{}
+	_, _, err = watcher.refresh(ctx, false)
+	require.NoError(t, err)
+
+	// 活動事件重新載入活動
+	paused := *activity
+	paused.Status = models.StatusPaused
+	expectActivity(mock, &paused)
+	broker.dispatch(channel, queueEventActivity)
+	watcher.refreshedAt = time.Time{}
+
+	status, err = watcher.Next(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, status)
+	assert.Equal(t, StatePaused, status.State)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,5 @@
+-- 記錄用戶主動離開隊列
+
+ALTER TABLE queue_entries ADD COLUMN abandoned_at TIMESTAMP;
+
+CREATE INDEX idx_queue_entries_abandoned ON queue_entries (activity_id) WHERE abandoned_at IS NOT NULL;
@@ -0,0 +1,23 @@
+-- 抽籤模式的開獎記錄（用於稽核）
+
+-- 每個活動一次開獎，保存種子以便重現洗牌結果
+CREATE TABLE lottery_draws (
+    activity_id BIGINT PRIMARY KEY REFERENCES activities(id),
+    seed BIGINT NOT NULL,
+    entrant_count INTEGER NOT NULL,
+    winner_count INTEGER NOT NULL,
+    drawn_at TIMESTAMP DEFAULT NOW()
+);
+
+-- 開獎結果：position 即分配的序號，前 winner_count 名中籤，其餘候補
+CREATE TABLE lottery_results (
+    activity_id BIGINT REFERENCES lottery_draws(activity_id),
+    position BIGINT NOT NULL,
+    session_id VARCHAR(100) NOT NULL,
+    user_hash VARCHAR(64) NOT NULL,
+    won BOOLEAN NOT NULL,
+
+    PRIMARY KEY (activity_id, position)
+);
+
+CREATE INDEX idx_lottery_results_session ON lottery_results (activity_id, session_id);
@@ -0,0 +1,29 @@
+-- 活動名單與邀請碼
+
+-- 名單記錄：value_hash 為 SHA-256(user_hash) 或 SHA-256(邀請碼)，不保存原始邀請碼
+CREATE TABLE allowlist_entries (
+    id BIGSERIAL PRIMARY KEY,
+    activity_id BIGINT REFERENCES activities(id),
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('user_hash', 'invite_code')),
+    value_hash VARCHAR(64) NOT NULL,
+    max_uses INTEGER NOT NULL DEFAULT 1 CHECK (max_uses > 0),
+    used_count INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+
+    CONSTRAINT unique_allowlist_value UNIQUE (activity_id, kind, value_hash)
+);
+
+-- 核銷記錄
+CREATE TABLE allowlist_redemptions (
+    id BIGSERIAL PRIMARY KEY,
+    entry_id BIGINT REFERENCES allowlist_entries(id),
+    activity_id BIGINT REFERENCES activities(id),
+    session_id VARCHAR(100) NOT NULL,
+    user_hash VARCHAR(64) NOT NULL,
+    redeemed_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_allowlist_redemptions_entry ON allowlist_redemptions (entry_id);
+CREATE INDEX idx_allowlist_redemptions_activity ON allowlist_redemptions (activity_id, redeemed_at);
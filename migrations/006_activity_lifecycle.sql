@@ -0,0 +1,18 @@
+-- 活動生命週期：draft → scheduled → active ⇄ paused → draining → ended → archived
+
+ALTER TABLE activities DROP CONSTRAINT IF EXISTS activities_status_check;
+ALTER TABLE activities ADD CONSTRAINT activities_status_check
+    CHECK (status IN ('draft', 'scheduled', 'active', 'paused', 'draining', 'ended', 'archived'));
+
+-- 狀態切換記錄；source 為 schedule（依 start_at / end_at 自動切換）或 admin
+CREATE TABLE activity_lifecycle_events (
+    id BIGSERIAL PRIMARY KEY,
+    activity_id BIGINT REFERENCES activities(id),
+    tenant_id VARCHAR(50) NOT NULL,
+    from_status VARCHAR(20) NOT NULL,
+    to_status VARCHAR(20) NOT NULL,
+    source VARCHAR(20) NOT NULL CHECK (source IN ('schedule', 'admin')),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_activity_lifecycle_events_activity ON activity_lifecycle_events (activity_id, created_at);
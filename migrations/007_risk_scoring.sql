@@ -0,0 +1,12 @@
+-- 進入風險評估：分數（0-100）、原因與處置
+
+-- 客戶端送出的指紋為雜湊字串而非 JSON，改為 TEXT 才能寫入並用於比對
+ALTER TABLE queue_entries ALTER COLUMN fingerprint TYPE TEXT USING fingerprint #>> '{}';
+
+ALTER TABLE queue_entries ADD COLUMN risk_score INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE queue_entries ADD COLUMN risk_reasons JSONB;
+ALTER TABLE queue_entries ADD COLUMN risk_action VARCHAR(20) NOT NULL DEFAULT 'allow'
+    CHECK (risk_action IN ('allow', 'penalize', 'shadow'));
+
+CREATE INDEX idx_queue_entries_risk ON queue_entries (activity_id, risk_score DESC) WHERE risk_score > 0;
+CREATE INDEX idx_queue_entries_fingerprint ON queue_entries (activity_id, fingerprint);
@@ -0,0 +1,8 @@
+-- IP 雜湊改為以輪替金鑰計算的 HMAC，記錄計算時使用的金鑰週期
+
+ALTER TABLE queue_entries ADD COLUMN ip_hash_key VARCHAR(20);
+
+-- 舊資料以固定字串加鹽的 SHA-256 計算，IPv4 可被窮舉還原。原始 IP 未保存，
+-- 服務啟動時以目前的 secret 對 ip_hash_key 為 NULL 的舊值再做一次 HMAC（ip_hash_key 記為 '<key_id>.legacy'），
+-- 同一 IP 的舊記錄仍可互相關聯
+CREATE INDEX idx_queue_entries_legacy_ip_hash ON queue_entries (id) WHERE ip_hash IS NOT NULL AND ip_hash_key IS NULL;
@@ -0,0 +1,50 @@
+package admission
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestNewSigner_RejectsShortKey(t *testing.T) {
+	if _, err := NewSigner("k1", []byte("short"), "test", time.Minute); err == nil {
+		t.Error("NewSigner() with short key should fail")
+	}
+}
+
+func TestSigner_Issue(t *testing.T) {
+	signer, err := NewSigner("k1", testKey, "test", time.Minute)
+	if err != nil {
+		t.Fatalf("NewSigner() error = %v", err)
+	}
+
+	token, claims, err := signer.Issue(Claims{TenantID: "tenant1", ActivityID: 123, Seq: 42})
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token has %d parts, want 3", len(parts))
+	}
+
+	var h header
+	headerJSON, _ := b64.DecodeString(parts[0])
+	if err := json.Unmarshal(headerJSON, &h); err != nil {
+		t.Fatalf("decode header: %v", err)
+	}
+	if h.Alg != algHS256 || h.Kid != "k1" {
+		t.Errorf("header = %+v, want alg %s kid k1", h, algHS256)
+	}
+
+	if got := b64.EncodeToString(mac(parts[0]+"."+parts[1], testKey)); got != parts[2] {
+		t.Error("signature does not match signing input")
+	}
+
+	if claims.ID == "" || claims.ExpiresAt-claims.IssuedAt != 60 {
+		t.Errorf("claims = %+v, want jti set and 60s lifetime", claims)
+	}
+}
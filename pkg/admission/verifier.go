@@ -0,0 +1,181 @@
+package admission
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"queue-system/pkg/keys"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	ErrMalformedToken   = errors.New("admission: malformed token")
+	ErrUnknownKey       = errors.New("admission: unknown key id")
+	ErrInvalidSignature = errors.New("admission: invalid signature")
+	ErrTokenExpired     = errors.New("admission: token expired")
+	ErrTokenNotYetValid = errors.New("admission: token not yet valid")
+	ErrInvalidIssuer    = errors.New("admission: invalid issuer")
+	ErrTokenReplayed    = errors.New("admission: token already used")
+)
+
+// ReplayStore 記錄已使用過的 token ID
+type ReplayStore interface {
+	// MarkUsed 在 token 首次使用時回傳 true，重複使用回傳 false
+	MarkUsed(ctx context.Context, tokenID string, ttl time.Duration) (bool, error)
+}
+
+type VerifierConfig struct {
+	// Keys 以 kid 對應驗證金鑰，輪替期間同時保留新舊金鑰
+	Keys map[string][]byte
+	// Issuer 不為空時要求 iss 相符
+	Issuer string
+	// ClockSkew 為 iat/exp 判斷時容許的時鐘誤差
+	ClockSkew time.Duration
+	// Replay 為 nil 時不做重放檢查
+	Replay ReplayStore
+}
+
+type Verifier struct {
+	keys   map[string][]byte
+	issuer string
+	skew   time.Duration
+	replay ReplayStore
+	now    func() time.Time
+}
+
+func NewVerifier(cfg VerifierConfig) (*Verifier, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, errors.New("admission: at least one verification key is required")
+	}
+
+	keySet := make(map[string][]byte, len(cfg.Keys))
+	for kid, key := range cfg.Keys {
+		keySet[kid] = key
+	}
+
+	return &Verifier{
+		keys:   keySet,
+		issuer: cfg.Issuer,
+		skew:   cfg.ClockSkew,
+		replay: cfg.Replay,
+		now:    time.Now,
+	}, nil
+}
+
+// Parse 驗證簽章與有效期間，不做重放檢查
+func (v *Verifier) Parse(token string) (*Claims, error) {
+	return v.parse(token, 0)
+}
+
+// ParseWithGrace 與 Parse 相同，但在 exp 之後 grace 內仍接受 token；
+// 供結帳完成、離開等在 token 過期後才發生的後續操作使用
+func (v *Verifier) ParseWithGrace(token string, grace time.Duration) (*Claims, error) {
+	if grace < 0 {
+		grace = 0
+	}
+	return v.parse(token, grace)
+}
+
+func (v *Verifier) parse(token string, grace time.Duration) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, err
+	}
+	if h.Alg != algHS256 {
+		return nil, ErrMalformedToken
+	}
+
+	key, ok := v.keys[h.Kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if !hmac.Equal(signature, mac(parts[0]+"."+parts[1], key)) {
+		return nil, ErrInvalidSignature
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	now := v.now()
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(v.skew + grace)) {
+		return nil, ErrTokenExpired
+	}
+	if now.Add(v.skew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return nil, ErrTokenNotYetValid
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, ErrInvalidIssuer
+	}
+
+	return &claims, nil
+}
+
+// Verify 驗證 token，並在設定 ReplayStore 時拒絕重複使用的 token
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	claims, err := v.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.replay == nil {
+		return claims, nil
+	}
+
+	// 保留到 token 過期（含時鐘誤差）為止即可
+	ttl := time.Unix(claims.ExpiresAt, 0).Add(v.skew).Sub(v.now())
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+
+	firstUse, err := v.replay.MarkUsed(ctx, claims.ID, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("admission: replay check failed: %w", err)
+	}
+	if !firstUse {
+		return nil, ErrTokenReplayed
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := b64.DecodeString(segment)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+// RedisReplayStore 以 Redis SETNX 記錄已使用的 token ID
+type RedisReplayStore struct {
+	redis *redis.Client
+}
+
+func NewRedisReplayStore(redis *redis.Client) *RedisReplayStore {
+	return &RedisReplayStore{redis: redis}
+}
+
+func (s *RedisReplayStore) MarkUsed(ctx context.Context, tokenID string, ttl time.Duration) (bool, error) {
+	return s.redis.SetNX(ctx, keys.AdmissionReplayKey(tokenID), 1, ttl).Result()
+}
@@ -0,0 +1,141 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type memoryReplayStore struct {
+	used map[string]bool
+}
+
+func (s *memoryReplayStore) MarkUsed(ctx context.Context, tokenID string, ttl time.Duration) (bool, error) {
+	if s.used[tokenID] {
+		return false, nil
+	}
+	s.used[tokenID] = true
+	return true, nil
+}
+
+func issueTestToken(t *testing.T, kid string, key []byte) (string, *Claims) {
+	t.Helper()
+
+	signer, err := NewSigner(kid, key, "test", time.Minute)
+	if err != nil {
+		t.Fatalf("NewSigner() error = %v", err)
+	}
+
+	token, claims, err := signer.Issue(Claims{TenantID: "tenant1", ActivityID: 123, Seq: 42})
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	return token, claims
+}
+
+func TestVerifier_KeyRotation(t *testing.T) {
+	oldKey := []byte("old-key-0123456789abcdef012345678")
+	newKey := []byte("new-key-0123456789abcdef012345678")
+
+	verifier, err := NewVerifier(VerifierConfig{
+		Keys:   map[string][]byte{"k1": oldKey, "k2": newKey},
+		Issuer: "test",
+	})
+	if err != nil {
+		t.Fatalf("NewVerifier() error = %v", err)
+	}
+
+	for _, kid := range []string{"k1", "k2"} {
+		key := oldKey
+		if kid == "k2" {
+			key = newKey
+		}
+		token, _ := issueTestToken(t, kid, key)
+		claims, err := verifier.Parse(token)
+		if err != nil {
+			t.Errorf("Parse() with %s error = %v", kid, err)
+			continue
+		}
+		if claims.Seq != 42 || claims.TenantID != "tenant1" {
+			t.Errorf("Parse() claims = %+v", claims)
+		}
+	}
+
+	token, _ := issueTestToken(t, "k3", newKey)
+	if _, err := verifier.Parse(token); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Parse() with unknown kid error = %v, want %v", err, ErrUnknownKey)
+	}
+
+	token, _ = issueTestToken(t, "k1", newKey)
+	if _, err := verifier.Parse(token); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Parse() with wrong key error = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestVerifier_ClockSkew(t *testing.T) {
+	token, claims := issueTestToken(t, "k1", testKey)
+
+	verifier, _ := NewVerifier(VerifierConfig{
+		Keys:      map[string][]byte{"k1": testKey},
+		ClockSkew: 5 * time.Second,
+	})
+
+	verifier.now = func() time.Time { return time.Unix(claims.ExpiresAt+3, 0) }
+	if _, err := verifier.Parse(token); err != nil {
+		t.Errorf("Parse() within skew error = %v", err)
+	}
+
+	verifier.now = func() time.Time { return time.Unix(claims.ExpiresAt+10, 0) }
+	if _, err := verifier.Parse(token); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Parse() after skew error = %v, want %v", err, ErrTokenExpired)
+	}
+
+	verifier.now = func() time.Time { return time.Unix(claims.IssuedAt-10, 0) }
+	if _, err := verifier.Parse(token); !errors.Is(err, ErrTokenNotYetValid) {
+		t.Errorf("Parse() before iat error = %v, want %v", err, ErrTokenNotYetValid)
+	}
+}
+
+func TestVerifier_ParseWithGrace(t *testing.T) {
+	token, claims := issueTestToken(t, "k1", testKey)
+
+	verifier, _ := NewVerifier(VerifierConfig{
+		Keys:      map[string][]byte{"k1": testKey},
+		ClockSkew: 5 * time.Second,
+	})
+
+	verifier.now = func() time.Time { return time.Unix(claims.ExpiresAt+60, 0) }
+	if _, err := verifier.Parse(token); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Parse() after exp error = %v, want %v", err, ErrTokenExpired)
+	}
+	if _, err := verifier.ParseWithGrace(token, 10*time.Minute); err != nil {
+		t.Errorf("ParseWithGrace() within grace error = %v", err)
+	}
+
+	verifier.now = func() time.Time { return time.Unix(claims.ExpiresAt+11*60, 0) }
+	if _, err := verifier.ParseWithGrace(token, 10*time.Minute); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("ParseWithGrace() after grace error = %v, want %v", err, ErrTokenExpired)
+	}
+
+	// 寬限期不放寬簽章檢查
+	if _, err := verifier.ParseWithGrace(token[:len(token)-2]+"xx", 10*time.Minute); err == nil {
+		t.Error("ParseWithGrace() accepted a tampered token")
+	}
+}
+
+func TestVerifier_Replay(t *testing.T) {
+	token, _ := issueTestToken(t, "k1", testKey)
+
+	verifier, _ := NewVerifier(VerifierConfig{
+		Keys:   map[string][]byte{"k1": testKey},
+		Replay: &memoryReplayStore{used: map[string]bool{}},
+	})
+
+	if _, err := verifier.Verify(context.Background(), token); err != nil {
+		t.Fatalf("Verify() first use error = %v", err)
+	}
+	if _, err := verifier.Verify(context.Background(), token); !errors.Is(err, ErrTokenReplayed) {
+		t.Errorf("Verify() second use error = %v, want %v", err, ErrTokenReplayed)
+	}
+}
@@ -0,0 +1,174 @@
+// Package clientip 在反向代理之後取得用戶端真實 IP。
+//
+// 只有直接連線來源屬於信任的代理網段時才讀取 Forwarded（RFC 7239）、X-Forwarded-For 與
+// X-Real-IP。代理鏈由右往左檢查，略過信任的代理，第一個不受信任的位址即為用戶端；
+// 最左邊的值可由用戶端任意填寫，不能直接採用。
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Resolver 依信任的代理網段解析用戶端 IP；零值不信任任何代理，一律使用連線來源
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// NewResolver 以 CIDR（例如 10.0.0.0/8）或單一 IP 建立 Resolver
+func NewResolver(trustedProxies []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, entry := range trustedProxies {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			r.trusted = append(r.trusted, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		addr = normalizeAddr(addr)
+		r.trusted = append(r.trusted, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return r, nil
+}
+
+// Resolve 回傳請求的用戶端 IP（正規化後的字串）；無法解析時回傳空字串
+func (r *Resolver) Resolve(req *http.Request) string {
+	remote, ok := parseHost(req.RemoteAddr)
+	if !ok {
+		return ""
+	}
+	if !r.trusts(remote) {
+		return remote.String()
+	}
+
+	// 同時存在時以 Forwarded 為準，代理不應同時維護兩者
+	if values := req.Header.Values("Forwarded"); len(values) > 0 {
+		return r.walk(parseForwarded(values), remote).String()
+	}
+	if values := req.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		return r.walk(splitList(values), remote).String()
+	}
+	if value := req.Header.Get("X-Real-IP"); value != "" {
+		if addr, ok := parseNode(value); ok {
+			return addr.String()
+		}
+	}
+	return remote.String()
+}
+
+// walk 由右往左略過信任的代理；遇到無法解析的值時退回連線來源，全部可信時取最左邊的位址
+func (r *Resolver) walk(chain []string, remote netip.Addr) netip.Addr {
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseNode(chain[i])
+		if !ok {
+			return remote
+		}
+		client = addr
+		if !r.trusts(addr) {
+			break
+		}
+	}
+	return client
+}
+
+func (r *Resolver) trusts(addr netip.Addr) bool {
+	if r == nil {
+		return false
+	}
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize 將 IP 轉為標準寫法：IPv6 小寫並壓縮、去除 zone，IPv4-mapped IPv6 轉回 IPv4；
+// 無法解析時原樣回傳
+func Normalize(ip string) string {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return ip
+	}
+	return normalizeAddr(addr).String()
+}
+
+func normalizeAddr(addr netip.Addr) netip.Addr {
+	return addr.Unmap().WithZone("")
+}
+
+// parseHost 解析 RemoteAddr 形式的 host:port
+func parseHost(hostport string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return normalizeAddr(addr), true
+}
+
+// parseNode 解析代理鏈中的一個節點，接受 1.2.3.4、1.2.3.4:80、2001:db8::1、[2001:db8::1]:80
+func parseNode(node string) (netip.Addr, bool) {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if strings.HasPrefix(node, "[") {
+		end := strings.Index(node, "]")
+		if end < 0 {
+			return netip.Addr{}, false
+		}
+		node = node[1:end]
+	} else if strings.Count(node, ":") == 1 {
+		node = node[:strings.Index(node, ":")]
+	}
+
+	addr, err := netip.ParseAddr(node)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return normalizeAddr(addr), true
+}
+
+// splitList 將多個 header 值以逗號拆成代理鏈
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			list = append(list, strings.TrimSpace(item))
+		}
+	}
+	return list
+}
+
+// parseForwarded 取出 Forwarded 各節點的 for 參數；缺少 for 的節點以空字串保留位置
+func parseForwarded(values []string) []string {
+	var list []string
+	for _, element := range splitList(values) {
+		node := ""
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				node = value
+			}
+		}
+		list = append(list, node)
+	}
+	return list
+}
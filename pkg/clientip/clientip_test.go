@@ -0,0 +1,69 @@
+package clientip
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	resolver, err := NewResolver([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.9:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.9"},
+		{"rightmost untrusted hop", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"all hops trusted", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"invalid hop falls back to peer", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "garbage"}, "10.0.0.1"},
+		{"forwarded header", "[::1]:5000", map[string]string{"Forwarded": `for=1.2.3.4, for="[2001:DB8::0:1]:4711";proto=https`}, "2001:db8::1"},
+		{"forwarded wins over xff", "10.0.0.1:5000", map[string]string{"Forwarded": "for=198.51.100.2:80", "X-Forwarded-For": "198.51.100.3"}, "198.51.100.2"},
+		{"x-real-ip", "10.0.0.1:5000", map[string]string{"X-Real-IP": "198.51.100.4"}, "198.51.100.4"},
+		{"mapped ipv4 peer", "[::ffff:203.0.113.9]:5000", nil, "203.0.113.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: tt.remote, Header: http.Header{}}
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			if got := resolver.Resolve(req); got != tt.want {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZeroResolverTrustsNobody(t *testing.T) {
+	req := &http.Request{RemoteAddr: "127.0.0.1:5000", Header: http.Header{"X-Forwarded-For": {"1.2.3.4"}}}
+	if got := (&Resolver{}).Resolve(req); got != "127.0.0.1" {
+		t.Errorf("Resolve() = %v, want 127.0.0.1", got)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"2001:0DB8:0000::0001": "2001:db8::1",
+		"::ffff:192.0.2.1":     "192.0.2.1",
+		"fe80::1%eth0":         "fe80::1",
+		" 192.0.2.1 ":          "192.0.2.1",
+		"not-an-ip":            "not-an-ip",
+	}
+	for input, want := range tests {
+		if got := Normalize(input); got != want {
+			t.Errorf("Normalize(%q) = %v, want %v", input, got, want)
+		}
+	}
+}
+
+func TestNewResolverInvalid(t *testing.T) {
+	if _, err := NewResolver([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("NewResolver() should reject invalid CIDR")
+	}
+}
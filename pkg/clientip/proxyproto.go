@@ -0,0 +1,173 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol（v1 文字、v2 二進位）：L4 負載平衡器在連線開頭送出原始來源位址。
+// 只接受信任代理送來的標頭，其他連線原樣交給 HTTP 伺服器。
+
+// 讀取標頭的期限
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errInvalidProxyHeader = errors.New("clientip: invalid PROXY protocol header")
+
+// Listener 在 Accept 的連線上解析 PROXY protocol 標頭，RemoteAddr 改為標頭中的來源位址
+type Listener struct {
+	net.Listener
+	resolver *Resolver
+}
+
+// NewListener 包裝 listener；只有來自 resolver 信任網段的連線會讀取標頭
+func NewListener(inner net.Listener, resolver *Resolver) *Listener {
+	return &Listener{Listener: inner, resolver: resolver}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	peer, ok := parseHost(conn.RemoteAddr().String())
+	if !ok || !l.resolver.trusts(peer) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn 在第一次 Read 或 RemoteAddr 時讀取標頭，避免阻塞 Accept
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remote, c.err = readProxyHeader(c.reader)
+}
+
+// readProxyHeader 讀取並移除標頭，回傳來源位址；沒有標頭或為 LOCAL / UNKNOWN 時回傳 nil
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(proxyV2Signature))
+	if err != nil && len(peek) == 0 {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(peek, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(peek, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	// 信任的代理未送標頭（例如健康檢查），維持原連線位址
+	return nil, nil
+}
+
+// readProxyV1 解析 "PROXY TCP4 <src> <dst> <sport> <dport>\r\n"，最長 107 bytes
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidProxyHeader
+	}
+
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(normalizeAddr(addr), uint16(port))), nil
+}
+
+// readProxyV2 解析二進位標頭；只取 TCP/UDP over IPv4/IPv6 的來源位址，TLV 略過
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version", errInvalidProxyHeader)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL：代理自己的連線（例如健康檢查）
+	if header[12]&0x0F == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1: // IPv4：src(4) dst(4) sport(2) dport(2)
+		if len(body) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		addr := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 2: // IPv6：src(16) dst(16) sport(2) dport(2)
+		if len(body) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		addr := normalizeAddr(netip.AddrFrom16([16]byte(body[0:16])))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[32:34]))), nil
+	}
+	// UNSPEC 或 Unix socket
+	return nil, nil
+}
@@ -0,0 +1,65 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 198.51.100.1 10.0.0.1 40000 443\r\nGET / HTTP/1.1\r\n"))
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatalf("readProxyHeader() error = %v", err)
+	}
+	if addr == nil || addr.String() != "198.51.100.1:40000" {
+		t.Errorf("readProxyHeader() = %v, want 198.51.100.1:40000", addr)
+	}
+
+	// 標頭之後的資料保留給 HTTP 伺服器
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("remaining data = %q", rest)
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.Write([]byte{0x21, 0x11}) // v2 PROXY, TCP over IPv4
+	binary.Write(&buf, binary.BigEndian, uint16(12))
+	buf.Write([]byte{198, 51, 100, 1, 10, 0, 0, 1})
+	binary.Write(&buf, binary.BigEndian, uint16(40000))
+	binary.Write(&buf, binary.BigEndian, uint16(443))
+	buf.WriteString("GET /")
+
+	r := bufio.NewReader(&buf)
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatalf("readProxyHeader() error = %v", err)
+	}
+	if addr == nil || addr.String() != "198.51.100.1:40000" {
+		t.Errorf("readProxyHeader() = %v, want 198.51.100.1:40000", addr)
+	}
+}
+
+func TestReadProxyHeaderAbsent(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("GET /health HTTP/1.1\r\n"))
+	addr, err := readProxyHeader(r)
+	if err != nil || addr != nil {
+		t.Errorf("readProxyHeader() = %v, %v; want nil, nil", addr, err)
+	}
+	if line, _ := r.ReadString('\n'); line != "GET /health HTTP/1.1\r\n" {
+		t.Errorf("request line = %q", line)
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 not-an-ip 10.0.0.1 1 2\r\n"))
+	if _, err := readProxyHeader(r); err == nil {
+		t.Error("readProxyHeader() should reject invalid address")
+	}
+}
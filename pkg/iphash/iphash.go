@@ -0,0 +1,123 @@
+// Package iphash 以輪替金鑰的 HMAC 雜湊用戶 IP。
+//
+// 每個輪替週期的金鑰由目前的 secret 與週期起點推導，不需要另外保存；
+// 週期結束後舊金鑰不再使用，同一 IP 在不同週期的雜湊無法互相關聯。
+// secret 本身也應定期更換：新 secret 放在第一把，舊 secret 保留在清單中直到不再需要比對。
+// 週期輪替後的寬限期內，以及舊 secret 仍在清單中時，比對會同時計算新舊金鑰的雜湊，
+// 讓限流與風險計數不會在換金鑰時歸零。
+package iphash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"queue-system/pkg/clientip"
+)
+
+// DefaultRotation 為未設定輪替週期時的預設值
+const DefaultRotation = 24 * time.Hour
+
+// 雜湊輸出的 hex 長度
+const hashLength = 32
+
+// secret ID 的長度上限；金鑰 ID「<secret ID>.<週期起點>」需放得進 ip_hash_key 欄位
+const maxSecretIDLength = 8
+
+// Secret 為具名的 HMAC secret，ID 寫入金鑰 ID，用來辨識雜湊以哪一把 secret 計算
+type Secret struct {
+	ID  string
+	Key []byte
+}
+
+type Hasher struct {
+	secrets  []Secret
+	rotation time.Duration
+	grace    time.Duration
+}
+
+// New 建立 Hasher；secrets 的第一把用於計算雜湊，其餘為更換前的舊 secret，只用於比對。
+// rotation 為 0 時每天輪替，grace 需小於 rotation
+func New(secrets []Secret, rotation, grace time.Duration) (*Hasher, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("iphash: at least one secret is required")
+	}
+	for _, secret := range secrets {
+		if secret.ID == "" || len(secret.ID) > maxSecretIDLength || strings.Contains(secret.ID, ".") {
+			return nil, errors.New("iphash: secret id must be 1-8 characters without '.'")
+		}
+		if len(secret.Key) < 16 {
+			return nil, errors.New("iphash: secret must be at least 16 bytes")
+		}
+	}
+	if rotation <= 0 {
+		rotation = DefaultRotation
+	}
+	if rotation < time.Second {
+		return nil, errors.New("iphash: rotation must be at least 1 second")
+	}
+	if grace < 0 || grace >= rotation {
+		return nil, errors.New("iphash: grace must be between 0 and rotation")
+	}
+	return &Hasher{secrets: secrets, rotation: rotation, grace: grace}, nil
+}
+
+// Hash 以目前的 secret 回傳 IP 在 now 所屬週期的雜湊與金鑰 ID（「<secret ID>.<週期起點的 Unix 秒數>」）；
+// IP 為空或 Hasher 為 nil 時皆為空字串
+func (h *Hasher) Hash(ip string, now time.Time) (string, string) {
+	if h == nil || ip == "" {
+		return "", ""
+	}
+	period := h.period(now)
+	current := h.secrets[0]
+	return h.sum(current.Key, ip, period), current.ID + "." + strconv.FormatInt(period, 10)
+}
+
+// Candidates 回傳比對時需檢查的雜湊，第一個為 Hash 的結果。
+// 週期輪替後的寬限期內附上前一週期的雜湊，並附上各把舊 secret 計算的雜湊
+func (h *Hasher) Candidates(ip string, now time.Time) []string {
+	if h == nil || ip == "" {
+		return nil
+	}
+	period := h.period(now)
+	inGrace := now.Unix()-period < int64(h.grace/time.Second)
+
+	hashes := make([]string, 0, 2*len(h.secrets))
+	for _, secret := range h.secrets {
+		hashes = append(hashes, h.sum(secret.Key, ip, period))
+		if inGrace {
+			hashes = append(hashes, h.sum(secret.Key, ip, period-int64(h.rotation/time.Second)))
+		}
+	}
+	return hashes
+}
+
+// Rehash 以目前的 secret 重新雜湊無法還原原始 IP 的舊雜湊值，回傳新雜湊與金鑰 ID（「<secret ID>.legacy」）。
+// 相同的舊值得到相同的新值，不隨週期輪替
+func (h *Hasher) Rehash(legacy string) (string, string) {
+	current := h.secrets[0]
+	mac := hmac.New(sha256.New, current.Key)
+	mac.Write([]byte("ip-hash-legacy:" + legacy))
+	return hex.EncodeToString(mac.Sum(nil))[:hashLength], current.ID + ".legacy"
+}
+
+// period 回傳 now 所屬週期的起點（Unix 秒數）
+func (h *Hasher) period(now time.Time) int64 {
+	seconds := int64(h.rotation / time.Second)
+	unix := now.Unix()
+	return unix - unix%seconds
+}
+
+func (h *Hasher) sum(secret []byte, ip string, period int64) string {
+	keyMAC := hmac.New(sha256.New, secret)
+	keyMAC.Write([]byte("ip-hash:" + strconv.FormatInt(period, 10)))
+
+	mac := hmac.New(sha256.New, keyMAC.Sum(nil))
+	// 同一 IPv6 位址的不同寫法應得到相同的雜湊
+	mac.Write([]byte(clientip.Normalize(ip)))
+	return hex.EncodeToString(mac.Sum(nil))[:hashLength]
+}
@@ -0,0 +1,136 @@
+package iphash
+
+import (
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+var testSecrets = []Secret{{ID: "k1", Key: testSecret}}
+
+func TestHashRotates(t *testing.T) {
+	h, err := New(testSecrets, 24*time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	day := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	first, keyID := h.Hash("192.0.2.1", day)
+	same, _ := h.Hash("192.0.2.1", day.Add(time.Hour))
+	next, nextKeyID := h.Hash("192.0.2.1", day.Add(24*time.Hour))
+
+	if len(first) != hashLength {
+		t.Errorf("Hash() length = %d, want %d", len(first), hashLength)
+	}
+	if first != same {
+		t.Error("Hash() should be stable within a rotation period")
+	}
+	if first == next || keyID == nextKeyID {
+		t.Error("Hash() should change after rotation")
+	}
+	if keyID != "k1.1767225600" {
+		t.Errorf("Hash() key id = %v, want k1.1767225600", keyID)
+	}
+}
+
+func TestHashNormalizesIPv6(t *testing.T) {
+	h, _ := New(testSecrets, 0, 0)
+	now := time.Now()
+
+	a, _ := h.Hash("2001:0DB8::0001", now)
+	b, _ := h.Hash("2001:db8::1", now)
+	if a != b {
+		t.Error("Hash() should normalize IPv6 addresses")
+	}
+}
+
+func TestHashDependsOnSecret(t *testing.T) {
+	now := time.Now()
+	a, _ := New(testSecrets, 0, 0)
+	b, _ := New([]Secret{{ID: "k1", Key: []byte("fedcba9876543210fedcba9876543210")}}, 0, 0)
+
+	hashA, _ := a.Hash("192.0.2.1", now)
+	hashB, _ := b.Hash("192.0.2.1", now)
+	if hashA == hashB {
+		t.Error("Hash() should depend on the secret")
+	}
+}
+
+func TestCandidatesGrace(t *testing.T) {
+	h, _ := New(testSecrets, 24*time.Hour, time.Hour)
+	midnight := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	previous, _ := h.Hash("192.0.2.1", midnight.Add(-time.Minute))
+	current, _ := h.Hash("192.0.2.1", midnight)
+
+	inGrace := h.Candidates("192.0.2.1", midnight.Add(30*time.Minute))
+	if len(inGrace) != 2 || inGrace[0] != current || inGrace[1] != previous {
+		t.Errorf("Candidates() in grace = %v, want [%v %v]", inGrace, current, previous)
+	}
+
+	afterGrace := h.Candidates("192.0.2.1", midnight.Add(time.Hour))
+	if len(afterGrace) != 1 || afterGrace[0] != current {
+		t.Errorf("Candidates() after grace = %v, want [%v]", afterGrace, current)
+	}
+}
+
+func TestCandidatesPreviousSecret(t *testing.T) {
+	previous := Secret{ID: "k1", Key: testSecret}
+	current := Secret{ID: "k2", Key: []byte("fedcba9876543210fedcba9876543210")}
+	noon := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+
+	before, _ := New([]Secret{previous}, 24*time.Hour, time.Hour)
+	rotated, _ := New([]Secret{current, previous}, 24*time.Hour, time.Hour)
+
+	old, _ := before.Hash("192.0.2.1", noon)
+	hash, keyID := rotated.Hash("192.0.2.1", noon)
+	if hash == old || keyID != "k2.1767312000" {
+		t.Errorf("Hash() = %v %v, want the new secret", hash, keyID)
+	}
+
+	// 更換 secret 後仍比對舊 secret 的雜湊
+	candidates := rotated.Candidates("192.0.2.1", noon)
+	if len(candidates) != 2 || candidates[0] != hash || candidates[1] != old {
+		t.Errorf("Candidates() = %v, want [%v %v]", candidates, hash, old)
+	}
+}
+
+func TestRehash(t *testing.T) {
+	h, _ := New(testSecrets, 0, 0)
+
+	a, keyID := h.Rehash("legacy-hash")
+	b, _ := h.Rehash("legacy-hash")
+	c, _ := h.Rehash("other-hash")
+	if a != b || a == c || len(a) != hashLength {
+		t.Errorf("Rehash() = %v %v %v, want stable per input", a, b, c)
+	}
+	if keyID != "k1.legacy" {
+		t.Errorf("Rehash() key id = %v, want k1.legacy", keyID)
+	}
+}
+
+func TestNilHasher(t *testing.T) {
+	var h *Hasher
+	if hash, keyID := h.Hash("192.0.2.1", time.Now()); hash != "" || keyID != "" {
+		t.Error("Hash() on nil Hasher should be empty")
+	}
+	if candidates := h.Candidates("192.0.2.1", time.Now()); candidates != nil {
+		t.Error("Candidates() on nil Hasher should be empty")
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	if _, err := New(nil, 0, 0); err == nil {
+		t.Error("New() should require a secret")
+	}
+	if _, err := New([]Secret{{ID: "k1", Key: []byte("short")}}, 0, 0); err == nil {
+		t.Error("New() should reject short secret")
+	}
+	if _, err := New([]Secret{{ID: "rotation.1", Key: testSecret}}, 0, 0); err == nil {
+		t.Error("New() should reject invalid secret id")
+	}
+	if _, err := New(testSecrets, time.Hour, time.Hour); err == nil {
+		t.Error("New() should reject grace >= rotation")
+	}
+}
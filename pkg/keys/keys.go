@@ -22,11 +22,6 @@ func ActiveUsersKey(tenantID string, activityID int64) string {
 	return fmt.Sprintf("active:users:%s:%d", tenantID, activityID)
 }
 
-// IP 節流鍵
-func IPThrottleKey(tenantID string, activityID int64, ipHash string) string {
-	return fmt.Sprintf("throttle:ip:%s:%d:%s", tenantID, activityID, ipHash)
-}
-
 // 用戶去重鍵
 func UserDedupeKey(tenantID string, activityID int64) string {
 	return fmt.Sprintf("dedupe:user:%s:%d", tenantID, activityID)
@@ -36,3 +31,192 @@ func UserDedupeKey(tenantID string, activityID int64) string {
 func MetricsKey(tenantID string, activityID int64, metric string) string {
 	return fmt.Sprintf("metrics:%s:%d:%s", tenantID, activityID, metric)
 }
+
+// Admission token 重放檢查鍵
+func AdmissionReplayKey(tokenID string) string {
+	return fmt.Sprintf("admission:jti:%s", tokenID)
+}
+
+// 待領取 admission 鍵（ZSET，member 為 seq，score 為領取期限）
+func ClaimPendingKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("claim:pending:%s:%d", tenantID, activityID)
+}
+
+// 逾時未領取 admission 鍵（SET，member 為 seq）
+func ClaimExpiredKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("claim:expired:%s:%d", tenantID, activityID)
+}
+
+// 額外釋放配額鍵（退回的名額數）
+func ReleaseCreditKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("release:credit:%s:%d", tenantID, activityID)
+}
+
+// 剩餘庫存鍵
+func StockKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("stock:%s:%d", tenantID, activityID)
+}
+
+// 已確認購買的 admission token 鍵
+func AdmissionCompletedKey(tokenID string) string {
+	return fmt.Sprintf("admission:completed:%s", tokenID)
+}
+
+// 已簽發 admission token 鍵（HASH，field 為通道與 seq，value 為 token 與到期時間）
+func AdmissionIssuedKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("admission:issued:%s:%d", tenantID, activityID)
+}
+
+// 活動名單快取鍵（SET，member 為 "kind:value_hash"；空字串 member 表示已從資料庫載入）
+func AllowlistKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("allowlist:%s:%d", tenantID, activityID)
+}
+
+// 同時在線名額租約鍵（ZSET，member 為 seq，score 為租約到期時間）
+func LeaseKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("lease:%s:%d", tenantID, activityID)
+}
+
+// 已離開隊列鍵（ZSET，member 與 score 皆為 seq）
+func AbandonedKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("abandoned:%s:%d", tenantID, activityID)
+}
+
+// 會話對應用戶鍵
+func SessionUserKey(tenantID string, activityID int64, sessionID string) string {
+	return fmt.Sprintf("session:user:%s:%d:%s", tenantID, activityID, sessionID)
+}
+
+// 等待中用戶最後輪詢時間鍵（ZSET，member 為 seq，score 為最後輪詢時間）
+func HeartbeatKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("heartbeat:%s:%d", tenantID, activityID)
+}
+
+// 因離線被跳過的序號鍵（SET，member 為 seq）
+func InactiveKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("inactive:%s:%d", tenantID, activityID)
+}
+
+// 會話 token 鍵（HASH，field 為 seq，value 為進入時發放的 token）
+func SessionTokenKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("session:token:%s:%d", tenantID, activityID)
+}
+
+// 預排隊登記鍵（HASH，field 為會話 token，value 為登記資料）
+func PreQueueKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("prequeue:%s:%d", tenantID, activityID)
+}
+
+// 預排隊已開放旗標鍵（HASH，保留的序號區段起點與已分配人數）
+func PreQueueOpenedKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("prequeue:opened:%s:%d", tenantID, activityID)
+}
+
+// 預排隊順序鍵（ZSET，member 為會話 token，score 為登記時抽出的隨機數）
+func PreQueueOrderKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("prequeue:order:%s:%d", tenantID, activityID)
+}
+
+// 已分配序號鍵：保留的序號區段尚未全部分配時存在，值為已分配的最大序號，
+// 釋放排程器不會越過此序號
+func AssignedSeqKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("assigned:seq:%s:%d", tenantID, activityID)
+}
+
+// 抽籤報名鍵（HASH，field 為會話 token，value 為登記資料）
+func LotteryEntriesKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("lottery:entries:%s:%d", tenantID, activityID)
+}
+
+// 抽籤已開獎旗標鍵
+func LotteryDrawnKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("lottery:drawn:%s:%d", tenantID, activityID)
+}
+
+// 生命週期主節點鎖鍵，多個實例中只有持有者執行生命週期檢查
+func LifecycleLeaderKey() string {
+	return "lifecycle:leader"
+}
+
+// 抽籤開獎鎖鍵，確保同一時間只有一個實例開獎
+func LotteryDrawLockKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("lottery:lock:%s:%d", tenantID, activityID)
+}
+
+// 活動暫停開始時間鍵（unix 秒）
+func PausedAtKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("paused:at:%s:%d", tenantID, activityID)
+}
+
+// 暫停區間鍵（ZSET，member 為 "開始:結束"，score 為開始時間）
+func PauseWindowsKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("pause:windows:%s:%d", tenantID, activityID)
+}
+
+// 活動生命週期事件鍵
+func LifecycleEventsKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("lifecycle:events:%s:%d", tenantID, activityID)
+}
+
+// 工作量證明挑戰重放檢查鍵
+func ChallengeReplayKey(challengeID string) string {
+	return fmt.Sprintf("pow:used:%s", challengeID)
+}
+
+// Entry token 重放檢查鍵，jti 由各租戶產生，因此加上租戶 ID
+func EntryTokenReplayKey(tenantID, tokenID string) string {
+	return fmt.Sprintf("entry:used:%s:%s", tenantID, tokenID)
+}
+
+// 每秒進入次數計數鍵，用於調整工作量證明難度
+func EntryRateKey(tenantID string, activityID int64, second int64) string {
+	return fmt.Sprintf("entry:rate:%s:%d:%d", tenantID, activityID, second)
+}
+
+// 同一瀏覽器指紋使用過的 user_hash 鍵（SET）
+func RiskFingerprintKey(tenantID string, activityID int64, fingerprintHash string) string {
+	return fmt.Sprintf("risk:fp:%s:%d:%s", tenantID, activityID, fingerprintHash)
+}
+
+// 每分鐘同一子網段進入次數鍵
+func RiskSubnetKey(tenantID string, activityID int64, subnetHash string, minute int64) string {
+	return fmt.Sprintf("risk:subnet:%s:%d:%s:%d", tenantID, activityID, subnetHash, minute)
+}
+
+// 會話輪詢節奏鍵（HASH，last 為上次輪詢時間，strikes 為過快輪詢次數）
+func RiskPollKey(tenantID string, activityID int64, sessionID string) string {
+	return fmt.Sprintf("risk:poll:%s:%d:%s", tenantID, activityID, sessionID)
+}
+
+// 會話風險評估鍵（HASH，field 為會話 token，value 為評估結果）
+func RiskScoresKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("risk:scores:%s:%d", tenantID, activityID)
+}
+
+// 高風險暫緩釋放鍵（ZSET，member 為 seq，score 為可釋放的 release_seq，+inf 表示不釋放）
+func RiskHoldKey(tenantID string, activityID int64) string {
+	return fmt.Sprintf("risk:hold:%s:%d", tenantID, activityID)
+}
+
+// 進入限流鍵（GCRA 的 TAT，微秒），dimension 為 ip、subnet、fingerprint 或 user_hash
+func RateLimitKey(tenantID string, activityID int64, dimension string, valueHash string) string {
+	return fmt.Sprintf("ratelimit:%s:%d:%s:%s", tenantID, activityID, dimension, valueHash)
+}
+
+// 隊列事件頻道（pub/sub），release_seq 前進或活動狀態改變時發布
+func QueueEventsChannel(tenantID string, activityID int64) string {
+	return fmt.Sprintf("queue:events:%s:%d", tenantID, activityID)
+}
+
+// 訂閱所有活動隊列事件的 pattern
+func QueueEventsPattern() string {
+	return "queue:events:*"
+}
+
+// LaneKey 將以 seq 為單位的鍵限定在指定通道；預設通道（空字串）沿用原鍵
+func LaneKey(key string, lane string) string {
+	if lane == "" {
+		return key
+	}
+	return fmt.Sprintf("%s:lane:%s", key, lane)
+}
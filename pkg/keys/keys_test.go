@@ -40,15 +40,6 @@ func TestActiveUsersKey(t *testing.T) {
 	}
 }
 
-func TestIPThrottleKey(t *testing.T) {
-	expected := "throttle:ip:tenant1:123:iphash789"
-	result := IPThrottleKey("tenant1", 123, "iphash789")
-
-	if result != expected {
-		t.Errorf("IPThrottleKey() = %v, want %v", result, expected)
-	}
-}
-
 func TestUserDedupeKey(t *testing.T) {
 	expected := "dedupe:user:tenant1:123"
 	result := UserDedupeKey("tenant1", 123)
@@ -66,3 +57,340 @@ func TestMetricsKey(t *testing.T) {
 		t.Errorf("MetricsKey() = %v, want %v", result, expected)
 	}
 }
+
+func TestAdmissionReplayKey(t *testing.T) {
+	expected := "admission:jti:abc123"
+	result := AdmissionReplayKey("abc123")
+
+	if result != expected {
+		t.Errorf("AdmissionReplayKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestClaimPendingKey(t *testing.T) {
+	expected := "claim:pending:tenant1:123"
+	result := ClaimPendingKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("ClaimPendingKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestClaimExpiredKey(t *testing.T) {
+	expected := "claim:expired:tenant1:123"
+	result := ClaimExpiredKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("ClaimExpiredKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestReleaseCreditKey(t *testing.T) {
+	expected := "release:credit:tenant1:123"
+	result := ReleaseCreditKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("ReleaseCreditKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestStockKey(t *testing.T) {
+	expected := "stock:tenant1:123"
+	result := StockKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("StockKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestAdmissionCompletedKey(t *testing.T) {
+	expected := "admission:completed:abc123"
+	result := AdmissionCompletedKey("abc123")
+
+	if result != expected {
+		t.Errorf("AdmissionCompletedKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestAdmissionIssuedKey(t *testing.T) {
+	expected := "admission:issued:tenant1:123"
+	result := AdmissionIssuedKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("AdmissionIssuedKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestLeaseKey(t *testing.T) {
+	expected := "lease:tenant1:123"
+	result := LeaseKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("LeaseKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestAbandonedKey(t *testing.T) {
+	expected := "abandoned:tenant1:123"
+	result := AbandonedKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("AbandonedKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestSessionUserKey(t *testing.T) {
+	expected := "session:user:tenant1:123:session456"
+	result := SessionUserKey("tenant1", 123, "session456")
+
+	if result != expected {
+		t.Errorf("SessionUserKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestHeartbeatKey(t *testing.T) {
+	expected := "heartbeat:tenant1:123"
+	result := HeartbeatKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("HeartbeatKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestInactiveKey(t *testing.T) {
+	expected := "inactive:tenant1:123"
+	result := InactiveKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("InactiveKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestSessionTokenKey(t *testing.T) {
+	expected := "session:token:tenant1:123"
+	result := SessionTokenKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("SessionTokenKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestPreQueueKey(t *testing.T) {
+	expected := "prequeue:tenant1:123"
+	result := PreQueueKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("PreQueueKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestPreQueueOpenedKey(t *testing.T) {
+	expected := "prequeue:opened:tenant1:123"
+	result := PreQueueOpenedKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("PreQueueOpenedKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestPreQueueOrderKey(t *testing.T) {
+	expected := "prequeue:order:tenant1:123"
+	result := PreQueueOrderKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("PreQueueOrderKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestAssignedSeqKey(t *testing.T) {
+	expected := "assigned:seq:tenant1:123"
+	result := AssignedSeqKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("AssignedSeqKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestLifecycleLeaderKey(t *testing.T) {
+	expected := "lifecycle:leader"
+	result := LifecycleLeaderKey()
+
+	if result != expected {
+		t.Errorf("LifecycleLeaderKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestLotteryEntriesKey(t *testing.T) {
+	expected := "lottery:entries:tenant1:123"
+	result := LotteryEntriesKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("LotteryEntriesKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestLotteryDrawnKey(t *testing.T) {
+	expected := "lottery:drawn:tenant1:123"
+	result := LotteryDrawnKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("LotteryDrawnKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestLotteryDrawLockKey(t *testing.T) {
+	expected := "lottery:lock:tenant1:123"
+	result := LotteryDrawLockKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("LotteryDrawLockKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestPausedAtKey(t *testing.T) {
+	expected := "paused:at:tenant1:123"
+	result := PausedAtKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("PausedAtKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestPauseWindowsKey(t *testing.T) {
+	expected := "pause:windows:tenant1:123"
+	result := PauseWindowsKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("PauseWindowsKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestLifecycleEventsKey(t *testing.T) {
+	expected := "lifecycle:events:tenant1:123"
+	result := LifecycleEventsKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("LifecycleEventsKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestChallengeReplayKey(t *testing.T) {
+	expected := "pow:used:abc123"
+	result := ChallengeReplayKey("abc123")
+
+	if result != expected {
+		t.Errorf("ChallengeReplayKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestEntryTokenReplayKey(t *testing.T) {
+	expected := "entry:used:tenant1:abc123"
+	result := EntryTokenReplayKey("tenant1", "abc123")
+
+	if result != expected {
+		t.Errorf("EntryTokenReplayKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestEntryRateKey(t *testing.T) {
+	expected := "entry:rate:tenant1:123:1700000000"
+	result := EntryRateKey("tenant1", 123, 1700000000)
+
+	if result != expected {
+		t.Errorf("EntryRateKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestRiskFingerprintKey(t *testing.T) {
+	expected := "risk:fp:tenant1:123:abc123"
+	result := RiskFingerprintKey("tenant1", 123, "abc123")
+
+	if result != expected {
+		t.Errorf("RiskFingerprintKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestRiskSubnetKey(t *testing.T) {
+	expected := "risk:subnet:tenant1:123:abc123:28333333"
+	result := RiskSubnetKey("tenant1", 123, "abc123", 28333333)
+
+	if result != expected {
+		t.Errorf("RiskSubnetKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestRiskPollKey(t *testing.T) {
+	expected := "risk:poll:tenant1:123:session456"
+	result := RiskPollKey("tenant1", 123, "session456")
+
+	if result != expected {
+		t.Errorf("RiskPollKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestRiskScoresKey(t *testing.T) {
+	expected := "risk:scores:tenant1:123"
+	result := RiskScoresKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("RiskScoresKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestRiskHoldKey(t *testing.T) {
+	expected := "risk:hold:tenant1:123"
+	result := RiskHoldKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("RiskHoldKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	expected := "ratelimit:tenant1:123:subnet:abc123"
+	result := RateLimitKey("tenant1", 123, "subnet", "abc123")
+
+	if result != expected {
+		t.Errorf("RateLimitKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestQueueEventsChannel(t *testing.T) {
+	expected := "queue:events:tenant1:123"
+	result := QueueEventsChannel("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("QueueEventsChannel() = %v, want %v", result, expected)
+	}
+}
+
+func TestQueueEventsPattern(t *testing.T) {
+	expected := "queue:events:*"
+	result := QueueEventsPattern()
+
+	if result != expected {
+		t.Errorf("QueueEventsPattern() = %v, want %v", result, expected)
+	}
+}
+
+func TestAllowlistKey(t *testing.T) {
+	expected := "allowlist:tenant1:123"
+	result := AllowlistKey("tenant1", 123)
+
+	if result != expected {
+		t.Errorf("AllowlistKey() = %v, want %v", result, expected)
+	}
+}
+
+func TestLaneKey(t *testing.T) {
+	base := QueueSeqKey("tenant1", 123)
+
+	if result := LaneKey(base, ""); result != base {
+		t.Errorf("LaneKey() = %v, want %v", result, base)
+	}
+
+	expected := "queue:seq:tenant1:123:lane:vip"
+	if result := LaneKey(base, "vip"); result != expected {
+		t.Errorf("LaneKey() = %v, want %v", result, expected)
+	}
+}
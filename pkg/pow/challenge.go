@@ -0,0 +1,222 @@
+// Package pow 提供進入隊列前的工作量證明（proof-of-work）挑戰。
+//
+// 挑戰以 HMAC 簽章，伺服器不保存；客戶端需找出 solution 使
+// SHA-256(challenge + ":" + solution) 的前 difficulty 個位元皆為 0。
+// 驗證只需一次雜湊與簽章比對，另以 ReplayStore 拒絕重複使用的挑戰。
+package pow
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+
+	"queue-system/pkg/keys"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 難度上限，避免設定錯誤讓客戶端無法解出
+const MaxDifficulty = 32
+
+var (
+	ErrMalformedChallenge = errors.New("pow: malformed challenge")
+	ErrInvalidSignature   = errors.New("pow: invalid signature")
+	ErrChallengeExpired   = errors.New("pow: challenge expired")
+	ErrWrongActivity      = errors.New("pow: challenge issued for another activity")
+	ErrInvalidSolution    = errors.New("pow: invalid solution")
+	ErrChallengeReplayed  = errors.New("pow: challenge already used")
+)
+
+// Challenge 是簽章保護的挑戰內容
+type Challenge struct {
+	ID         string `json:"id"`
+	TenantID   string `json:"tid"`
+	ActivityID int64  `json:"aid"`
+	Difficulty int    `json:"d"`
+	IssuedAt   int64  `json:"iat"`
+	ExpiresAt  int64  `json:"exp"`
+}
+
+// ReplayStore 記錄已使用過的挑戰 ID
+type ReplayStore interface {
+	// MarkUsed 在挑戰首次使用時回傳 true，重複使用回傳 false
+	MarkUsed(ctx context.Context, challengeID string, ttl time.Duration) (bool, error)
+}
+
+type Config struct {
+	// Key 為簽章金鑰，多個實例需使用相同金鑰
+	Key []byte
+	// TTL 為挑戰的有效時間
+	TTL time.Duration
+	// Replay 為 nil 時不做重放檢查
+	Replay ReplayStore
+}
+
+type Issuer struct {
+	key    []byte
+	ttl    time.Duration
+	replay ReplayStore
+	now    func() time.Time
+}
+
+var b64 = base64.RawURLEncoding
+
+func NewIssuer(cfg Config) (*Issuer, error) {
+	if len(cfg.Key) < 32 {
+		return nil, errors.New("pow: signing key must be at least 32 bytes")
+	}
+	if cfg.TTL <= 0 {
+		return nil, errors.New("pow: challenge ttl must be positive")
+	}
+
+	return &Issuer{
+		key:    cfg.Key,
+		ttl:    cfg.TTL,
+		replay: cfg.Replay,
+		now:    time.Now,
+	}, nil
+}
+
+// Issue 簽發指定難度的挑戰
+func (i *Issuer) Issue(tenantID string, activityID int64, difficulty int) (string, *Challenge, error) {
+	if difficulty < 0 || difficulty > MaxDifficulty {
+		return "", nil, fmt.Errorf("pow: difficulty must be between 0 and %d", MaxDifficulty)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, fmt.Errorf("pow: generate challenge id: %w", err)
+	}
+
+	now := i.now()
+	challenge := &Challenge{
+		ID:         hex.EncodeToString(id),
+		TenantID:   tenantID,
+		ActivityID: activityID,
+		Difficulty: difficulty,
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  now.Add(i.ttl).Unix(),
+	}
+
+	payload, err := json.Marshal(challenge)
+	if err != nil {
+		return "", nil, fmt.Errorf("pow: encode challenge: %w", err)
+	}
+
+	encoded := b64.EncodeToString(payload)
+	return encoded + "." + b64.EncodeToString(i.mac(encoded)), challenge, nil
+}
+
+// Verify 檢查簽章、有效期間、活動與解答，最後才記錄挑戰已使用，
+// 錯誤的解答不會消耗挑戰
+func (i *Issuer) Verify(ctx context.Context, token, solution string, activityID int64) (*Challenge, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrMalformedChallenge
+	}
+
+	sig, err := b64.DecodeString(signature)
+	if err != nil {
+		return nil, ErrMalformedChallenge
+	}
+	if !hmac.Equal(sig, i.mac(encoded)) {
+		return nil, ErrInvalidSignature
+	}
+
+	payload, err := b64.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrMalformedChallenge
+	}
+	var challenge Challenge
+	if err := json.Unmarshal(payload, &challenge); err != nil {
+		return nil, ErrMalformedChallenge
+	}
+
+	now := i.now()
+	if now.After(time.Unix(challenge.ExpiresAt, 0)) {
+		return nil, ErrChallengeExpired
+	}
+	if challenge.ActivityID != activityID {
+		return nil, ErrWrongActivity
+	}
+	if !Check(token, solution, challenge.Difficulty) {
+		return nil, ErrInvalidSolution
+	}
+
+	if i.replay == nil {
+		return &challenge, nil
+	}
+
+	ttl := time.Unix(challenge.ExpiresAt, 0).Sub(now)
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	firstUse, err := i.replay.MarkUsed(ctx, challenge.ID, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("pow: replay check failed: %w", err)
+	}
+	if !firstUse {
+		return nil, ErrChallengeReplayed
+	}
+
+	return &challenge, nil
+}
+
+func (i *Issuer) mac(encoded string) []byte {
+	h := hmac.New(sha256.New, i.key)
+	h.Write([]byte(encoded))
+	return h.Sum(nil)
+}
+
+// Check 檢查 SHA-256(token + ":" + solution) 是否有 difficulty 個前導零位元
+func Check(token, solution string, difficulty int) bool {
+	if solution == "" || len(solution) > 64 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token + ":" + solution))
+	return leadingZeroBits(sum[:]) >= difficulty
+}
+
+// Solve 以遞增的十進位數字尋找解答，供測試與參考客戶端使用
+func Solve(token string, difficulty int) string {
+	for n := uint64(0); ; n++ {
+		solution := strconv.FormatUint(n, 10)
+		if Check(token, solution, difficulty) {
+			return solution
+		}
+	}
+}
+
+func leadingZeroBits(hash []byte) int {
+	count := 0
+	for _, b := range hash {
+		if b != 0 {
+			return count + bits.LeadingZeros8(b)
+		}
+		count += 8
+	}
+	return count
+}
+
+// RedisReplayStore 以 Redis SETNX 記錄已使用的挑戰 ID
+type RedisReplayStore struct {
+	redis *redis.Client
+}
+
+func NewRedisReplayStore(redis *redis.Client) *RedisReplayStore {
+	return &RedisReplayStore{redis: redis}
+}
+
+func (s *RedisReplayStore) MarkUsed(ctx context.Context, challengeID string, ttl time.Duration) (bool, error) {
+	return s.redis.SetNX(ctx, keys.ChallengeReplayKey(challengeID), 1, ttl).Result()
+}
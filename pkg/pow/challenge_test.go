@@ -0,0 +1,114 @@
+package pow
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+type memoryReplayStore struct {
+	used map[string]bool
+}
+
+func (s *memoryReplayStore) MarkUsed(ctx context.Context, challengeID string, ttl time.Duration) (bool, error) {
+	if s.used[challengeID] {
+		return false, nil
+	}
+	s.used[challengeID] = true
+	return true, nil
+}
+
+func newTestIssuer(t *testing.T) *Issuer {
+	t.Helper()
+
+	issuer, err := NewIssuer(Config{
+		Key:    testKey,
+		TTL:    time.Minute,
+		Replay: &memoryReplayStore{used: map[string]bool{}},
+	})
+	if err != nil {
+		t.Fatalf("NewIssuer() error = %v", err)
+	}
+	return issuer
+}
+
+func TestNewIssuer_RejectsShortKey(t *testing.T) {
+	if _, err := NewIssuer(Config{Key: []byte("short"), TTL: time.Minute}); err == nil {
+		t.Error("NewIssuer() with short key should fail")
+	}
+}
+
+func TestIssuer_VerifySolution(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	token, _, err := issuer.Issue("tenant1", 123, 8)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+
+	if _, err := issuer.Verify(context.Background(), token, "not-a-solution", 123); !errors.Is(err, ErrInvalidSolution) {
+		t.Errorf("Verify() with wrong solution error = %v, want %v", err, ErrInvalidSolution)
+	}
+
+	solution := Solve(token, 8)
+	if _, err := issuer.Verify(context.Background(), token, solution, 456); !errors.Is(err, ErrWrongActivity) {
+		t.Errorf("Verify() for another activity error = %v, want %v", err, ErrWrongActivity)
+	}
+
+	challenge, err := issuer.Verify(context.Background(), token, solution, 123)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if challenge.TenantID != "tenant1" || challenge.Difficulty != 8 {
+		t.Errorf("challenge = %+v, want tenant1 with difficulty 8", challenge)
+	}
+
+	if _, err := issuer.Verify(context.Background(), token, solution, 123); !errors.Is(err, ErrChallengeReplayed) {
+		t.Errorf("Verify() second use error = %v, want %v", err, ErrChallengeReplayed)
+	}
+}
+
+func TestIssuer_RejectsTamperedChallenge(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	token, _, _ := issuer.Issue("tenant1", 123, 8)
+	easier, _, _ := issuer.Issue("tenant1", 123, 0)
+
+	// 以低難度挑戰的內容搭配原本的簽章
+	tampered := easier[:len(easier)-43] + token[len(token)-43:]
+	if _, err := issuer.Verify(context.Background(), tampered, "0", 123); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() tampered error = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestIssuer_Expired(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	token, _, _ := issuer.Issue("tenant1", 123, 0)
+	issuer.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+	if _, err := issuer.Verify(context.Background(), token, "0", 123); !errors.Is(err, ErrChallengeExpired) {
+		t.Errorf("Verify() expired error = %v, want %v", err, ErrChallengeExpired)
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	tests := []struct {
+		hash []byte
+		want int
+	}{
+		{[]byte{0x80}, 0},
+		{[]byte{0x0f}, 4},
+		{[]byte{0x00, 0x01}, 15},
+		{[]byte{0x00, 0x00}, 16},
+	}
+
+	for _, tt := range tests {
+		if got := leadingZeroBits(tt.hash); got != tt.want {
+			t.Errorf("leadingZeroBits(%x) = %d, want %d", tt.hash, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Package ratelimit 以 GCRA（generic cell rate algorithm）在 Redis 上實作限流。
+//
+// 每個 key 只保存一個時間戳 TAT（theoretical arrival time）：每次請求將 TAT 往後推
+// 一個發放間隔（period / rate），TAT 超前現在超過 burst 個間隔時拒絕。
+// 與固定窗口不同，窗口交界不會出現兩倍流量，狀態也只需一個 key。
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Limit 表示每 Period 最多 Rate 次，可瞬間使用 Burst 次；Burst 未設定時等於 Rate
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+// Capacity 回傳可瞬間使用的次數
+func (l Limit) Capacity() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+func (l Limit) valid() bool {
+	return l.Rate > 0 && l.Period > 0
+}
+
+// Rule 為一個限流條件；同一次檢查的所有條件都通過才會計入
+type Rule struct {
+	Key   string
+	Limit Limit
+}
+
+// Result 為限流檢查的結果，Rule / Remaining / ResetAfter 取自最嚴格的條件
+type Result struct {
+	Allowed bool
+	// 觸發拒絕或剩餘次數最少的條件
+	Rule       Rule
+	Remaining  int
+	RetryAfter time.Duration
+	// 額度完全恢復所需的時間
+	ResetAfter time.Duration
+}
+
+// gcraScript 依序檢查每個 key，全部通過才更新 TAT；被拒絕時不消耗任何額度。
+// KEYS: 各條件的 key
+// ARGV: 每個條件兩個值：發放間隔（微秒）、burst
+// 回傳 {是否通過, 條件索引（1 起算）, 剩餘次數, 重試等待（微秒）, 完全恢復時間（微秒）}
+var gcraScript = redis.NewScript(`
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+local tats = {}
+local blocked, retry, blockedReset = 0, 0, 0
+local tightest, tightestRemaining, tightestReset = 0, -1, 0
+
+for i = 1, #KEYS do
+	local interval = tonumber(ARGV[i * 2 - 1])
+	local burst = tonumber(ARGV[i * 2])
+	local tat = tonumber(redis.call('GET', KEYS[i]) or '0')
+	if tat < now then
+		tat = now
+	end
+	local newTat = tat + interval
+	local allowAt = newTat - burst * interval
+	if allowAt > now then
+		if allowAt - now > retry then
+			blocked, retry, blockedReset = i, allowAt - now, tat - now
+		end
+	else
+		local remaining = math.floor((now - allowAt) / interval)
+		if tightestRemaining < 0 or remaining < tightestRemaining then
+			tightest, tightestRemaining, tightestReset = i, remaining, newTat - now
+		end
+	end
+	tats[i] = newTat
+end
+
+if blocked > 0 then
+	return {0, blocked, 0, retry, blockedReset}
+end
+
+for i = 1, #KEYS do
+	local ttl = math.ceil((tats[i] - now) / 1000)
+	redis.call('SET', KEYS[i], string.format('%.0f', tats[i]), 'PX', ttl)
+end
+return {1, tightest, tightestRemaining, 0, tightestReset}
+`)
+
+type Limiter struct {
+	redis *redis.Client
+}
+
+func NewLimiter(redis *redis.Client) *Limiter {
+	return &Limiter{redis: redis}
+}
+
+// Allow 檢查所有條件並在全部通過時計入一次；沒有有效條件時直接通過
+func (l *Limiter) Allow(ctx context.Context, rules []Rule) (*Result, error) {
+	active := make([]Rule, 0, len(rules))
+	scriptKeys := make([]string, 0, len(rules))
+	args := make([]interface{}, 0, 2*len(rules))
+	for _, rule := range rules {
+		if rule.Key == "" || !rule.Limit.valid() {
+			continue
+		}
+		interval := rule.Limit.Period.Microseconds() / int64(rule.Limit.Rate)
+		if interval <= 0 {
+			return nil, fmt.Errorf("ratelimit: rate too high for period in rule %s", rule.Key)
+		}
+		active = append(active, rule)
+		scriptKeys = append(scriptKeys, rule.Key)
+		args = append(args, interval, rule.Limit.Capacity())
+	}
+	if len(active) == 0 {
+		return &Result{Allowed: true, Remaining: -1}, nil
+	}
+
+	values, err := gcraScript.Run(ctx, l.redis, scriptKeys, args...).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit: %w", err)
+	}
+	if len(values) != 5 || values[1] < 1 || values[1] > int64(len(active)) {
+		return nil, errors.New("ratelimit: unexpected script result")
+	}
+
+	return &Result{
+		Allowed:    values[0] == 1,
+		Rule:       active[values[1]-1],
+		Remaining:  int(values[2]),
+		RetryAfter: time.Duration(values[3]) * time.Microsecond,
+		ResetAfter: time.Duration(values[4]) * time.Microsecond,
+	}, nil
+}
+
+// SetHeaders 寫入 RateLimit-Limit / RateLimit-Remaining / RateLimit-Reset / RateLimit-Policy，
+// 被拒絕時另外寫入 Retry-After；時間皆為無條件進位的秒數
+func (r *Result) SetHeaders(h http.Header) {
+	if r.Remaining < 0 {
+		return
+	}
+	limit := r.Rule.Limit
+	h.Set("RateLimit-Limit", strconv.Itoa(limit.Capacity()))
+	h.Set("RateLimit-Remaining", strconv.Itoa(r.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(r.ResetAfter)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Rate, ceilSeconds(limit.Period)))
+	if !r.Allowed {
+		h.Set("Retry-After", strconv.Itoa(ceilSeconds(r.RetryAfter)))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
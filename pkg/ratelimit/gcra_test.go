@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLimitCapacity(t *testing.T) {
+	if got := (Limit{Rate: 10, Period: time.Minute}).Capacity(); got != 10 {
+		t.Errorf("Capacity() = %d, want 10", got)
+	}
+	if got := (Limit{Rate: 10, Period: time.Minute, Burst: 3}).Capacity(); got != 3 {
+		t.Errorf("Capacity() = %d, want 3", got)
+	}
+}
+
+func TestAllowWithoutRules(t *testing.T) {
+	// 沒有有效條件時不會存取 Redis
+	limiter := NewLimiter(nil)
+	result, err := limiter.Allow(context.Background(), []Rule{
+		{Key: "", Limit: Limit{Rate: 1, Period: time.Second}},
+		{Key: "k", Limit: Limit{Rate: 0, Period: time.Second}},
+	})
+	if err != nil {
+		t.Fatalf("Allow() error = %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Allow() should allow when no rule applies")
+	}
+
+	h := http.Header{}
+	result.SetHeaders(h)
+	if len(h) != 0 {
+		t.Errorf("SetHeaders() wrote %v, want no headers", h)
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	result := &Result{
+		Allowed:    false,
+		Rule:       Rule{Key: "k", Limit: Limit{Rate: 10, Period: time.Minute, Burst: 5}},
+		Remaining:  0,
+		RetryAfter: 5500 * time.Millisecond,
+		ResetAfter: 30 * time.Second,
+	}
+
+	h := http.Header{}
+	result.SetHeaders(h)
+
+	want := map[string]string{
+		"RateLimit-Limit":     "5",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "30",
+		"RateLimit-Policy":    "10;w=60",
+		"Retry-After":         "6",
+	}
+	for name, value := range want {
+		if got := h.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	result.Allowed = true
+	h = http.Header{}
+	result.SetHeaders(h)
+	if h.Get("Retry-After") != "" {
+		t.Error("Retry-After should only be set when rejected")
+	}
+}
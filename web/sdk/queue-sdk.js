@@ -8,11 +8,22 @@ class QueueSDK {
         this.activityId = options.activityId;
         this.userHash = options.userHash || this.generateUserHash();
         this.fingerprint = options.fingerprint || this.generateFingerprint();
+        // 先前進入時取得的會話 token，重新進入時沿用原序號
+        this.sessionId = options.sessionId || null;
+        // 商店簽發的 entry token，用來進入優先通道
+        this.entryToken = options.entryToken || null;
+        // 預售邀請碼
+        this.inviteCode = options.inviteCode || null;
+        // 回傳人機驗證 token 的非同步函式（活動啟用 captcha_provider 時提供）
+        this.getCaptchaToken = options.getCaptchaToken || null;
         
         // 狀態管理
         this.status = 'idle'; // idle, queuing, ready, error
         this.queueData = null;
         this.pollTimer = null;
+        // 狀態串流（SSE）；無法使用或連線失敗時改回輪詢
+        this.eventSource = null;
+        this.streamFailed = false;
         this.listeners = {};
         
         // 配置
@@ -20,12 +31,15 @@ class QueueSDK {
             maxRetries: 3,
             retryDelay: 1000,
             defaultPollInterval: 2000,
+            maxRedirects: 3,
+            useStream: true,
             ...options.config
         };
 
         // 自動重連機制
         this.retryCount = 0;
         this.isDestroyed = false;
+        this.redirectCount = 0;
     }
 
     /**
@@ -41,14 +55,36 @@ class QueueSDK {
             this.setStatus('queuing');
             this.retryCount = 0;
 
+            // 活動啟用工作量證明時先解題
+            const proof = await this.solveChallenge();
+            const captchaToken = this.getCaptchaToken ? await this.getCaptchaToken() : undefined;
+
             const response = await this.makeRequest('POST', '/queue/enter', {
                 activity_id: this.activityId,
                 user_hash: this.userHash,
-                fingerprint: this.fingerprint
+                fingerprint: this.fingerprint,
+                session_id: this.sessionId || undefined,
+                entry_token: this.entryToken || undefined,
+                invite_code: this.inviteCode || undefined,
+                challenge: proof?.challenge,
+                solution: proof?.solution,
+                captcha_token: captchaToken || undefined
             });
 
             if (response.success) {
+                // 隊列已滿，改為進入 overflow 活動
+                if (response.data.state === 'redirected' && response.data.redirect_activity_id &&
+                    this.redirectCount < this.config.maxRedirects) {
+                    this.redirectCount++;
+                    this.activityId = response.data.redirect_activity_id;
+                    this.sessionId = null;
+                    this.setStatus('idle');
+                    this.emit('redirected', response.data);
+                    return this.enterQueue();
+                }
+
                 this.queueData = response.data;
+                this.sessionId = response.data.session_id;
                 this.emit('entered', this.queueData);
                 
                 // 開始輪詢狀態
@@ -64,6 +100,26 @@ class QueueSDK {
         }
     }
 
+    /**
+     * 離開隊列
+     */
+    async leaveQueue() {
+        if (!this.queueData) return;
+
+        const params = new URLSearchParams({
+            activity_id: this.activityId,
+            session_id: this.queueData.session_id
+        });
+
+        this.stopPolling();
+        await this.makeRequest('DELETE', `/queue/leave?${params}`);
+
+        this.queueData = null;
+        this.sessionId = null;
+        this.setStatus('idle');
+        this.emit('left');
+    }
+
     /**
      * 開始輪詢隊列狀態
      */
@@ -72,6 +128,12 @@ class QueueSDK {
 
         this.stopPolling(); // 確保沒有重複的輪詢
 
+        // 優先使用伺服器推送，不支援或失敗過才輪詢
+        if (this.config.useStream && !this.streamFailed && typeof EventSource !== 'undefined') {
+            this.startStream();
+            return;
+        }
+
         const poll = async () => {
             try {
                 const status = await this.getQueueStatus();
@@ -85,6 +147,43 @@ class QueueSDK {
         poll();
     }
 
+    /**
+     * 以 Server-Sent Events 接收狀態更新
+     */
+    startStream() {
+        const params = new URLSearchParams({
+            activity_id: this.activityId,
+            session_id: this.queueData.session_id
+        });
+        if (this.queueData.seq) {
+            params.set('seq', this.queueData.seq);
+        }
+
+        const source = new EventSource(`${this.apiBase}/queue/stream?${params}`);
+        this.eventSource = source;
+        let errors = 0;
+
+        source.addEventListener('status', (event) => {
+            errors = 0;
+            const status = JSON.parse(event.data);
+            this.handleStatusUpdate(status);
+
+            // 伺服器在最終狀態後結束串流，關閉以免瀏覽器自動重連
+            if (['eligible', 'expired', 'sold_out'].includes(status.state)) {
+                this.stopPolling();
+            }
+        });
+
+        // 瀏覽器依伺服器的 retry 自動重連；連續失敗或被拒絕時改回輪詢
+        source.onerror = () => {
+            errors++;
+            if (source.readyState === EventSource.CLOSED || errors >= this.config.maxRetries) {
+                this.streamFailed = true;
+                this.startPolling();
+            }
+        };
+    }
+
     /**
      * 停止輪詢
      */
@@ -93,6 +192,10 @@ class QueueSDK {
             clearTimeout(this.pollTimer);
             this.pollTimer = null;
         }
+        if (this.eventSource) {
+            this.eventSource.close();
+            this.eventSource = null;
+        }
     }
 
     /**
@@ -105,9 +208,12 @@ class QueueSDK {
 
         const params = new URLSearchParams({
             activity_id: this.activityId,
-            seq: this.queueData.seq,
             session_id: this.queueData.session_id
         });
+        // 預排隊中尚未分配序號
+        if (this.queueData.seq) {
+            params.set('seq', this.queueData.seq);
+        }
 
         const response = await this.makeRequest('GET', `/queue/status?${params}`);
         
@@ -142,8 +248,23 @@ class QueueSDK {
             return;
         }
 
+        // 活動暫停：保留位置，依伺服器訊息顯示
+        if (status.state === 'paused' && this.status !== 'paused') {
+            this.setStatus('paused');
+            this.emit('paused', { message: status.message });
+        } else if (status.state !== 'paused' && this.status === 'paused') {
+            this.setStatus('queuing');
+            this.emit('resumed', status);
+        }
+
+        // 串流中由伺服器推送，不需排程輪詢
+        if (this.eventSource) {
+            this.retryCount = 0;
+            return;
+        }
+
         // 計算下次輪詢間隔
-        const pollInterval = status.eta?.next_poll_interval_ms || this.config.defaultPollInterval;
+        const pollInterval = status.next_poll_ms || status.eta?.next_poll_interval_ms || this.config.defaultPollInterval;
         
         // 設置下次輪詢
         this.pollTimer = setTimeout(() => {
@@ -253,6 +374,37 @@ class QueueSDK {
         return result;
     }
 
+    /**
+     * 取得並解出工作量證明挑戰；活動未啟用時回傳 null
+     */
+    async solveChallenge() {
+        const response = await this.makeRequest('GET', `/queue/challenge?activity_id=${this.activityId}`);
+        if (!response.success || !response.data.required) {
+            return null;
+        }
+
+        const { challenge, difficulty } = response.data;
+        const encoder = new TextEncoder();
+        for (let n = 0; ; n++) {
+            const solution = String(n);
+            const digest = await crypto.subtle.digest('SHA-256', encoder.encode(`${challenge}:${solution}`));
+            if (this.leadingZeroBits(new Uint8Array(digest)) >= difficulty) {
+                return { challenge, solution };
+            }
+        }
+    }
+
+    leadingZeroBits(bytes) {
+        let count = 0;
+        for (const b of bytes) {
+            if (b !== 0) {
+                return count + Math.clz32(b) - 24;
+            }
+            count += 8;
+        }
+        return count;
+    }
+
     /**
      * 生成用戶雜湊
      */
@@ -317,7 +469,8 @@ class QueueSDK {
             status: this.status,
             queueData: this.queueData,
             activityId: this.activityId,
-            userHash: this.userHash
+            userHash: this.userHash,
+            sessionId: this.sessionId
         };
     }
 